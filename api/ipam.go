@@ -1,10 +1,19 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
 	"net"
 )
 
+// Allocation describes an allocated address along with the other
+// settings needed to configure an interface with it.
+type Allocation struct {
+	IP        *net.IPNet
+	Gateway   net.IP // nil if the host is not exposed on the subnet
+	Broadcast net.IP
+}
+
 func (client *Client) ipamOp(ID string, op string) (*net.IPNet, error) {
 	ip, err := client.httpVerb(op, fmt.Sprintf("/ip/%s", ID), nil)
 	if err != nil {
@@ -26,6 +35,24 @@ func (client *Client) AllocateIPInSubnet(ID string, subnet *net.IPNet) (*net.IPN
 	return parseIP(ip)
 }
 
+// AllocateIPWithInfo is like AllocateIPInSubnet, also returning the
+// subnet's gateway and broadcast addresses.
+func (client *Client) AllocateIPWithInfo(ID string, subnet *net.IPNet) (*Allocation, error) {
+	body, err := client.httpVerbAccept("POST", fmt.Sprintf("/ip/%s/%s", ID, subnet), nil, "application/json")
+	if err != nil {
+		return nil, err
+	}
+	var info struct{ Address, Gateway, Broadcast string }
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		return nil, err
+	}
+	ip, err := parseIP(info.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &Allocation{IP: ip, Gateway: net.ParseIP(info.Gateway), Broadcast: net.ParseIP(info.Broadcast)}, nil
+}
+
 // returns an IP for the ID given, or nil if one has not been
 // allocated
 func (client *Client) LookupIP(ID string) (*net.IPNet, error) {
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -17,11 +19,18 @@ const (
 )
 
 type Client struct {
-	baseURL string
-	resolve func() (string, error)
+	baseURL    string
+	resolve    func() (string, error)
+	httpClient *http.Client // http.DefaultClient if nil
 }
 
 func (client *Client) httpVerb(verb string, url string, values url.Values) (string, error) {
+	return client.httpVerbAccept(verb, url, values, "")
+}
+
+// httpVerbAccept is like httpVerb, but asks for a particular content
+// type if accept is not empty.
+func (client *Client) httpVerbAccept(verb string, url string, values url.Values, accept string) (string, error) {
 	baseURL := client.baseURL
 	if client.resolve != nil {
 		addr, err := client.resolve()
@@ -43,7 +52,14 @@ func (client *Client) httpVerb(verb string, url string, values url.Values) (stri
 	if values != nil {
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	httpClient := client.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -55,6 +71,12 @@ func (client *Client) httpVerb(verb string, url string, values url.Values) (stri
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusNoContent {
 		return string(rbody), nil
 	}
+	if resp.Header.Get("Content-Type") == "application/problem+json" {
+		var problem struct{ Detail string }
+		if json.Unmarshal(rbody, &problem) == nil {
+			rbody = []byte(problem.Detail)
+		}
+	}
 	return "", errors.New(resp.Status + ": " + string(rbody))
 }
 
@@ -62,10 +84,36 @@ func NewClient(addr string) *Client {
 	return &Client{baseURL: fmt.Sprintf("http://%s:%d", addr, WeaveHTTPPort)}
 }
 
+// NewClientForHTTPAddr talks to the router whose --http-addr is
+// httpAddr: host:port, or the absolute path of a unix domain socket.
+func NewClientForHTTPAddr(httpAddr string) *Client {
+	if !strings.HasPrefix(httpAddr, "/") {
+		return &Client{baseURL: "http://" + httpAddr}
+	}
+	dial := func(string, string) (net.Conn, error) { return net.Dial("unix", httpAddr) }
+	return &Client{baseURL: "http://unix", httpClient: &http.Client{Transport: &http.Transport{Dial: dial}}}
+}
+
 func NewClientWithResolver(resolver func() (string, error)) *Client {
 	return &Client{resolve: resolver}
 }
 
+// Report returns the router's status report, as JSON
+func (client *Client) Report() (string, error) {
+	return client.httpVerbAccept("GET", "/report", nil, "application/json")
+}
+
+// RingStats returns how full each part of the IPAM ring is, as JSON
+func (client *Client) RingStats() (string, error) {
+	return client.httpVerb("GET", "/ring/stats", nil)
+}
+
+// ProbeDataPaths has the router check its data path to each peer, and
+// returns the results as JSON
+func (client *Client) ProbeDataPaths() (string, error) {
+	return client.httpVerb("POST", "/probe", nil)
+}
+
 func (client *Client) Connect(remote string) error {
 	_, err := client.httpVerb("POST", "/connect", url.Values{"peer": {remote}})
 	return err
@@ -0,0 +1,131 @@
+// Package bootstrap lets peers find each other through a store they
+// share, e.g. a key in Consul or etcd, rather than a list of peers
+// given to each. That suits hosts which come and go, such as those of
+// an autoscaling group, whose addresses are not known in advance.
+//
+// Each peer keeps a record of its address in the store, under its
+// peer name, and connects to the addresses in the records of the
+// others. Records are rewritten every interval, and ones not rewritten
+// for several intervals are taken to be of peers which have gone, so
+// that stores without expiry of their own need no tidying up. Once a
+// peer has connected to any other, the rest of the network finds it by
+// the usual means, so the store is only needed to get started.
+package bootstrap
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// Records not rewritten for this many intervals are stale
+const staleIntervals = 3
+
+// Store holds a value for each of a set of keys. Keys are peer names.
+type Store interface {
+	Put(key string, value []byte) error
+	Delete(key string) error
+	List() (map[string][]byte, error)
+}
+
+type record struct {
+	Address string
+	Updated time.Time
+}
+
+type Bootstrap struct {
+	store    Store
+	name     string // our peer name
+	address  string // at which other peers can connect to us
+	interval time.Duration
+	connect  func(addresses []string)
+	stop     chan struct{}
+}
+
+// New returns a Bootstrap which records our address in store, and
+// passes the addresses of other peers to connect.
+func New(store Store, name, address string, interval time.Duration, connect func(addresses []string)) *Bootstrap {
+	return &Bootstrap{
+		store:    store,
+		name:     name,
+		address:  address,
+		interval: interval,
+		connect:  connect,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start records our address and connects to the other peers
+// straight away, and then does so again every interval until stopped.
+func (b *Bootstrap) Start() {
+	b.refresh()
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.refresh()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing, and removes our record from the store.
+func (b *Bootstrap) Stop() error {
+	close(b.stop)
+	return b.store.Delete(b.name)
+}
+
+func (b *Bootstrap) refresh() {
+	if err := b.register(); err != nil {
+		common.Log.Warnf("[bootstrap] Unable to record our address: %s", err)
+	}
+	addresses, err := b.Peers()
+	if err != nil {
+		common.Log.Warnf("[bootstrap] Unable to list peers: %s", err)
+		return
+	}
+	if len(addresses) > 0 {
+		b.connect(addresses)
+	}
+}
+
+func (b *Bootstrap) register() error {
+	value, err := json.Marshal(record{b.address, time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return b.store.Put(b.name, value)
+}
+
+// Peers returns the addresses recorded by the other peers, in order,
+// leaving out stale ones.
+func (b *Bootstrap) Peers() ([]string, error) {
+	values, err := b.store.List()
+	if err != nil {
+		return nil, err
+	}
+	staleBefore := time.Now().Add(-staleIntervals * b.interval)
+	var addresses []string
+	for name, value := range values {
+		var r record
+		if name == b.name {
+			continue
+		}
+		if err := json.Unmarshal(value, &r); err != nil {
+			common.Log.Warnf("[bootstrap] Ignoring record of %s: %s", name, err)
+			continue
+		}
+		if r.Updated.Before(staleBefore) {
+			continue
+		}
+		addresses = append(addresses, r.Address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
@@ -0,0 +1,83 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bootstrap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := NewStore("file://" + dir)
+	require.NoError(t, err)
+
+	// A peer which stopped refreshing its record long ago
+	stale, _ := json.Marshal(record{"10.0.0.9:6783", time.Now().Add(-24 * time.Hour)})
+	require.NoError(t, store.Put("09:00:00:09:00:00", stale))
+
+	var connected [][]string
+	connect := func(addresses []string) { connected = append(connected, addresses) }
+	b1 := New(store, "01:00:00:01:00:00", "10.0.0.1:6783", time.Hour, connect)
+	b1.Start()
+	require.Empty(t, connected, "nobody else to connect to")
+	b2 := New(store, "02:00:00:02:00:00", "10.0.0.2:6783", time.Hour, connect)
+	b2.Start()
+	require.Equal(t, [][]string{{"10.0.0.1:6783"}}, connected)
+
+	require.NoError(t, b2.Stop())
+	peers, err := b1.Peers()
+	require.NoError(t, err)
+	require.Empty(t, peers)
+	require.NoError(t, b1.Stop())
+}
+
+func TestConsulStore(t *testing.T) {
+	var lock sync.Mutex
+	kv := make(map[string][]byte)
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case "PUT":
+			kv[key], _ = ioutil.ReadAll(r.Body)
+		case "DELETE":
+			delete(kv, key)
+		case "GET":
+			var pairs []map[string]interface{}
+			for k, v := range kv {
+				if strings.HasPrefix(k, key) {
+					pairs = append(pairs, map[string]interface{}{"Key": k, "Value": v})
+				}
+			}
+			if len(pairs) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(pairs)
+		}
+	}))
+	defer consul.Close()
+
+	store, err := NewStore(strings.Replace(consul.URL, "http://", "consul://", 1) + "/weave/cluster1")
+	require.NoError(t, err)
+	values, err := store.List()
+	require.NoError(t, err)
+	require.Empty(t, values)
+	require.NoError(t, store.Put("01:00:00:01:00:00", []byte("one")))
+	require.NoError(t, store.Put("02:00:00:02:00:00", []byte("two")))
+	require.NoError(t, store.Delete("01:00:00:01:00:00"))
+	values, err = store.List()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"02:00:00:02:00:00": []byte("two")}, values)
+}
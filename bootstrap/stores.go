@@ -0,0 +1,192 @@
+package bootstrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// NewStore returns the Store given by a URL:
+//
+//	consul://host:8500/some/prefix - keys under the prefix in Consul's KV store
+//	etcd://host:2379/some/prefix   - keys under the prefix in etcd, via its v2 API
+//	file:///some/dir               - files in a directory, e.g. on a shared filesystem
+func NewStore(storeURL string) (Store, error) {
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "consul":
+		return &ConsulStore{URL: "http://" + u.Host, Prefix: prefix, Client: client}, nil
+	case "etcd":
+		return &EtcdStore{URL: "http://" + u.Host, Prefix: prefix, Client: client}, nil
+	case "file":
+		return &FileStore{Dir: u.Path}, nil
+	}
+	return nil, fmt.Errorf("unknown kind of bootstrap store %q; expected consul, etcd or file", u.Scheme)
+}
+
+// ConsulStore keeps values under a prefix in Consul's KV store.
+type ConsulStore struct {
+	URL    string // of the agent, e.g. http://localhost:8500
+	Prefix string
+	Client *http.Client
+}
+
+func (cs *ConsulStore) keyURL(key string) string {
+	return cs.URL + "/v1/kv/" + path.Join(cs.Prefix, key)
+}
+
+func (cs *ConsulStore) Put(key string, value []byte) error {
+	_, err := do(cs.Client, "PUT", cs.keyURL(key), "", bytes.NewReader(value))
+	return err
+}
+
+func (cs *ConsulStore) Delete(key string) error {
+	_, err := do(cs.Client, "DELETE", cs.keyURL(key), "", nil)
+	return err
+}
+
+func (cs *ConsulStore) List() (map[string][]byte, error) {
+	body, err := do(cs.Client, "GET", cs.keyURL("")+"/?recurse", "", nil)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	var pairs []struct {
+		Key   string
+		Value []byte // base64 in the JSON
+	}
+	if err := json.Unmarshal(body, &pairs); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		values[path.Base(pair.Key)] = pair.Value
+	}
+	return values, nil
+}
+
+// EtcdStore keeps values under a prefix in etcd, through its v2 API.
+type EtcdStore struct {
+	URL    string // of a member, e.g. http://localhost:2379
+	Prefix string
+	Client *http.Client
+}
+
+func (es *EtcdStore) keyURL(key string) string {
+	return es.URL + "/v2/keys/" + path.Join(es.Prefix, key)
+}
+
+func (es *EtcdStore) Put(key string, value []byte) error {
+	form := url.Values{"value": {string(value)}}
+	_, err := do(es.Client, "PUT", es.keyURL(key), "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	return err
+}
+
+func (es *EtcdStore) Delete(key string) error {
+	_, err := do(es.Client, "DELETE", es.keyURL(key), "", nil)
+	return err
+}
+
+func (es *EtcdStore) List() (map[string][]byte, error) {
+	body, err := do(es.Client, "GET", es.keyURL(""), "", nil)
+	if err != nil || body == nil {
+		return nil, err
+	}
+	var response struct {
+		Node struct {
+			Nodes []struct {
+				Key   string
+				Value string
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(response.Node.Nodes))
+	for _, node := range response.Node.Nodes {
+		values[path.Base(node.Key)] = []byte(node.Value)
+	}
+	return values, nil
+}
+
+// Makes a request, returning the body of a successful response, or
+// nil if there was nothing at the URL.
+func do(client *http.Client, method, target, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return nil, fmt.Errorf("%s %s: %s %s", method, target, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, err
+}
+
+// FileStore keeps each value in a file of its own in a directory.
+type FileStore struct {
+	Dir string
+}
+
+func (fs *FileStore) Put(key string, value []byte) error {
+	// Write and rename, so that readers never see half a value
+	tmp := filepath.Join(fs.Dir, "."+key+".tmp")
+	if err := ioutil.WriteFile(tmp, value, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(fs.Dir, key))
+}
+
+func (fs *FileStore) Delete(key string) error {
+	if err := os.Remove(filepath.Join(fs.Dir, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) List() (map[string][]byte, error) {
+	infos, err := ioutil.ReadDir(fs.Dir)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	for _, info := range infos {
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		value, err := ioutil.ReadFile(filepath.Join(fs.Dir, info.Name()))
+		if err != nil {
+			if os.IsNotExist(err) { // removed since we listed it
+				continue
+			}
+			return nil, err
+		}
+		values[info.Name()] = value
+	}
+	return values, nil
+}
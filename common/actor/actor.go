@@ -0,0 +1,123 @@
+// Package actor runs functions one at a time on a goroutine of their
+// own, so that the state they share needs no locks. Clients send
+// functions to the mailbox; they are run in order, interleaved with
+// ticks from an optional ticker.
+package actor
+
+import (
+	"expvar"
+	"runtime/debug"
+	"time"
+
+	"github.com/weaveworks/weave/common/clock"
+	"github.com/weaveworks/weave/common/diagnostics"
+)
+
+// Mailbox lengths and numbers of functions run, by actor name
+var (
+	expQueued    = expvar.NewMap("actor.queued")
+	expProcessed = expvar.NewMap("actor.processed")
+)
+
+type Config struct {
+	Name      string // for metrics and panic reports
+	QueueSize int
+
+	// If Ticker is set, OnTick is run on each of its ticks.
+	Ticker clock.Ticker
+	OnTick func()
+
+	// After, if set, is run after each function from the mailbox, with
+	// action true, and after each tick, with action false. It is the
+	// place to check invariants or publish state.
+	After func(action bool)
+
+	// If OnPanic is set, a panic in a function, OnTick or After is
+	// recovered and passed to it along with the stack trace, and the
+	// actor carries on. Otherwise the panic takes the process down.
+	OnPanic func(recovered interface{}, stack []byte)
+}
+
+type Actor struct {
+	Config
+	mailbox chan func()
+}
+
+func New(config Config) *Actor {
+	return &Actor{Config: config, mailbox: make(chan func(), config.QueueSize)}
+}
+
+// Mailbox is where clients send functions to run. Sending nil stops
+// the actor; see Stop.
+func (actor *Actor) Mailbox() chan<- func() {
+	return actor.mailbox
+}
+
+// Start runs the actor goroutine
+func (actor *Actor) Start() {
+	expQueued.Set(actor.Name, expvar.Func(func() interface{} { return len(actor.mailbox) }))
+	diagnostics.RegisterQueue("actor "+actor.Name, func() int { return len(actor.mailbox) }, func() int { return cap(actor.mailbox) })
+	go actor.loop()
+}
+
+// Stop makes the actor goroutine exit once it has run everything sent
+// before. Any functions sent after will never run, so callers waiting
+// for them hang; only use this where nothing else will be sent, e.g.
+// in tests. Async.
+func (actor *Actor) Stop() {
+	if actor.Ticker != nil {
+		actor.Ticker.Stop()
+	}
+	actor.mailbox <- nil
+}
+
+// Call (Sync) runs f on the actor and waits for it to finish.
+func (actor *Actor) Call(f func()) {
+	done := make(chan struct{})
+	actor.mailbox <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+}
+
+func (actor *Actor) loop() {
+	var ticks <-chan time.Time
+	if actor.Ticker != nil {
+		ticks = actor.Ticker.Chan()
+	}
+	for {
+		select {
+		case f := <-actor.mailbox:
+			if f == nil {
+				diagnostics.UnregisterQueue("actor " + actor.Name)
+				return
+			}
+			actor.run(f)
+			actor.run(func() { actor.after(true) })
+			expProcessed.Add(actor.Name, 1)
+		case <-ticks:
+			if actor.OnTick != nil {
+				actor.run(actor.OnTick)
+			}
+			actor.run(func() { actor.after(false) })
+		}
+	}
+}
+
+func (actor *Actor) after(action bool) {
+	if actor.After != nil {
+		actor.After(action)
+	}
+}
+
+func (actor *Actor) run(f func()) {
+	if actor.OnPanic != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				actor.OnPanic(r, debug.Stack())
+			}
+		}()
+	}
+	f()
+}
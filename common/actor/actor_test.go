@@ -0,0 +1,72 @@
+package actor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/common/clock"
+)
+
+func TestActorRunsInOrder(t *testing.T) {
+	var (
+		ran     []int
+		actions int
+	)
+	actor := New(Config{Name: "test-order", QueueSize: 10, After: func(action bool) {
+		if action {
+			actions++
+		}
+	}})
+	actor.Start()
+	defer actor.Stop()
+
+	for i := 0; i < 5; i++ {
+		i := i
+		actor.Mailbox() <- func() { ran = append(ran, i) }
+	}
+	actor.Call(func() {
+		require.Equal(t, []int{0, 1, 2, 3, 4}, ran)
+		require.Equal(t, 5, actions)
+	})
+}
+
+func TestActorTicks(t *testing.T) {
+	clk := clock.NewVirtual(time.Now())
+	var ticks, afterTicks int
+	actor := New(Config{
+		Name:   "test-ticks",
+		Ticker: clk.NewTicker(time.Second),
+		OnTick: func() { ticks++ },
+		After: func(action bool) {
+			if !action {
+				afterTicks++
+			}
+		},
+	})
+	actor.Start()
+	defer actor.Stop()
+
+	clk.Advance(3 * time.Second)
+	actor.Call(func() {
+		require.Equal(t, 3, ticks)
+		require.Equal(t, 3, afterTicks)
+	})
+}
+
+func TestActorRecoversPanics(t *testing.T) {
+	var recovered []interface{}
+	actor := New(Config{Name: "test-panic", OnPanic: func(r interface{}, stack []byte) {
+		recovered = append(recovered, r)
+		require.NotEmpty(t, stack)
+	}})
+	actor.Start()
+	defer actor.Stop()
+
+	actor.Mailbox() <- func() { panic("oops") }
+	ran := false
+	actor.Call(func() { ran = true })
+	require.True(t, ran, "actor carries on after a panic")
+	require.Equal(t, []interface{}{"oops"}, recovered)
+}
@@ -0,0 +1,55 @@
+// Package bufpool recycles the buffers which gossip is encoded into.
+// A busy peer encodes its state many times a second, and encoding
+// into a fresh buffer grows it several times over, leaving garbage
+// at each step. Encoding into a pooled buffer and copying the result
+// out once, at its final size, leaves only that copy.
+package bufpool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+)
+
+// Buffers which have grown beyond this are not kept, so that one huge
+// message doesn't pin its memory for ever
+const maxPooledSize = 1 << 20
+
+var pool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Get returns an empty buffer. Give it back with Release once nothing
+// refers to its contents.
+func Get() *bytes.Buffer {
+	return pool.Get().(*bytes.Buffer)
+}
+
+// Release returns buf to the pool, and reports whether the pool kept
+// it rather than leaving it to the garbage collector. buf and anything
+// obtained from its Bytes method must not be used afterwards.
+func Release(buf *bytes.Buffer) bool {
+	if buf.Cap() > maxPooledSize {
+		return false
+	}
+	buf.Reset()
+	pool.Put(buf)
+	return true
+}
+
+// Copy returns a copy of the contents of buf, which stays valid after
+// buf is released.
+func Copy(buf *bytes.Buffer) []byte {
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// GobEncode encodes values, in order, as one gob stream.
+func GobEncode(values ...interface{}) ([]byte, error) {
+	buf := Get()
+	defer Release(buf)
+	enc := gob.NewEncoder(buf)
+	for _, value := range values {
+		if err := enc.Encode(value); err != nil {
+			return nil, err
+		}
+	}
+	return Copy(buf), nil
+}
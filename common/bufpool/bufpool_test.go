@@ -0,0 +1,40 @@
+package bufpool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGobEncode(t *testing.T) {
+	msg, err := GobEncode("hello", 42)
+	require.NoError(t, err)
+
+	// The result doesn't share the pooled buffer
+	buf := Get()
+	buf.WriteString("overwritten")
+	Release(buf)
+
+	var s string
+	var n int
+	dec := gob.NewDecoder(bytes.NewReader(msg))
+	require.NoError(t, dec.Decode(&s))
+	require.NoError(t, dec.Decode(&n))
+	require.Equal(t, "hello", s)
+	require.Equal(t, 42, n)
+}
+
+func TestRelease(t *testing.T) {
+	buf := Get()
+	buf.WriteString("contents")
+	require.True(t, Release(buf))
+	require.Equal(t, 0, Get().Len())
+
+	// Huge buffers are dropped rather than pooled
+	huge := bytes.NewBuffer(make([]byte, 0, 2*maxPooledSize))
+	huge.WriteString("contents")
+	require.False(t, Release(huge))
+	require.Equal(t, "contents", huge.String(), "dropped buffer was reset")
+}
@@ -0,0 +1,132 @@
+// Package clock lets time-driven code run either on the real clock or
+// on virtual time controlled by a test.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
+
+// Virtual is a clock which only moves when told to. Its tickers are
+// unbuffered, and Advance blocks until every tick falling due has
+// been received, so once Advance returns the receiver has started
+// handling the last of them. Combined with a single-threaded actor
+// loop this makes timer-driven behaviour deterministic.
+type Virtual struct {
+	sync.Mutex
+	now     time.Time
+	tickers []*virtualTicker
+}
+
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.Lock()
+	defer v.Unlock()
+	return v.now
+}
+
+func (v *Virtual) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	v.Lock()
+	defer v.Unlock()
+	ticker := &virtualTicker{
+		clock:   v,
+		c:       make(chan time.Time),
+		stopped: make(chan struct{}),
+		period:  d,
+		next:    v.now.Add(d),
+	}
+	v.tickers = append(v.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d, delivering ticks in time
+// order as it goes.
+func (v *Virtual) Advance(d time.Duration) {
+	v.Lock()
+	target := v.now.Add(d)
+	for {
+		sort.Sort(byNext(v.tickers))
+		if len(v.tickers) == 0 || v.tickers[0].next.After(target) {
+			break
+		}
+		ticker := v.tickers[0]
+		v.now = ticker.next
+		ticker.next = ticker.next.Add(ticker.period)
+		now := v.now
+		v.Unlock()
+		select {
+		case ticker.c <- now:
+		case <-ticker.stopped:
+		}
+		v.Lock()
+	}
+	v.now = target
+	v.Unlock()
+}
+
+func (v *Virtual) remove(ticker *virtualTicker) {
+	v.Lock()
+	defer v.Unlock()
+	for i, t := range v.tickers {
+		if t == ticker {
+			v.tickers = append(v.tickers[:i], v.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+type virtualTicker struct {
+	clock   *Virtual
+	c       chan time.Time
+	stopped chan struct{}
+	period  time.Duration
+	next    time.Time
+	once    sync.Once
+}
+
+func (t *virtualTicker) Chan() <-chan time.Time { return t.c }
+
+func (t *virtualTicker) Stop() {
+	t.once.Do(func() {
+		close(t.stopped)
+		t.clock.remove(t)
+	})
+}
+
+type byNext []*virtualTicker
+
+func (ts byNext) Len() int           { return len(ts) }
+func (ts byNext) Swap(i, j int)      { ts[i], ts[j] = ts[j], ts[i] }
+func (ts byNext) Less(i, j int) bool { return ts[i].next.Before(ts[j].next) }
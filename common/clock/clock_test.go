@@ -0,0 +1,46 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualTicks(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clk := NewVirtual(start)
+	fast := clk.NewTicker(time.Second)
+	slow := clk.NewTicker(3 * time.Second)
+
+	var got []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for len(got) < 4 {
+			select {
+			case now := <-fast.Chan():
+				got = append(got, "fast@"+now.Sub(start).String())
+			case now := <-slow.Chan():
+				got = append(got, "slow@"+now.Sub(start).String())
+			}
+		}
+	}()
+
+	clk.Advance(3500 * time.Millisecond)
+	<-done
+	// ties are delivered in either order
+	require.Equal(t, []string{"fast@1s", "fast@2s"}, got[:2])
+	require.Contains(t, got[2:], "fast@3s")
+	require.Contains(t, got[2:], "slow@3s")
+	require.Equal(t, start.Add(3500*time.Millisecond), clk.Now())
+}
+
+func TestVirtualStoppedTickerDoesNotBlock(t *testing.T) {
+	clk := NewVirtual(time.Unix(0, 0))
+	ticker := clk.NewTicker(time.Second)
+	ticker.Stop()
+	ticker.Stop()
+	clk.Advance(time.Minute)
+	require.Equal(t, time.Unix(60, 0), clk.Now())
+}
@@ -0,0 +1,247 @@
+// Package diagnostics reports on the queues between weave's goroutines
+// and on the goroutines themselves, to help pinpoint a deadlock or a
+// backlog: a queue which stays full, or goroutines stuck sending, show
+// which part of the actor graph has stopped making progress.
+package diagnostics
+
+import (
+	"bufio"
+	"bytes"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Goroutines reported by the runtime as waiting in one of these states
+// for a minute or more are taken to be stuck
+var blockingStates = []string{"chan send", "semacquire", "sync.Mutex.Lock", "sync.RWMutex.Lock", "sync.RWMutex.RLock"}
+
+// Queue is the state of a queue, e.g. the mailbox of an actor.
+type Queue struct {
+	Name     string
+	Length   int
+	Capacity int `json:",omitempty"` // 0 if unbounded
+}
+
+type queue struct {
+	length, capacity func() int
+}
+
+var (
+	lock   sync.Mutex
+	queues = make(map[string]queue)
+)
+
+// RegisterQueue adds a queue to the report, replacing any of the same
+// name. capacity may be nil for an unbounded queue.
+func RegisterQueue(name string, length, capacity func() int) {
+	lock.Lock()
+	defer lock.Unlock()
+	queues[name] = queue{length, capacity}
+}
+
+// UnregisterQueue removes a queue from the report.
+func UnregisterQueue(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(queues, name)
+}
+
+// Queues returns the state of the registered queues, fullest first.
+func Queues() []Queue {
+	lock.Lock()
+	result := make([]Queue, 0, len(queues))
+	for name, q := range queues {
+		entry := Queue{Name: name, Length: q.length()}
+		if q.capacity != nil {
+			entry.Capacity = q.capacity()
+		}
+		result = append(result, entry)
+	}
+	lock.Unlock()
+	sort.Sort(byFullness(result))
+	return result
+}
+
+type byFullness []Queue
+
+func (s byFullness) Len() int      { return len(s) }
+func (s byFullness) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFullness) Less(i, j int) bool {
+	if fi, fj := s[i].fullness(), s[j].fullness(); fi != fj {
+		return fi > fj
+	}
+	return s[i].Name < s[j].Name
+}
+
+// Unbounded queues are ranked by length alone, after any full ones
+func (q Queue) fullness() float64 {
+	if q.Capacity == 0 {
+		return float64(q.Length) / (float64(q.Length) + 1)
+	}
+	return float64(q.Length) / float64(q.Capacity)
+}
+
+// Subsystem counts the goroutines started by one package.
+type Subsystem struct {
+	Name       string // package which created them, e.g. "ipam", "mesh" or "net/http"
+	Goroutines int
+	Blocked    int `json:",omitempty"`
+}
+
+// Goroutine is a goroutine which looks stuck.
+type Goroutine struct {
+	ID        int
+	Subsystem string
+	State     string // as the runtime gives it, e.g. "chan send, 5 minutes"
+	Function  string // where it is waiting
+}
+
+// Report is what the diagnostics endpoint returns.
+type Report struct {
+	Goroutines int
+	Subsystems []Subsystem
+	Blocked    []Goroutine `json:",omitempty"`
+	Queues     []Queue
+}
+
+// Collect takes a snapshot of the queues and goroutines.
+func Collect() Report {
+	report := Report{Queues: Queues()}
+	goroutines := parseStacks(allStacks())
+	counts := make(map[string]*Subsystem)
+	for _, g := range goroutines {
+		s, found := counts[g.Subsystem]
+		if !found {
+			s = &Subsystem{Name: g.Subsystem}
+			counts[g.Subsystem] = s
+		}
+		s.Goroutines++
+		if g.blocked() {
+			s.Blocked++
+			report.Blocked = append(report.Blocked, g)
+		}
+	}
+	report.Goroutines = len(goroutines)
+	for _, s := range counts {
+		report.Subsystems = append(report.Subsystems, *s)
+	}
+	sort.Sort(bySize(report.Subsystems))
+	return report
+}
+
+type bySize []Subsystem
+
+func (s bySize) Len() int      { return len(s) }
+func (s bySize) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySize) Less(i, j int) bool {
+	if s[i].Goroutines != s[j].Goroutines {
+		return s[i].Goroutines > s[j].Goroutines
+	}
+	return s[i].Name < s[j].Name
+}
+
+func allStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// The runtime adds how long a goroutine has been waiting to its state
+// once it is a minute or more, e.g. "chan send, 2 minutes".
+func (g Goroutine) blocked() bool {
+	if !strings.Contains(g.State, "minutes") {
+		return false
+	}
+	for _, state := range blockingStates {
+		if strings.HasPrefix(g.State, state+",") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseStacks parses the output of runtime.Stack for all goroutines:
+//
+//	goroutine 7 [chan send, 3 minutes]:
+//	github.com/weaveworks/weave/ipam.(*Allocator).Allocate(...)
+//		/go/src/github.com/weaveworks/weave/ipam/allocator.go:200 +0x1a2
+//	...
+//	created by github.com/weaveworks/weave/ipam.(*Allocator).Start
+//		/go/src/github.com/weaveworks/weave/ipam/allocator.go:160 +0x3f
+func parseStacks(stacks []byte) []Goroutine {
+	var (
+		result  []Goroutine
+		current *Goroutine
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(stacks))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "goroutine "):
+			if current != nil {
+				result = append(result, *current)
+			}
+			current = parseHeader(line)
+		case current == nil || line == "" || strings.HasPrefix(line, "\t"):
+		case strings.HasPrefix(line, "created by "):
+			current.Subsystem = subsystem(strings.TrimPrefix(line, "created by "))
+		case current.Function == "":
+			current.Function = function(line)
+		}
+	}
+	if current != nil {
+		result = append(result, *current)
+	}
+	return result
+}
+
+func parseHeader(line string) *Goroutine {
+	g := &Goroutine{Subsystem: "main"} // the only one not created by another
+	fields := strings.SplitN(strings.TrimPrefix(line, "goroutine "), " ", 2)
+	g.ID, _ = strconv.Atoi(fields[0])
+	if len(fields) > 1 {
+		g.State = strings.TrimSuffix(strings.TrimPrefix(fields[1], "["), "]:")
+	}
+	return g
+}
+
+// function strips the arguments from a frame, e.g.
+// "main.main()" or "sync.(*Mutex).Lock(0xc42000e0f0)"
+func function(frame string) string {
+	if i := strings.LastIndex(frame, "("); i > 0 {
+		return frame[:i]
+	}
+	return frame
+}
+
+// subsystem gives the package of the function in a "created by" line,
+// relative to weave's own if it is one of weave's.
+func subsystem(creator string) string {
+	if i := strings.Index(creator, " in goroutine "); i >= 0 {
+		creator = creator[:i]
+	}
+	// The package path ends at the first dot after the last slash
+	pkg := creator
+	slash := strings.LastIndex(pkg, "/")
+	if dot := strings.Index(pkg[slash+1:], "."); dot >= 0 {
+		pkg = pkg[:slash+1+dot]
+	}
+	switch {
+	case strings.HasPrefix(pkg, "github.com/weaveworks/weave/vendor/"):
+		pkg = strings.TrimPrefix(pkg, "github.com/weaveworks/weave/vendor/")
+	case strings.HasPrefix(pkg, "github.com/weaveworks/weave/"):
+		return strings.TrimPrefix(pkg, "github.com/weaveworks/weave/")
+	}
+	if pkg == "github.com/weaveworks/mesh" {
+		return "mesh"
+	}
+	return pkg
+}
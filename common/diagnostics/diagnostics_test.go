@@ -0,0 +1,66 @@
+package diagnostics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const stacks = `goroutine 1 [chan receive]:
+main.main()
+	/go/src/github.com/weaveworks/weave/prog/weaver/main.go:380 +0x2a1
+
+goroutine 17 [chan send, 12 minutes]:
+github.com/weaveworks/weave/ipam.(*Allocator).OnGossipBroadcast(0xc420010000, 0x1, 0xc420020000, 0x10, 0x10, 0x0, 0x0, 0x0)
+	/go/src/github.com/weaveworks/weave/ipam/allocator.go:636 +0x1a2
+created by github.com/weaveworks/mesh.(*gossipChannel).deliver
+	/go/src/github.com/weaveworks/mesh/gossip_channel.go:80 +0x3f
+
+goroutine 18 [select, 12 minutes]:
+github.com/weaveworks/weave/common/actor.(*Actor).loop(0xc420010100)
+	/go/src/github.com/weaveworks/weave/common/actor/actor.go:90 +0x11c
+created by github.com/weaveworks/weave/common/actor.(*Actor).Start in goroutine 1
+	/go/src/github.com/weaveworks/weave/common/actor/actor.go:58 +0x8d
+
+goroutine 19 [IO wait]:
+net.runtime_pollWait(0x7f0000000000, 0x72)
+	/usr/local/go/src/runtime/netpoll.go:160 +0x59
+created by net/http.(*Server).Serve
+	/usr/local/go/src/net/http/server.go:2293 +0x44d
+`
+
+func TestParseStacks(t *testing.T) {
+	goroutines := parseStacks([]byte(stacks))
+	require.Equal(t, []Goroutine{
+		{1, "main", "chan receive", "main.main"},
+		{17, "mesh", "chan send, 12 minutes", "github.com/weaveworks/weave/ipam.(*Allocator).OnGossipBroadcast"},
+		{18, "common/actor", "select, 12 minutes", "github.com/weaveworks/weave/common/actor.(*Actor).loop"},
+		{19, "net/http", "IO wait", "net.runtime_pollWait"},
+	}, goroutines)
+	var blocked []int
+	for _, g := range goroutines {
+		if g.blocked() {
+			blocked = append(blocked, g.ID)
+		}
+	}
+	require.Equal(t, []int{17}, blocked, "only a long wait to send is stuck; an idle select is not")
+}
+
+func TestQueues(t *testing.T) {
+	mailbox := make(chan int, 4)
+	mailbox <- 1
+	mailbox <- 2
+	pending := []string{"a"}
+	RegisterQueue("test mailbox", func() int { return len(mailbox) }, func() int { return cap(mailbox) })
+	RegisterQueue("test pending", func() int { return len(pending) }, nil)
+	defer UnregisterQueue("test mailbox")
+
+	require.Equal(t, []Queue{{"test mailbox", 2, 4}, {"test pending", 1, 0}}, Queues())
+	UnregisterQueue("test pending")
+	require.Equal(t, []Queue{{"test mailbox", 2, 4}}, Queues())
+
+	report := Collect()
+	require.Equal(t, Queue{"test mailbox", 2, 4}, report.Queues[0])
+	require.True(t, report.Goroutines > 0)
+	require.NotEmpty(t, report.Subsystems)
+}
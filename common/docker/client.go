@@ -8,6 +8,7 @@ import (
 	docker "github.com/fsouza/go-dockerclient"
 
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/supervisor"
 )
 
 // An observer for container events
@@ -79,7 +80,8 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 		return err
 	}
 
-	go func() {
+	// Restarting after a panic loses only the event which caused it
+	supervisor.Go("docker events", func() {
 		for event := range events {
 			switch event.Status {
 			case "start":
@@ -90,7 +92,7 @@ func (c *Client) AddObserver(ob ContainerObserver) error {
 				ob.ContainerDestroyed(event.ID)
 			}
 		}
-	}()
+	})
 	return nil
 }
 
@@ -107,6 +109,32 @@ func (c *Client) IsContainerNotRunning(idStr string) bool {
 	return false
 }
 
+// ContainerExists returns false only if we have checked with Docker
+// that there is no such container; an error means we couldn't tell.
+func (c *Client) ContainerExists(idStr string) (bool, error) {
+	_, err := c.InspectContainer(idStr)
+	if err == nil {
+		return true, nil
+	}
+	if _, notThere := err.(*docker.NoSuchContainer); notThere {
+		return false, nil
+	}
+	return false, err
+}
+
+// ContainerRunning returns true only if we have checked with Docker
+// that the container is running; one which doesn't exist isn't.
+func (c *Client) ContainerRunning(idStr string) (bool, error) {
+	container, err := c.InspectContainer(idStr)
+	if err == nil {
+		return container.State.Running, nil
+	}
+	if _, notThere := err.(*docker.NoSuchContainer); notThere {
+		return false, nil
+	}
+	return false, err
+}
+
 // This is intended to find an IP address that we can reach the container on;
 // if it is on the Docker bridge network then that address; if on the host network
 // then localhost
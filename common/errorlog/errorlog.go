@@ -0,0 +1,89 @@
+// Package errorlog keeps the last few errors of each subsystem, e.g.
+// the allocator, a gossip channel or the connection to a peer, so that
+// a transient failure which has long since scrolled out of the log can
+// still be seen in the status report.
+package errorlog
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// How many errors are kept for each subsystem
+	PerSubsystem = 10
+	// Beyond this many subsystems, the one with the oldest latest
+	// error is forgotten to make room
+	MaxSubsystems = 100
+)
+
+type Error struct {
+	Time  time.Time
+	Error string
+}
+
+type Subsystem struct {
+	Name   string
+	Errors []Error // oldest first
+}
+
+var (
+	lock       sync.Mutex
+	subsystems = make(map[string][]Error)
+	now        = time.Now
+)
+
+// Record adds err to the history of subsystem. A nil err is ignored.
+func Record(subsystem string, err error) {
+	if err == nil {
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	errors, found := subsystems[subsystem]
+	if !found && len(subsystems) >= MaxSubsystems {
+		forgetStalest()
+	}
+	if len(errors) >= PerSubsystem {
+		errors = append(errors[:0], errors[len(errors)-PerSubsystem+1:]...)
+	}
+	subsystems[subsystem] = append(errors, Error{now(), err.Error()})
+}
+
+func forgetStalest() {
+	var stalest string
+	var stalestTime time.Time
+	for name, errors := range subsystems {
+		if latest := errors[len(errors)-1].Time; stalest == "" || latest.Before(stalestTime) {
+			stalest, stalestTime = name, latest
+		}
+	}
+	delete(subsystems, stalest)
+}
+
+// Recent returns the errors recorded for every subsystem, in name
+// order.
+func Recent() []Subsystem {
+	lock.Lock()
+	defer lock.Unlock()
+	result := make([]Subsystem, 0, len(subsystems))
+	for name, errors := range subsystems {
+		result = append(result, Subsystem{name, append([]Error(nil), errors...)})
+	}
+	sort.Sort(byName(result))
+	return result
+}
+
+// For returns the errors recorded for subsystem, oldest first.
+func For(subsystem string) []Error {
+	lock.Lock()
+	defer lock.Unlock()
+	return append([]Error(nil), subsystems[subsystem]...)
+}
+
+type byName []Subsystem
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
@@ -0,0 +1,61 @@
+package errorlog
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func reset() {
+	subsystems = make(map[string][]Error)
+	var tick int64
+	now = func() time.Time {
+		tick++
+		return time.Unix(tick, 0)
+	}
+}
+
+func TestRecordKeepsLatest(t *testing.T) {
+	reset()
+	defer func() { now = time.Now }()
+
+	Record("allocator", nil)
+	require.Empty(t, Recent())
+
+	for i := 0; i < PerSubsystem+3; i++ {
+		Record("gossip ipam", fmt.Errorf("error %d", i))
+	}
+	Record("allocator", errors.New("boom"))
+
+	recent := Recent()
+	require.Len(t, recent, 2)
+	require.Equal(t, "allocator", recent[0].Name)
+	require.Equal(t, []Error{{time.Unix(PerSubsystem+4, 0), "boom"}}, recent[0].Errors)
+	require.Equal(t, "gossip ipam", recent[1].Name)
+	require.Len(t, recent[1].Errors, PerSubsystem)
+	require.Equal(t, "error 3", recent[1].Errors[0].Error)
+	require.Equal(t, fmt.Sprintf("error %d", PerSubsystem+2), recent[1].Errors[PerSubsystem-1].Error)
+	require.Equal(t, recent[0].Errors, For("allocator"))
+	require.Empty(t, For("router"))
+}
+
+func TestForgetsStalestSubsystem(t *testing.T) {
+	reset()
+	defer func() { now = time.Now }()
+
+	for i := 0; i < MaxSubsystems; i++ {
+		Record(fmt.Sprintf("connection %03d", i), errors.New("failed"))
+	}
+	// the first subsystem has had an error since, so the second goes
+	Record("connection 000", errors.New("failed again"))
+	Record("router", errors.New("failed"))
+
+	recent := Recent()
+	require.Len(t, recent, MaxSubsystems)
+	require.Equal(t, "connection 000", recent[0].Name)
+	require.Equal(t, "connection 002", recent[1].Name)
+	require.Equal(t, "router", recent[MaxSubsystems-1].Name)
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 )
@@ -64,3 +66,65 @@ func CheckWarn(e error) {
 		Log.Warnln(e)
 	}
 }
+
+// Beyond this many distinct messages, a Throttle forgets those it has
+// not logged for an interval
+const maxThrottled = 1000
+
+// A Throttle stops a message which keeps repeating, e.g. the same error
+// from a flapping connection, from flooding the log. The first of a run
+// of identical messages is logged; repeats within the interval after it
+// are only counted, and the count is added to the message the next time
+// it is logged.
+type Throttle struct {
+	sync.Mutex
+	interval time.Duration
+	seen     map[string]*throttled
+	now      func() time.Time
+}
+
+type throttled struct {
+	logged     time.Time
+	suppressed int
+}
+
+func NewThrottle(interval time.Duration) *Throttle {
+	return &Throttle{interval: interval, seen: make(map[string]*throttled), now: time.Now}
+}
+
+// Logf formats a message and passes it to logf, e.g. Log.Warnf, unless
+// the same message was passed on less than the interval ago.
+func (t *Throttle) Logf(logf func(format string, args ...interface{}), format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if suppressed, ok := t.check(msg); !ok {
+		return
+	} else if suppressed > 0 {
+		msg = fmt.Sprintf("%s (last message repeated %d times)", msg, suppressed)
+	}
+	logf("%s", msg)
+}
+
+// check says whether msg is to be logged now and, if so, how many
+// times it was suppressed since it was last logged.
+func (t *Throttle) check(msg string) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	if entry, found := t.seen[msg]; found && now.Sub(entry.logged) < t.interval {
+		entry.suppressed++
+		return 0, false
+	} else if found {
+		suppressed := entry.suppressed
+		*entry = throttled{logged: now}
+		return suppressed, true
+	}
+	if len(t.seen) >= maxThrottled {
+		for m, entry := range t.seen {
+			if now.Sub(entry.logged) >= t.interval {
+				delete(t.seen, m)
+			}
+		}
+	}
+	t.seen[msg] = &throttled{logged: now}
+	return 0, true
+}
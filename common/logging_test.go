@@ -0,0 +1,30 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle(time.Minute)
+	now := time.Unix(1000, 0)
+	throttle.now = func() time.Time { return now }
+	var logged []string
+	logf := func(format string, args ...interface{}) { logged = append(logged, fmt.Sprintf(format, args...)) }
+
+	for i := 0; i < 5; i++ {
+		throttle.Logf(logf, "decryption failed from %s", "10.0.0.1")
+	}
+	throttle.Logf(logf, "decryption failed from %s", "10.0.0.2")
+	require.Equal(t, []string{"decryption failed from 10.0.0.1", "decryption failed from 10.0.0.2"}, logged)
+
+	now = now.Add(time.Minute)
+	throttle.Logf(logf, "decryption failed from %s", "10.0.0.1")
+	throttle.Logf(logf, "decryption failed from %s", "10.0.0.2")
+	require.Equal(t, "decryption failed from 10.0.0.1 (last message repeated 4 times)", logged[2])
+	require.Equal(t, "decryption failed from 10.0.0.2", logged[3])
+	require.Len(t, logged, 4)
+}
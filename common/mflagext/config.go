@@ -0,0 +1,168 @@
+package mflagext
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/mflag"
+)
+
+// CanonicalName is the name a flag is documented under, without dashes
+func CanonicalName(f *mflag.Flag) string {
+	for _, n := range f.Names {
+		if n[0] != '#' {
+			return strings.TrimLeft(n, "#-")
+		}
+	}
+	return ""
+}
+
+// LoadConfig sets the flags which weren't given on the command line
+// from, in order of precedence, environment variables and the config
+// file at path (skipped if path is blank).
+//
+// The config file holds a JSON object of flag values by canonical
+// name. Objects may be nested to group settings, the keys being joined
+// with dashes, so
+//
+//	{"ipalloc": {"range": "10.32.0.0/12", "reserve": 0.1}}
+//
+// sets --ipalloc-range and --ipalloc-reserve. An array sets a list
+// flag to each of its elements.
+//
+// Environment variables are named envPrefix followed by the canonical
+// name upper-cased with dashes turned into underscores, e.g.
+// WEAVER_IPALLOC_RANGE; empty ones are ignored.
+//
+// Returns the values it set, by canonical name.
+func LoadConfig(path, envPrefix string) (map[string]string, error) {
+	config, err := ReadConfig(path, envPrefix)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[string]string)
+	mflag.VisitAll(func(f *mflag.Flag) {
+		name := CanonicalName(f)
+		values, found := config[name]
+		if err != nil || !found {
+			return
+		}
+		for _, value := range values {
+			if err = f.Value.Set(value); err != nil {
+				err = fmt.Errorf("invalid value %q for %s: %s", value, name, err)
+				return
+			}
+		}
+		applied[name] = f.Value.String()
+	})
+	return applied, err
+}
+
+// ReadConfig returns the values LoadConfig would set, without setting
+// them, by canonical name. A list flag may have several.
+func ReadConfig(path, envPrefix string) (map[string][]string, error) {
+	fileValues := make(map[string][]string)
+	if path != "" {
+		if err := readConfigFile(path, fileValues); err != nil {
+			return nil, err
+		}
+	}
+
+	onCommandLine := make(map[*mflag.Flag]bool)
+	mflag.Visit(func(f *mflag.Flag) { onCommandLine[f] = true })
+
+	config := make(map[string][]string)
+	mflag.VisitAll(func(f *mflag.Flag) {
+		name := CanonicalName(f)
+		values, found := fileValues[name]
+		delete(fileValues, name)
+		if name == "" || onCommandLine[f] {
+			return
+		}
+		if env := os.Getenv(envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))); env != "" {
+			values, found = []string{env}, true
+		}
+		if found {
+			config[name] = values
+		}
+	})
+	for name := range fileValues {
+		return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+	}
+	return config, nil
+}
+
+// EffectiveValues returns the value of every flag, however it was set,
+// by canonical name.
+func EffectiveValues() map[string]string {
+	values := make(map[string]string)
+	mflag.VisitAll(func(f *mflag.Flag) {
+		if name := CanonicalName(f); name != "" {
+			values[name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+func readConfigFile(path string, values map[string][]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	var settings map[string]interface{}
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return flatten("", settings, values)
+}
+
+func flatten(prefix string, settings map[string]interface{}, values map[string][]string) error {
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := prefix + key
+		switch setting := settings[key].(type) {
+		case map[string]interface{}:
+			if err := flatten(name+"-", setting, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			for _, elem := range setting {
+				value, err := configValue(name, elem)
+				if err != nil {
+					return err
+				}
+				values[name] = append(values[name], value)
+			}
+		default:
+			value, err := configValue(name, setting)
+			if err != nil {
+				return err
+			}
+			values[name] = []string{value}
+		}
+	}
+	return nil
+}
+
+func configValue(name string, setting interface{}) (string, error) {
+	switch value := setting.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	return "", fmt.Errorf("unsupported value for %s: %v", name, setting)
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
 )
 
@@ -12,9 +13,41 @@ type SignalReceiver interface {
 	Stop() error
 }
 
+type dumpHook struct {
+	name string
+	dump func() string
+}
+
+type reloadHook struct {
+	name   string
+	reload func() error
+}
+
+var (
+	hooksLock   sync.Mutex
+	dumpHooks   []dumpHook
+	reloadHooks []reloadHook
+)
+
+// OnDump registers dump to describe a subsystem's state in the log
+// when SIGUSR1 is received, along with all goroutine stacks.
+func OnDump(name string, dump func() string) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	dumpHooks = append(dumpHooks, dumpHook{name, dump})
+}
+
+// OnReload registers reload to be called, e.g. to re-read config,
+// when SIGHUP is received.
+func OnReload(name string, reload func() error) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	reloadHooks = append(reloadHooks, reloadHook{name, reload})
+}
+
 func SignalHandlerLoop(ss ...SignalReceiver) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	buf := make([]byte, 1<<20)
 	for {
 		switch <-sigs {
@@ -27,6 +60,36 @@ func SignalHandlerLoop(ss ...SignalReceiver) {
 		case syscall.SIGQUIT:
 			stacklen := runtime.Stack(buf, true)
 			Log.Infof("=== received SIGQUIT ===\n*** goroutine dump...\n%s\n*** end", buf[:stacklen])
+		case syscall.SIGHUP:
+			Log.Infof("=== received SIGHUP ===")
+			reload()
+		case syscall.SIGUSR1:
+			Log.Infof("=== received SIGUSR1 ===")
+			dump(buf)
+		}
+	}
+}
+
+func reload() {
+	hooksLock.Lock()
+	hooks := reloadHooks
+	hooksLock.Unlock()
+	for _, hook := range hooks {
+		if err := hook.reload(); err != nil {
+			Log.Errorf("*** reloading %s failed: %s", hook.name, err)
+		} else {
+			Log.Infof("*** reloaded %s", hook.name)
 		}
 	}
 }
+
+func dump(buf []byte) {
+	hooksLock.Lock()
+	hooks := dumpHooks
+	hooksLock.Unlock()
+	for _, hook := range hooks {
+		Log.Infof("*** %s dump...\n%s\n*** end", hook.name, hook.dump())
+	}
+	stacklen := runtime.Stack(buf, true)
+	Log.Infof("*** goroutine dump...\n%s\n*** end", buf[:stacklen])
+}
@@ -0,0 +1,103 @@
+// Package supervisor stops a panic in a long-running goroutine from
+// either taking the whole process down or silently leaving part of it
+// dead. Goroutines which can start again from clean state are
+// restarted; the rest are recorded as degraded, for the health check.
+package supervisor
+
+import (
+	"expvar"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+// Panics recovered, by goroutine name
+var expPanics = expvar.NewMap("supervisor.panics")
+
+// RestartDelay is how long Go waits before restarting a goroutine
+// which panicked, so one which panics straight away doesn't spin.
+var RestartDelay = time.Second
+
+var (
+	lock     sync.Mutex
+	degraded = make(map[string]string)
+)
+
+// Go runs f on a goroutine of its own. If f panics, the panic is
+// logged and f is run again, after RestartDelay; f must therefore set
+// up its state from scratch each time. Once f returns, that's it.
+func Go(name string, f func()) {
+	go func() {
+		for !runRecovering(name, f) {
+			Log.Warnf("[supervisor] Restarting %s", name)
+			time.Sleep(RestartDelay)
+		}
+	}()
+}
+
+// Returns true if f returned normally
+func runRecovering(name string, f func()) (returned bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			report(name, r, debug.Stack())
+		}
+	}()
+	f()
+	return true
+}
+
+// Recover is deferred at the top of a goroutine which can't safely be
+// restarted. A panic is logged, name is marked degraded and the
+// goroutine exits.
+func Recover(name string) {
+	if r := recover(); r != nil {
+		Panicked(name, r, debug.Stack())
+	}
+}
+
+// Panicked logs a panic which was recovered elsewhere, e.g. by an
+// actor, and marks name degraded.
+func Panicked(name string, recovered interface{}, stack []byte) {
+	report(name, recovered, stack)
+	lock.Lock()
+	defer lock.Unlock()
+	degraded[name] = fmt.Sprint(recovered)
+}
+
+// MarkDegraded records that name has stopped part of its work, for a
+// reason other than a panic.
+func MarkDegraded(name string, reason string) {
+	lock.Lock()
+	defer lock.Unlock()
+	degraded[name] = reason
+}
+
+// ClearDegraded records that name is no longer degraded, e.g. once
+// whatever it was marked degraded for has been put right.
+func ClearDegraded(name string) {
+	lock.Lock()
+	defer lock.Unlock()
+	delete(degraded, name)
+}
+
+func report(name string, recovered interface{}, stack []byte) {
+	expPanics.Add(name, 1)
+	Log.Errorf("[supervisor] Panic in %s: %v\n%s", name, recovered, stack)
+}
+
+// Degraded describes, in name order, each goroutine which has panicked
+// and not been restarted, or has been marked degraded.
+func Degraded() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	result := make([]string, 0, len(degraded))
+	for name, reason := range degraded {
+		result = append(result, fmt.Sprintf("%s: %s", name, reason))
+	}
+	sort.Strings(result)
+	return result
+}
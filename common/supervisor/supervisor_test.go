@@ -0,0 +1,52 @@
+package supervisor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGoRestartsAfterPanic(t *testing.T) {
+	RestartDelay = time.Millisecond
+	runs := make(chan int, 3)
+	count := 0
+	Go("restartable", func() {
+		count++
+		runs <- count
+		if count < 3 {
+			panic("boom")
+		}
+	})
+	for i := 1; i <= 3; i++ {
+		select {
+		case n := <-runs:
+			require.Equal(t, i, n)
+		case <-time.After(time.Second):
+			require.FailNow(t, "goroutine was not restarted")
+		}
+	}
+	require.NotContains(t, Degraded(), "restartable: boom")
+}
+
+func TestRecoverMarksDegraded(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer Recover("fragile")
+		panic("boom")
+	}()
+	<-done
+	require.Contains(t, Degraded(), "fragile: boom")
+}
+
+func TestMarkDegraded(t *testing.T) {
+	MarkDegraded("careful", "stopped")
+	require.Contains(t, Degraded(), "careful: stopped")
+}
+
+func TestClearDegraded(t *testing.T) {
+	MarkDegraded("recovering", "stopped")
+	ClearDegraded("recovering")
+	require.NotContains(t, Degraded(), "recovering: stopped")
+}
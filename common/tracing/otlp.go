@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/supervisor"
+)
+
+const (
+	// How often the OTLP exporter sends the spans it has collected
+	otlpInterval = 5 * time.Second
+	// Spans beyond this many between sends are dropped
+	otlpMaxPending = 2048
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector, as OTLP
+// JSON over HTTP, in batches.
+type OTLPExporter struct {
+	url      string
+	resource otlpResource
+	client   *http.Client
+	lock     sync.Mutex
+	pending  []*Span
+	dropped  int
+}
+
+// NewOTLPExporter starts exporting to url, e.g.
+// "http://collector:4318/v1/traces", spans which are labelled with
+// the given service and instance names.
+func NewOTLPExporter(url, service, instance string) *OTLPExporter {
+	exporter := &OTLPExporter{
+		url: url,
+		resource: otlpResource{[]otlpAttribute{
+			{"service.name", otlpValue{service}},
+			{"service.instance.id", otlpValue{instance}},
+		}},
+		client: &http.Client{Timeout: otlpInterval},
+	}
+	supervisor.Go("tracing", exporter.loop)
+	return exporter
+}
+
+func (exporter *OTLPExporter) Export(span *Span) {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	if len(exporter.pending) >= otlpMaxPending {
+		exporter.dropped++
+		return
+	}
+	exporter.pending = append(exporter.pending, span)
+}
+
+func (exporter *OTLPExporter) loop() {
+	for range time.Tick(otlpInterval) {
+		exporter.lock.Lock()
+		spans, dropped := exporter.pending, exporter.dropped
+		exporter.pending, exporter.dropped = nil, 0
+		exporter.lock.Unlock()
+		if dropped > 0 {
+			Log.Warnf("[tracing] Dropped %d spans which arrived faster than they could be exported", dropped)
+		}
+		if len(spans) > 0 {
+			if err := exporter.send(spans); err != nil {
+				Log.Warnf("[tracing] Unable to export %d spans to %s: %s", len(spans), exporter.url, err)
+			}
+		}
+	}
+}
+
+func (exporter *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(encodeOTLP(exporter.resource, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := exporter.client.Post(exporter.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
+
+// The parts of the OTLP JSON encoding we use; see
+// opentelemetry-proto's trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0 unset, 2 error
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+func encodeOTLP(resource otlpResource, spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: fmt.Sprint(span.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprint(span.End.UnixNano()),
+		}
+		if span.Parent != (SpanID{}) {
+			s.ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		keys := make([]string, 0, len(span.Attributes))
+		for key := range span.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s.Attributes = append(s.Attributes, otlpAttribute{key, otlpValue{span.Attributes[key]}})
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{otlpStatusError, span.Error}
+		}
+		encoded[i] = s
+	}
+	return otlpRequest{[]otlpResourceSpans{{resource, []otlpScopeSpans{{otlpScope{"weave"}, encoded}}}}}
+}
@@ -0,0 +1,139 @@
+// Package tracing records spans of work, such as an IP allocation,
+// which can cross from one peer to another, for analysis in a tracing
+// backend. Span contexts travel in W3C Trace Context form: the
+// "traceparent" header over HTTP, and the same string in gossip.
+// Spans are exported only once SetExporter has been called; until
+// then they just carry the context along.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const traceparentHeader = "traceparent"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+// SpanContext identifies a span, and the trace it is part of, across
+// process boundaries. The zero value is not a valid context.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// String returns the context in traceparent form, or "" if it is not
+// valid.
+func (c SpanContext) String() string {
+	if !c.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(c.TraceID[:]), hex.EncodeToString(c.SpanID[:]))
+}
+
+// Parse reads a context in traceparent form, returning the zero
+// SpanContext if s is not one.
+func Parse(s string) SpanContext {
+	var c SpanContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		hex.DecodedLen(len(parts[1])) != len(c.TraceID) || hex.DecodedLen(len(parts[2])) != len(c.SpanID) {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}
+	}
+	return c
+}
+
+// FromHeader returns the context of the caller's span from an HTTP
+// request's headers, or the zero SpanContext if there is none.
+func FromHeader(h http.Header) SpanContext {
+	return Parse(h.Get(traceparentHeader))
+}
+
+// Inject sets the HTTP headers which carry the context to a server.
+func (c SpanContext) Inject(h http.Header) {
+	if c.IsValid() {
+		h.Set(traceparentHeader, c.String())
+	}
+}
+
+// Span is a timed piece of work. Its fields are for exporters; they
+// must not be changed once it has ended.
+type Span struct {
+	Name       string
+	Context    SpanContext
+	Parent     SpanID // zero for the root of a trace
+	Start, End time.Time
+	Attributes map[string]string
+	Error      string // empty if the work succeeded
+}
+
+// Exporter sends spans, once they have ended, to a tracing backend.
+// Export must not block.
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	lock     sync.RWMutex
+	exporter Exporter
+)
+
+// SetExporter sends spans which end from now on to e, or nowhere if e
+// is nil.
+func SetExporter(e Exporter) {
+	lock.Lock()
+	defer lock.Unlock()
+	exporter = e
+}
+
+// Start begins a span. If parent is valid the span is its child;
+// otherwise the span starts a new trace.
+func Start(name string, parent SpanContext) *Span {
+	span := &Span{Name: name, Start: time.Now(), Attributes: make(map[string]string)}
+	if parent.IsValid() {
+		span.Context.TraceID, span.Parent = parent.TraceID, parent.SpanID
+	} else {
+		randomise(span.Context.TraceID[:])
+	}
+	randomise(span.Context.SpanID[:])
+	return span
+}
+
+func randomise(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	span.Attributes[key] = fmt.Sprint(value)
+}
+
+// Finish ends the span, recording err if it is not nil.
+func (span *Span) Finish(err error) {
+	if err != nil {
+		span.Error = err.Error()
+	}
+	span.End = time.Now()
+	lock.RLock()
+	defer lock.RUnlock()
+	if exporter != nil {
+		exporter.Export(span)
+	}
+}
@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recorder []*Span
+
+func (r *recorder) Export(span *Span) {
+	*r = append(*r, span)
+}
+
+func TestSpanContext(t *testing.T) {
+	require.False(t, SpanContext{}.IsValid())
+	require.Equal(t, "", SpanContext{}.String())
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c := Parse(traceparent)
+	require.True(t, c.IsValid())
+	require.Equal(t, traceparent, c.String())
+
+	for _, bad := range []string{"", "00-4bf92f35-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01"} {
+		require.False(t, Parse(bad).IsValid(), bad)
+	}
+
+	h := http.Header{}
+	c.Inject(h)
+	require.Equal(t, c, FromHeader(h))
+}
+
+func TestSpans(t *testing.T) {
+	var spans recorder
+	SetExporter(&spans)
+	defer SetExporter(nil)
+
+	root := Start("root", SpanContext{})
+	child := Start("child", root.Context)
+	child.SetAttribute("count", 3)
+	child.Finish(errors.New("failed"))
+	root.Finish(nil)
+
+	require.Len(t, spans, 2)
+	require.Equal(t, root.Context.TraceID, child.Context.TraceID)
+	require.Equal(t, root.Context.SpanID, child.Parent)
+	require.NotEqual(t, root.Context.SpanID, child.Context.SpanID)
+	require.Equal(t, SpanID{}, root.Parent)
+	require.Equal(t, "3", child.Attributes["count"])
+	require.Equal(t, "failed", child.Error)
+
+	// Without an exporter, spans still carry the context
+	SetExporter(nil)
+	Start("unexported", root.Context).Finish(nil)
+	require.Len(t, spans, 2)
+
+	request := encodeOTLP(otlpResource{}, spans)
+	encoded := request.ResourceSpans[0].ScopeSpans[0].Spans
+	require.Equal(t, root.Context.String()[3:35], encoded[1].TraceID)
+	require.Equal(t, encoded[1].SpanID, encoded[0].ParentSpanID)
+	require.Equal(t, "", encoded[1].ParentSpanID)
+	require.Equal(t, otlpStatusError, encoded[0].Status.Code)
+	require.Equal(t, []otlpAttribute{{"count", otlpValue{"3"}}}, encoded[0].Attributes)
+}
@@ -0,0 +1,128 @@
+// Package election picks a coordinator from a set of peers, for
+// subsystems which need one peer to act on behalf of all of them.
+//
+// The leader is simply the lowest-named member. Peers which agree on
+// the membership therefore agree on the leader without exchanging any
+// messages; after a partition heals they converge once membership
+// does. Each change of leader starts a new term, so observers can
+// tell a re-elected leader from one that never went away.
+package election
+
+import (
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+type Term struct {
+	Number uint64
+	Leader mesh.PeerName
+}
+
+type Election struct {
+	sync.Mutex
+	ourName    mesh.PeerName
+	members    map[mesh.PeerName]struct{}
+	term       Term
+	observers  []func(Term)
+	pending    []Term // terms not yet delivered to observers
+	delivering bool
+}
+
+// New creates an election in which we are initially the only member,
+// and hence the leader, in term 1.
+func New(ourName mesh.PeerName) *Election {
+	return &Election{
+		ourName: ourName,
+		members: map[mesh.PeerName]struct{}{ourName: {}},
+		term:    Term{Number: 1, Leader: ourName},
+	}
+}
+
+// Observe registers a function to be called, without the lock held,
+// at the start of every subsequent term. Terms are delivered one at a
+// time and in order, though not necessarily on the goroutine which
+// caused the change: if another change is already being delivered,
+// that delivery carries on with ours. Observers may call back into
+// the election.
+func (e *Election) Observe(f func(Term)) {
+	e.Lock()
+	defer e.Unlock()
+	e.observers = append(e.observers, f)
+}
+
+func (e *Election) Term() Term {
+	e.Lock()
+	defer e.Unlock()
+	return e.term
+}
+
+func (e *Election) IsLeader() bool {
+	return e.Term().Leader == e.ourName
+}
+
+// PeerJoined adds a member.
+func (e *Election) PeerJoined(name mesh.PeerName) {
+	e.change(func() { e.members[name] = struct{}{} })
+}
+
+// PeerGone removes a member. We never remove ourself.
+func (e *Election) PeerGone(name mesh.PeerName) {
+	if name == e.ourName {
+		return
+	}
+	e.change(func() { delete(e.members, name) })
+}
+
+// SetMembers replaces the membership wholesale, e.g. with the names of
+// all peers currently known to the router. We are always a member.
+func (e *Election) SetMembers(names []mesh.PeerName) {
+	e.change(func() {
+		e.members = map[mesh.PeerName]struct{}{e.ourName: {}}
+		for _, name := range names {
+			e.members[name] = struct{}{}
+		}
+	})
+}
+
+func (e *Election) change(f func()) {
+	e.Lock()
+	f()
+	leader := e.ourName
+	for name := range e.members {
+		if name < leader {
+			leader = name
+		}
+	}
+	if leader == e.term.Leader {
+		e.Unlock()
+		return
+	}
+	e.term = Term{Number: e.term.Number + 1, Leader: leader}
+	e.pending = append(e.pending, e.term)
+	if e.delivering {
+		e.Unlock()
+		return
+	}
+	e.delivering = true
+	for len(e.pending) > 0 {
+		term := e.pending[0]
+		e.pending = e.pending[1:]
+		observers := append([]func(Term){}, e.observers...)
+		e.Unlock()
+		for _, observer := range observers {
+			observer(term)
+		}
+		e.Lock()
+	}
+	e.delivering = false
+	e.Unlock()
+}
+
+// SetMembersFromPeers sets the membership to the peers currently
+// known to the router.
+func (e *Election) SetMembersFromPeers(peers *mesh.Peers) {
+	var names []mesh.PeerName
+	peers.ForEach(func(peer *mesh.Peer) { names = append(names, peer.Name) })
+	e.SetMembers(names)
+}
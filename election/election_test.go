@@ -0,0 +1,88 @@
+package election
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestLowestNameLeads(t *testing.T) {
+	e := New(5)
+	require.True(t, e.IsLeader())
+	require.Equal(t, Term{1, 5}, e.Term())
+
+	var terms []Term
+	e.Observe(func(term Term) { terms = append(terms, term) })
+
+	e.PeerJoined(7) // higher name: no change
+	require.True(t, e.IsLeader())
+	require.Len(t, terms, 0)
+
+	e.PeerJoined(3)
+	require.False(t, e.IsLeader())
+	require.Equal(t, Term{2, 3}, e.Term())
+
+	e.PeerGone(3)
+	require.True(t, e.IsLeader())
+	require.Equal(t, []Term{{2, 3}, {3, 5}}, terms)
+
+	e.PeerGone(5) // can't remove ourself
+	require.True(t, e.IsLeader())
+}
+
+func TestSetMembersAgrees(t *testing.T) {
+	names := []mesh.PeerName{4, 2, 9}
+	elections := []*Election{New(4), New(2), New(9)}
+	for _, e := range elections {
+		e.SetMembers(names)
+		require.Equal(t, mesh.PeerName(2), e.Term().Leader)
+	}
+	require.True(t, elections[1].IsLeader())
+
+	elections[0].SetMembers(nil)
+	require.True(t, elections[0].IsLeader())
+}
+
+func TestObserversSeeTermsInOrder(t *testing.T) {
+	e := New(5)
+	var terms []Term
+	e.Observe(func(term Term) {
+		terms = append(terms, term)
+		// changes made while observing are delivered after this one
+		if term.Number == 2 {
+			e.PeerGone(3)
+			require.Len(t, terms, 1)
+		}
+	})
+	e.PeerJoined(3)
+	require.Equal(t, []Term{{2, 3}, {3, 5}}, terms)
+}
+
+func TestConcurrentChangesDeliveredInOrder(t *testing.T) {
+	e := New(100)
+	var (
+		mu   sync.Mutex
+		last uint64 = 1
+	)
+	e.Observe(func(term Term) {
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, last+1, term.Number)
+		last = term.Number
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name mesh.PeerName) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e.PeerJoined(name)
+				e.PeerGone(name)
+			}
+		}(mesh.PeerName(i))
+	}
+	wg.Wait()
+	require.Equal(t, e.Term().Number, last)
+}
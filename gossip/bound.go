@@ -0,0 +1,70 @@
+package gossip
+
+import (
+	"fmt"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/errorlog"
+)
+
+// DefaultMaxMessageSize is the largest gossip message weave decodes
+// by default. It is well above what a network of a thousand peers
+// gossips for IPAM or DNS.
+const DefaultMaxMessageSize = 8 << 20
+
+// Bound returns a Router which registers gossipers with router,
+// refusing received messages longer than maxSize before they get to
+// be decoded. The error makes mesh close the connection the message
+// came in on. A maxSize of 0 leaves messages unbounded.
+func Bound(router Router, maxSize int) Router {
+	if maxSize <= 0 {
+		return router
+	}
+	return &boundedRouter{Router: router, maxSize: maxSize}
+}
+
+type boundedRouter struct {
+	Router
+	maxSize int
+}
+
+func (router *boundedRouter) NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	return router.Router.NewGossip(channel, &boundedGossiper{Gossiper: gossiper, channel: channel, maxSize: router.maxSize})
+}
+
+type boundedGossiper struct {
+	mesh.Gossiper
+	channel string
+	maxSize int
+}
+
+func (g *boundedGossiper) check(msg []byte) error {
+	if len(msg) <= g.maxSize {
+		return nil
+	}
+	err := fmt.Errorf("gossip message of %d bytes exceeds the limit of %d", len(msg), g.maxSize)
+	errorlog.Record("gossip "+g.channel, err)
+	return err
+}
+
+func (g *boundedGossiper) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	if err := g.check(msg); err != nil {
+		return err
+	}
+	return g.Gossiper.OnGossipUnicast(src, msg)
+}
+
+func (g *boundedGossiper) OnGossipBroadcast(src mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	if err := g.check(msg); err != nil {
+		return nil, err
+	}
+	return g.Gossiper.OnGossipBroadcast(src, msg)
+}
+
+func (g *boundedGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	if err := g.check(msg); err != nil {
+		return nil, err
+	}
+	return g.Gossiper.OnGossip(msg)
+}
@@ -0,0 +1,35 @@
+package gossip
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBound(t *testing.T) {
+	source := NewMap(1)
+	require.NoError(t, source.Set("k", make([]byte, 100)))
+	msg := source.Gossip().Encode()[0]
+
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	m := NewMap(2)
+	m.SetGossip(Bound(router, len(msg)-1).NewGossip("test", m))
+	require.Error(t, router.gossiper.OnGossipUnicast(1, msg))
+	_, err := router.gossiper.OnGossipBroadcast(1, msg)
+	require.Error(t, err)
+	_, err = router.gossiper.OnGossip(msg)
+	require.Error(t, err)
+	_, found := m.Get("k")
+	require.False(t, found)
+
+	m.SetGossip(Bound(router, len(msg)).NewGossip("test", m))
+	_, err = router.gossiper.OnGossip(msg)
+	require.NoError(t, err)
+	_, found = m.Get("k")
+	require.True(t, found)
+}
+
+func TestUnbounded(t *testing.T) {
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	require.Equal(t, router, Bound(router, 0))
+}
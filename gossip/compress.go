@@ -0,0 +1,175 @@
+package gossip
+
+import (
+	"bytes"
+	"compress/flate"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Compression of gossip messages above a threshold size, with
+// compress/flate. Ring and paxos state is highly repetitive, so shrinks
+// to a fraction of its size.
+//
+// mesh gives gossipers no way to agree anything per connection, and
+// broadcasts are relayed unchanged, so compressed messages are marked
+// rather than negotiated: they start with compressedMagic, which no
+// uncompressed message on weave's channels can. Those are either gob
+// streams, whose first byte is 0xff only when the next is 128 or more,
+// or IPAM unicasts, which start with a small message type. Peers of
+// every version since compression was added accept compressed
+// messages, but only send them when told to, so that it can be turned
+// on once every peer has been upgraded.
+
+var compressedMagic = []byte{0xff, 'W'}
+
+// Bytes sent less than they would have been without compression, by
+// channel
+var expCompressionSaved = expvar.NewMap("gossip.compressionSaved")
+
+// Compress returns a Router which registers gossipers with router,
+// compressing messages longer than threshold bytes, if that makes
+// them smaller. Compressed messages are accepted whatever threshold
+// is, even 0, which means sending none. maxSize bounds the size
+// messages are decompressed to; 0 leaves them unbounded.
+func Compress(router Router, threshold, maxSize int) Router {
+	return &compressingRouter{Router: router, threshold: threshold, maxSize: maxSize}
+}
+
+type compressingRouter struct {
+	Router
+	threshold int
+	maxSize   int
+}
+
+func (router *compressingRouter) NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	c := &compressor{channel: channel, threshold: router.threshold, maxSize: router.maxSize}
+	return &compressingGossip{
+		Gossip:     router.Router.NewGossip(channel, &compressingGossiper{Gossiper: gossiper, compressor: c}),
+		compressor: c,
+	}
+}
+
+type compressor struct {
+	channel   string
+	threshold int
+	maxSize   int
+}
+
+func (c *compressor) compress(msg []byte) []byte {
+	if c.threshold <= 0 || len(msg) <= c.threshold {
+		return msg
+	}
+	var buf bytes.Buffer
+	buf.Write(compressedMagic)
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return msg
+	}
+	if _, err := w.Write(msg); err != nil {
+		return msg
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(msg) {
+		return msg
+	}
+	expCompressionSaved.Add(c.channel, int64(len(msg)-buf.Len()))
+	return buf.Bytes()
+}
+
+func (c *compressor) decompress(msg []byte) ([]byte, error) {
+	if !bytes.HasPrefix(msg, compressedMagic) {
+		return msg, nil
+	}
+	var r io.Reader = flate.NewReader(bytes.NewReader(msg[len(compressedMagic):]))
+	if c.maxSize > 0 {
+		r = io.LimitReader(r, int64(c.maxSize)+1)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing gossip: %s", err)
+	}
+	if c.maxSize > 0 && len(decompressed) > c.maxSize {
+		return nil, fmt.Errorf("gossip message decompresses to more than the limit of %d bytes", c.maxSize)
+	}
+	return decompressed, nil
+}
+
+func (c *compressor) wrap(data mesh.GossipData) mesh.GossipData {
+	if data == nil {
+		return nil
+	}
+	return &compressedGossipData{GossipData: data, compressor: c}
+}
+
+// Wraps GossipData to compress its messages once mesh encodes them
+type compressedGossipData struct {
+	mesh.GossipData
+	compressor *compressor
+}
+
+func (d *compressedGossipData) Merge(other mesh.GossipData) mesh.GossipData {
+	if o, ok := other.(*compressedGossipData); ok {
+		other = o.GossipData
+	}
+	return d.compressor.wrap(d.GossipData.Merge(other))
+}
+
+func (d *compressedGossipData) Encode() [][]byte {
+	msgs := d.GossipData.Encode()
+	for i, msg := range msgs {
+		msgs[i] = d.compressor.compress(msg)
+	}
+	return msgs
+}
+
+type compressingGossiper struct {
+	mesh.Gossiper
+	*compressor
+}
+
+func (g *compressingGossiper) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	msg, err := g.decompress(msg)
+	if err != nil {
+		return err
+	}
+	return g.Gossiper.OnGossipUnicast(src, msg)
+}
+
+func (g *compressingGossiper) OnGossipBroadcast(src mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	msg, err := g.decompress(msg)
+	if err != nil {
+		return nil, err
+	}
+	update, err := g.Gossiper.OnGossipBroadcast(src, msg)
+	return g.wrap(update), err
+}
+
+func (g *compressingGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	msg, err := g.decompress(msg)
+	if err != nil {
+		return nil, err
+	}
+	delta, err := g.Gossiper.OnGossip(msg)
+	return g.wrap(delta), err
+}
+
+func (g *compressingGossiper) Gossip() mesh.GossipData {
+	return g.wrap(g.Gossiper.Gossip())
+}
+
+type compressingGossip struct {
+	mesh.Gossip
+	*compressor
+}
+
+func (g *compressingGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	return g.Gossip.GossipUnicast(dst, g.compress(msg))
+}
+
+func (g *compressingGossip) GossipBroadcast(update mesh.GossipData) error {
+	return g.Gossip.GossipBroadcast(g.wrap(update))
+}
@@ -0,0 +1,47 @@
+package gossip
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress(t *testing.T) {
+	sender := &recordingRouter{gossip: &recordingGossip{}}
+	source := NewMap(1)
+	source.SetGossip(Compress(sender, 64, 0).NewGossip("test", source))
+	require.NoError(t, source.Set("small", []byte("v")))
+	require.NoError(t, source.Set("big", bytes.Repeat([]byte("10.32.0.0/12 "), 100)))
+	require.Len(t, sender.gossip.broadcasts, 2)
+	small := sender.gossip.broadcasts[0].Encode()[0]
+	require.False(t, bytes.HasPrefix(small, compressedMagic))
+	big := sender.gossip.broadcasts[1].Encode()[0]
+	require.True(t, bytes.HasPrefix(big, compressedMagic))
+	require.True(t, len(big) < 1300)
+
+	// Merged updates are still compressed
+	merged := sender.gossip.broadcasts[0].Merge(sender.gossip.broadcasts[1])
+	require.True(t, bytes.HasPrefix(merged.Encode()[0], compressedMagic))
+
+	// A peer not sending compressed messages still accepts them, and
+	// passes the rest through
+	receiver := &recordingRouter{gossip: &recordingGossip{}}
+	m := NewMap(2)
+	m.SetGossip(Compress(receiver, 0, 0).NewGossip("test", m))
+	_, err := receiver.gossiper.OnGossipBroadcast(1, small)
+	require.NoError(t, err)
+	update, err := receiver.gossiper.OnGossipBroadcast(1, big)
+	require.NoError(t, err)
+	_, found := m.Get("big")
+	require.True(t, found)
+	_, found = m.Get("small")
+	require.True(t, found)
+	// but does not compress them when passing them on
+	require.False(t, bytes.HasPrefix(update.Encode()[0], compressedMagic))
+
+	// Decompressed messages are bounded
+	m.SetGossip(Compress(receiver, 0, 1000).NewGossip("test", m))
+	_, err = receiver.gossiper.OnGossip(big)
+	require.Error(t, err)
+}
@@ -0,0 +1,269 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/ipam/paxos"
+)
+
+// Consensus agrees a value for each key between peers, using the same
+// Paxos over gossip that IPAM uses to seed its ring. Unlike a Map
+// entry, once a key's value is agreed it never changes, and every peer
+// sees the same value even if several proposed different ones at
+// once. Agreement needs a quorum of peers to take part, so Consensus
+// needs to be told the quorum, as IPAM is.
+//
+// A proposal which gossip fails to deliver is not retried; propose
+// again to retry, which does no harm once a value has been agreed.
+//
+// Usage:
+//
+//	c := gossip.NewConsensus(router.Ourself.Peer.Name, router.Ourself.Peer.UID, quorum)
+//	c.SetGossip(router.NewGossip("consensus", c))
+//	c.OnAgreed(func(key string, value []byte) { ... })
+//	c.Propose("key", []byte("value"))
+type Consensus struct {
+	sync.Mutex
+	ourName  mesh.PeerName
+	ourUID   mesh.PeerUID
+	quorum   uint
+	nodes    map[string]*paxos.Node
+	agreed   map[string][]byte
+	gossip   mesh.Gossip
+	onAgreed func(key string, value []byte)
+}
+
+func NewConsensus(ourName mesh.PeerName, ourUID mesh.PeerUID, quorum uint) *Consensus {
+	return &Consensus{
+		ourName: ourName,
+		ourUID:  ourUID,
+		quorum:  quorum,
+		nodes:   make(map[string]*paxos.Node),
+		agreed:  make(map[string][]byte),
+	}
+}
+
+func (c *Consensus) SetGossip(gossip mesh.Gossip) {
+	c.Lock()
+	defer c.Unlock()
+	c.gossip = gossip
+}
+
+// OnAgreed registers a function to be called, without the lock held,
+// when we learn the agreed value of a key.
+func (c *Consensus) OnAgreed(f func(key string, value []byte)) {
+	c.Lock()
+	defer c.Unlock()
+	c.onAgreed = f
+}
+
+// Get returns the agreed value of key, if there is one yet.
+func (c *Consensus) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	value, found := c.agreed[key]
+	return value, found
+}
+
+// Propose puts value forward for key. The agreed value may turn out to
+// be one proposed by another peer.
+func (c *Consensus) Propose(key string, value []byte) error {
+	c.Lock()
+	if _, found := c.agreed[key]; found {
+		c.Unlock()
+		return nil
+	}
+	node := c.node(key)
+	node.SetProposal(value)
+	node.Propose()
+	agreed := c.checkAgreed(key)
+	update := &ConsensusGossipData{Keys: map[string]paxos.GossipState{key: copyState(node.GossipState())}}
+	gossip, onAgreed := c.gossip, c.onAgreed
+	c.Unlock()
+
+	c.notify(onAgreed, agreed)
+	if gossip == nil {
+		return nil
+	}
+	return gossip.GossipBroadcast(update)
+}
+
+// Lock must be held
+func (c *Consensus) node(key string) *paxos.Node {
+	node, found := c.nodes[key]
+	if !found {
+		node = paxos.NewNode(c.ourName, c.ourUID, c.quorum)
+		c.nodes[key] = node
+	}
+	return node
+}
+
+// Lock must be held. Returns key and its value if key has just been
+// agreed, or nil.
+func (c *Consensus) checkAgreed(key string) map[string][]byte {
+	if _, found := c.agreed[key]; found {
+		return nil
+	}
+	ok, val := c.nodes[key].Consensus()
+	if !ok {
+		return nil
+	}
+	c.agreed[key] = val.Data
+	return map[string][]byte{key: val.Data}
+}
+
+func (c *Consensus) notify(onAgreed func(string, []byte), agreed map[string][]byte) {
+	if onAgreed == nil {
+		return
+	}
+	for key, value := range agreed {
+		onAgreed(key, value)
+	}
+}
+
+// merge incoming claims into our state, returning the state of the
+// keys which changed, or nil if none did. Also returns our own claims
+// for the keys where hearing about others changed them, which need
+// broadcasting.
+func (c *Consensus) merge(incoming map[string]paxos.GossipState) (changed, ours map[string]paxos.GossipState) {
+	var (
+		agreed   = make(map[string][]byte)
+		onAgreed func(string, []byte)
+	)
+
+	c.Lock()
+	for key, state := range incoming {
+		node := c.node(key)
+		if !node.Update(state) {
+			continue
+		}
+		if changed == nil {
+			changed = make(map[string]paxos.GossipState)
+		}
+		if node.Think() {
+			if ours == nil {
+				ours = make(map[string]paxos.GossipState)
+			}
+			ours[key] = copyState(node.GossipState())
+		}
+		changed[key] = copyState(node.GossipState())
+		for k, v := range c.checkAgreed(key) {
+			agreed[k] = v
+		}
+	}
+	onAgreed = c.onAgreed
+	c.Unlock()
+
+	c.notify(onAgreed, agreed)
+	return changed, ours
+}
+
+func (c *Consensus) Gossip() mesh.GossipData {
+	c.Lock()
+	defer c.Unlock()
+	keys := make(map[string]paxos.GossipState, len(c.nodes))
+	for key, node := range c.nodes {
+		keys[key] = copyState(node.GossipState())
+	}
+	return &ConsensusGossipData{Keys: keys}
+}
+
+func (c *Consensus) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	gossip, err := c.receive(msg)
+	if err != nil {
+		return err
+	}
+	c.mergeAndBroadcast(gossip.Keys)
+	return nil
+}
+
+// merge received data into state and return "everything new I've
+// just learnt", or nil if nothing in the received data was new
+func (c *Consensus) OnGossip(msg []byte) (mesh.GossipData, error) {
+	gossip, err := c.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	if changed := c.mergeAndBroadcast(gossip.Keys); changed != nil {
+		return &ConsensusGossipData{Keys: changed}, nil
+	}
+	return nil, nil
+}
+
+// merge received data into state and return a representation of
+// the received data, for further propagation
+func (c *Consensus) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	gossip, err := c.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	c.mergeAndBroadcast(gossip.Keys)
+	return gossip, nil
+}
+
+// Like IPAM, when what we heard changes our own claims, we broadcast
+// them rather than waiting for them to be gossiped.
+func (c *Consensus) mergeAndBroadcast(incoming map[string]paxos.GossipState) map[string]paxos.GossipState {
+	changed, ours := c.merge(incoming)
+	if ours != nil {
+		c.Lock()
+		gossip := c.gossip
+		c.Unlock()
+		if gossip != nil {
+			gossip.GossipBroadcast(&ConsensusGossipData{Keys: ours})
+		}
+	}
+	return changed
+}
+
+func (c *Consensus) receive(msg []byte) (*ConsensusGossipData, error) {
+	var gossip ConsensusGossipData
+	if err := gossip.Decode(msg); err != nil {
+		return nil, err
+	}
+	return &gossip, nil
+}
+
+func copyState(state paxos.GossipState) paxos.GossipState {
+	result := make(paxos.GossipState, len(state))
+	result.Update(state)
+	return result
+}
+
+// ConsensusGossipData is the mesh.GossipData exchanged by Consensus.
+type ConsensusGossipData struct {
+	Keys map[string]paxos.GossipState
+}
+
+func (g *ConsensusGossipData) Merge(o mesh.GossipData) mesh.GossipData {
+	other := o.(*ConsensusGossipData)
+	merged := &ConsensusGossipData{Keys: make(map[string]paxos.GossipState, len(g.Keys))}
+	for key, state := range g.Keys {
+		merged.Keys[key] = copyState(state)
+	}
+	for key, state := range other.Keys {
+		if existing, found := merged.Keys[key]; found {
+			existing.Update(state)
+		} else {
+			merged.Keys[key] = copyState(state)
+		}
+	}
+	return merged
+}
+
+func (g *ConsensusGossipData) Decode(msg []byte) error {
+	return gob.NewDecoder(bytes.NewReader(msg)).Decode(g)
+}
+
+func (g *ConsensusGossipData) Encode() [][]byte {
+	msg, err := bufpool.GobEncode(g)
+	if err != nil {
+		panic(err)
+	}
+	return [][]byte{msg}
+}
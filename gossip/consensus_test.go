@@ -0,0 +1,72 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	testgossip "github.com/weaveworks/weave/testing/gossip"
+)
+
+func makeNetworkOfConsensus(t *testing.T, size int, quorum uint) ([]*Consensus, *testgossip.TestRouter) {
+	router := testgossip.NewTestRouter(0.0)
+	cs := make([]*Consensus, size)
+	for i := range cs {
+		name, err := mesh.PeerNameFromString(fmt.Sprintf("%02d:00:00:01:00:00", i))
+		require.NoError(t, err)
+		cs[i] = NewConsensus(name, mesh.PeerUID(i), quorum)
+		cs[i].SetGossip(router.Connect(name, cs[i]))
+	}
+	return cs, router
+}
+
+func TestConsensusAgrees(t *testing.T) {
+	cs, router := makeNetworkOfConsensus(t, 3, 2)
+	defer router.Stop()
+
+	agreed := make(chan string, 10)
+	cs[2].OnAgreed(func(key string, value []byte) { agreed <- key + "=" + string(value) })
+
+	// Competing proposals still lead to a single value
+	require.NoError(t, cs[0].Propose("cidr", []byte("10.32.0.0/12")))
+	require.NoError(t, cs[1].Propose("cidr", []byte("10.40.0.0/16")))
+	for i := 0; i < 5; i++ {
+		router.Flush()
+	}
+
+	value, found := cs[0].Get("cidr")
+	require.True(t, found)
+	for _, c := range cs[1:] {
+		other, found := c.Get("cidr")
+		require.True(t, found)
+		require.Equal(t, value, other)
+	}
+	require.Equal(t, "cidr="+string(value), <-agreed)
+
+	// Once agreed, a value doesn't change
+	require.NoError(t, cs[2].Propose("cidr", []byte("192.168.0.0/16")))
+	router.Flush()
+	other, _ := cs[0].Get("cidr")
+	require.Equal(t, value, other)
+
+	_, found = cs[0].Get("other")
+	require.False(t, found)
+}
+
+func TestConsensusGossipDataMerge(t *testing.T) {
+	c1, c2 := NewConsensus(1, 1, 2), NewConsensus(2, 2, 2)
+	require.NoError(t, c1.Propose("a", []byte("1")))
+	require.NoError(t, c2.Propose("b", []byte("2")))
+
+	merged := c1.Gossip().Merge(c2.Gossip()).(*ConsensusGossipData)
+	require.Len(t, merged.Keys, 2)
+	require.Len(t, merged.Keys["a"], 1)
+	require.Len(t, merged.Keys["b"], 1)
+
+	// Hearing about the other's proposals makes each promise to them
+	_, err := c1.OnGossip(merged.Encode()[0])
+	require.NoError(t, err)
+	require.Len(t, c1.Gossip().(*ConsensusGossipData).Keys["b"], 2)
+}
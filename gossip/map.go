@@ -0,0 +1,255 @@
+// Package gossip contains helpers for applications which embed a mesh
+// router and want to replicate state between peers without writing
+// their own mesh.Gossiper.
+package gossip
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+)
+
+// Map is a string-keyed map replicated to every peer via gossip. It
+// is a last-writer-wins CRDT: each write is stamped with a Lamport
+// clock and the writing peer's name, and on conflict the entry with
+// the higher (clock, peer) pair wins. Deletes leave tombstones so
+// that they propagate like any other write. Tombstones are kept until
+// PruneTombstones is called; applications which delete keys should
+// call it periodically, or the full state exchanged with new peers
+// grows without bound.
+//
+// Usage:
+//
+//	m := gossip.NewMap(router.Ourself.Peer.Name)
+//	m.SetGossip(router.NewGossip("mymap", m))
+//	m.Set("key", []byte("value"))
+type Map struct {
+	sync.RWMutex
+	ourName  mesh.PeerName
+	clock    uint64
+	entries  map[string]mapEntry
+	gossip   mesh.Gossip
+	onChange func(key string, value []byte, deleted bool)
+}
+
+type mapEntry struct {
+	Value     []byte
+	Clock     uint64
+	Origin    mesh.PeerName
+	Deleted   bool
+	DeletedAt int64 // unix time, according to the deleting peer
+}
+
+var now = func() int64 { return time.Now().Unix() }
+
+func (e mapEntry) newerThan(other mapEntry) bool {
+	return e.Clock > other.Clock || (e.Clock == other.Clock && e.Origin > other.Origin)
+}
+
+func NewMap(ourName mesh.PeerName) *Map {
+	return &Map{ourName: ourName, entries: make(map[string]mapEntry)}
+}
+
+func (m *Map) SetGossip(gossip mesh.Gossip) {
+	m.Lock()
+	defer m.Unlock()
+	m.gossip = gossip
+}
+
+// OnChange registers a function to be called, without the lock held,
+// whenever a key is changed by a remote peer.
+func (m *Map) OnChange(f func(key string, value []byte, deleted bool)) {
+	m.Lock()
+	defer m.Unlock()
+	m.onChange = f
+}
+
+func (m *Map) Get(key string) ([]byte, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	entry, found := m.entries[key]
+	if !found || entry.Deleted {
+		return nil, false
+	}
+	return entry.Value, true
+}
+
+// Keys returns the live keys, sorted.
+func (m *Map) Keys() []string {
+	m.RLock()
+	defer m.RUnlock()
+	keys := make([]string, 0, len(m.entries))
+	for key, entry := range m.entries {
+		if !entry.Deleted {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *Map) Set(key string, value []byte) error {
+	return m.write(key, mapEntry{Value: value})
+}
+
+func (m *Map) Delete(key string) error {
+	return m.write(key, mapEntry{Deleted: true, DeletedAt: now()})
+}
+
+func (m *Map) write(key string, entry mapEntry) error {
+	m.Lock()
+	m.clock++
+	entry.Clock = m.clock
+	entry.Origin = m.ourName
+	m.entries[key] = entry
+	gossip := m.gossip
+	m.Unlock()
+	if gossip == nil {
+		return nil
+	}
+	return gossip.GossipBroadcast(&MapGossipData{Entries: map[string]mapEntry{key: entry}})
+}
+
+// PruneTombstones forgets deletes made more than maxAge ago. maxAge
+// needs to cover the time it takes a delete to reach every peer, plus
+// the clock skew between peers: a peer which has not heard of a
+// delete by the time everyone else prunes it can bring the key back.
+func (m *Map) PruneTombstones(maxAge time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	cutoff := now() - int64(maxAge/time.Second)
+	for key, entry := range m.entries {
+		if entry.Deleted && entry.DeletedAt < cutoff {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// merge incoming entries into our state, returning those which were
+// new to us, or nil if none were.
+func (m *Map) merge(incoming map[string]mapEntry) map[string]mapEntry {
+	type change struct {
+		key   string
+		entry mapEntry
+	}
+	var (
+		changed  map[string]mapEntry
+		changes  []change
+		onChange func(string, []byte, bool)
+	)
+
+	m.Lock()
+	for key, entry := range incoming {
+		// advance our clock past anything we've seen, so our
+		// subsequent writes win over it
+		if entry.Clock > m.clock {
+			m.clock = entry.Clock
+		}
+		if existing, found := m.entries[key]; found && !entry.newerThan(existing) {
+			continue
+		}
+		m.entries[key] = entry
+		if changed == nil {
+			changed = make(map[string]mapEntry)
+		}
+		changed[key] = entry
+		changes = append(changes, change{key, entry})
+	}
+	onChange = m.onChange
+	m.Unlock()
+
+	if onChange != nil {
+		for _, c := range changes {
+			onChange(c.key, c.entry.Value, c.entry.Deleted)
+		}
+	}
+	return changed
+}
+
+func (m *Map) Gossip() mesh.GossipData {
+	m.RLock()
+	defer m.RUnlock()
+	entries := make(map[string]mapEntry, len(m.entries))
+	for key, entry := range m.entries {
+		entries[key] = entry
+	}
+	return &MapGossipData{Entries: entries}
+}
+
+func (m *Map) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	gossip, err := m.receive(msg)
+	if err != nil {
+		return err
+	}
+	m.merge(gossip.Entries)
+	return nil
+}
+
+// merge received data into state and return "everything new I've
+// just learnt", or nil if nothing in the received data was new
+func (m *Map) OnGossip(msg []byte) (mesh.GossipData, error) {
+	gossip, err := m.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	if changed := m.merge(gossip.Entries); changed != nil {
+		return &MapGossipData{Entries: changed}, nil
+	}
+	return nil, nil
+}
+
+// merge received data into state and return a representation of
+// the received data, for further propagation
+func (m *Map) OnGossipBroadcast(_ mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	gossip, err := m.receive(msg)
+	if err != nil {
+		return nil, err
+	}
+	m.merge(gossip.Entries)
+	return gossip, nil
+}
+
+func (m *Map) receive(msg []byte) (*MapGossipData, error) {
+	var gossip MapGossipData
+	if err := gossip.Decode(msg); err != nil {
+		return nil, err
+	}
+	return &gossip, nil
+}
+
+// MapGossipData is the mesh.GossipData exchanged by Map.
+type MapGossipData struct {
+	Entries map[string]mapEntry
+}
+
+func (g *MapGossipData) Merge(o mesh.GossipData) mesh.GossipData {
+	other := o.(*MapGossipData)
+	merged := &MapGossipData{Entries: make(map[string]mapEntry, len(g.Entries))}
+	for key, entry := range g.Entries {
+		merged.Entries[key] = entry
+	}
+	for key, entry := range other.Entries {
+		if existing, found := merged.Entries[key]; !found || entry.newerThan(existing) {
+			merged.Entries[key] = entry
+		}
+	}
+	return merged
+}
+
+func (g *MapGossipData) Decode(msg []byte) error {
+	return gob.NewDecoder(bytes.NewReader(msg)).Decode(g)
+}
+
+func (g *MapGossipData) Encode() [][]byte {
+	msg, err := bufpool.GobEncode(g)
+	if err != nil {
+		panic(err)
+	}
+	return [][]byte{msg}
+}
@@ -0,0 +1,120 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	testgossip "github.com/weaveworks/weave/testing/gossip"
+)
+
+func makeNetworkOfMaps(t *testing.T, size int) ([]*Map, *testgossip.TestRouter) {
+	router := testgossip.NewTestRouter(0.0)
+	maps := make([]*Map, size)
+	for i := range maps {
+		name, err := mesh.PeerNameFromString(fmt.Sprintf("%02d:00:00:01:00:00", i))
+		require.NoError(t, err)
+		maps[i] = NewMap(name)
+		maps[i].SetGossip(router.Connect(name, maps[i]))
+	}
+	return maps, router
+}
+
+func TestMapReplicates(t *testing.T) {
+	maps, router := makeNetworkOfMaps(t, 3)
+	defer router.Stop()
+
+	require.NoError(t, maps[0].Set("a", []byte("1")))
+	require.NoError(t, maps[1].Set("b", []byte("2")))
+	router.Flush()
+
+	for _, m := range maps {
+		require.Equal(t, []string{"a", "b"}, m.Keys())
+		value, found := m.Get("a")
+		require.True(t, found)
+		require.Equal(t, []byte("1"), value)
+	}
+
+	require.NoError(t, maps[2].Delete("a"))
+	router.Flush()
+	for _, m := range maps {
+		_, found := m.Get("a")
+		require.False(t, found)
+		require.Equal(t, []string{"b"}, m.Keys())
+	}
+}
+
+func TestMapConflicts(t *testing.T) {
+	m1, m2 := NewMap(1), NewMap(2)
+	require.NoError(t, m1.Set("k", []byte("one")))
+	require.NoError(t, m2.Set("k", []byte("two")))
+
+	// Concurrent writes with equal clocks: the higher peer name wins,
+	// whichever order the gossip arrives in.
+	_, err := m1.OnGossip(m2.Gossip().Encode()[0])
+	require.NoError(t, err)
+	_, err = m2.OnGossip(m1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	v1, _ := m1.Get("k")
+	v2, _ := m2.Get("k")
+	require.Equal(t, []byte("two"), v1)
+	require.Equal(t, []byte("two"), v2)
+
+	// Having seen m2's write, m1's next write supersedes it.
+	require.NoError(t, m1.Set("k", []byte("three")))
+	delta, err := m2.OnGossip(m1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	v2, _ = m2.Get("k")
+	require.Equal(t, []byte("three"), v2)
+
+	// Re-receiving the same state yields no delta.
+	delta, err = m2.OnGossip(m1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	require.Nil(t, delta)
+}
+
+func TestMapOnChange(t *testing.T) {
+	m1, m2 := NewMap(1), NewMap(2)
+	var changes []string
+	m2.OnChange(func(key string, value []byte, deleted bool) {
+		changes = append(changes, fmt.Sprintf("%s=%s/%v", key, value, deleted))
+	})
+	require.NoError(t, m1.Set("k", []byte("v")))
+	_, err := m2.OnGossipBroadcast(1, m1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	require.NoError(t, m1.Delete("k"))
+	require.NoError(t, m2.OnGossipUnicast(1, m1.Gossip().Encode()[0]))
+	require.Equal(t, []string{"k=v/false", "k=/true"}, changes)
+}
+
+func TestMapPruneTombstones(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1000 }
+
+	maps, router := makeNetworkOfMaps(t, 2)
+	defer router.Stop()
+	require.NoError(t, maps[0].Set("a", []byte("1")))
+	require.NoError(t, maps[0].Set("b", []byte("2")))
+	require.NoError(t, maps[0].Delete("a"))
+	router.Flush()
+
+	now = func() int64 { return 1000 + 60 }
+	for _, m := range maps {
+		m.PruneTombstones(time.Minute)
+		require.Len(t, m.Gossip().(*MapGossipData).Entries, 2, "tombstone pruned too early")
+	}
+
+	now = func() int64 { return 1000 + 61 }
+	for _, m := range maps {
+		m.PruneTombstones(time.Minute)
+		entries := m.Gossip().(*MapGossipData).Entries
+		require.Len(t, entries, 1)
+		require.Contains(t, entries, "b")
+		require.Equal(t, []string{"b"}, m.Keys())
+	}
+}
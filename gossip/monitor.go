@@ -0,0 +1,195 @@
+package gossip
+
+import (
+	"sync"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/errorlog"
+)
+
+type MessageKind int
+
+const (
+	Unicast MessageKind = iota
+	Broadcast
+	Gossip
+)
+
+func (kind MessageKind) String() string {
+	switch kind {
+	case Unicast:
+		return "unicast"
+	case Broadcast:
+		return "broadcast"
+	case Gossip:
+		return "gossip"
+	}
+	return "unknown"
+}
+
+type Direction int
+
+const (
+	Received Direction = iota
+	Sent
+)
+
+func (dir Direction) String() string {
+	if dir == Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Monitor receives copies of the gossip messages on every channel
+// registered via a Tap, in both directions. Monitors cannot affect
+// gossip; they are for debugging tools. peer is the sender of
+// received messages and the destination of sent unicasts;
+// mesh.UnknownPeerName otherwise. Sent broadcasts are seen before
+// mesh merges them with other pending updates, so what goes on the
+// wire may be larger.
+type Monitor interface {
+	OnGossipMessage(channel string, dir Direction, kind MessageKind, peer mesh.PeerName, msg []byte)
+}
+
+// Router is the part of mesh.Router needed to register gossipers.
+type Router interface {
+	NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip
+}
+
+// Tap fans out gossip traffic to monitors. Only channels registered
+// through the Tap are seen; mesh's own topology gossip is not.
+type Tap struct {
+	sync.RWMutex
+	monitors         []Monitor
+	receivedMonitors []Monitor // which only see received messages
+}
+
+func NewTap() *Tap {
+	return &Tap{}
+}
+
+func (tap *Tap) AddMonitor(monitor Monitor) {
+	tap.Lock()
+	defer tap.Unlock()
+	tap.monitors = append(tap.monitors, monitor)
+}
+
+// NewGossip registers gossiper on channel with router, like
+// router.NewGossip, tapping the messages it receives and those sent
+// through the returned Gossip.
+func (tap *Tap) NewGossip(router Router, channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	return &tappedGossip{
+		Gossip:  router.NewGossip(channel, tap.Wrap(channel, gossiper)),
+		tap:     tap,
+		channel: channel,
+	}
+}
+
+// Wrap returns a Gossiper to register on channel in place of
+// gossiper. Only received messages are tapped; use NewGossip to see
+// sent ones too.
+func (tap *Tap) Wrap(channel string, gossiper mesh.Gossiper) mesh.Gossiper {
+	return &tappedGossiper{Gossiper: gossiper, tap: tap, channel: channel}
+}
+
+// AddReceivedMonitor adds a monitor which only sees received messages.
+// Sent broadcasts are only encoded for monitors which see them, so
+// this costs less where the monitor would ignore them.
+func (tap *Tap) AddReceivedMonitor(monitor Monitor) {
+	tap.Lock()
+	defer tap.Unlock()
+	tap.receivedMonitors = append(tap.receivedMonitors, monitor)
+}
+
+func (tap *Tap) active() bool {
+	tap.RLock()
+	defer tap.RUnlock()
+	return len(tap.monitors) > 0
+}
+
+func (tap *Tap) notify(channel string, dir Direction, kind MessageKind, peer mesh.PeerName, msg []byte) {
+	tap.RLock()
+	defer tap.RUnlock()
+	monitors := tap.monitors
+	if dir == Received {
+		monitors = append(monitors[:len(monitors):len(monitors)], tap.receivedMonitors...)
+	}
+	for _, monitor := range monitors {
+		// each monitor gets its own copy, so none of them can
+		// interfere with the message the gossiper sees
+		monitor.OnGossipMessage(channel, dir, kind, peer, append([]byte(nil), msg...))
+	}
+}
+
+type tappedGossiper struct {
+	mesh.Gossiper
+	tap     *Tap
+	channel string
+}
+
+func (g *tappedGossiper) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	g.tap.notify(g.channel, Received, Unicast, src, msg)
+	return g.record(g.Gossiper.OnGossipUnicast(src, msg))
+}
+
+func (g *tappedGossiper) OnGossipBroadcast(src mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	g.tap.notify(g.channel, Received, Broadcast, src, msg)
+	update, err := g.Gossiper.OnGossipBroadcast(src, msg)
+	return update, g.record(err)
+}
+
+func (g *tappedGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	g.tap.notify(g.channel, Received, Gossip, mesh.UnknownPeerName, msg)
+	update, err := g.Gossiper.OnGossip(msg)
+	return update, g.record(err)
+}
+
+// Errors on a tapped channel are kept for the status report
+func (g *tappedGossiper) record(err error) error {
+	errorlog.Record("gossip "+g.channel, err)
+	return err
+}
+
+type tappedGossip struct {
+	mesh.Gossip
+	tap     *Tap
+	channel string
+}
+
+func (g *tappedGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	g.tap.notify(g.channel, Sent, Unicast, dst, msg)
+	err := g.Gossip.GossipUnicast(dst, msg)
+	errorlog.Record("gossip "+g.channel, err)
+	return err
+}
+
+func (g *tappedGossip) GossipBroadcast(update mesh.GossipData) error {
+	// only pay for encoding if someone is listening. Encoding is done
+	// in the background since some GossipData, like IPAM's, encode by
+	// asking an actor which may be the one broadcasting.
+	if g.tap.active() {
+		go func() {
+			for _, msg := range update.Encode() {
+				g.tap.notify(g.channel, Sent, Broadcast, mesh.UnknownPeerName, msg)
+			}
+		}()
+	}
+	return g.Gossip.GossipBroadcast(update)
+}
+
+// LogMonitor logs a line for every gossip message at debug level.
+type LogMonitor struct{}
+
+func (LogMonitor) OnGossipMessage(channel string, dir Direction, kind MessageKind, peer mesh.PeerName, msg []byte) {
+	switch {
+	case dir == Received:
+		common.Log.Debugf("[gossip %s] %s from %s: %d bytes", channel, kind, peer, len(msg))
+	case peer != mesh.UnknownPeerName:
+		common.Log.Debugf("[gossip %s] %s to %s: %d bytes", channel, kind, peer, len(msg))
+	default:
+		common.Log.Debugf("[gossip %s] %s sent: %d bytes", channel, kind, len(msg))
+	}
+}
@@ -0,0 +1,139 @@
+package gossip
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+type recordingMonitor struct {
+	sync.Mutex
+	seen []string
+}
+
+func (m *recordingMonitor) OnGossipMessage(channel string, dir Direction, kind MessageKind, peer mesh.PeerName, msg []byte) {
+	m.Lock()
+	defer m.Unlock()
+	m.seen = append(m.seen, fmt.Sprintf("%s %s %s %d %d", channel, dir, kind, peer, len(msg)))
+	msg[0] = 0 // must not affect the gossiper
+}
+
+// Sent messages are seen in the background, so wait for n of them
+func (m *recordingMonitor) waitFor(n int) []string {
+	for i := 0; i < 100; i++ {
+		m.Lock()
+		seen := m.seen
+		m.Unlock()
+		if len(seen) >= n {
+			return seen
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+type recordingGossip struct {
+	unicasts   [][]byte
+	broadcasts []mesh.GossipData
+}
+
+func (g *recordingGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	g.unicasts = append(g.unicasts, msg)
+	return nil
+}
+
+func (g *recordingGossip) GossipBroadcast(update mesh.GossipData) error {
+	g.broadcasts = append(g.broadcasts, update)
+	return nil
+}
+
+type recordingRouter struct {
+	gossip   *recordingGossip
+	gossiper mesh.Gossiper
+}
+
+func (r *recordingRouter) NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	r.gossiper = gossiper
+	return r.gossip
+}
+
+func TestTapCopiesTraffic(t *testing.T) {
+	monitor := &recordingMonitor{}
+	tap := NewTap()
+	tap.AddMonitor(monitor)
+
+	source := NewMap(1)
+	require.NoError(t, source.Set("k", []byte("v")))
+	msg := source.Gossip().Encode()[0]
+	n := len(msg)
+
+	m := NewMap(2)
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	m.SetGossip(tap.NewGossip(router, "test", m))
+	tapped := router.gossiper
+	require.NoError(t, tapped.OnGossipUnicast(1, append([]byte(nil), msg...)))
+	_, err := tapped.OnGossipBroadcast(1, append([]byte(nil), msg...))
+	require.NoError(t, err)
+	_, err = tapped.OnGossip(append([]byte(nil), msg...))
+	require.NoError(t, err)
+	value, found := m.Get("k")
+	require.True(t, found)
+	require.Equal(t, []byte("v"), value)
+	require.Equal(t, []string{
+		fmt.Sprintf("test received unicast 1 %d", n),
+		fmt.Sprintf("test received broadcast 1 %d", n),
+		fmt.Sprintf("test received gossip %d %d", mesh.UnknownPeerName, n),
+	}, monitor.seen)
+
+	// Sends are seen too
+	monitor.seen = nil
+	require.NoError(t, m.Set("k2", []byte("v2")))
+	require.Len(t, router.gossip.broadcasts, 1)
+	sent := router.gossip.broadcasts[0].Encode()
+	require.Len(t, sent, 1)
+
+	require.Equal(t, []string{
+		fmt.Sprintf("test sent broadcast %d %d", mesh.UnknownPeerName, len(sent[0])),
+	}, monitor.waitFor(1))
+}
+
+func TestTapUnwatched(t *testing.T) {
+	tap := NewTap()
+	m := NewMap(2)
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	m.SetGossip(tap.NewGossip(router, "test", m))
+	require.NoError(t, m.Set("k", []byte("v")))
+	require.Len(t, router.gossip.broadcasts, 1)
+}
+
+func TestStatsMonitor(t *testing.T) {
+	stats := NewStatsMonitor()
+	tap := NewTap()
+	tap.AddReceivedMonitor(stats)
+	require.False(t, tap.active(), "sent broadcasts need not be encoded")
+
+	m := NewMap(2)
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	m.SetGossip(tap.NewGossip(router, "test", m))
+	tapped := router.gossiper
+	source := NewMap(1)
+	require.NoError(t, source.Set("k", []byte("v")))
+	msg := source.Gossip().Encode()[0]
+	for i := 0; i < 2; i++ {
+		_, err := tapped.OnGossipBroadcast(1, append([]byte(nil), msg...))
+		require.NoError(t, err)
+	}
+	tapped.OnGossipUnicast(3, []byte{7, 1, 2})
+	require.NoError(t, m.Set("k2", []byte("v2"))) // sent, so not counted
+
+	require.Equal(t, []MessageStats{
+		{Peer: mesh.PeerName(1).String(), Channel: "test", Kind: "broadcast", Messages: 2, Bytes: uint64(2 * len(msg))},
+		{Peer: mesh.PeerName(3).String(), Channel: "test", Kind: "unicast", Type: "07", Messages: 1, Bytes: 3},
+	}, stats.Stats())
+	stats.Forget(1)
+	require.Len(t, stats.Stats(), 1)
+}
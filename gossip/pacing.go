@@ -0,0 +1,117 @@
+package gossip
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/clock"
+)
+
+// Pacing bounds how often a channel's state is gossiped periodically.
+// Right after a change, either made locally or learnt from another
+// peer, a channel gossips at Min; each periodic gossip without a
+// further change doubles the interval, up to Max. mesh asks for
+// periodic gossip on a fixed interval of its own, so a Min below that
+// means gossiping every time it asks.
+type Pacing struct {
+	Min, Max time.Duration
+}
+
+// Pace returns a Router which registers gossipers with router, paced
+// per channel. Pacing with a Max no greater than its Min is a fixed
+// interval; a zero Pacing leaves periodic gossip to mesh.
+func Pace(router Router, pacing Pacing) Router {
+	if pacing.Max <= 0 {
+		return router
+	}
+	if pacing.Max < pacing.Min {
+		pacing.Max = pacing.Min
+	}
+	return &pacedRouter{Router: router, pacing: pacing, clock: clock.Real}
+}
+
+type pacedRouter struct {
+	Router
+	pacing Pacing
+	clock  clock.Clock
+}
+
+func (router *pacedRouter) NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	pacer := &pacer{pacing: router.pacing, clock: router.clock}
+	pacer.changed()
+	return &pacedGossip{
+		Gossip: router.Router.NewGossip(channel, &pacedGossiper{Gossiper: gossiper, pacer: pacer}),
+		pacer:  pacer,
+	}
+}
+
+type pacer struct {
+	sync.Mutex
+	pacing   Pacing
+	clock    clock.Clock
+	interval time.Duration
+	last     time.Time // of the last periodic gossip
+}
+
+func (p *pacer) changed() {
+	p.Lock()
+	defer p.Unlock()
+	p.interval = p.pacing.Min
+}
+
+// due reports whether it is time for periodic gossip, and if so backs
+// off for the next
+func (p *pacer) due() bool {
+	p.Lock()
+	defer p.Unlock()
+	now := p.clock.Now()
+	if now.Sub(p.last) < p.interval {
+		return false
+	}
+	p.last = now
+	if p.interval *= 2; p.interval > p.pacing.Max {
+		p.interval = p.pacing.Max
+	}
+	return true
+}
+
+type pacedGossiper struct {
+	mesh.Gossiper
+	pacer *pacer
+}
+
+func (g *pacedGossiper) Gossip() mesh.GossipData {
+	if !g.pacer.due() {
+		return nil
+	}
+	return g.Gossiper.Gossip()
+}
+
+func (g *pacedGossiper) OnGossipBroadcast(src mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	update, err := g.Gossiper.OnGossipBroadcast(src, msg)
+	if update != nil {
+		g.pacer.changed()
+	}
+	return update, err
+}
+
+func (g *pacedGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	delta, err := g.Gossiper.OnGossip(msg)
+	if delta != nil {
+		g.pacer.changed()
+	}
+	return delta, err
+}
+
+// Gossipers broadcast their local changes
+type pacedGossip struct {
+	mesh.Gossip
+	pacer *pacer
+}
+
+func (g *pacedGossip) GossipBroadcast(update mesh.GossipData) error {
+	g.pacer.changed()
+	return g.Gossip.GossipBroadcast(update)
+}
@@ -0,0 +1,55 @@
+package gossip
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/weaveworks/weave/common/clock"
+)
+
+func TestPacing(t *testing.T) {
+	const tick = 30 * time.Second // as mesh asks for gossip
+	virtual := clock.NewVirtual(time.Unix(0, 0))
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	paced := Pace(router, Pacing{Min: tick, Max: 4 * tick}).(*pacedRouter)
+	paced.clock = virtual
+
+	m := NewMap(1)
+	m.SetGossip(paced.NewGossip("test", m))
+	require.NoError(t, m.Set("k", []byte("v")))
+
+	// Which of the next n ticks mesh gets any gossip on
+	gossiped := func(n int) []bool {
+		var result []bool
+		for i := 0; i < n; i++ {
+			virtual.Advance(tick)
+			result = append(result, router.gossiper.Gossip() != nil)
+		}
+		return result
+	}
+	require.Equal(t, []bool{true, false, true, false, false, false, true, false, false, false, true, false}, gossiped(12))
+
+	// A local change goes back to gossiping at the minimum
+	require.NoError(t, m.Set("k2", []byte("v2")))
+	require.Equal(t, []bool{true, false, true, false}, gossiped(4))
+
+	// So does learning of a change elsewhere
+	other := NewMap(2)
+	require.NoError(t, other.Set("k3", []byte("v3")))
+	delta, err := router.gossiper.OnGossip(other.Gossip().Encode()[0])
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	require.Equal(t, []bool{true, false, true, false}, gossiped(4))
+
+	// But not hearing what we already know
+	_, err = router.gossiper.OnGossip(other.Gossip().Encode()[0])
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, true, false}, gossiped(4))
+}
+
+func TestNoPacing(t *testing.T) {
+	router := &recordingRouter{gossip: &recordingGossip{}}
+	require.Equal(t, router, Pace(router, Pacing{}))
+}
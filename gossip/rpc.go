@@ -0,0 +1,167 @@
+package gossip
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+)
+
+// Request and response over gossip unicast. mesh delivers single
+// messages with no notion of an answer, so a gossiper which asks
+// another peer for something has to recognise the reply among
+// everything else it hears, and has no way to tell that none is
+// coming. An RPC numbers each request, pairs the response with it,
+// gives up on it at a deadline, and carries errors back as values of
+// their own type.
+//
+// An RPC is not safe for concurrent use: its owner calls it from one
+// goroutine, e.g. its actor, and that is where handlers and callbacks
+// run. The owner also frames its messages, so that they can share a
+// channel with others, passing what it sends and what it receives.
+
+// Codes of the RPCErrors returned by RPC itself
+const (
+	RPCTimeout       = "timeout"        // no response by the deadline
+	RPCUnknownMethod = "unknown method" // the remote peer has no such method
+	RPCFailed        = "failed"         // the handler returned some other error
+)
+
+// RPCError is an error returned by a remote peer, or the timeout of a
+// call.
+type RPCError struct {
+	Code    string
+	Message string
+}
+
+func (err *RPCError) Error() string {
+	if err.Message == "" {
+		return err.Code
+	}
+	return err.Code + ": " + err.Message
+}
+
+// IsRPCError returns whether err is an RPCError with the code given.
+func IsRPCError(err error, code string) bool {
+	rpcErr, ok := err.(*RPCError)
+	return ok && rpcErr.Code == code
+}
+
+// RPCHandler answers a request. It may return a response along with
+// an error; an error which is not an RPCError reaches the caller as
+// one with code RPCFailed.
+type RPCHandler func(sender mesh.PeerName, method string, request []byte) ([]byte, error)
+
+type rpcMessage struct {
+	ID       uint64
+	Response bool
+	Method   string // of a request
+	Body     []byte
+	Err      *RPCError // of a response
+}
+
+type rpcCall struct {
+	dest     mesh.PeerName
+	deadline time.Time
+	done     func(response []byte, err error)
+}
+
+type RPC struct {
+	send    func(dest mesh.PeerName, msg []byte) error
+	handler RPCHandler
+	nextID  uint64
+	calls   map[uint64]*rpcCall
+}
+
+// NewRPC returns an RPC which sends messages with send and passes the
+// requests it receives to handler.
+func NewRPC(send func(dest mesh.PeerName, msg []byte) error, handler RPCHandler) *RPC {
+	return &RPC{send: send, handler: handler, calls: make(map[uint64]*rpcCall)}
+}
+
+// Call sends a request to dest, and arranges for done to be called
+// with the response, or with an error if there is none by deadline.
+// If the request cannot be sent, Call returns the error and done is
+// never called.
+func (rpc *RPC) Call(dest mesh.PeerName, method string, request []byte, deadline time.Time, done func(response []byte, err error)) error {
+	rpc.nextID++
+	if err := rpc.sendMessage(dest, rpcMessage{ID: rpc.nextID, Method: method, Body: request}); err != nil {
+		return err
+	}
+	rpc.calls[rpc.nextID] = &rpcCall{dest: dest, deadline: deadline, done: done}
+	return nil
+}
+
+// OnMessage handles a message received from sender, answering it if
+// it is a request and completing its call if a response.
+func (rpc *RPC) OnMessage(sender mesh.PeerName, msg []byte) error {
+	var m rpcMessage
+	if err := gob.NewDecoder(bytes.NewReader(msg)).Decode(&m); err != nil {
+		return err
+	}
+	if m.Response {
+		call, found := rpc.calls[m.ID]
+		if !found || call.dest != sender {
+			return nil // too late, or not ours
+		}
+		delete(rpc.calls, m.ID)
+		var err error
+		if m.Err != nil {
+			err = m.Err
+		}
+		call.done(m.Body, err)
+		return nil
+	}
+
+	response := rpcMessage{ID: m.ID, Response: true}
+	body, err := rpc.handler(sender, m.Method, m.Body)
+	response.Body = body
+	if err != nil {
+		rpcErr, ok := err.(*RPCError)
+		if !ok {
+			rpcErr = &RPCError{Code: RPCFailed, Message: err.Error()}
+		}
+		response.Err = rpcErr
+	}
+	return rpc.sendMessage(sender, response)
+}
+
+// Expire fails the calls whose deadline has passed by now, with an
+// RPCError with code RPCTimeout, in the order they were made.
+func (rpc *RPC) Expire(now time.Time) {
+	var expired []uint64
+	for id, call := range rpc.calls {
+		if !now.Before(call.deadline) {
+			expired = append(expired, id)
+		}
+	}
+	sort.Sort(uint64s(expired))
+	for _, id := range expired {
+		call := rpc.calls[id]
+		delete(rpc.calls, id)
+		call.done(nil, &RPCError{Code: RPCTimeout, Message: "no response from " + call.dest.String()})
+	}
+}
+
+// Pending returns the number of calls awaiting a response.
+func (rpc *RPC) Pending() int {
+	return len(rpc.calls)
+}
+
+func (rpc *RPC) sendMessage(dest mesh.PeerName, m rpcMessage) error {
+	msg, err := bufpool.GobEncode(m)
+	if err != nil {
+		return err
+	}
+	return rpc.send(dest, msg)
+}
+
+type uint64s []uint64
+
+func (s uint64s) Len() int           { return len(s) }
+func (s uint64s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint64s) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,86 @@
+package gossip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+// Two RPCs, with messages queued until delivered
+type rpcPair struct {
+	names  [2]mesh.PeerName
+	rpcs   [2]*RPC
+	queued [][2]interface{} // destination index and message
+}
+
+func newRPCPair(handler RPCHandler) *rpcPair {
+	p := &rpcPair{names: [2]mesh.PeerName{1, 2}}
+	for i := range p.rpcs {
+		from := i
+		p.rpcs[i] = NewRPC(func(dest mesh.PeerName, msg []byte) error {
+			p.queued = append(p.queued, [2]interface{}{1 - from, msg})
+			return nil
+		}, handler)
+	}
+	return p
+}
+
+func (p *rpcPair) deliver(t *testing.T) {
+	for len(p.queued) > 0 {
+		q := p.queued[0]
+		p.queued = p.queued[1:]
+		to := q[0].(int)
+		require.NoError(t, p.rpcs[to].OnMessage(p.names[1-to], q[1].([]byte)))
+	}
+}
+
+func TestRPC(t *testing.T) {
+	p := newRPCPair(func(sender mesh.PeerName, method string, request []byte) ([]byte, error) {
+		switch method {
+		case "echo":
+			return request, nil
+		case "fail":
+			return []byte("partial"), fmt.Errorf("failed on purpose")
+		case "deny":
+			return nil, &RPCError{Code: "denied"}
+		}
+		return nil, &RPCError{Code: RPCUnknownMethod, Message: method}
+	})
+	type result struct {
+		response string
+		err      error
+	}
+	var results []result
+	done := func(response []byte, err error) {
+		results = append(results, result{string(response), err})
+	}
+	now := time.Now()
+	for _, method := range []string{"echo", "fail", "deny", "other"} {
+		require.NoError(t, p.rpcs[0].Call(p.names[1], method, []byte("hello"), now.Add(time.Second), done))
+	}
+	require.Equal(t, 4, p.rpcs[0].Pending())
+	p.deliver(t)
+	require.Equal(t, 0, p.rpcs[0].Pending())
+	require.Equal(t, []result{
+		{"hello", nil},
+		{"partial", &RPCError{Code: RPCFailed, Message: "failed on purpose"}},
+		{"", &RPCError{Code: "denied"}},
+		{"", &RPCError{Code: RPCUnknownMethod, Message: "other"}},
+	}, results)
+	require.True(t, IsRPCError(results[2].err, "denied"))
+
+	// A call not answered by its deadline times out, and a late
+	// response is ignored
+	results = nil
+	require.NoError(t, p.rpcs[0].Call(p.names[1], "echo", []byte("late"), now.Add(time.Second), done))
+	p.rpcs[0].Expire(now)
+	require.Empty(t, results)
+	p.rpcs[0].Expire(now.Add(time.Second))
+	require.Len(t, results, 1)
+	require.True(t, IsRPCError(results[0].err, RPCTimeout))
+	p.deliver(t)
+	require.Len(t, results, 1)
+}
@@ -0,0 +1,107 @@
+package gossip
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// StatsMonitor counts the gossip messages received on each channel
+// from each peer, by kind and, for unicasts, by their first byte,
+// which the gossipers in weave use for the type of message. A flood
+// of one kind of message then shows up in the counts. Add it to a Tap
+// with AddReceivedMonitor.
+type StatsMonitor struct {
+	sync.Mutex
+	counts map[messageKey]*MessageStats
+}
+
+type messageKey struct {
+	peer    mesh.PeerName
+	channel string
+	kind    MessageKind
+	msgType int
+}
+
+// MessageStats counts the messages of one kind received from a peer
+// on a channel.
+type MessageStats struct {
+	Peer     string
+	Channel  string
+	Kind     string
+	Type     string `json:",omitempty"` // first byte of a unicast, in hex
+	Messages uint64
+	Bytes    uint64
+}
+
+func NewStatsMonitor() *StatsMonitor {
+	return &StatsMonitor{counts: make(map[messageKey]*MessageStats)}
+}
+
+func (sm *StatsMonitor) OnGossipMessage(channel string, dir Direction, kind MessageKind, peer mesh.PeerName, msg []byte) {
+	if dir != Received {
+		return
+	}
+	key := messageKey{peer, channel, kind, -1}
+	if kind == Unicast && len(msg) > 0 {
+		key.msgType = int(msg[0])
+	}
+	sm.Lock()
+	defer sm.Unlock()
+	stats, found := sm.counts[key]
+	if !found {
+		stats = &MessageStats{Peer: peer.String(), Channel: channel, Kind: kind.String()}
+		if key.msgType >= 0 {
+			stats.Type = fmt.Sprintf("%02x", key.msgType)
+		}
+		sm.counts[key] = stats
+	}
+	stats.Messages++
+	stats.Bytes += uint64(len(msg))
+}
+
+// Stats returns the counts, busiest first.
+func (sm *StatsMonitor) Stats() []MessageStats {
+	sm.Lock()
+	result := make([]MessageStats, 0, len(sm.counts))
+	for _, stats := range sm.counts {
+		result = append(result, *stats)
+	}
+	sm.Unlock()
+	sort.Sort(byMessages(result))
+	return result
+}
+
+// Forget drops the counts for peer, e.g. once it has gone.
+func (sm *StatsMonitor) Forget(peer mesh.PeerName) {
+	sm.Lock()
+	defer sm.Unlock()
+	for key := range sm.counts {
+		if key.peer == peer {
+			delete(sm.counts, key)
+		}
+	}
+}
+
+type byMessages []MessageStats
+
+func (s byMessages) Len() int      { return len(s) }
+func (s byMessages) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byMessages) Less(i, j int) bool {
+	if s[i].Messages != s[j].Messages {
+		return s[i].Messages > s[j].Messages
+	}
+	a, b := s[i], s[j]
+	if a.Peer != b.Peer {
+		return a.Peer < b.Peer
+	}
+	if a.Channel != b.Channel {
+		return a.Channel < b.Channel
+	}
+	if a.Kind != b.Kind {
+		return a.Kind < b.Kind
+	}
+	return a.Type < b.Type
+}
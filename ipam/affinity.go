@@ -0,0 +1,80 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A container which is restarted, or recreated under the same name by
+// an orchestrator, is better off with the address it had before. So
+// for a while after an address is freed we remember who had it, and if
+// they allocate again while it is still free they get it back.
+
+type recentAddress struct {
+	addr    address.Address
+	expires time.Time
+}
+
+// SetAffinityTTL sets how long freed addresses are remembered for
+// their previous owner. It must be called before Start; 0, the
+// default, disables affinity.
+func (alloc *Allocator) SetAffinityTTL(ttl time.Duration) {
+	alloc.affinityTTL = ttl
+}
+
+// Actor client: remember that ident has just freed addr
+func (alloc *Allocator) rememberAffinity(ident string, addr address.Address) {
+	if alloc.affinityTTL <= 0 {
+		return
+	}
+	expires := alloc.clock.Now().Add(alloc.affinityTTL)
+	recent := alloc.affinity[ident]
+	for i := range recent {
+		if recent[i].addr == addr {
+			recent[i].expires = expires
+			return
+		}
+	}
+	alloc.affinity[ident] = append(recent, recentAddress{addr, expires})
+}
+
+// Actor client: claim an address recently freed by ident within r, if
+// one is still free.
+func (alloc *Allocator) claimAffinity(ident string, r address.Range) (address.Address, bool) {
+	recent := alloc.affinity[ident]
+	for i, ra := range recent {
+		if !r.Contains(ra.addr) {
+			continue
+		}
+		alloc.releaseHeldAddress(ra.addr)
+		if alloc.space.Claim(ra.addr) != nil {
+			continue
+		}
+		if len(recent) == 1 {
+			delete(alloc.affinity, ident)
+		} else {
+			alloc.affinity[ident] = append(recent[:i], recent[i+1:]...)
+		}
+		return ra.addr, true
+	}
+	return 0, false
+}
+
+// Actor client
+func (alloc *Allocator) removeExpiredAffinities() {
+	now := alloc.clock.Now()
+	for ident, recent := range alloc.affinity {
+		var kept []recentAddress
+		for _, ra := range recent {
+			if !now.After(ra.expires) {
+				kept = append(kept, ra)
+			}
+		}
+		if kept == nil {
+			delete(alloc.affinity, ident)
+		} else {
+			alloc.affinity[ident] = kept
+		}
+	}
+}
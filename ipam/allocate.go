@@ -1,8 +1,7 @@
 package ipam
 
 import (
-	"fmt"
-
+	"github.com/weaveworks/weave/common/tracing"
 	"github.com/weaveworks/weave/net/address"
 )
 
@@ -14,8 +13,12 @@ type allocateResult struct {
 type allocate struct {
 	resultChan       chan<- allocateResult
 	ident            string
+	key              string        // idempotency key, if any
 	r                address.Range // Range we are trying to allocate within
 	hasBeenCancelled func() bool
+	denied           bool // a peer we asked for space had none
+	unanswered       bool // no peer we asked for space answered; see spacerequest.go
+	trace            tracing.SpanContext
 }
 
 // Try returns true if the request is completed, false if pending
@@ -25,6 +28,14 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		return true
 	}
 
+	if g.key != "" {
+		if addr, found := alloc.lookupKey(g.key, g.ident, g.r); found {
+			delete(alloc.dead, g.ident)
+			g.resultChan <- allocateResult{addr, nil}
+			return true
+		}
+	}
+
 	if addr, found := alloc.lookupOwned(g.ident, g.r); found {
 		// If we had heard that this container died, resurrect it
 		delete(alloc.dead, g.ident) // delete is no-op if key not in map
@@ -32,13 +43,36 @@ func (g *allocate) Try(alloc *Allocator) bool {
 		return true
 	}
 
-	if !alloc.universe.Overlaps(g.r) {
-		g.resultChan <- allocateResult{0, fmt.Errorf("range %s out of bounds: %s", g.r, alloc.universe)}
+	if alloc.quarantined != "" {
+		g.resultChan <- allocateResult{0, alloc.quarantineError()}
+		return true
+	}
+	if alloc.readOnly {
+		g.resultChan <- allocateResult{0, alloc.readOnlyError()}
+		return true
+	}
+
+	if !alloc.ring.Overlaps(g.r) {
+		g.resultChan <- allocateResult{0, newError(ErrOutOfRange, "range %s out of bounds: %s", g.r, alloc.ring.RangesString())}
 		return true
 	}
 
 	alloc.establishRing()
 
+	// Keep the reserve for when no one else can give us space
+	if alloc.inReserve() && !g.denied && !g.unanswered && alloc.askForSpace(g.r, g.trace) {
+		return false
+	}
+
+	if addr, found := alloc.claimAffinity(g.ident, g.r); found {
+		alloc.debugln("Reallocated", addr, "to its previous owner", g.ident, "in", g.r)
+		g.allocated(alloc, addr)
+		return true
+	}
+
+	if alloc.space.NumFreeAddressesInRange(g.r) == 0 {
+		alloc.releaseHeldIn(g.r)
+	}
 	if ok, addr := alloc.space.Allocate(g.r); ok {
 		// If caller hasn't supplied a unique ID, file it under the IP address
 		// which lets the caller then release the address using DELETE /ip/address
@@ -46,27 +80,48 @@ func (g *allocate) Try(alloc *Allocator) bool {
 			g.ident = addr.String()
 		}
 		alloc.debugln("Allocated", addr, "for", g.ident, "in", g.r)
-		alloc.addOwned(g.ident, addr)
-		g.resultChan <- allocateResult{addr, nil}
+		g.allocated(alloc, addr)
 		return true
 	}
 
 	// out of space
-	donors := alloc.ring.ChoosePeersToAskForSpace(g.r.Start, g.r.End)
-	for _, donor := range donors {
-		if err := alloc.sendSpaceRequest(donor, g.r); err != nil {
-			alloc.debugln("Problem asking peer", donor, "for space:", err)
-		} else {
-			alloc.debugln("Decided to ask peer", donor, "for space in range", g.r)
-			break
+	if !alloc.ring.Empty() && alloc.ownsAll(g.r) {
+		// nobody could give us any; don't wait for our own containers to free some
+		g.resultChan <- allocateResult{0, newError(ErrNoSpace, "no free addresses in range %s", g.r)}
+		return true
+	}
+	if g.unanswered {
+		g.resultChan <- allocateResult{0, newError(ErrNoSpace, "no free addresses in range %s, and no answer from the peers asked for some", g.r)}
+		return true
+	}
+	alloc.askForSpace(g.r, g.trace)
+	return false
+}
+
+// Actor client: whether no other peer owns any of r
+func (alloc *Allocator) ownsAll(r address.Range) bool {
+	for _, info := range alloc.ring.AllRangeInfo() {
+		if info.Peer != alloc.ourName && info.Overlaps(r) {
+			return false
 		}
 	}
+	return true
+}
 
-	return false
+func (g *allocate) allocated(alloc *Allocator, addr address.Address) {
+	alloc.addOwned(g.ident, addr)
+	if g.key != "" {
+		alloc.recordKey(g.key, g.ident, addr)
+	}
+	g.resultChan <- allocateResult{addr, nil}
 }
 
 func (g *allocate) Cancel() {
-	g.resultChan <- allocateResult{0, &errorCancelled{"Allocate", g.ident}}
+	g.Fail(&errorCancelled{"Allocate", g.ident})
+}
+
+func (g *allocate) Fail(err error) {
+	g.resultChan <- allocateResult{0, err}
 }
 
 func (g *allocate) ForContainer(ident string) bool {
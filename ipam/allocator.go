@@ -5,15 +5,24 @@ import (
 	"encoding/gob"
 	"fmt"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/actor"
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/common/clock"
+	"github.com/weaveworks/weave/common/errorlog"
+	"github.com/weaveworks/weave/common/supervisor"
+	"github.com/weaveworks/weave/common/tracing"
+	"github.com/weaveworks/weave/gossip"
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/ipam/ring"
 	"github.com/weaveworks/weave/ipam/space"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/peernames"
 )
 
 // Kinds of message we can unicast to other peers
@@ -21,6 +30,10 @@ const (
 	msgSpaceRequest = iota
 	msgRingUpdate
 	msgSpaceRequestDenied
+	msgAuditRequest
+	msgAuditReply
+	msgRPC     // see rpc.go
+	msgUnknown // of a kind of message we don't know; see unknown.go
 
 	tickInterval         = time.Second * 5
 	MinSubnetSize        = 4 // first and last addresses are excluded, so 2 would be too small
@@ -35,12 +48,15 @@ type operation interface {
 
 	Cancel()
 
+	// Fail gives up on this operation, returning err
+	Fail(err error)
+
 	// Does this operation pertain to the given container id?
 	// Used for tidying up pending operations when containers die.
 	ForContainer(ident string) bool
 }
 
-// Allocator brings together Ring and space.Set, and does the
+// Allocator brings together Ring and space.Space, and does the
 // necessary plumbing.  Runs as a single-threaded Actor, so no locks
 // are used around data structures.
 type Allocator struct {
@@ -51,46 +67,114 @@ type Allocator struct {
 	space            space.Space                  // more detail on ranges owned by us
 	owned            map[string][]address.Address // who owns what addresses, indexed by container-ID
 	nicknames        map[mesh.PeerName]string     // so we can map nicknames for rmpeer
+	nicknameIndex    map[string][]mesh.PeerName   // peers by lower-cased nickname; see nicknames.go
+	peerNames        *peernames.Registry          // shared with the rest of weave; see nicknames.go
 	pendingAllocates []operation                  // held until we get some free space
 	pendingClaims    []operation                  // held until we know who owns the space
+	spaceRequests    spaceRequests                // awaiting an answer; see spacerequest.go
+	peerHops         func(mesh.PeerName) int      // for choosing nearby donors, if set
 	dead             map[string]time.Time         // containers we heard were dead, and when
+	keys             map[string]*keyedAllocation  // by idempotency key; see idempotency.go
+	registrar        Registrar                    // told about allocations, if set; see registrar.go
+	hooks            []Hooks                      // see hooks.go
+	affinity         map[string][]recentAddress   // recently freed, by previous owner; see affinity.go
+	affinityTTL      time.Duration                // how long they are remembered for
+	held             []heldAddress                // freed, but not to be reused yet; see reuse.go
+	reuseDelay       time.Duration                // how long they are held for
+	awaitingSetup    setupDeadlines               // see setup.go
 	gossip           mesh.Gossip                  // our link to the outside world for sending messages
+	rpc              *gossip.RPC                  // requests to other peers which expect a response
 	paxos            *paxos.Node
 	paxosActive      bool
-	ticker           *time.Ticker
+	awaitingPeers    bool          // asked for a ring, but too few peers yet
+	initPeerCount    int           // peers to wait for; see readiness.go
+	peerCount        func() int    // how many there are now, if set
+	proposalBackoff  paxos.Backoff // see backoff.go
+	proposals        uint          // made so far
+	proposalDelay    time.Duration // before the next one
+	nextProposal     time.Time
+	manualSeed       bool // only create the ring when told to via Seed
+	reserveFraction  float64
+	reserve          address.Offset // free addresses we won't donate; see reserve.go
+	lowWatermarks    [2]float64     // local and mesh-wide; see watermark.go
+	lowSpace         [2]string      // descriptions of watermarks we are below
+	clock            clock.Clock
+	clockSkew        map[mesh.PeerName]time.Duration
+	incarnations     map[mesh.PeerName]Incarnation // see incarnations.go
+	restarts         map[mesh.PeerName][]time.Time
+	exclusions       map[mesh.PeerName]hostExclusions // see exclusions.go
+	excludedClaims   map[address.Address]struct{}
+	audits           map[uint64]*audit // in progress; see audit.go
+	nextAuditID      uint64
+	stateVersion     uint64         // of nicknames, incarnations and exclusions
+	encoded          encodedState   // the last encoding of our state; see encode.go
+	quarantined      string         // why, if we have stopped allocating; see quarantine.go
+	readOnly         bool           // see readonly.go
+	releaseChecker   ReleaseChecker // asked before releasing over HTTP; see release.go
+	snapshot         atomic.Value   // *statusSnapshot, for lock-free status reads
+	snapshotStale    bool           // whether snapshot needs republishing
+	actor            *actor.Actor
 	shuttingDown     bool // to avoid doing any requests while trying to shut down
 	isKnownPeer      func(mesh.PeerName) bool
-	now              func() time.Time
 }
 
 // NewAllocator creates and initialises a new Allocator
 func NewAllocator(ourName mesh.PeerName, ourUID mesh.PeerUID, ourNickname string, universe address.Range, quorum uint, isKnownPeer func(name mesh.PeerName) bool) *Allocator {
-	return &Allocator{
-		ourName:     ourName,
-		universe:    universe,
-		ring:        ring.New(universe.Start, universe.End, ourName),
-		owned:       make(map[string][]address.Address),
-		paxos:       paxos.NewNode(ourName, ourUID, quorum),
-		nicknames:   map[mesh.PeerName]string{ourName: ourNickname},
-		isKnownPeer: isKnownPeer,
-		dead:        make(map[string]time.Time),
-		now:         time.Now,
+	alloc := &Allocator{
+		ourName:         ourName,
+		universe:        universe,
+		ring:            ring.New(universe.Start, universe.End, ourName),
+		owned:           make(map[string][]address.Address),
+		paxos:           paxos.NewNode(ourName, ourUID, quorum),
+		nicknames:       map[mesh.PeerName]string{ourName: ourNickname},
+		nicknameIndex:   map[string][]mesh.PeerName{nicknameKey(ourNickname): {ourName}},
+		isKnownPeer:     isKnownPeer,
+		dead:            make(map[string]time.Time),
+		spaceRequests:   make(spaceRequests),
+		keys:            make(map[string]*keyedAllocation),
+		affinity:        make(map[string][]recentAddress),
+		awaitingSetup:   make(setupDeadlines),
+		clockSkew:       make(map[mesh.PeerName]time.Duration),
+		incarnations:    map[mesh.PeerName]Incarnation{ourName: {UID: ourUID, Features: ourFeatures}},
+		restarts:        make(map[mesh.PeerName][]time.Time),
+		exclusions:      make(map[mesh.PeerName]hostExclusions),
+		excludedClaims:  make(map[address.Address]struct{}),
+		audits:          make(map[uint64]*audit),
+		clock:           clock.Real,
+		proposalBackoff: paxos.NewExponentialBackoff(minProposalInterval, DefaultMaxProposalInterval, ourName),
 	}
+	alloc.rpc = gossip.NewRPC(alloc.sendRPC, alloc.handleRPC)
+	alloc.SetPeerNames(peernames.NewRegistry())
+	return alloc
 }
 
 // Start runs the allocator goroutine
 func (alloc *Allocator) Start() {
-	actionChan := make(chan func(), mesh.ChannelSize)
-	alloc.actionChan = actionChan
-	alloc.ticker = time.NewTicker(tickInterval)
-	go alloc.actorLoop(actionChan)
+	ours := alloc.incarnations[alloc.ourName]
+	ours.Started = alloc.clock.Now().Unix()
+	alloc.incarnations[alloc.ourName] = ours
+	alloc.actor = actor.New(actor.Config{
+		Name:      "ipam",
+		QueueSize: mesh.ChannelSize,
+		Ticker:    alloc.clock.NewTicker(tickInterval),
+		OnTick:    alloc.tick,
+		After:     alloc.afterAction,
+		// The allocator's state can't be rebuilt from scratch without
+		// losing track of allocations, so carry on but flag it
+		OnPanic: func(recovered interface{}, stack []byte) {
+			supervisor.Panicked("ipam", recovered, stack)
+			alloc.quarantine(fmt.Sprint(recovered))
+		},
+	})
+	alloc.actionChan = alloc.actor.Mailbox()
+	alloc.updateSnapshot()
+	alloc.actor.Start()
 }
 
 // Stop makes the actor routine exit, for test purposes ONLY because any
 // calls after this is processed will hang. Async.
 func (alloc *Allocator) Stop() {
-	alloc.ticker.Stop()
-	alloc.actionChan <- nil
+	alloc.actor.Stop()
 }
 
 // Operation life cycle
@@ -99,7 +183,7 @@ func (alloc *Allocator) Stop() {
 func (alloc *Allocator) doOperation(op operation, ops *[]operation) {
 	alloc.actionChan <- func() {
 		if alloc.shuttingDown {
-			op.Cancel()
+			op.Fail(newError(ErrShuttingDown, "allocator is shutting down"))
 			return
 		}
 		if !op.Try(alloc) {
@@ -124,9 +208,9 @@ func (alloc *Allocator) cancelOp(op operation, ops *[]operation) {
 }
 
 // Cancel all operations in a queue
-func (alloc *Allocator) cancelOps(ops *[]operation) {
+func (alloc *Allocator) failOps(ops *[]operation, err error) {
 	for _, op := range *ops {
-		op.Cancel()
+		op.Fail(err)
 	}
 	*ops = []operation{}
 }
@@ -173,6 +257,11 @@ func (alloc *Allocator) tryPendingOps() {
 }
 
 func (alloc *Allocator) spaceRequestDenied(sender mesh.PeerName, r address.Range) {
+	for _, op := range alloc.pendingAllocates {
+		if allocate := op.(*allocate); allocate.r.Overlaps(r) {
+			allocate.denied = true
+		}
+	}
 	for i := 0; i < len(alloc.pendingClaims); {
 		claim := alloc.pendingClaims[i].(*claim)
 		if r.Contains(claim.addr) {
@@ -196,12 +285,38 @@ func (e *errorCancelled) Error() string {
 // Actor client API
 
 // Allocate (Sync) - get new IP address for container with given name in range
-// if there isn't any space in that range we block indefinitely
+// if there isn't any space in that range we block indefinitely, unless
+// no other peer owns any of it, when we fail with ErrNoSpace
 func (alloc *Allocator) Allocate(ident string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	return alloc.AllocateWithKey(ident, "", r, hasBeenCancelled)
+}
+
+// AllocateWithKey (Sync) - like Allocate, but if an address has
+// recently been allocated with the same idempotency key, return that
+// one, now owned by ident. An empty key is ignored.
+func (alloc *Allocator) AllocateWithKey(ident string, key string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	return alloc.allocateTraced(tracing.SpanContext{}, ident, key, r, hasBeenCancelled)
+}
+
+// allocateTraced is AllocateWithKey as part of the trace of parent,
+// if that is valid
+func (alloc *Allocator) allocateTraced(parent tracing.SpanContext, ident string, key string, r address.Range, hasBeenCancelled func() bool) (address.Address, error) {
+	span := tracing.Start("ipam.allocate", parent)
+	span.SetAttribute("peer", alloc.ourName)
+	span.SetAttribute("ident", ident)
+	span.SetAttribute("range", r)
+	if err := alloc.preAllocate(ident, r); err != nil {
+		span.Finish(err)
+		return 0, err
+	}
 	resultChan := make(chan allocateResult)
-	op := &allocate{resultChan: resultChan, ident: ident, r: r, hasBeenCancelled: hasBeenCancelled}
+	op := &allocate{resultChan: resultChan, ident: ident, key: key, r: r, hasBeenCancelled: hasBeenCancelled, trace: span.Context}
 	alloc.doOperation(op, &alloc.pendingAllocates)
 	result := <-resultChan
+	span.Finish(result.err)
+	if result.err == nil {
+		alloc.postAllocate(ident, result.addr)
+	}
 	return result.addr, result.err
 }
 
@@ -213,7 +328,7 @@ func (alloc *Allocator) Lookup(ident string, r address.Range) (address.Address,
 			resultChan <- allocateResult{addr: addr}
 			return
 		}
-		resultChan <- allocateResult{err: fmt.Errorf("lookup: no address found for %s in range %s", ident, r)}
+		resultChan <- allocateResult{err: newError(ErrNotOwned, "lookup: no address found for %s in range %s", ident, r)}
 	}
 	result := <-resultChan
 	return result.addr, result.err
@@ -232,7 +347,7 @@ func (alloc *Allocator) ContainerDied(ident string) {
 	alloc.actionChan <- func() {
 		if _, found := alloc.lookupOwned(ident, alloc.universe); found {
 			alloc.debugln("Container", ident, "died; noting to remove later")
-			alloc.dead[ident] = alloc.now()
+			alloc.dead[ident] = alloc.clock.Now()
 		}
 		// Also remove any pending ops
 		alloc.cancelOpsFor(&alloc.pendingAllocates, ident)
@@ -252,7 +367,7 @@ func (alloc *Allocator) ContainerDestroyed(ident string) {
 }
 
 func (alloc *Allocator) removeDeadContainers() {
-	cutoff := alloc.now().Add(-containerDiedTimeout)
+	cutoff := alloc.clock.Now().Add(-containerDiedTimeout)
 	for ident, timeOfDeath := range alloc.dead {
 		if timeOfDeath.Before(cutoff) {
 			if err := alloc.delete(ident); err == nil {
@@ -267,6 +382,11 @@ func (alloc *Allocator) ContainerStarted(ident string) {}
 
 // Delete (Sync) - release all IP addresses for container with given name
 func (alloc *Allocator) Delete(ident string) error {
+	if len(alloc.hooks) > 0 {
+		if err := alloc.preFree(ident, alloc.ownedBy(ident)...); err != nil {
+			return err
+		}
+	}
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
 		errChan <- alloc.delete(ident)
@@ -277,36 +397,35 @@ func (alloc *Allocator) Delete(ident string) error {
 func (alloc *Allocator) delete(ident string) error {
 	addrs, found := alloc.owned[ident]
 	for _, addr := range addrs {
-		alloc.space.Free(addr)
+		alloc.freeAddress(addr)
+		alloc.deregister(ident, addr)
+		alloc.rememberAffinity(ident, addr)
 	}
 	delete(alloc.owned, ident)
 
 	if !found {
-		return fmt.Errorf("Delete: no addresses for %s", ident)
+		return newError(ErrNotOwned, "Delete: no addresses for %s", ident)
 	}
 	return nil
 }
 
 // Free (Sync) - release single IP address for container
 func (alloc *Allocator) Free(ident string, addrToFree address.Address) error {
+	if err := alloc.preFree(ident, addrToFree); err != nil {
+		return err
+	}
 	errChan := make(chan error)
 	alloc.actionChan <- func() {
-		addrs := alloc.owned[ident]
-		for i, ownedAddr := range addrs {
-			if ownedAddr == addrToFree {
-				alloc.debugln("Freed", addrToFree, "for", ident)
-				if len(addrs) == 1 {
-					delete(alloc.owned, ident)
-				} else {
-					alloc.owned[ident] = append(addrs[:i], addrs[i+1:]...)
-				}
-				alloc.space.Free(addrToFree)
-				errChan <- nil
-				return
-			}
+		if alloc.owns(ident, addrToFree) {
+			alloc.debugln("Freed", addrToFree, "for", ident)
+			alloc.removeOwned(ident, addrToFree)
+			alloc.freeAddress(addrToFree)
+			alloc.rememberAffinity(ident, addrToFree)
+			errChan <- nil
+			return
 		}
 
-		errChan <- fmt.Errorf("Free: address %s not found for %s", addrToFree, ident)
+		errChan <- newError(ErrNotOwned, "Free: address %s not found for %s", addrToFree, ident)
 	}
 	return <-errChan
 }
@@ -344,12 +463,13 @@ func (alloc *Allocator) Shutdown() {
 	doneChan := make(chan struct{})
 	alloc.actionChan <- func() {
 		alloc.shuttingDown = true
-		alloc.cancelOps(&alloc.pendingClaims)
-		alloc.cancelOps(&alloc.pendingAllocates)
+		err := newError(ErrShuttingDown, "allocator is shutting down")
+		alloc.failOps(&alloc.pendingClaims, err)
+		alloc.failOps(&alloc.pendingAllocates, err)
 		if heir := alloc.pickPeerForTransfer(); heir != mesh.UnknownPeerName {
 			alloc.ring.Transfer(alloc.ourName, heir)
 			alloc.space.Clear()
-			alloc.gossip.GossipBroadcast(alloc.Gossip())
+			alloc.gossip.GossipBroadcast(alloc.fullGossip())
 			time.Sleep(100 * time.Millisecond)
 		}
 		doneChan <- struct{}{}
@@ -358,13 +478,15 @@ func (alloc *Allocator) Shutdown() {
 }
 
 // AdminTakeoverRanges (Sync) - take over the ranges owned by a given peer.
-// Only done on adminstrator command.
-func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) error {
+// Only done on adminstrator command. Taking over from a peer which is
+// still running would leave two peers allocating from the same ranges,
+// so unless forced we refuse if the router still knows the peer.
+func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string, force bool) error {
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
 		peername, err := alloc.lookupPeername(peerNameOrNickname)
 		if err != nil {
-			resultChan <- fmt.Errorf("Cannot find peer '%s'", peerNameOrNickname)
+			resultChan <- err
 			return
 		}
 
@@ -373,34 +495,58 @@ func (alloc *Allocator) AdminTakeoverRanges(peerNameOrNickname string) error {
 			resultChan <- fmt.Errorf("Cannot take over ranges from yourself!")
 			return
 		}
+		if !force && alloc.isKnownPeer(peername) {
+			resultChan <- fmt.Errorf("Peer %s appears to be alive; stop it first, or force the takeover if you are sure it is gone", alloc.annotatePeernames([]mesh.PeerName{peername})[0])
+			return
+		}
 
 		newRanges, err := alloc.ring.Transfer(peername, alloc.ourName)
 		alloc.space.AddRanges(newRanges)
+		alloc.applyExclusions()
+		alloc.tombstone(peername, newRanges)
 		resultChan <- err
 	}
 	return <-resultChan
 }
 
-// Lookup a PeerName by nickname or stringified PeerName.  We can't
-// call into the router for this because we are interested in peers
-// that have gone away but are still in the ring, which is why we
-// maintain our own nicknames map.
-func (alloc *Allocator) lookupPeername(name string) (mesh.PeerName, error) {
-	for peername, nickname := range alloc.nicknames {
-		if nickname == name {
-			return peername, nil
+// Seed (Sync) - create the ring now, shared between peers (names or
+// nicknames), plus ourself. Only done on administrator command,
+// typically with --ipalloc-manual-seed.
+func (alloc *Allocator) Seed(peerNamesOrNicknames []string) error {
+	resultChan := make(chan error)
+	alloc.actionChan <- func() {
+		if !alloc.ring.Empty() {
+			resultChan <- fmt.Errorf("IP allocation has already been seeded by %v", alloc.annotatePeernames(alloc.ring.Seeds))
+			return
 		}
+		peers := []mesh.PeerName{alloc.ourName}
+		for _, str := range peerNamesOrNicknames {
+			peername, err := alloc.lookupPeername(str)
+			if err != nil {
+				resultChan <- err
+				return
+			}
+			peers = append(peers, peername)
+		}
+		alloc.infof("Seeding with %v", alloc.annotatePeernames(normalizeConsensus(peers)))
+		alloc.createRing(peers)
+		resultChan <- nil
 	}
-
-	return mesh.PeerNameFromString(name)
+	return <-resultChan
 }
 
-// Restrict the peers in "nicknames" to those in the ring plus peers known to the router
+// Restrict the peers in "nicknames", "incarnations" and "exclusions" to those in the ring plus peers known to the router
 func (alloc *Allocator) pruneNicknames() {
 	ringPeers := alloc.ring.PeerNames()
 	for name := range alloc.nicknames {
 		if _, ok := ringPeers[name]; !ok && !alloc.isKnownPeer(name) {
-			delete(alloc.nicknames, name)
+			alloc.removeNickname(name)
+		}
+	}
+	for name := range alloc.incarnations {
+		if _, ok := ringPeers[name]; !ok && !alloc.isKnownPeer(name) && name != alloc.ourName {
+			alloc.removeIncarnation(name)
+			alloc.removeExclusions(name)
 		}
 	}
 }
@@ -411,7 +557,7 @@ func (alloc *Allocator) annotatePeernames(names []mesh.PeerName) []string {
 		if nickname, found := alloc.nicknames[name]; found {
 			res = append(res, fmt.Sprint(name, "(", nickname, ")"))
 		} else {
-			res = append(res, name.String())
+			res = append(res, alloc.peerNames.Annotate(name))
 		}
 	}
 	return res
@@ -425,14 +571,22 @@ func decodeRange(msg []byte) (r address.Range, err error) {
 // OnGossipUnicast (Sync)
 func (alloc *Allocator) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
 	alloc.debugln("OnGossipUnicast from", sender, ": ", len(msg), "bytes")
+	if len(msg) == 0 {
+		return fmt.Errorf("empty message from %s", sender)
+	}
 	resultChan := make(chan error)
 	alloc.actionChan <- func() {
 		switch msg[0] {
 		case msgSpaceRequest:
 			// some other peer asked us for space
-			r, err := decodeRange(msg[1:])
+			r, trace, err := decodeSpaceRequest(msg[1:])
 			if err == nil {
-				alloc.donateSpace(r, sender)
+				if !alloc.donateTracedSpace(r, sender, trace) {
+					alloc.sendSpaceRequestDenied(sender, r)
+				}
+				// Whatever we did, the ring tells the requester of any
+				// space we gave it, or where it might find some more
+				alloc.sendRingUpdate(sender)
 			}
 			resultChan <- err
 		case msgSpaceRequestDenied:
@@ -441,51 +595,93 @@ func (alloc *Allocator) OnGossipUnicast(sender mesh.PeerName, msg []byte) error
 				alloc.spaceRequestDenied(sender, r)
 			}
 			resultChan <- err
+		case msgAuditRequest:
+			id, err := decodeAuditID(msg[1:])
+			if err == nil {
+				err = alloc.answerAudit(sender, id)
+			}
+			resultChan <- err
+		case msgAuditReply:
+			resultChan <- alloc.auditAnswered(sender, msg[1:])
 		case msgRingUpdate:
-			resultChan <- alloc.update(sender, msg[1:])
+			alloc.spaceRequestAnsweredBy(sender)
+			resultChan <- alloc.unicastUpdate(sender, msg[1:])
+		case msgRPC:
+			resultChan <- alloc.rpc.OnMessage(sender, msg[1:])
+		case msgUnknown:
+			resultChan <- alloc.unknownMessageNacked(sender, msg[1:])
+		default:
+			resultChan <- alloc.unknownMessage(sender, msg[0])
 		}
 	}
 	return <-resultChan
 }
 
-// OnGossipBroadcast (Sync)
+// Actor client: merge an update sent to us alone
+func (alloc *Allocator) unicastUpdate(sender mesh.PeerName, msg []byte) error {
+	update, err := alloc.update(sender, msg)
+	if _, isDelta := update.(*paxosDelta); isDelta {
+		// nobody relays a unicast, so pass on what we learnt
+		alloc.gossip.GossipBroadcast(update)
+	}
+	return err
+}
+
+type updateResult struct {
+	update mesh.GossipData
+	err    error
+}
+
+// OnGossipBroadcast (Sync). While agreeing a ring, what the router
+// relays onwards is just the paxos claims which changed, or nothing if
+// we knew it all already.
 func (alloc *Allocator) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
 	alloc.debugln("OnGossipBroadcast from", sender, ":", len(msg), "bytes")
-	resultChan := make(chan error)
+	resultChan := make(chan updateResult)
 	alloc.actionChan <- func() {
-		resultChan <- alloc.update(sender, msg)
+		update, err := alloc.update(sender, msg)
+		resultChan <- updateResult{update, err}
 	}
-	return alloc.Gossip(), <-resultChan
+	result := <-resultChan
+	return result.update, result.err
 }
 
 type gossipState struct {
 	// We send a timstamp along with the information to be
 	// gossipped in order to detect skewed clocks
-	Now       int64
-	Nicknames map[mesh.PeerName]string
-
-	Paxos paxos.GossipState
-	Ring  *ring.Ring
+	Now          int64
+	Nicknames    map[mesh.PeerName]string
+	Incarnations map[mesh.PeerName]Incarnation
+	Exclusions   map[mesh.PeerName]hostExclusions
+
+	Paxos   paxos.GossipState
+	Ring    *ring.Ring
+	Summary *ring.Summary // see summary.go
 }
 
 func (alloc *Allocator) encode() []byte {
-	data := gossipState{
-		Now:       alloc.now().Unix(),
-		Nicknames: alloc.nicknames,
-	}
-
 	// We're only interested in Paxos until we have a Ring.
 	if alloc.ring.Empty() {
-		data.Paxos = alloc.paxos.GossipState()
-	} else {
-		data.Ring = alloc.ring
+		return alloc.encodeState(gossipState{Paxos: alloc.paxos.GossipState()})
 	}
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(data); err != nil {
+	return alloc.encodeRing()
+}
+
+// Actor client
+func (alloc *Allocator) encodeState(data gossipState) []byte {
+	data.Nicknames = alloc.nicknames
+	data.Incarnations = alloc.incarnations
+	data.Exclusions = alloc.exclusions
+	return alloc.encodeWithTime(data)
+}
+
+func (alloc *Allocator) encodeWithTime(data gossipState) []byte {
+	data.Now = alloc.clock.Now().Unix()
+	msg, err := bufpool.GobEncode(data)
+	if err != nil {
 		panic(err)
 	}
-	return buf.Bytes()
+	return msg
 }
 
 // Encode (Sync)
@@ -500,11 +696,18 @@ func (alloc *Allocator) Encode() []byte {
 // OnGossip (Sync)
 func (alloc *Allocator) OnGossip(msg []byte) (mesh.GossipData, error) {
 	alloc.debugln("Allocator.OnGossip:", len(msg), "bytes")
-	resultChan := make(chan error)
+	resultChan := make(chan updateResult)
 	alloc.actionChan <- func() {
-		resultChan <- alloc.update(mesh.UnknownPeerName, msg)
+		update, err := alloc.update(mesh.UnknownPeerName, msg)
+		resultChan <- updateResult{update, err}
 	}
-	return nil, <-resultChan // for now, we never propagate updates. TBD
+	result := <-resultChan
+	// We propagate changes to paxos claims, which are small. For now,
+	// we never propagate ring updates. TBD
+	if _, isDelta := result.update.(*paxosDelta); isDelta {
+		return result.update, result.err
+	}
+	return nil, result.err
 }
 
 // GossipData implementation is trivial - we always gossip the latest
@@ -521,48 +724,120 @@ func (d *ipamGossipData) Encode() [][]byte {
 	return [][]byte{d.alloc.Encode()}
 }
 
-// Gossip returns a GossipData implementation, which in this case always
-// returns the latest ring state (and does nothing on merge)
-func (alloc *Allocator) Gossip() mesh.GossipData {
+// fullGossip returns a GossipData implementation, which in this case
+// always returns the latest ring state (and does nothing on merge)
+func (alloc *Allocator) fullGossip() mesh.GossipData {
 	return &ipamGossipData{alloc}
 }
 
+// While we are agreeing a ring, paxosDelta carries only the paxos
+// claims which changed since we last broadcast, rather than the claims
+// of every peer. The full state still goes out when we propose, every
+// tick, which makes up for any deltas which get lost. Unlike
+// ipamGossipData, it holds everything it needs, so it can be encoded
+// without a round trip to the actor.
+type paxosDelta struct {
+	alloc     *Allocator
+	claims    paxos.GossipState
+	nicknames map[mesh.PeerName]string
+}
+
+func (d *paxosDelta) Merge(other mesh.GossipData) mesh.GossipData {
+	switch other := other.(type) {
+	case *paxosDelta:
+		merged := &paxosDelta{d.alloc, paxos.GossipState{}, other.nicknames}
+		merged.claims.Update(d.claims)
+		merged.claims.Update(other.claims)
+		return merged
+	default: // the full state includes everything in the delta
+		return other
+	}
+}
+
+func (d *paxosDelta) Encode() [][]byte {
+	return [][]byte{d.alloc.encodeWithTime(gossipState{Paxos: d.claims, Nicknames: d.nicknames})}
+}
+
+// Actor client
+func (alloc *Allocator) paxosChanges() mesh.GossipData {
+	nicknames := make(map[mesh.PeerName]string, len(alloc.nicknames))
+	for peer, nickname := range alloc.nicknames {
+		nicknames[peer] = nickname
+	}
+	return &paxosDelta{alloc, alloc.paxos.TakeChanges(), nicknames}
+}
+
 // SetInterfaces gives the allocator two interfaces for talking to the outside world
 func (alloc *Allocator) SetInterfaces(gossip mesh.Gossip) {
 	alloc.gossip = gossip
 }
 
+// RequireManualSeed stops the allocator from agreeing the initial ring
+// with other peers; instead an administrator calls Seed. It must be
+// called before Start, and should be used on all peers or none: we do
+// not take part in other peers' elections.
+func (alloc *Allocator) RequireManualSeed() {
+	alloc.manualSeed = true
+}
+
 // ACTOR server
 
-func (alloc *Allocator) actorLoop(actionChan <-chan func()) {
-	for {
-		select {
-		case action := <-actionChan:
-			if action == nil {
-				return
-			}
-			action()
-		case <-alloc.ticker.C:
-			if alloc.paxosActive {
-				alloc.propose()
-			}
-			alloc.removeDeadContainers()
-			alloc.tryPendingOps()
-		}
+func (alloc *Allocator) tick() {
+	// A tick can only change things if there is work in
+	// progress; most of the time there isn't
+	if alloc.paxosActive || alloc.awaitingPeers || len(alloc.dead) > 0 ||
+		len(alloc.pendingClaims) > 0 || len(alloc.pendingAllocates) > 0 {
+		alloc.snapshotStale = true
+	}
+	if alloc.awaitingPeers {
+		alloc.establishRing()
+	}
+	if alloc.paxosActive && !alloc.clock.Now().Before(alloc.nextProposal) {
+		alloc.propose()
+	}
+	alloc.removeDeadContainers()
+	alloc.removeExpiredKeys()
+	alloc.removeExpiredAffinities()
+	alloc.releaseHeldAddresses()
+	alloc.removeUnsetup()
+	alloc.rpc.Expire(alloc.clock.Now())
+	alloc.expireSpaceRequests()
+	alloc.tryPendingOps()
+}
 
-		alloc.assertInvariants()
-		alloc.reportFreeSpace()
+func (alloc *Allocator) afterAction(action bool) {
+	if action {
+		alloc.snapshotStale = true
+	}
+	if alloc.quarantined == "" {
+		if err := alloc.checkInvariants(); err != nil {
+			alloc.quarantine(err.Error())
+		} else if err := alloc.reportFreeSpace(); err != nil {
+			alloc.quarantine(err.Error())
+		}
+	}
+	if alloc.snapshotStale {
+		alloc.checkWatermarks()
+		alloc.updateSnapshot()
+		alloc.snapshotStale = false
 	}
 }
 
 // Helper functions
 
-// Ensure we are making progress towards an established ring
+// Ensure we are making progress towards an established ring, once
+// enough peers have turned up to hold the election
 func (alloc *Allocator) establishRing() {
-	if !alloc.ring.Empty() || alloc.paxosActive {
+	if !alloc.ring.Empty() || alloc.paxosActive || alloc.manualSeed {
+		alloc.awaitingPeers = false
+		return
+	}
+	if !alloc.enoughPeers() {
+		alloc.awaitingPeers = true
 		return
 	}
 
+	alloc.awaitingPeers = false
 	alloc.paxosActive = true
 	alloc.propose()
 	if ok, cons := alloc.paxos.Consensus(); ok {
@@ -575,7 +850,7 @@ func (alloc *Allocator) establishRing() {
 func (alloc *Allocator) createRing(peers []mesh.PeerName) {
 	alloc.debugln("Paxos consensus:", peers)
 	alloc.ring.ClaimForPeers(normalizeConsensus(peers))
-	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.gossip.GossipBroadcast(alloc.fullGossip())
 	alloc.ringUpdated()
 }
 
@@ -587,6 +862,8 @@ func (alloc *Allocator) ringUpdated() {
 	}
 
 	alloc.space.UpdateRanges(alloc.ring.OwnedRanges())
+	alloc.applyExclusions()
+	alloc.updateReserve()
 	alloc.tryPendingOps()
 }
 
@@ -621,22 +898,28 @@ func normalizeConsensus(consensus []mesh.PeerName) []mesh.PeerName {
 }
 
 func (alloc *Allocator) propose() {
-	alloc.debugf("Paxos proposing")
+	alloc.proposals++
+	alloc.proposalDelay = alloc.proposalBackoff.Delay(alloc.proposals)
+	alloc.nextProposal = alloc.clock.Now().Add(alloc.proposalDelay)
+	alloc.debugf("Paxos proposing; will propose again in %s if no consensus", alloc.proposalDelay)
 	alloc.paxos.Propose()
-	alloc.gossip.GossipBroadcast(alloc.Gossip())
+	alloc.paxos.TakeChanges() // covered by the full state
+	alloc.gossip.GossipBroadcast(alloc.fullGossip())
 }
 
 func encodeRange(r address.Range) []byte {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(r); err != nil {
+	msg, err := bufpool.GobEncode(r)
+	if err != nil {
 		panic(err)
 	}
-	return buf.Bytes()
+	return msg
 }
 
-func (alloc *Allocator) sendSpaceRequest(dest mesh.PeerName, r address.Range) error {
-	msg := append([]byte{msgSpaceRequest}, encodeRange(r)...)
+func (alloc *Allocator) sendSpaceRequest(dest mesh.PeerName, r address.Range, traceparent string) error {
+	if alloc.peerHasFeature(dest, featureRPC) {
+		return alloc.callSpaceRequest(dest, r, traceparent)
+	}
+	msg := append([]byte{msgSpaceRequest}, encodeSpaceRequest(r, traceparent)...)
 	return alloc.gossip.GossipUnicast(dest, msg)
 }
 
@@ -650,57 +933,79 @@ func (alloc *Allocator) sendRingUpdate(dest mesh.PeerName) {
 	alloc.gossip.GossipUnicast(dest, msg)
 }
 
-func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
+// Actor client: merge gossip into our state. Returns what is worth
+// passing on to other peers: the full state if a ring arrived, the
+// paxos claims which changed if paxos claims did, or nil.
+func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
 	reader := bytes.NewReader(msg)
 	decoder := gob.NewDecoder(reader)
 	var data gossipState
 	var err error
 
 	if err := decoder.Decode(&data); err != nil {
-		return err
+		return nil, err
+	}
+
+	// Now is only to the second, so compare like with like
+	deltat := time.Unix(data.Now, 0).Sub(time.Unix(alloc.clock.Now().Unix(), 0))
+	alloc.recordClockSkew(sender, deltat)
+	if abs(deltat) > maxClockSkew {
+		return nil, fmt.Errorf("clock skew of %v detected, ignoring update", deltat)
 	}
 
-	deltat := time.Unix(data.Now, 0).Sub(alloc.now())
-	if deltat > time.Hour || -deltat > time.Hour {
-		return fmt.Errorf("clock skew of %v detected, ignoring update", deltat)
+	if alloc.quarantined != "" {
+		alloc.debugln("Quarantined; ignoring update from", sender)
+		return nil, nil
 	}
 
 	// Merge nicknames
 	for peer, nickname := range data.Nicknames {
-		alloc.nicknames[peer] = nickname
+		alloc.setNickname(peer, nickname)
 	}
+	alloc.mergeIncarnations(data.Incarnations)
+	alloc.mergeExclusions(data.Exclusions)
 
 	// only one of Ring and Paxos should be present.  And we
 	// shouldn't get updates for a empty Ring. But tolerate
 	// them just in case.
+	if data.Summary != nil && data.Ring == nil {
+		alloc.answerSummary(data.Summary, true)
+		return nil, nil
+	}
 	if data.Ring != nil {
 		switch err = alloc.ring.Merge(*data.Ring); err {
 		case ring.ErrDifferentSeeds:
-			return fmt.Errorf("IP allocation was seeded by different peers (received: %v, ours: %v)",
+			return alloc.fullGossip(), fmt.Errorf("IP allocation was seeded by different peers (received: %v, ours: %v)",
 				alloc.annotatePeernames(data.Ring.Seeds), alloc.annotatePeernames(alloc.ring.Seeds))
 		case ring.ErrDifferentRange:
-			return fmt.Errorf("Incompatible IP allocation ranges (received: %s, ours: %s)",
-				data.Ring.Range().AsCIDRString(), alloc.ring.Range().AsCIDRString())
+			return alloc.fullGossip(), fmt.Errorf("Incompatible IP allocation ranges (received: %s, ours: %s)",
+				data.Ring.RangesString(), alloc.ring.RangesString())
 		default:
 			if err == nil && !alloc.ring.Empty() {
 				alloc.pruneNicknames()
 				alloc.ringUpdated()
 			}
-			return err
+			if err == nil && data.Summary != nil {
+				alloc.answerSummary(data.Summary, false)
+			}
+			return alloc.fullGossip(), err
 		}
 	}
 
 	if data.Paxos != nil {
-		if alloc.ring.Empty() {
+		if alloc.ring.Empty() && alloc.manualSeed {
+			alloc.debugln("Ignoring paxos from", sender, "- waiting to be seeded manually")
+		} else if alloc.ring.Empty() {
 			if alloc.paxos.Update(data.Paxos) {
-				if alloc.paxos.Think() {
-					// If something important changed, broadcast
-					alloc.gossip.GossipBroadcast(alloc.Gossip())
-				}
+				// Whatever changed, including any change to our own
+				// claims, goes to other peers in our return value
+				alloc.paxos.Think()
+				changes := alloc.paxosChanges()
 
 				if ok, cons := alloc.paxos.Consensus(); ok {
 					alloc.createRing(cons.Value)
 				}
+				return changes, nil
 			}
 		} else if sender != mesh.UnknownPeerName {
 			// Sender is trying to initialize a ring, but we have one
@@ -709,33 +1014,38 @@ func (alloc *Allocator) update(sender mesh.PeerName, msg []byte) error {
 		}
 	}
 
-	return nil
+	return nil, nil
 }
 
-func (alloc *Allocator) donateSpace(r address.Range, to mesh.PeerName) {
-	// No matter what we do, we'll send a unicast gossip
-	// of our ring back to the chap who asked for space.
-	// This serves to both tell him of any space we might
-	// have given him, or tell him where he might find some
-	// more.
-	defer alloc.sendRingUpdate(to)
-
+// Actor client: give some of r to a peer which asked for it,
+// returning false if we have none to give. Either way, the peer is
+// then sent our ring, which tells it of any space we gave it, or
+// where it might find some more.
+func (alloc *Allocator) donateSpace(r address.Range, to mesh.PeerName) bool {
 	alloc.debugln("Peer", to, "asked me for space")
+	if alloc.quarantined != "" {
+		return false
+	}
+	if alloc.inReserve() {
+		alloc.debugln("Only reserve space left; not giving any to peer", to)
+		return false
+	}
 	chunk, ok := alloc.space.Donate(r)
 	if !ok {
-		free := alloc.space.NumFreeAddressesInRange(r)
-		common.Assert(free == 0)
+		if free := alloc.space.NumFreeAddressesInRange(r); free != 0 {
+			alloc.quarantine(fmt.Sprintf("could not donate from %s despite %d free addresses", r, free))
+			return false
+		}
+		// down-level peers ignore the denial, and still get the ring
 		alloc.debugln("No space to give to peer", to)
-		// separate message maintains backwards-compatibility:
-		// down-level peers will ignore this and still get the ring update.
-		alloc.sendSpaceRequestDenied(to, r)
-		return
+		return false
 	}
 	alloc.debugln("Giving range", chunk, "to", to)
 	alloc.ring.GrantRangeToHost(chunk.Start, chunk.End, to)
+	return true
 }
 
-func (alloc *Allocator) assertInvariants() {
+func (alloc *Allocator) checkInvariants() error {
 	// We need to ensure all ranges the ring thinks we own have
 	// a corresponding space in the space set, and vice versa
 	checkSpace := space.New()
@@ -743,26 +1053,31 @@ func (alloc *Allocator) assertInvariants() {
 	ranges := checkSpace.OwnedRanges()
 	spaces := alloc.space.OwnedRanges()
 
-	common.Assert(len(ranges) == len(spaces))
+	if len(ranges) != len(spaces) {
+		return fmt.Errorf("ring gives us %d ranges but we have space in %d", len(ranges), len(spaces))
+	}
 
 	for i := 0; i < len(ranges); i++ {
 		r := ranges[i]
 		s := spaces[i]
-		common.Assert(s.Start == r.Start && s.End == r.End)
+		if s.Start != r.Start || s.End != r.End {
+			return fmt.Errorf("ring gives us %s but we have space in %s", r, s)
+		}
 	}
+	return nil
 }
 
-func (alloc *Allocator) reportFreeSpace() {
+func (alloc *Allocator) reportFreeSpace() error {
 	ranges := alloc.ring.OwnedRanges()
 	if len(ranges) == 0 {
-		return
+		return nil
 	}
 
 	freespace := make(map[address.Address]address.Offset)
 	for _, r := range ranges {
 		freespace[r.Start] = alloc.space.NumFreeAddressesInRange(r)
 	}
-	alloc.ring.ReportFree(freespace)
+	return alloc.ring.ReportFree(freespace)
 }
 
 // Owned addresses
@@ -770,6 +1085,31 @@ func (alloc *Allocator) reportFreeSpace() {
 // NB: addr must not be owned by ident already
 func (alloc *Allocator) addOwned(ident string, addr address.Address) {
 	alloc.owned[ident] = append(alloc.owned[ident], addr)
+	alloc.register(ident, addr)
+}
+
+func (alloc *Allocator) owns(ident string, addr address.Address) bool {
+	for _, owned := range alloc.owned[ident] {
+		if owned == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (alloc *Allocator) removeOwned(ident string, addr address.Address) {
+	addrs := alloc.owned[ident]
+	for i, owned := range addrs {
+		if owned == addr {
+			if len(addrs) == 1 {
+				delete(alloc.owned, ident)
+			} else {
+				alloc.owned[ident] = append(addrs[:i], addrs[i+1:]...)
+			}
+			alloc.deregister(ident, addr)
+			return
+		}
+	}
 }
 
 func (alloc *Allocator) lookupOwned(ident string, r address.Range) (address.Address, bool) {
@@ -797,6 +1137,13 @@ func (alloc *Allocator) findOwner(addr address.Address) string {
 func (alloc *Allocator) infof(fmt string, args ...interface{}) {
 	common.Log.Infof("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
 }
+func (alloc *Allocator) errorf(format string, args ...interface{}) {
+	common.Log.Errorf("[allocator %s] "+format, append([]interface{}{alloc.ourName}, args...)...)
+	errorlog.Record("allocator", fmt.Errorf(format, args...))
+}
+func (alloc *Allocator) warnf(fmt string, args ...interface{}) {
+	common.Log.Warnf("[allocator %s] "+fmt, append([]interface{}{alloc.ourName}, args...)...)
+}
 func (alloc *Allocator) debugln(args ...interface{}) {
 	common.Log.Debugln(append([]interface{}{fmt.Sprintf("[allocator %s]:", alloc.ourName)}, args...)...)
 }
@@ -1,16 +1,28 @@
 package ipam
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/clock"
+	"github.com/weaveworks/weave/common/tracing"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/ipam/space"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/peernames"
+	wt "github.com/weaveworks/weave/testing"
 	"github.com/weaveworks/weave/testing/gossip"
 )
 
@@ -35,7 +47,7 @@ func TestAllocFree(t *testing.T) {
 		spaceSize  = 62 // 64 IP addresses in /26, minus .0 and .63
 	)
 
-	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	alloc, subnet, clk := makeAllocatorWithVirtualClock(t, "01:00:00:01:00:00", universe, 1, time.Now())
 	defer alloc.Stop()
 	_, cidr1, _ := address.ParseCIDR(subnet1)
 	_, cidr2, _ := address.ParseCIDR(subnet2)
@@ -76,10 +88,8 @@ func TestAllocFree(t *testing.T) {
 	require.Equal(t, addr1b, addr1c, "address")
 
 	alloc.ContainerDied(container3)
-	alloc.Encode() // sync up
-	// Move the clock forward and clear out the dead container
-	alloc.actionChan <- func() { alloc.now = func() time.Time { return time.Now().Add(containerDiedTimeout * 2) } }
-	alloc.actionChan <- func() { alloc.removeDeadContainers() }
+	// Move the clock forward; the ticks clear out the dead container
+	clk.Advance(containerDiedTimeout * 2)
 	require.Equal(t, address.Offset(spaceSize-1), alloc.NumFreeAddresses(subnet))
 }
 
@@ -108,7 +118,7 @@ func TestBootstrap(t *testing.T) {
 		alloc1.Allocate("somecontainer", subnet, returnFalse)
 		done <- true
 	}()
-	time.Sleep(100 * time.Millisecond)
+	waitForPendingAllocates(t, alloc1, 1)
 	AssertNothingSent(t, done)
 
 	CheckAllExpectedMessagesSent(alloc1, alloc2)
@@ -118,16 +128,23 @@ func TestBootstrap(t *testing.T) {
 
 	CheckAllExpectedMessagesSent(alloc1, alloc2)
 
-	// alloc2 receives paxos update and broadcasts its reply
-	ExpectBroadcastMessage(alloc2, nil)
-	alloc2.OnGossipBroadcast(alloc1.ourName, alloc1.Encode())
+	// alloc2 receives paxos update, and its reply goes out with
+	// what the router relays
+	update, err := alloc2.OnGossipBroadcast(alloc1.ourName, alloc1.Encode())
+	require.NoError(t, err)
+	require.IsType(t, &paxosDelta{}, update)
 
-	ExpectBroadcastMessage(alloc1, nil)
-	alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.Encode())
+	update, err = alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.Encode())
+	require.NoError(t, err)
+	require.IsType(t, &paxosDelta{}, update)
+
+	// Nothing new, so nothing to relay
+	update, err = alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.Encode())
+	require.NoError(t, err)
+	require.Nil(t, update)
 
 	// both nodes will get consensus now so initialize the ring
 	ExpectBroadcastMessage(alloc2, nil)
-	ExpectBroadcastMessage(alloc2, nil)
 	alloc2.OnGossipBroadcast(alloc1.ourName, alloc1.Encode())
 
 	CheckAllExpectedMessagesSent(alloc1, alloc2)
@@ -249,7 +266,7 @@ func TestCancel(t *testing.T) {
 		doneChan <- ok == nil
 	}()
 
-	time.Sleep(100 * time.Millisecond)
+	waitForPendingAllocates(t, alloc1, 1)
 	AssertNothingSent(t, doneChan)
 
 	cancelChan <- true
@@ -281,7 +298,7 @@ func TestCancelOnDied(t *testing.T) {
 	go f()
 
 	// Nothing should happen, because we declared the quorum as 2
-	time.Sleep(100 * time.Millisecond)
+	waitForPendingAllocates(t, alloc1, 2)
 	AssertNothingSent(t, doneChan)
 
 	alloc1.ContainerDied(container1)
@@ -337,8 +354,12 @@ func TestTransfer(t *testing.T) {
 	alloc2.Stop()
 	alloc3.Stop()
 	router.Flush()
-	require.NoError(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String()))
-	require.NoError(t, alloc1.AdminTakeoverRanges(alloc3.ourName.String()))
+	// our test allocators think every peer is alive
+	err = alloc1.AdminTakeoverRanges(alloc2.ourName.String(), false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "appears to be alive")
+	require.NoError(t, alloc1.AdminTakeoverRanges(alloc2.ourName.String(), true))
+	require.NoError(t, alloc1.AdminTakeoverRanges(alloc3.ourName.String(), true))
 	router.Flush()
 
 	require.Equal(t, address.Offset(1022), alloc1.NumFreeAddresses(subnet))
@@ -348,6 +369,110 @@ func TestTransfer(t *testing.T) {
 	alloc1.Stop()
 }
 
+func TestSpaceRequestRPC(t *testing.T) {
+	allocs, router, subnet := makeNetworkOfAllocators(2, "10.0.1.0/28")
+	defer stopNetworkOfAllocators(allocs)
+
+	// Once the ring is agreed, the peers know each other supports RPC
+	_, err := allocs[1].Allocate("container1", subnet, returnFalse)
+	require.NoError(t, err)
+	allocs[1].gossip.GossipBroadcast(allocs[1].Gossip())
+	router.Flush()
+	hasRPC := make(chan bool)
+	allocs[0].actionChan <- func() { hasRPC <- allocs[0].peerHasFeature(allocs[1].ourName, featureRPC) }
+	require.True(t, <-hasRPC)
+
+	// so the first, when it runs out, asks the second for space by a call
+	for i := 0; allocs[0].NumFreeAddresses(subnet) > 0; i++ {
+		_, err = allocs[0].Allocate(fmt.Sprint("container0-", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	free := allocs[1].NumFreeAddresses(subnet)
+	_, err = allocs[0].Allocate("one-more", subnet, returnFalse)
+	require.NoError(t, err)
+	require.True(t, allocs[1].NumFreeAddresses(subnet) < free)
+	require.Equal(t, 0, allocs[0].rpc.Pending())
+}
+
+func TestSpaceRequestTimeout(t *testing.T) {
+	const peer = "02:00:00:02:00:00"
+	alloc, subnet, clk := makeAllocatorWithVirtualClock(t, "01:00:00:01:00:00", "10.0.3.0/26", 1, time.Now())
+	defer alloc.Stop()
+	peerName, _ := mesh.PeerNameFromString(peer)
+	done := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.ring.ClaimForPeers([]mesh.PeerName{peerName})
+		close(done)
+	}
+	<-done
+	sent := func() bool {
+		m := alloc.gossip.(*mockGossipComms)
+		m.RLock()
+		defer m.RUnlock()
+		return len(m.messages) == 0
+	}
+
+	ExpectMessage(alloc, peer, msgSpaceRequest, nil)
+	errChan := make(chan error)
+	go func() {
+		_, err := alloc.Allocate("container", subnet, returnFalse)
+		errChan <- err
+	}()
+	wt.AssertEventually(t, time.Second, sent, "space requested")
+
+	// Not asked again on the next tick, but once the request times out
+	clk.Advance(tickInterval)
+	for i := 1; i < maxSpaceRequestAttempts; i++ {
+		ExpectMessage(alloc, peer, msgSpaceRequest, nil)
+		clk.Advance(spaceRequestTimeout)
+		wt.AssertEventually(t, time.Second, sent, "space requested again")
+	}
+
+	// and after that, the allocation fails
+	clk.Advance(spaceRequestTimeout)
+	err := <-errChan
+	require.Error(t, err)
+	require.Equal(t, ErrNoSpace, ErrorKind(err))
+}
+
+func TestAudit(t *testing.T) {
+	const cidr = "10.0.1.7/22"
+	allocs, router, subnet := makeNetworkOfAllocators(3, cidr)
+	defer stopNetworkOfAllocators(allocs)
+
+	for i, alloc := range allocs {
+		_, err := alloc.Allocate(fmt.Sprint("container", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	for _, alloc := range allocs {
+		alloc.gossip.GossipBroadcast(alloc.Gossip())
+		router.Flush()
+	}
+
+	report := allocs[0].Audit(5 * time.Second)
+	require.Len(t, report.Peers, 3)
+	for _, peer := range report.Peers {
+		require.Equal(t, "answered", peer.Status)
+	}
+	require.Empty(t, report.Divergences)
+
+	// One peer's copy of an entry goes ahead of the rest, and another
+	// stops answering
+	done := make(chan struct{})
+	allocs[1].actionChan <- func() {
+		allocs[1].ring.Entries[0].Version += 2
+		close(done)
+	}
+	<-done
+	router.RemovePeer(allocs[2].ourName)
+
+	report = allocs[0].Audit(100 * time.Millisecond)
+	require.Equal(t, "no answer", report.Peers[2].Status)
+	require.Len(t, report.Divergences, 1)
+	require.Equal(t, ring.StaleVersion, report.Divergences[0].Kind)
+	require.Contains(t, report.Divergences[0].Detail, allocs[0].ourName.String())
+}
+
 func TestFakeRouterSimple(t *testing.T) {
 	const (
 		cidr = "10.0.1.7/22"
@@ -576,11 +701,1020 @@ func TestAllocatorFuzz(t *testing.T) {
 func TestGossipSkew(t *testing.T) {
 	alloc1, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.1.0/22", 2)
 	defer alloc1.Stop()
-	alloc2, _ := makeAllocatorWithMockGossip(t, "02:00:00:02:00:00", "10.0.1.0/22", 2)
-	alloc2.now = func() time.Time { return time.Now().Add(time.Hour * 2) }
+	alloc2, _, _ := makeAllocatorWithVirtualClock(t, "02:00:00:02:00:00", "10.0.1.0/22", 2, time.Now().Add(time.Hour*2))
 	defer alloc2.Stop()
 
 	if _, err := alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.Encode()); err == nil {
 		t.Fail()
 	}
 }
+
+func TestStatusWhileActorBusy(t *testing.T) {
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.1.0/22", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	_, err := alloc.Allocate("abcdef", subnet, returnFalse)
+	require.NoError(t, err)
+
+	// Wedge the actor
+	unblock := make(chan struct{})
+	alloc.actionChan <- func() { <-unblock }
+	defer close(unblock)
+
+	statusChan := make(chan *Status)
+	go func() { statusChan <- NewStatus(alloc, address.CIDR{}) }()
+	select {
+	case status := <-statusChan:
+		require.Equal(t, "10.0.0.0-10.0.3.255", status.Range)
+		require.Len(t, status.Entries, 1)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "status blocked on the actor loop")
+	}
+}
+
+func TestStatusShowsPendingAllocation(t *testing.T) {
+	// No ring until a second peer turns up, so allocations wait
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.1.0/22", 2)
+	defer alloc.Stop()
+	ExpectBroadcastMessage(alloc, nil) // paxos proposal
+
+	go alloc.Allocate("abcdef", subnet, returnFalse)
+	pending := func() []string { return NewStatus(alloc, address.CIDR{}).PendingAllocates }
+	wt.AssertEventually(t, 5*time.Second, func() bool { return len(pending()) > 0 }, "pending allocation never appeared in status")
+	require.Equal(t, []string{"abcdef " + subnet.String()}, pending())
+
+	// Still there while the actor is busy
+	unblock := make(chan struct{})
+	alloc.actionChan <- func() { <-unblock }
+	defer close(unblock)
+	require.Equal(t, []string{"abcdef " + subnet.String()}, pending())
+}
+
+func TestPrime(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", "10.0.3.0/29", 1)
+	defer alloc.Stop()
+	require.Equal(t, WaitingForPeers, alloc.Readiness())
+
+	// With a quorum of one, we reach consensus straight away
+	ExpectBroadcastMessage(alloc, nil) // paxos proposal
+	ExpectBroadcastMessage(alloc, nil) // the new ring
+	alloc.Prime()
+	alloc.Encode() // sync up
+	require.Equal(t, Ready, alloc.Readiness())
+	CheckAllExpectedMessagesSent(alloc)
+
+	// Priming again is harmless
+	alloc.Prime()
+	alloc.Encode()
+	require.Equal(t, Ready, alloc.Readiness())
+}
+
+func TestInitPeerCount(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 2)
+	clk := clock.NewVirtual(time.Now())
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	peers := int32(1)
+	alloc.SetInitPeerCount(3, func() int { return int(atomic.LoadInt32(&peers)) })
+	alloc.Start()
+	defer alloc.Stop()
+
+	// Neither priming nor allocating starts the election while we
+	// are on our own
+	alloc.Prime()
+	go alloc.Allocate("abcdef", subnet, returnFalse)
+	pending := func() []string { return NewStatus(alloc, address.CIDR{}).PendingAllocates }
+	wt.AssertEventually(t, 5*time.Second, func() bool { return len(pending()) > 0 }, "allocation never became pending")
+	clk.Advance(tickInterval)
+	alloc.Encode() // sync up
+	require.Equal(t, WaitingForPeers, alloc.Readiness())
+
+	// Nor does it with fewer peers than expected
+	atomic.StoreInt32(&peers, 2)
+	clk.Advance(tickInterval)
+	alloc.Encode()
+	require.Equal(t, WaitingForPeers, alloc.Readiness())
+
+	// Once they have all turned up, the next tick proposes
+	atomic.StoreInt32(&peers, 3)
+	ExpectBroadcastMessage(alloc, nil)
+	clk.Advance(tickInterval)
+	alloc.Encode()
+	CheckAllExpectedMessagesSent(alloc)
+	require.Equal(t, Electing, alloc.Readiness())
+}
+
+func TestManualSeed(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.RequireManualSeed()
+	alloc.Start()
+	defer alloc.Stop()
+
+	// Nothing happens without being told, even with a quorum of one
+	alloc.Prime()
+	alloc.Encode() // sync up
+	require.Equal(t, WaitingForPeers, alloc.Readiness())
+
+	require.Error(t, alloc.Seed([]string{"no-such-peer"}))
+	ExpectBroadcastMessage(alloc, nil) // the new ring
+	require.NoError(t, alloc.Seed([]string{"02:00:00:02:00:00"}))
+	alloc.Encode()
+	require.Equal(t, Ready, alloc.Readiness())
+	CheckAllExpectedMessagesSent(alloc)
+	require.Len(t, alloc.ring.Seeds, 2)
+	require.Len(t, NewStatus(alloc, address.CIDR{}).Entries, 2)
+
+	require.Error(t, alloc.Seed(nil), "seeding twice")
+	_, err := alloc.Allocate("abcdef", subnet, returnFalse)
+	require.NoError(t, err)
+}
+
+func TestEmergencyReserve(t *testing.T) {
+	const peer = "02:00:00:02:00:00"
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetEmergencyReserve(0.5) // half of 8 addresses
+	alloc.Start()
+	defer alloc.Stop()
+	ExpectBroadcastMessage(alloc, nil)
+	require.NoError(t, alloc.Seed(nil))
+
+	for i := 0; i < 4; i++ {
+		_, err := alloc.Allocate(fmt.Sprintf("c%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+
+	// Down to the reserve, so we don't give any away
+	peerName, _ := mesh.PeerNameFromString(peer)
+	ExpectMessage(alloc, peer, msgSpaceRequestDenied, nil)
+	ExpectMessage(alloc, peer, msgRingUpdate, nil)
+	require.NoError(t, alloc.OnGossipUnicast(peerName, append([]byte{msgSpaceRequest}, encodeRange(subnet)...)))
+	CheckAllExpectedMessagesSent(alloc)
+
+	// but with no one else to ask, we use it ourselves
+	_, err := alloc.Allocate("c4", subnet, returnFalse)
+	require.NoError(t, err)
+}
+
+func TestUpdateEmergencyReserve(t *testing.T) {
+	const peer = "02:00:00:02:00:00"
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetEmergencyReserve(0.5)
+	alloc.Start()
+	defer alloc.Stop()
+	ExpectBroadcastMessage(alloc, nil)
+	require.NoError(t, alloc.Seed(nil))
+	for i := 0; i < 4; i++ {
+		_, err := alloc.Allocate(fmt.Sprintf("c%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+
+	// Without the reserve, the rest is there to be given away
+	free := alloc.NumFreeAddresses(subnet)
+	alloc.UpdateEmergencyReserve(0)
+	peerName, _ := mesh.PeerNameFromString(peer)
+	ExpectMessage(alloc, peer, msgRingUpdate, nil)
+	require.NoError(t, alloc.OnGossipUnicast(peerName, append([]byte{msgSpaceRequest}, encodeRange(subnet)...)))
+	CheckAllExpectedMessagesSent(alloc)
+	require.True(t, alloc.NumFreeAddresses(subnet) < free)
+}
+
+func TestNicknames(t *testing.T) {
+	alloc, _ := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	peer2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	peer3, _ := mesh.PeerNameFromString("03:00:00:03:00:00")
+
+	alloc.setNickname(peer2, "Host2")
+	name, err := alloc.lookupPeername("host2")
+	require.NoError(t, err)
+	require.Equal(t, peer2, name)
+	name, err = alloc.lookupPeername(peer3.String())
+	require.NoError(t, err)
+	require.Equal(t, peer3, name)
+	_, err = alloc.lookupPeername("host3")
+	require.Error(t, err)
+	require.Nil(t, alloc.nicknameCollisions())
+
+	// Two peers with the same nickname, give or take case
+	alloc.setNickname(peer3, "HOST2")
+	_, err = alloc.lookupPeername("host2")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ambiguous")
+	require.Len(t, alloc.nicknameCollisions(), 1)
+
+	// A peer changing its nickname, or going away, resolves it
+	alloc.setNickname(peer3, "host3")
+	name, err = alloc.lookupPeername("host2")
+	require.NoError(t, err)
+	require.Equal(t, peer2, name)
+	alloc.setNickname(peer3, "host2")
+	alloc.removeNickname(peer2)
+	name, err = alloc.lookupPeername("Host2")
+	require.NoError(t, err)
+	require.Equal(t, peer3, name)
+	require.Nil(t, alloc.nicknameCollisions())
+
+	// Nicknames are shared with the registry, both ways
+	registry := peernames.NewRegistry()
+	alloc.SetPeerNames(registry)
+	require.Equal(t, "03:00:00:03:00:00(host2)", registry.Annotate(peer3))
+	peer4, _ := mesh.PeerNameFromString("04:00:00:04:00:00")
+	registry.Set("topology", peer4, "host4")
+	name, err = alloc.lookupPeername("host4")
+	require.NoError(t, err)
+	require.Equal(t, peer4, name)
+	require.Equal(t, []string{"04:00:00:04:00:00(host4)"}, alloc.annotatePeernames([]mesh.PeerName{peer4}))
+}
+
+func TestLowWatermarks(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetLowWatermarks(0.5, 0)
+	alloc.Start()
+	defer alloc.Stop()
+	ExpectBroadcastMessage(alloc, nil)
+	require.NoError(t, alloc.Seed(nil))
+
+	lowSpace := func() []string { return NewStatus(alloc, address.CIDR{}).LowSpace }
+	for i := 0; i < 4; i++ {
+		require.Nil(t, lowSpace())
+		_, err := alloc.Allocate(fmt.Sprintf("c%d", i), subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	// 5 of 8 allocated
+	_, err := alloc.Allocate("c4", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, []string{"local: 3 of 8 addresses free"}, lowSpace())
+
+	require.NoError(t, alloc.Delete("c4"))
+	require.NoError(t, alloc.Delete("c3"))
+	require.Nil(t, lowSpace())
+}
+
+type fakeContainerChecker map[string]bool
+
+func (checker fakeContainerChecker) ContainerExists(ident string) (bool, error) {
+	return checker[ident], nil
+}
+
+func TestReconcile(t *testing.T) {
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/29", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	alive := strings.Repeat("a", 64)
+	gone := strings.Repeat("b", 64)
+	for _, ident := range []string{alive, gone, "weave:expose"} {
+		_, err := alloc.Allocate(ident, subnet, returnFalse)
+		require.NoError(t, err)
+	}
+	checker := fakeContainerChecker{alive: true}
+
+	require.Equal(t, []string{gone}, alloc.Reconcile(checker, true))
+	_, err := alloc.Lookup(gone, subnet)
+	require.NoError(t, err, "dry run released addresses")
+
+	require.Equal(t, []string{gone}, alloc.Reconcile(checker, false))
+	_, err = alloc.Lookup(gone, subnet)
+	require.Error(t, err)
+	for _, ident := range []string{alive, "weave:expose"} {
+		_, err = alloc.Lookup(ident, subnet)
+		require.NoError(t, err)
+	}
+	require.Nil(t, alloc.Reconcile(checker, false))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	alloc, subnet, clk := makeAllocatorWithVirtualClock(t, "01:00:00:01:00:00", "10.0.3.0/26", 1, time.Now())
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.AllocateWithKey("container1", "key", subnet, returnFalse)
+	require.NoError(t, err)
+
+	// A retry, for a replacement container, gets the same address
+	addr2, err := alloc.AllocateWithKey("container2", "key", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr2)
+	_, err = alloc.Lookup("container1", subnet)
+	require.Error(t, err, "address still owned by the first container")
+	addr, err := alloc.Lookup("container2", subnet)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr)
+
+	// Other keys get other addresses
+	addr3, err := alloc.AllocateWithKey("container3", "other", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr1, addr3)
+
+	// Once freed, the key no longer refers to the address
+	require.NoError(t, alloc.Delete("container2"))
+	_, err = alloc.Allocate("container4", subnet, returnFalse) // takes addr1
+	require.NoError(t, err)
+	addr5, err := alloc.AllocateWithKey("container5", "key", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr1, addr5)
+
+	// and keys expire
+	clk.Advance(keyTTL + tickInterval)
+	addr6, err := alloc.AllocateWithKey("container6", "other", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr3, addr6)
+	_, err = alloc.Lookup("container3", subnet)
+	require.NoError(t, err)
+}
+
+func TestRegistrar(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+	)
+	flushed := make(chan []RegistrationEvent, 10)
+	registrar := NewBatchingRegistrar(3, time.Hour, func(events []RegistrationEvent) { flushed <- events })
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetRegistrar(registrar)
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	addr2, err := alloc.Allocate(container2, subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Free(container1, addr1))
+
+	// A full batch is flushed straight away
+	events := <-flushed
+	metadata := map[string]string{"peer": "01:00:00:01:00:00", "nickname": "nick-01:00:00:01:00:00"}
+	require.Equal(t, []RegistrationEvent{
+		{true, container1, addr1, metadata},
+		{true, container2, addr2, metadata},
+		{false, container1, addr1, metadata},
+	}, events)
+
+	// The rest go when stopped
+	require.NoError(t, alloc.Delete(container2))
+	registrar.Stop()
+	require.Equal(t, []RegistrationEvent{{false, container2, addr2, metadata}}, <-flushed)
+}
+
+type recordingHooks struct {
+	NoHooks
+	name  string
+	calls *[]string
+	veto  string // ident to refuse
+}
+
+func (h recordingHooks) PreAllocate(ident string, r address.Range) error {
+	*h.calls = append(*h.calls, h.name+" pre-allocate "+ident)
+	if ident == h.veto {
+		return fmt.Errorf("%s refused", ident)
+	}
+	return nil
+}
+
+func (h recordingHooks) PostAllocate(ident string, addr address.Address) {
+	*h.calls = append(*h.calls, h.name+" post-allocate "+ident+" "+addr.String())
+}
+
+func (h recordingHooks) PreFree(ident string, addr address.Address) error {
+	*h.calls = append(*h.calls, h.name+" pre-free "+ident+" "+addr.String())
+	if ident == h.veto {
+		return fmt.Errorf("%s refused", ident)
+	}
+	return nil
+}
+
+func TestHooks(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+	)
+	var calls []string
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.AddHooks(recordingHooks{name: "a", calls: &calls})
+	alloc.AddHooks(recordingHooks{name: "b", calls: &calls, veto: container2})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	_, err = alloc.Allocate(container2, subnet, returnFalse)
+	require.Error(t, err, "vetoed by a hook")
+	require.NoError(t, alloc.Delete(container1))
+	require.Equal(t, []string{
+		"a pre-allocate " + container1,
+		"b pre-allocate " + container1,
+		"b post-allocate " + container1 + " " + addr1.String(),
+		"a post-allocate " + container1 + " " + addr1.String(),
+		"a pre-allocate " + container2,
+		"b pre-allocate " + container2,
+		"a pre-free " + container1 + " " + addr1.String(),
+		"b pre-free " + container1 + " " + addr1.String(),
+	}, calls)
+	_, err = alloc.Lookup(container2, subnet)
+	require.Error(t, err, "nothing allocated when vetoed")
+}
+
+func TestAffinity(t *testing.T) {
+	const (
+		container1 = "abcdef"
+		container2 = "baddf00d"
+		container3 = "b01df00d"
+	)
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	clk := clock.NewVirtual(time.Now())
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetAffinityTTL(time.Minute)
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	addr2, err := alloc.Allocate(container2, subnet, returnFalse)
+	require.NoError(t, err)
+
+	// Without affinity, container2 would get addr1, the lowest free
+	require.NoError(t, alloc.Delete(container1))
+	require.NoError(t, alloc.Delete(container2))
+	addr, err := alloc.Allocate(container2, subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr2, addr)
+
+	// Someone else can take the address, after which affinity doesn't help
+	addr, err = alloc.Allocate(container3, subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr)
+	addr, err = alloc.Allocate(container1, subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr1, addr)
+
+	// and it is forgotten after the TTL
+	require.NoError(t, alloc.Free(container2, addr2))
+	require.NoError(t, alloc.Delete(container3))
+	clk.Advance(time.Minute + tickInterval)
+	addr, err = alloc.Allocate(container2, subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr)
+}
+
+func TestReuseDelay(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/30", 1)
+	clk := clock.NewVirtual(time.Now())
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetReuseDelay(time.Minute)
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate("c1", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Delete("c1"))
+	// the lowest free address, were addr1 not held back
+	addr2, err := alloc.Allocate("c2", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NotEqual(t, addr1, addr2)
+
+	// Once there are no others, the held address is reused
+	addr, err := alloc.Allocate("c3", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr)
+
+	// and in any case after the delay
+	require.NoError(t, alloc.Delete("c2"))
+	clk.Advance(time.Minute + tickInterval)
+	require.NoError(t, alloc.Delete("c3"))
+	addr, err = alloc.Allocate("c4", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr2, addr)
+}
+
+func TestAllocationStrategy(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/29", 1)
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetAllocationStrategy(space.LeastRecentlyUsed)
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate("c1", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.Delete("c1"))
+	// Sequential allocation would hand addr1 straight back
+	for _, ident := range []string{"c2", "c3", "c4", "c5", "c6"} {
+		addr, err := alloc.Allocate(ident, subnet, returnFalse)
+		require.NoError(t, err)
+		require.NotEqual(t, addr1, addr)
+	}
+	addr, err := alloc.Allocate("c7", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr1, addr)
+}
+
+func TestSetupDeadline(t *testing.T) {
+	alloc, subnet := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 1)
+	clk := clock.NewVirtual(time.Now())
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	addr1, err := alloc.Allocate("c1", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.AwaitSetup("c1", addr1, time.Minute))
+	addr2, err := alloc.Allocate("c2", subnet, returnFalse)
+	require.NoError(t, err)
+	require.NoError(t, alloc.AwaitSetup("c2", addr2, time.Minute))
+	require.NoError(t, alloc.ReportSetup("c2", addr2, true))
+
+	clk.Advance(time.Minute + tickInterval)
+	_, err = alloc.Lookup("c1", subnet)
+	require.Error(t, err, "address freed, never having been set up")
+	addr, err := alloc.Lookup("c2", subnet)
+	require.NoError(t, err)
+	require.Equal(t, addr2, addr)
+}
+
+// Waits proposals times the interval before proposing again
+type linearBackoff time.Duration
+
+func (b linearBackoff) Delay(proposals uint) time.Duration {
+	return time.Duration(b) * time.Duration(proposals)
+}
+
+func TestProposalBackoff(t *testing.T) {
+	alloc, _ := makeAllocator("01:00:00:01:00:00", "10.0.3.0/26", 2)
+	clk := clock.NewVirtual(time.Now())
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.SetProposalBackoff(linearBackoff(tickInterval))
+	alloc.Start()
+	defer alloc.Stop()
+
+	ExpectBroadcastMessage(alloc, nil) // first proposal
+	alloc.Prime()
+	alloc.syncActor()
+	CheckAllExpectedMessagesSent(alloc)
+	require.Equal(t, uint(1), NewStatus(alloc, address.CIDR{}).Paxos.Proposals)
+	require.Equal(t, tickInterval, NewStatus(alloc, address.CIDR{}).Paxos.Backoff)
+
+	// The second proposal waits one tick, the third two
+	ExpectBroadcastMessage(alloc, nil)
+	clk.Advance(tickInterval)
+	alloc.Encode()
+	CheckAllExpectedMessagesSent(alloc)
+	clk.Advance(tickInterval)
+	alloc.Encode()
+	ExpectBroadcastMessage(alloc, nil)
+	clk.Advance(tickInterval)
+	alloc.Encode()
+	CheckAllExpectedMessagesSent(alloc)
+	require.Equal(t, uint(3), NewStatus(alloc, address.CIDR{}).Paxos.Proposals)
+	require.Equal(t, 3*tickInterval, NewStatus(alloc, address.CIDR{}).Paxos.Backoff)
+}
+
+func TestClockSkew(t *testing.T) {
+	alloc1, _ := makeAllocator("01:00:00:01:00:00", "10.0.1.0/22", 2)
+	alloc1.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc1.Start()
+	defer alloc1.Stop()
+	alloc2, _ := makeAllocator("02:00:00:02:00:00", "10.0.1.0/22", 2)
+	clk := clock.NewVirtual(time.Now())
+	alloc2.clock = clk
+
+	skew := func() []ClockSkewStatus {
+		alloc1.Encode() // wait for the actor to finish
+		return NewStatus(alloc1, address.CIDR{}).ClockSkew
+	}
+
+	_, err := alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+	require.NoError(t, err)
+	require.Len(t, skew(), 1)
+	require.Equal(t, alloc2.ourName.String(), skew()[0].Peer)
+	require.Empty(t, skew()[0].Warning)
+
+	// Warned about well before updates are ignored
+	clk.Advance(40 * time.Minute)
+	_, err = alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+	require.NoError(t, err)
+	require.InDelta(t, 40*time.Minute, skew()[0].Skew, float64(time.Second))
+	require.NotEmpty(t, skew()[0].Warning)
+
+	clk.Advance(time.Hour)
+	_, err = alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+	require.Error(t, err)
+	require.NotEmpty(t, skew()[0].Warning)
+}
+
+func TestIncarnations(t *testing.T) {
+	alloc1, _ := makeAllocator("01:00:00:01:00:00", "10.0.1.0/22", 2)
+	alloc1.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc1.Start()
+	defer alloc1.Stop()
+	alloc2, _ := makeAllocator("02:00:00:02:00:00", "10.0.1.0/22", 2)
+	alloc2.SetIncarnation(1)
+
+	incarnation := func() IncarnationStatus {
+		alloc1.Encode() // wait for the actor to finish
+		for _, status := range NewStatus(alloc1, address.CIDR{}).Incarnations {
+			if status.Peer == alloc2.ourName.String() {
+				return status
+			}
+		}
+		require.FailNow(t, "peer not found")
+		return IncarnationStatus{}
+	}
+	restart := func(count uint64) {
+		ours := alloc2.incarnations[alloc2.ourName]
+		alloc2.incarnations[alloc2.ourName] = Incarnation{UID: ours.UID + 1, Count: count, Started: ours.Started + 1}
+		_, err := alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+		require.NoError(t, err)
+	}
+
+	_, err := alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), incarnation().Incarnation)
+	require.Equal(t, 0, incarnation().RecentRestarts)
+
+	// Gossip about the same incarnation is not a restart
+	_, err = alloc1.OnGossipBroadcast(alloc2.ourName, alloc2.encode())
+	require.NoError(t, err)
+	require.Equal(t, 0, incarnation().RecentRestarts)
+
+	restart(2)
+	require.Equal(t, uint64(2), incarnation().Incarnation)
+	require.Equal(t, 1, incarnation().RecentRestarts)
+	require.Empty(t, incarnation().Warning)
+
+	restart(3)
+	restart(4)
+	require.Equal(t, flappingRestarts, incarnation().RecentRestarts)
+	require.NotEmpty(t, incarnation().Warning)
+
+	// A lower count is a different peer, not a restart
+	restart(1)
+	require.Equal(t, uint64(1), incarnation().Incarnation)
+	require.Equal(t, flappingRestarts, incarnation().RecentRestarts)
+}
+
+// Records unicasts, for the test to deliver
+type unicastRecorder struct {
+	sync.Mutex
+	unicasts [][]byte
+}
+
+func (r *unicastRecorder) GossipUnicast(dst mesh.PeerName, buf []byte) error {
+	r.Lock()
+	defer r.Unlock()
+	r.unicasts = append(r.unicasts, buf)
+	return nil
+}
+
+func (r *unicastRecorder) GossipBroadcast(update mesh.GossipData) error {
+	return nil
+}
+
+func (r *unicastRecorder) take() [][]byte {
+	r.Lock()
+	defer r.Unlock()
+	unicasts := r.unicasts
+	r.unicasts = nil
+	return unicasts
+}
+
+func TestSummaryGossip(t *testing.T) {
+	decode := func(msg []byte) (data gossipState) {
+		require.NoError(t, gob.NewDecoder(bytes.NewReader(msg)).Decode(&data))
+		return data
+	}
+
+	alloc1, _ := makeAllocator("01:00:00:01:00:00", "10.0.1.0/22", 2)
+	alloc2, _ := makeAllocator("02:00:00:02:00:00", "10.0.1.0/22", 2)
+	alloc1.claimRingForTesting(alloc2)
+	gossip1, gossip2 := &unicastRecorder{}, &unicastRecorder{}
+	alloc1.SetInterfaces(gossip1)
+	alloc2.SetInterfaces(gossip2)
+	alloc1.Start()
+	defer alloc1.Stop()
+	alloc2.Start()
+	defer alloc2.Stop()
+
+	// A small ring is gossiped whole
+	require.NotNil(t, decode(alloc1.Gossip().Encode()[0]).Ring)
+
+	defer func(old int) { summariseRingsFrom = old }(summariseRingsFrom)
+	summariseRingsFrom = 0
+	msg := alloc1.Gossip().Encode()[0]
+	require.Nil(t, decode(msg).Ring)
+	require.NotNil(t, decode(msg).Summary)
+
+	// alloc2 has no ring, so asks for everything
+	_, err := alloc2.OnGossip(msg)
+	require.NoError(t, err)
+	unicasts := gossip2.take()
+	require.Len(t, unicasts, 1)
+	require.NoError(t, alloc1.OnGossipUnicast(alloc2.ourName, unicasts[0]))
+	unicasts = gossip1.take()
+	require.Len(t, unicasts, 1)
+	require.Nil(t, decode(unicasts[0][1:]).Summary)
+	require.NoError(t, alloc2.OnGossipUnicast(alloc1.ourName, unicasts[0]))
+
+	alloc2.Encode() // wait for the actor to finish
+	diffs, err := alloc2.ring.Differences(alloc1.ring.Summary())
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	// Once the rings match, a summary gets no reply
+	_, err = alloc2.OnGossip(alloc1.Gossip().Encode()[0])
+	require.NoError(t, err)
+	alloc2.Encode()
+	require.Empty(t, gossip2.take())
+}
+
+func TestDisjointRanges(t *testing.T) {
+	_, cidr1, _ := address.ParseCIDR("10.2.0.0/24")
+	_, cidr2, _ := address.ParseCIDR("10.9.0.0/24")
+	_, gap, _ := address.ParseCIDR("10.5.0.0/24")
+	alloc, _ := makeAllocator("01:00:00:01:00:00", "10.2.0.0/24", 1)
+	alloc.SetRanges([]address.Range{cidr1.Range(), cidr2.Range()})
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: "01:00:00:01:00:00"})
+	alloc.Start()
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+
+	require.Equal(t, address.Offset(512), alloc.NumFreeAddresses(address.Range{Start: cidr1.Start, End: cidr2.Range().End}))
+	addr, err := alloc.Allocate("foo", cidr2.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, "10.9.0.1", addr.String())
+	_, err = alloc.Allocate("bar", gap.HostRange(), returnFalse)
+	require.Error(t, err)
+
+	status := NewStatus(alloc, cidr1)
+	require.Equal(t, "10.2.0.0-10.2.0.255, 10.9.0.0-10.9.0.255", status.Range)
+	require.Equal(t, 512, status.RangeNumIPs)
+}
+
+func TestExclusions(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	_, cidr, _ := address.ParseCIDR("10.0.3.0/26")
+	ip := func(s string) address.Address {
+		addr, _ := address.ParseIP(s)
+		return addr
+	}
+
+	alloc.SetHostExclusions(map[address.Address]string{
+		ip("10.0.3.1"): "on host interface weave",
+		ip("10.9.9.9"): "on host interface eth0",
+	})
+	addr, err := alloc.Allocate("c1", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.3.2", addr.String())
+
+	exclusions := NewStatus(alloc, cidr).Exclusions
+	require.Len(t, exclusions, 3)
+	require.Equal(t, Exclusion{Address: "10.0.3.0", Reason: "network address of 10.0.3.0/26"}, exclusions[0])
+	require.Equal(t, "10.0.3.63", exclusions[1].Address)
+	require.Equal(t, Exclusion{"10.0.3.1", "on host interface weave", alloc.ourName.String(), "nick-01:00:00:01:00:00"}, exclusions[2])
+
+	// Other peers' exclusions are kept clear too
+	alloc2, _ := makeAllocator("02:00:00:02:00:00", "10.0.3.0/26", 1)
+	alloc2.exclusions[alloc2.ourName] = hostExclusions{Version: 1, Reasons: map[address.Address]string{ip("10.0.3.4"): "on host interface weave"}}
+	_, err = alloc.OnGossipBroadcast(alloc2.ourName, alloc2.encodeState(gossipState{}))
+	require.NoError(t, err)
+	addr, err = alloc.Allocate("c2", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.3.3", addr.String())
+	addr, err = alloc.Allocate("c3", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.3.5", addr.String())
+
+	// A container can claim an excluded address
+	require.NoError(t, alloc.Claim("c4", ip("10.0.3.1"), false))
+}
+
+func TestHostExclusionsVersions(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	ip := func(s string) address.Address {
+		addr, _ := address.ParseIP(s)
+		return addr
+	}
+	versions := func() (uint64, uint64) {
+		resultChan := make(chan [2]uint64)
+		alloc.actionChan <- func() {
+			resultChan <- [2]uint64{alloc.exclusions[alloc.ourName].Version, alloc.stateVersion}
+		}
+		result := <-resultChan
+		return result[0], result[1]
+	}
+
+	reasons := map[address.Address]string{ip("10.0.3.1"): "on host interface weave"}
+	alloc.SetHostExclusions(reasons)
+	version1, stateVersion1 := versions()
+	require.Equal(t, uint64(1), version1)
+
+	// Setting the same again changes nothing, so there is nothing to gossip
+	alloc.SetHostExclusions(map[address.Address]string{ip("10.0.3.1"): "on host interface weave"})
+	version, stateVersion := versions()
+	require.Equal(t, version1, version)
+	require.Equal(t, stateVersion1, stateVersion)
+
+	reasons[ip("10.0.3.2")] = "on host interface docker0"
+	alloc.SetHostExclusions(reasons)
+	version, stateVersion = versions()
+	require.Equal(t, uint64(2), version)
+	require.NotEqual(t, stateVersion1, stateVersion)
+
+	// A later incarnation's exclusions replace an earlier one's, even
+	// though its count has started again
+	old := hostExclusions{UID: 1, Started: 100, Version: 5}
+	later := hostExclusions{UID: 2, Started: 200, Version: 1}
+	require.True(t, later.newerThan(old))
+	require.False(t, old.newerThan(later))
+	require.True(t, hostExclusions{UID: 1, Started: 100, Version: 6}.newerThan(old))
+	require.False(t, old.newerThan(old))
+}
+
+func TestQuarantine(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	_, cidr, _ := address.ParseCIDR("10.0.3.0/26")
+	addr, err := alloc.Allocate("c1", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+
+	// Lose track of our space, so that it no longer matches the ring
+	alloc.actionChan <- func() { alloc.space = *space.New() }
+	alloc.Encode()
+
+	require.Equal(t, Quarantined, alloc.Readiness())
+	status := NewStatus(alloc, cidr)
+	require.Equal(t, "quarantined", status.Readiness)
+	require.Contains(t, status.Quarantined, "ring gives us")
+	_, err = alloc.Allocate("c2", cidr.HostRange(), returnFalse)
+	require.Error(t, err)
+	require.Error(t, alloc.Claim("c3", address.Add(addr, 1), false))
+
+	// What is already allocated can still be looked up
+	addr2, err := alloc.Allocate("c1", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr, addr2)
+}
+
+func TestReadOnly(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	_, cidr, _ := address.ParseCIDR("10.0.3.0/26")
+	addr, err := alloc.Allocate("c1", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+
+	alloc.SetReadOnly(true)
+	require.True(t, NewStatus(alloc, cidr).ReadOnly)
+	_, err = alloc.Allocate("c2", cidr.HostRange(), returnFalse)
+	require.Equal(t, ErrNotReady, ErrorKind(err))
+	require.Equal(t, ErrNotReady, ErrorKind(alloc.Claim("c3", address.Add(addr, 1), false)))
+
+	// What is already allocated can still be looked up, and freed
+	addr2, err := alloc.Allocate("c1", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+	require.Equal(t, addr, addr2)
+	require.NoError(t, alloc.Claim("c1", addr, false))
+	require.NoError(t, alloc.Free("c1", addr))
+
+	alloc.SetReadOnly(false)
+	require.False(t, NewStatus(alloc, cidr).ReadOnly)
+	_, err = alloc.Allocate("c2", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+}
+
+func TestUnknownMessage(t *testing.T) {
+	alloc, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	peer2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+	peer3, _ := mesh.PeerNameFromString("03:00:00:03:00:00")
+
+	unknown := func() string {
+		if v := expUnknownMessages.Get("200"); v != nil {
+			return v.String()
+		}
+		return "0"
+	}
+	before, _ := strconv.Atoi(unknown())
+
+	require.Error(t, alloc.OnGossipUnicast(peer2, nil))
+	// Only a peer which says it understands a nack is sent one
+	require.Error(t, alloc.OnGossipUnicast(peer2, []byte{200, 1, 2}))
+	alloc.actionChan <- func() { alloc.incarnations[peer3] = Incarnation{Features: ourFeatures} }
+	ExpectMessage(alloc, "03:00:00:03:00:00", msgUnknown, []byte{200})
+	require.Error(t, alloc.OnGossipUnicast(peer3, []byte{200}))
+	CheckAllExpectedMessagesSent(alloc)
+	require.Equal(t, strconv.Itoa(before+2), unknown())
+
+	require.NoError(t, alloc.OnGossipUnicast(peer3, []byte{msgUnknown, msgRPC}))
+}
+
+func TestErrorKinds(t *testing.T) {
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/30", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	ip := func(s string) address.Address {
+		addr, _ := address.ParseIP(s)
+		return addr
+	}
+
+	addr1, err := alloc.Allocate("c1", subnet, returnFalse)
+	require.NoError(t, err)
+	_, err = alloc.Allocate("c2", subnet, returnFalse)
+	require.NoError(t, err)
+	_, err = alloc.Allocate("c3", subnet, returnFalse)
+	require.Equal(t, ErrNoSpace, ErrorKind(err))
+
+	_, err = alloc.Allocate("c3", address.NewRange(ip("10.9.0.0"), 4), returnFalse)
+	require.Equal(t, ErrOutOfRange, ErrorKind(err))
+	require.Equal(t, ErrAlreadyOwned, ErrorKind(alloc.Claim("c3", addr1, false)))
+	require.Equal(t, ErrNotOwned, ErrorKind(alloc.Free("c3", addr1)))
+	require.Equal(t, ErrNotOwned, ErrorKind(alloc.Delete("c3")))
+	_, err = alloc.Lookup("c3", subnet)
+	require.Equal(t, ErrNotOwned, ErrorKind(err))
+
+	alloc.Shutdown()
+	_, err = alloc.Allocate("c3", subnet, returnFalse)
+	require.Equal(t, ErrShuttingDown, ErrorKind(err))
+	require.Nil(t, ErrorKind(fmt.Errorf("some other error")))
+}
+
+type spanRecorder []*tracing.Span
+
+func (r *spanRecorder) Export(span *tracing.Span) {
+	*r = append(*r, span)
+}
+
+func TestTracing(t *testing.T) {
+	const peer = "02:00:00:02:00:00"
+	var spans spanRecorder
+	tracing.SetExporter(&spans)
+	defer tracing.SetExporter(nil)
+
+	alloc, subnet := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", "10.0.3.0/26", 1)
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	parent := tracing.Start("test", tracing.SpanContext{})
+
+	_, err := alloc.allocateTraced(parent.Context, "c1", "", subnet, returnFalse)
+	require.NoError(t, err)
+	require.Len(t, spans, 1)
+	require.Equal(t, "ipam.allocate", spans[0].Name)
+	require.Equal(t, parent.Context.TraceID, spans[0].Context.TraceID)
+	require.Equal(t, parent.Context.SpanID, spans[0].Parent)
+
+	// A space request from a peer which traces it is traced here too
+	r, trace, err := decodeSpaceRequest(encodeSpaceRequest(subnet, parent.Context.String()))
+	require.NoError(t, err)
+	require.Equal(t, subnet, r)
+	require.Equal(t, parent.Context, trace)
+	peerName, _ := mesh.PeerNameFromString(peer)
+	ExpectMessage(alloc, peer, msgRingUpdate, nil)
+	require.NoError(t, alloc.OnGossipUnicast(peerName, append([]byte{msgSpaceRequest}, encodeSpaceRequest(subnet, parent.Context.String())...)))
+	CheckAllExpectedMessagesSent(alloc)
+	require.Len(t, spans, 2)
+	require.Equal(t, "ipam.donate", spans[1].Name)
+	require.Equal(t, parent.Context.SpanID, spans[1].Parent)
+
+	// and one from a peer which doesn't is not
+	_, trace, err = decodeSpaceRequest(encodeRange(subnet))
+	require.NoError(t, err)
+	require.False(t, trace.IsValid())
+}
+
+func TestEncodeCached(t *testing.T) {
+	alloc, subnet, clk := makeAllocatorWithVirtualClock(t, "01:00:00:01:00:00", "10.0.1.0/22", 1, time.Unix(1000, 0))
+	defer alloc.Stop()
+	alloc.claimRingForTesting()
+	same := func(a, b []byte) bool { return &a[0] == &b[0] }
+
+	addr, err := alloc.Allocate("abcdef", subnet, returnFalse)
+	require.NoError(t, err)
+	msg := alloc.Encode()
+	require.True(t, same(msg, alloc.Encode()), "nothing has changed")
+
+	clk.Advance(time.Second)
+	msg2 := alloc.Encode()
+	require.False(t, same(msg, msg2), "time for a new timestamp")
+	require.True(t, same(msg2, alloc.Encode()), "nothing has changed")
+
+	require.NoError(t, alloc.Free("abcdef", addr))
+	require.False(t, same(msg2, alloc.Encode()), "the ring has changed")
+}
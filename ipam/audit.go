@@ -0,0 +1,172 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/ipam/ring"
+)
+
+// An audit asks every reachable peer for its copy of the ring, and
+// reports where the copies disagree (see ring.Compare), so that an
+// inconsistency can be looked into from one host rather than by
+// comparing the output of 'weave status ipam' on every one.
+
+// DefaultAuditTimeout is how long an audit waits for peers to answer
+const DefaultAuditTimeout = 5 * time.Second
+
+type audit struct {
+	id      uint64
+	waiting map[mesh.PeerName]struct{}
+	rings   map[mesh.PeerName]*ring.Ring
+	done    chan struct{} // closed once every peer has answered
+}
+
+type AuditReport struct {
+	Peers       []AuditPeer
+	Divergences []ring.Divergence
+}
+
+type AuditPeer struct {
+	Peer     string
+	Nickname string
+	Status   string // "answered", "no answer" or "unreachable"
+	Entries  int    `json:",omitempty"`
+}
+
+// Audit (Sync) collects the ring from every reachable peer, waiting
+// at most timeout for them to answer, and compares them with ours.
+func (alloc *Allocator) Audit(timeout time.Duration) *AuditReport {
+	auditChan := make(chan *audit)
+	alloc.actionChan <- func() {
+		auditChan <- alloc.startAudit()
+	}
+	a := <-auditChan
+
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+	}
+
+	reportChan := make(chan *AuditReport)
+	alloc.actionChan <- func() {
+		delete(alloc.audits, a.id)
+		reportChan <- alloc.auditReport(a)
+	}
+	return <-reportChan
+}
+
+// Actor client
+func (alloc *Allocator) startAudit() *audit {
+	alloc.nextAuditID++
+	a := &audit{
+		id:      alloc.nextAuditID,
+		waiting: make(map[mesh.PeerName]struct{}),
+		rings:   make(map[mesh.PeerName]*ring.Ring),
+		done:    make(chan struct{}),
+	}
+	for peer := range alloc.auditPeers() {
+		if peer != alloc.ourName && alloc.isKnownPeer(peer) {
+			a.waiting[peer] = struct{}{}
+		}
+	}
+	if len(a.waiting) == 0 {
+		close(a.done)
+		return a
+	}
+	alloc.audits[a.id] = a
+	msg := append([]byte{msgAuditRequest}, encodeAuditID(a.id)...)
+	for peer := range a.waiting {
+		alloc.gossip.GossipUnicast(peer, msg)
+	}
+	return a
+}
+
+// Actor client: every peer we have heard of, from the ring or gossip
+func (alloc *Allocator) auditPeers() map[mesh.PeerName]struct{} {
+	peers := alloc.ring.PeerNames()
+	for peer := range alloc.nicknames {
+		peers[peer] = struct{}{}
+	}
+	return peers
+}
+
+// Actor client: answer a peer's audit request with our ring
+func (alloc *Allocator) answerAudit(sender mesh.PeerName, id uint64) error {
+	msg, err := bufpool.GobEncode(id, alloc.ring)
+	if err != nil {
+		return err
+	}
+	return alloc.gossip.GossipUnicast(sender, append([]byte{msgAuditReply}, msg...))
+}
+
+// Actor client: record a peer's ring, for an audit still in progress
+func (alloc *Allocator) auditAnswered(sender mesh.PeerName, msg []byte) error {
+	decoder := gob.NewDecoder(bytes.NewReader(msg))
+	var id uint64
+	if err := decoder.Decode(&id); err != nil {
+		return err
+	}
+	var r ring.Ring
+	if err := decoder.Decode(&r); err != nil {
+		return err
+	}
+	a, found := alloc.audits[id]
+	if !found {
+		return nil // too late
+	}
+	if _, waiting := a.waiting[sender]; !waiting {
+		return nil
+	}
+	delete(a.waiting, sender)
+	a.rings[sender] = &r
+	if len(a.waiting) == 0 {
+		close(a.done)
+	}
+	return nil
+}
+
+// Actor client
+func (alloc *Allocator) auditReport(a *audit) *AuditReport {
+	a.rings[alloc.ourName] = alloc.ring
+	report := &AuditReport{Divergences: ring.Compare(a.rings)}
+	for peer := range alloc.auditPeers() {
+		status := AuditPeer{Peer: peer.String(), Nickname: alloc.nickname(peer)}
+		r, answered := a.rings[peer]
+		switch {
+		case answered:
+			status.Status, status.Entries = "answered", len(r.Entries)
+		case alloc.isKnownPeer(peer):
+			status.Status = "no answer"
+		default:
+			status.Status = "unreachable"
+		}
+		report.Peers = append(report.Peers, status)
+	}
+	sort.Sort(auditPeersByName(report.Peers))
+	return report
+}
+
+func encodeAuditID(id uint64) []byte {
+	msg, err := bufpool.GobEncode(id)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func decodeAuditID(msg []byte) (id uint64, err error) {
+	decoder := gob.NewDecoder(bytes.NewReader(msg))
+	return id, decoder.Decode(&id)
+}
+
+type auditPeersByName []AuditPeer
+
+func (s auditPeersByName) Len() int           { return len(s) }
+func (s auditPeersByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s auditPeersByName) Less(i, j int) bool { return s[i].Peer < s[j].Peer }
@@ -0,0 +1,29 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/ipam/paxos"
+)
+
+// While agreeing the ring, we propose again if there is no consensus
+// after a while, backing off exponentially in case we are duelling
+// with another proposer. Proposals are made on ticks, so delays are
+// rounded up to a whole number of ticks.
+const (
+	minProposalInterval        = tickInterval
+	DefaultMaxProposalInterval = time.Minute
+)
+
+// SetProposalBackoff replaces the default exponential backoff between
+// proposals. It must be called before Start.
+func (alloc *Allocator) SetProposalBackoff(backoff paxos.Backoff) {
+	alloc.proposalBackoff = backoff
+}
+
+// SetMaxProposalInterval keeps the default exponential backoff, but
+// caps it at max instead of DefaultMaxProposalInterval. It must be
+// called before Start.
+func (alloc *Allocator) SetMaxProposalInterval(max time.Duration) {
+	alloc.SetProposalBackoff(paxos.NewExponentialBackoff(minProposalInterval, max, alloc.ourName))
+}
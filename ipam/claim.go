@@ -1,8 +1,6 @@
 package ipam
 
 import (
-	"fmt"
-
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
@@ -32,6 +30,15 @@ func (c *claim) sendResult(result error) {
 
 // Try returns true for success (or failure), false if we need to try again later
 func (c *claim) Try(alloc *Allocator) bool {
+	if alloc.quarantined != "" {
+		c.sendResult(alloc.quarantineError())
+		return true
+	}
+	if alloc.readOnly && !alloc.owns(c.ident, c.addr) {
+		c.sendResult(alloc.readOnlyError())
+		return true
+	}
+
 	if !alloc.ring.Contains(c.addr) {
 		// Address not within our universe; assume user knows what they are doing
 		alloc.infof("Ignored address %s claimed by %s - not in our universe", c.addr, c.ident)
@@ -53,12 +60,12 @@ func (c *claim) Try(alloc *Allocator) bool {
 			alloc.infof("Claim %s for %s: address allocator still initializing; will try later.", c.addr, c.ident)
 			c.sendResult(nil)
 		} else {
-			c.sendResult(fmt.Errorf("%s is in the range %s, but the allocator is not initialized yet", c.addr, alloc.universe.AsCIDRString()))
+			c.sendResult(newError(ErrNotReady, "%s is in the range %s, but the allocator is not initialized yet", c.addr, alloc.universeString()))
 		}
 		return false
 	default:
 		alloc.debugf("requesting address %s from other peer %s", c.addr, owner)
-		err := alloc.sendSpaceRequest(owner, address.NewRange(c.addr, 1))
+		err := alloc.sendSpaceRequest(owner, address.NewRange(c.addr, 1), "")
 		if err != nil { // can't speak to owner right now
 			if c.noErrorOnUnknown {
 				alloc.infof("Claim %s for %s: %s; will try later.", c.addr, c.ident, err)
@@ -73,12 +80,14 @@ func (c *claim) Try(alloc *Allocator) bool {
 	// We are the owner, check we haven't given it to another container
 	switch existingIdent := alloc.findOwner(c.addr); existingIdent {
 	case "":
+		alloc.releaseExclusion(c.addr)
+		alloc.releaseHeldAddress(c.addr)
 		if err := alloc.space.Claim(c.addr); err == nil {
 			alloc.debugln("Claimed", c.addr, "for", c.ident)
 			alloc.addOwned(c.ident, c.addr)
 			c.sendResult(nil)
 		} else {
-			c.sendResult(err)
+			c.sendResult(newError(ErrAlreadyOwned, "%s", err))
 		}
 	case c.ident:
 		// same identifier is claiming same address; that's OK
@@ -86,23 +95,27 @@ func (c *claim) Try(alloc *Allocator) bool {
 		c.sendResult(nil)
 	default:
 		// Addr already owned by container on this machine
-		c.sendResult(fmt.Errorf("address %s is already owned by %s", c.addr.String(), existingIdent))
+		c.sendResult(newError(ErrAlreadyOwned, "address %s is already owned by %s", c.addr.String(), existingIdent))
 	}
 	return true
 }
 
 func (c *claim) deniedBy(alloc *Allocator, owner mesh.PeerName) {
-	name, found := alloc.nicknames[owner]
-	if found {
+	name := alloc.nickname(owner)
+	if name != "" {
 		name = " (" + name + ")"
 	}
-	c.sendResult(fmt.Errorf("address %s is owned by other peer %s%s", c.addr.String(), owner, name))
+	c.sendResult(newError(ErrAlreadyOwned, "address %s is owned by other peer %s%s", c.addr.String(), owner, name))
 }
 
 func (c *claim) Cancel() {
 	c.sendResult(&errorCancelled{"Claim", c.ident})
 }
 
+func (c *claim) Fail(err error) {
+	c.sendResult(err)
+}
+
 func (c *claim) ForContainer(ident string) bool {
 	return c.ident == ident
 }
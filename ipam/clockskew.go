@@ -0,0 +1,73 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Gossip carries the sender's clock, to the second. Updates from a
+// peer whose clock is more than maxClockSkew from ours are ignored,
+// so we keep the skew last measured for each peer and warn once it
+// gets within sight of that.
+//
+// Mesh re-encodes broadcasts at each hop, so for a peer we are not
+// connected to directly, the skew measured is that of the last peer to
+// relay its gossip to us.
+const (
+	maxClockSkew     = time.Hour
+	clockSkewWarning = maxClockSkew / 2
+)
+
+type ClockSkewStatus struct {
+	Peer     string
+	Nickname string
+	Skew     time.Duration // positive if the peer's clock is ahead
+	Warning  string        `json:",omitempty"`
+}
+
+// Actor client
+func (alloc *Allocator) recordClockSkew(sender mesh.PeerName, skew time.Duration) {
+	if sender == mesh.UnknownPeerName {
+		return
+	}
+	previous, found := alloc.clockSkew[sender]
+	peer := alloc.annotatePeernames([]mesh.PeerName{sender})[0]
+	switch {
+	case abs(skew) >= clockSkewWarning && (!found || abs(previous) < clockSkewWarning):
+		alloc.warnf("Clock of peer %s is %v out from ours; its updates will be ignored beyond %v", peer, skew, maxClockSkew)
+	case abs(skew) < clockSkewWarning && found && abs(previous) >= clockSkewWarning:
+		alloc.infof("Clock of peer %s is back within %v of ours", peer, clockSkewWarning)
+	}
+	alloc.clockSkew[sender] = skew
+}
+
+// Actor client
+func (alloc *Allocator) clockSkewStatus() []ClockSkewStatus {
+	var result []ClockSkewStatus
+	for peer, skew := range alloc.clockSkew {
+		status := ClockSkewStatus{Peer: peer.String(), Nickname: alloc.nickname(peer), Skew: skew}
+		if abs(skew) >= clockSkewWarning {
+			status.Warning = fmt.Sprintf("clock of %s is %v out; updates are ignored beyond %v",
+				alloc.annotatePeernames([]mesh.PeerName{peer})[0], skew, maxClockSkew)
+		}
+		result = append(result, status)
+	}
+	sort.Sort(clockSkewsByPeer(result))
+	return result
+}
+
+type clockSkewsByPeer []ClockSkewStatus
+
+func (s clockSkewsByPeer) Len() int           { return len(s) }
+func (s clockSkewsByPeer) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s clockSkewsByPeer) Less(i, j int) bool { return s[i].Peer < s[j].Peer }
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,45 @@
+package ipam
+
+import (
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/ipam/ring"
+)
+
+// Our state, ring and all, is encoded for each of our periodic
+// broadcasts and again each time a peer relays gossip through us,
+// though it seldom changes in between. Encoding a big ring takes a
+// while, so we keep the last encoding until the ring, or the rest of
+// our state, changes. It carries the time, to the second, for peers
+// to detect clock skew, so it is only kept for that second.
+
+type encodingKey struct {
+	ring         *ring.Ring
+	ringVersion  uint64
+	stateVersion uint64
+	now          int64
+}
+
+type encodedState struct {
+	key encodingKey
+	msg []byte
+}
+
+// Actor client
+func (alloc *Allocator) encodeRing() []byte {
+	key := encodingKey{alloc.ring, alloc.ring.Version(), alloc.stateVersion, alloc.clock.Now().Unix()}
+	if alloc.encoded.msg == nil || alloc.encoded.key != key {
+		data := gossipState{
+			Now:          key.now,
+			Nicknames:    alloc.nicknames,
+			Incarnations: alloc.incarnations,
+			Exclusions:   alloc.exclusions,
+			Ring:         alloc.ring,
+		}
+		msg, err := bufpool.GobEncode(data)
+		if err != nil {
+			panic(err)
+		}
+		alloc.encoded = encodedState{key, msg}
+	}
+	return alloc.encoded.msg
+}
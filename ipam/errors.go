@@ -0,0 +1,57 @@
+package ipam
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of failure a client of the allocator may want to act on,
+// e.g. to choose an HTTP status code. They come wrapped in an *Error
+// carrying the details of the request; use ErrorKind to get them back.
+var (
+	// The container has no such address
+	ErrNotOwned = errors.New("address not owned by container")
+	// The address is already in use, by another container or peer
+	ErrAlreadyOwned = errors.New("address already owned")
+	// The request falls outside the allocation range
+	ErrOutOfRange = errors.New("outside the allocation range")
+	// The allocator stopped before the request could be served
+	ErrShuttingDown = errors.New("allocator shutting down")
+	// Every address the request could be given is in use
+	ErrNoSpace = errors.New("no free addresses")
+	// The allocator cannot serve the request yet, or has stopped
+	// allocating after an internal inconsistency
+	ErrNotReady = errors.New("allocator not ready")
+	// The container whose address is to be released is still running
+	ErrInUse = errors.New("address still in use")
+)
+
+type Error struct {
+	Kind error // one of the Err values above
+	msg  string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+func newError(kind error, format string, args ...interface{}) error {
+	return &Error{kind, fmt.Sprintf(format, args...)}
+}
+
+// prefixError adds to the start of err's message, keeping its kind
+func prefixError(prefix string, err error) error {
+	if e, ok := err.(*Error); ok {
+		return &Error{e.Kind, prefix + e.msg}
+	}
+	return fmt.Errorf("%s%s", prefix, err)
+}
+
+// ErrorKind returns which of the Err values above err is, or nil if it
+// is not one of them.
+func ErrorKind(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return nil
+}
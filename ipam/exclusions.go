@@ -0,0 +1,185 @@
+package ipam
+
+import (
+	"sort"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Addresses within the allocation range can already be in use by the
+// hosts running peers, e.g. a bridge address set by hand. Each peer
+// is told which are on its own host and gossips them, and every peer
+// keeps clear of them all by claiming any which fall in its space. An
+// explicit claim by a container takes precedence, so that e.g. weave
+// expose can reclaim the bridge address after a restart.
+//
+// The network and broadcast addresses of the range and of the default
+// subnet are listed too, although they are never handed out anyway,
+// since allocation is always within a subnet's host range.
+
+type hostExclusions struct {
+	UID     mesh.PeerUID // of the incarnation which set them; see incarnations.go
+	Started int64        // when that incarnation started, in Unix time
+	Version uint64       // counts the changes made by that incarnation
+	Reasons map[address.Address]string
+}
+
+// The exclusions of a later incarnation of a peer replace those of an
+// earlier one, as with incarnations themselves; within an incarnation
+// the higher version wins. The UIDs break a tie.
+func (e hostExclusions) newerThan(other hostExclusions) bool {
+	switch {
+	case e.UID == other.UID:
+		return e.Version > other.Version
+	case e.Started != other.Started:
+		return e.Started > other.Started
+	}
+	return e.UID > other.UID
+}
+
+func sameReasons(a, b map[address.Address]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for addr, reason := range a {
+		if other, found := b[addr]; !found || other != reason {
+			return false
+		}
+	}
+	return true
+}
+
+type Exclusion struct {
+	Address  string
+	Reason   string
+	Peer     string `json:",omitempty"` // blank if every peer excludes it
+	Nickname string `json:",omitempty"`
+}
+
+// SetHostExclusions (Async) replaces the addresses on this peer's
+// host which are not to be handed out, with the reason for each.
+// Those outside the allocation range are ignored. Nothing is gossiped
+// if they are the same as last time.
+func (alloc *Allocator) SetHostExclusions(reasons map[address.Address]string) {
+	alloc.actionChan <- func() {
+		inRange := make(map[address.Address]string)
+		for addr, reason := range reasons {
+			if alloc.ring.Contains(addr) {
+				inRange[addr] = reason
+			}
+		}
+		ours, found := alloc.exclusions[alloc.ourName]
+		if found && sameReasons(ours.Reasons, inRange) {
+			return
+		}
+		incarnation := alloc.incarnations[alloc.ourName]
+		alloc.exclusions[alloc.ourName] = hostExclusions{incarnation.UID, incarnation.Started, ours.Version + 1, inRange}
+		alloc.stateVersion++
+		alloc.applyExclusions()
+	}
+}
+
+// Actor client: merge exclusions heard in gossip
+func (alloc *Allocator) mergeExclusions(incoming map[mesh.PeerName]hostExclusions) {
+	changed := false
+	for peer, exclusions := range incoming {
+		if known, found := alloc.exclusions[peer]; peer != alloc.ourName && (!found || exclusions.newerThan(known)) {
+			alloc.exclusions[peer] = exclusions
+			changed = true
+		}
+	}
+	if changed {
+		alloc.stateVersion++
+		alloc.applyExclusions()
+	}
+}
+
+// Actor client: forget the exclusions of peers which have gone
+func (alloc *Allocator) removeExclusions(peer mesh.PeerName) {
+	if _, found := alloc.exclusions[peer]; found {
+		delete(alloc.exclusions, peer)
+		alloc.stateVersion++
+		alloc.applyExclusions()
+	}
+}
+
+// Actor client: claim any excluded addresses which are free in our
+// space, and give back any we claimed which are no longer excluded.
+// Called whenever the exclusions or our space change.
+func (alloc *Allocator) applyExclusions() {
+	excluded := make(map[address.Address]struct{})
+	for _, exclusions := range alloc.exclusions {
+		for addr := range exclusions.Reasons {
+			excluded[addr] = struct{}{}
+		}
+	}
+	for addr := range alloc.excludedClaims {
+		if _, found := excluded[addr]; !found {
+			alloc.space.Free(addr)
+			delete(alloc.excludedClaims, addr)
+		}
+	}
+	for addr := range excluded {
+		if _, found := alloc.excludedClaims[addr]; !found && alloc.space.Claim(addr) == nil {
+			alloc.debugln("Excluded", addr, "from allocation")
+			alloc.excludedClaims[addr] = struct{}{}
+		}
+	}
+}
+
+// Actor client: let a container claim an address we are keeping clear
+func (alloc *Allocator) releaseExclusion(addr address.Address) {
+	if _, found := alloc.excludedClaims[addr]; found {
+		alloc.space.Free(addr)
+		delete(alloc.excludedClaims, addr)
+	}
+}
+
+// Actor client
+func (alloc *Allocator) hostExclusionStatus() []Exclusion {
+	var result []Exclusion
+	for peer, exclusions := range alloc.exclusions {
+		for addr, reason := range exclusions.Reasons {
+			result = append(result, Exclusion{addr.String(), reason, peer.String(), alloc.nickname(peer)})
+		}
+	}
+	return result
+}
+
+// The exclusions which every peer makes, followed by those of each host
+func exclusionStatus(ranges []address.Range, defaultSubnet address.CIDR, hosts []Exclusion) []Exclusion {
+	var result []Exclusion
+	seen := make(map[address.Address]bool)
+	add := func(addr address.Address, reason string) {
+		if !seen[addr] {
+			seen[addr] = true
+			result = append(result, Exclusion{Address: addr.String(), Reason: reason})
+		}
+	}
+	ranges = append([]address.Range(nil), ranges...)
+	if defaultSubnet != (address.CIDR{}) {
+		ranges = append(ranges, defaultSubnet.Range())
+	}
+	for _, r := range ranges {
+		if r.Size() > 2 {
+			add(r.Start, "network address of "+r.AsCIDRString())
+			add(r.End-1, "broadcast address of "+r.AsCIDRString())
+		}
+	}
+	sort.Sort(exclusionsByAddress(result))
+	hosts = append([]Exclusion(nil), hosts...)
+	sort.Sort(exclusionsByAddress(hosts))
+	return append(result, hosts...)
+}
+
+type exclusionsByAddress []Exclusion
+
+func (s exclusionsByAddress) Len() int      { return len(s) }
+func (s exclusionsByAddress) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s exclusionsByAddress) Less(i, j int) bool {
+	a, _ := address.ParseIP(s[i].Address)
+	b, _ := address.ParseIP(s[j].Address)
+	return a < b || (a == b && s[i].Peer < s[j].Peer)
+}
@@ -0,0 +1,127 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A host can be replaced without waiting for the rest of the network
+// to give up on the old one: export the old peer's IPAM state, start
+// the new host with the old peer's name, and import the state there
+// before anything is allocated. The new host then owns the old one's
+// ranges, and the addresses of any containers moved with it. The
+// ring is carried as in gossip, so that it comes back exactly; the
+// rest is readable, so that it can be checked before importing.
+
+// ExportedState is the IPAM state of one peer.
+type ExportedState struct {
+	Peer     string
+	Nickname string
+	Exported time.Time
+	Ring     []byte              // gob-encoded
+	Owned    map[string][]string // addresses, by container ID
+}
+
+// Export (Sync) returns our state, for Import on a replacement host.
+func (alloc *Allocator) Export() (*ExportedState, error) {
+	resultChan := make(chan *ExportedState)
+	errChan := make(chan error)
+	alloc.actionChan <- func() {
+		ringBytes, err := bufpool.GobEncode(alloc.ring)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		state := &ExportedState{
+			Peer:     alloc.ourName.String(),
+			Nickname: alloc.nickname(alloc.ourName),
+			Exported: alloc.clock.Now().UTC(),
+			Ring:     ringBytes,
+			Owned:    make(map[string][]string, len(alloc.owned)),
+		}
+		for ident, addrs := range alloc.owned {
+			for _, addr := range addrs {
+				state.Owned[ident] = append(state.Owned[ident], addr.String())
+			}
+		}
+		resultChan <- state
+	}
+	select {
+	case state := <-resultChan:
+		return state, nil
+	case err := <-errChan:
+		return nil, err
+	}
+}
+
+// Import (Sync) takes on the state exported by a peer of the same
+// name. It is refused once we have allocated anything ourselves, and
+// if the exported ring cannot be merged with ours, e.g. because our
+// own entries in it have moved on since the export.
+func (alloc *Allocator) Import(state *ExportedState) error {
+	peer, err := mesh.PeerNameFromString(state.Peer)
+	if err != nil {
+		return err
+	}
+	var r ring.Ring
+	if err := gob.NewDecoder(bytes.NewReader(state.Ring)).Decode(&r); err != nil {
+		return err
+	}
+	owned := make(map[string][]address.Address, len(state.Owned))
+	for ident, addrStrs := range state.Owned {
+		for _, addrStr := range addrStrs {
+			addr, err := address.ParseIP(addrStr)
+			if err != nil {
+				return err
+			}
+			owned[ident] = append(owned[ident], addr)
+		}
+	}
+
+	errChan := make(chan error)
+	alloc.actionChan <- func() {
+		errChan <- alloc.importState(peer, &r, owned)
+	}
+	return <-errChan
+}
+
+// Actor client
+func (alloc *Allocator) importState(peer mesh.PeerName, r *ring.Ring, owned map[string][]address.Address) error {
+	if peer != alloc.ourName {
+		return fmt.Errorf("state is of peer %s, but we are %s", peer, alloc.ourName)
+	}
+	if len(alloc.owned) > 0 {
+		return newError(ErrAlreadyOwned, "cannot import state once addresses have been allocated here")
+	}
+	if alloc.quarantined != "" {
+		return alloc.quarantineError()
+	}
+	if err := alloc.ring.Merge(*r); err != nil {
+		return fmt.Errorf("cannot merge imported ring: %s", err)
+	}
+	alloc.ringUpdated()
+	for ident, addrs := range owned {
+		for _, addr := range addrs {
+			if alloc.ring.Owner(addr) != alloc.ourName {
+				alloc.warnf("Not importing %s for %s: no longer in our ranges", addr, ident)
+				continue
+			}
+			if err := alloc.space.Claim(addr); err != nil {
+				alloc.warnf("Not importing %s for %s: %s", addr, ident, err)
+				continue
+			}
+			alloc.addOwned(ident, addr)
+		}
+	}
+	alloc.infof("Imported state exported by %s", peer)
+	alloc.gossip.GossipBroadcast(alloc.fullGossip())
+	return nil
+}
@@ -0,0 +1,232 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Some organisations keep the authoritative record of which address
+// is used by what in an IPAM system of their own, e.g. Infoblox or
+// NetBox. ExternalSync mirrors weave's allocations into one, as a
+// Registrar, so it never holds up the allocator: changes are queued
+// and sent in order from a goroutine of its own, and retried, backing
+// off, while the external system is unreachable. An address which the
+// external system has recorded for something else is a conflict; it
+// is reported rather than retried, since only a person can resolve it.
+
+// ExternalIPAM is an external record of addresses.
+type ExternalIPAM interface {
+	// Record records addr as used by ident. It returns a
+	// *ConflictError if addr is recorded for something else.
+	Record(ident string, addr address.Address, metadata map[string]string) error
+	// Remove removes the record of addr being used by ident.
+	Remove(ident string, addr address.Address) error
+}
+
+// ConflictError is returned by an ExternalIPAM which has recorded an
+// address for someone other than the ident given.
+type ConflictError struct {
+	Addr   address.Address
+	Holder string // as the external system describes it
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("%s is recorded for %s", err.Addr, err.Holder)
+}
+
+// ExternalConflict is a change which could not be mirrored.
+type ExternalConflict struct {
+	RegistrationEvent
+	Holder string
+	Time   time.Time
+}
+
+const maxExternalConflicts = 100 // the most recent are kept
+
+// ExternalSync is a Registrar which mirrors allocations into an
+// ExternalIPAM.
+type ExternalSync struct {
+	sync.Mutex
+	external    ExternalIPAM
+	pending     []RegistrationEvent
+	conflicts   []ExternalConflict
+	minInterval time.Duration // between retries, doubling up to maxInterval
+	maxInterval time.Duration
+	wake        chan struct{}
+	stop        chan struct{}
+}
+
+func NewExternalSync(external ExternalIPAM, minInterval, maxInterval time.Duration) *ExternalSync {
+	es := &ExternalSync{
+		external:    external,
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	go es.loop()
+	return es
+}
+
+func (es *ExternalSync) Register(ident string, addr address.Address, metadata map[string]string) {
+	es.add(RegistrationEvent{true, ident, addr, metadata})
+}
+
+func (es *ExternalSync) Deregister(ident string, addr address.Address, metadata map[string]string) {
+	es.add(RegistrationEvent{false, ident, addr, metadata})
+}
+
+// Stop stops mirroring; changes not yet sent are dropped.
+func (es *ExternalSync) Stop() {
+	close(es.stop)
+}
+
+// Pending returns the number of changes not yet sent.
+func (es *ExternalSync) Pending() int {
+	es.Lock()
+	defer es.Unlock()
+	return len(es.pending)
+}
+
+// Conflicts returns the most recent changes which conflicted with the
+// external record, oldest first.
+func (es *ExternalSync) Conflicts() []ExternalConflict {
+	es.Lock()
+	defer es.Unlock()
+	return append([]ExternalConflict(nil), es.conflicts...)
+}
+
+func (es *ExternalSync) add(event RegistrationEvent) {
+	es.Lock()
+	es.pending = append(es.pending, event)
+	es.Unlock()
+	select {
+	case es.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+func (es *ExternalSync) loop() {
+	interval := es.minInterval
+	for {
+		select {
+		case <-es.wake:
+		case <-es.stop:
+			return
+		}
+		for {
+			es.Lock()
+			if len(es.pending) == 0 {
+				es.Unlock()
+				break
+			}
+			event := es.pending[0]
+			es.Unlock()
+
+			if err := es.send(event); err != nil {
+				// Retry the same change, so they stay in order
+				common.Log.Warnf("[external IPAM] %s; retrying in %s", err, interval)
+				select {
+				case <-time.After(interval):
+				case <-es.stop:
+					return
+				}
+				if interval *= 2; interval > es.maxInterval {
+					interval = es.maxInterval
+				}
+				continue
+			}
+			interval = es.minInterval
+			es.Lock()
+			es.pending = es.pending[1:]
+			es.Unlock()
+		}
+	}
+}
+
+// Sends event, returning an error if it is to be retried
+func (es *ExternalSync) send(event RegistrationEvent) error {
+	var err error
+	if event.Registered {
+		err = es.external.Record(event.Ident, event.Addr, event.Metadata)
+	} else {
+		err = es.external.Remove(event.Ident, event.Addr)
+	}
+	conflict, ok := err.(*ConflictError)
+	if !ok {
+		return err
+	}
+	common.Log.Errorf("[external IPAM] Conflict for %s: %s", event.Ident, conflict)
+	es.Lock()
+	es.conflicts = append(es.conflicts, ExternalConflict{event, conflict.Holder, time.Now()})
+	if len(es.conflicts) > maxExternalConflicts {
+		es.conflicts = es.conflicts[len(es.conflicts)-maxExternalConflicts:]
+	}
+	es.Unlock()
+	return nil
+}
+
+// HTTPExternalIPAM is an ExternalIPAM reached over HTTP, with one
+// resource per address under a base URL: PUT records it, with a JSON
+// body giving the ident and metadata, and DELETE?ident= removes it. A
+// 409 response is a conflict, its body describing the holder.
+type HTTPExternalIPAM struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPExternalIPAM(baseURL string) *HTTPExternalIPAM {
+	return &HTTPExternalIPAM{URL: strings.TrimSuffix(baseURL, "/"), Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *HTTPExternalIPAM) Record(ident string, addr address.Address, metadata map[string]string) error {
+	body, err := json.Marshal(struct {
+		Ident    string            `json:"ident"`
+		Metadata map[string]string `json:"metadata,omitempty"`
+	}{ident, metadata})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", h.URL+"/"+addr.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return h.do(req, addr, false)
+}
+
+func (h *HTTPExternalIPAM) Remove(ident string, addr address.Address) error {
+	req, err := http.NewRequest("DELETE", h.URL+"/"+addr.String()+"?ident="+url.QueryEscape(ident), nil)
+	if err != nil {
+		return err
+	}
+	return h.do(req, addr, true)
+}
+
+func (h *HTTPExternalIPAM) do(req *http.Request, addr address.Address, notFoundOK bool) error {
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound && notFoundOK:
+		return nil
+	case resp.StatusCode == http.StatusConflict:
+		return &ConflictError{Addr: addr, Holder: strings.TrimSpace(string(body))}
+	}
+	return fmt.Errorf("%s %s: %s %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(body)))
+}
@@ -0,0 +1,73 @@
+package ipam
+
+import (
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Hooks let site-specific policy, e.g. naming conventions, audit
+// logging or keeping an external IPAM in step, be applied around
+// allocation without changing the allocator. Unlike a Registrar, hooks
+// are called from the goroutine of the request rather than the actor,
+// so they may block, holding up only that request, and the Pre hooks
+// may refuse it by returning an error. They are not called when an
+// address is freed because its container has gone.
+type Hooks interface {
+	// PreAllocate is called before ident is allocated an address in r.
+	PreAllocate(ident string, r address.Range) error
+	// PostAllocate is called once ident has been allocated addr.
+	PostAllocate(ident string, addr address.Address)
+	// PreFree is called before addr is freed for ident, by Free or
+	// Delete.
+	PreFree(ident string, addr address.Address) error
+}
+
+// NoHooks does nothing; embed it to implement only some of Hooks.
+type NoHooks struct{}
+
+func (NoHooks) PreAllocate(string, address.Range) error { return nil }
+func (NoHooks) PostAllocate(string, address.Address)    {}
+func (NoHooks) PreFree(string, address.Address) error   { return nil }
+
+// AddHooks adds hooks after any added already: Pre hooks are called
+// in the order they were added, stopping at the first to return an
+// error, and Post hooks in the reverse order. Must be called before
+// Start.
+func (alloc *Allocator) AddHooks(hooks Hooks) {
+	alloc.hooks = append(alloc.hooks, hooks)
+}
+
+func (alloc *Allocator) preAllocate(ident string, r address.Range) error {
+	for _, hooks := range alloc.hooks {
+		if err := hooks.PreAllocate(ident, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (alloc *Allocator) postAllocate(ident string, addr address.Address) {
+	for i := len(alloc.hooks) - 1; i >= 0; i-- {
+		alloc.hooks[i].PostAllocate(ident, addr)
+	}
+}
+
+func (alloc *Allocator) preFree(ident string, addrs ...address.Address) error {
+	for _, hooks := range alloc.hooks {
+		for _, addr := range addrs {
+			if err := hooks.PreFree(ident, addr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Sync - the addresses owned by ident, for the hooks to hear about
+// before Delete frees them
+func (alloc *Allocator) ownedBy(ident string) []address.Address {
+	resultChan := make(chan []address.Address)
+	alloc.actionChan <- func() {
+		resultChan <- append([]address.Address(nil), alloc.owned[ident]...)
+	}
+	return <-resultChan
+}
@@ -1,37 +1,116 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/common/tracing"
 	"github.com/weaveworks/weave/net/address"
 )
 
-func badRequest(w http.ResponseWriter, err error) {
-	http.Error(w, err.Error(), http.StatusBadRequest)
+// Problem is the body of an error response for clients which accept
+// JSON, as described in RFC 7807. Type is the name of the kind of
+// error, e.g. "not-owned", or "about:blank" for errors which aren't
+// one of the allocator's Err values.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+}
+
+var httpErrors = map[error]struct {
+	status int
+	name   string
+}{
+	ErrNotOwned:     {http.StatusNotFound, "not-owned"},
+	ErrAlreadyOwned: {http.StatusConflict, "already-owned"},
+	ErrOutOfRange:   {http.StatusBadRequest, "out-of-range"},
+	ErrShuttingDown: {http.StatusServiceUnavailable, "shutting-down"},
+	ErrNoSpace:      {http.StatusServiceUnavailable, "no-space"},
+	ErrNotReady:     {http.StatusServiceUnavailable, "not-ready"},
+	ErrInUse:        {http.StatusConflict, "in-use"},
+}
+
+// httpError replies with the status code for the kind of err, or 400
+// if it has none, as problem+json if the client accepts JSON or as
+// text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, err error) {
 	common.Log.Warningln("[allocator]:", err.Error())
+	problem := Problem{"about:blank", http.StatusText(http.StatusBadRequest), http.StatusBadRequest, err.Error()}
+	if kind := ErrorKind(err); kind != nil {
+		problem.Type, problem.Title, problem.Status = httpErrors[kind].name, kind.Error(), httpErrors[kind].status
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "json") {
+		http.Error(w, problem.Detail, problem.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
 }
 
-func parseCIDR(w http.ResponseWriter, cidrStr string) (address.CIDR, bool) {
+func parseCIDR(w http.ResponseWriter, r *http.Request, cidrStr string) (address.CIDR, bool) {
 	subnetAddr, cidr, err := address.ParseCIDR(cidrStr)
 	if err != nil {
-		badRequest(w, err)
+		httpError(w, r, err)
 		return address.CIDR{}, false
 	}
 	if cidr.Start != subnetAddr {
-		badRequest(w, fmt.Errorf("Invalid subnet %s - bits after network prefix are not all zero", cidrStr))
+		httpError(w, r, fmt.Errorf("Invalid subnet %s - bits after network prefix are not all zero", cidrStr))
 		return address.CIDR{}, false
 	}
 	return cidr, true
 }
 
-func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, ident string, checkAlive bool, subnet address.CIDR) {
+// AllocationInfo is what an allocation request returns when asked for
+// JSON, so that callers configuring an interface have everything they
+// need. Gateway is the host's address on the subnet, given to it by
+// "weave expose", and is empty if the host is not exposed.
+type AllocationInfo struct {
+	Address   string // in CIDR notation
+	Gateway   string `json:",omitempty"`
+	Broadcast string
+}
+
+// The ident under which "weave expose" allocates the host's addresses
+const exposeIdent = "weave:expose"
+
+func (alloc *Allocator) allocationInfo(addr address.Address, subnet address.CIDR) AllocationInfo {
+	info := AllocationInfo{
+		Address:   fmt.Sprintf("%s/%d", addr, subnet.PrefixLen),
+		Broadcast: subnet.Broadcast().String(),
+	}
+	if gateway, err := alloc.Lookup(exposeIdent, subnet.HostRange()); err == nil {
+		info.Gateway = gateway.String()
+	}
+	return info
+}
+
+func wantsJSON(r *http.Request) bool {
+	return r.Header.Get("Accept") == "application/json"
+}
+
+func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.ResponseWriter, r *http.Request, ident string, key string, checkAlive bool, asJSON bool, subnet address.CIDR) {
+	var setupTimeout time.Duration
+	if timeoutStr := r.FormValue("setup-timeout"); timeoutStr != "" {
+		var err error
+		if setupTimeout, err = time.ParseDuration(timeoutStr); err != nil {
+			httpError(w, r, fmt.Errorf("invalid setup-timeout: %s", err))
+			return
+		}
+	}
+	span := tracing.Start("ipam.http.allocate", tracing.FromHeader(r.Header))
+	span.SetAttribute("http.path", r.URL.Path)
 	closedChan := w.(http.CloseNotifier).CloseNotify()
-	addr, err := alloc.Allocate(ident, subnet.HostRange(),
+	addr, err := alloc.allocateTraced(span.Context, ident, key, subnet.HostRange(),
 		func() bool {
 			select {
 			case <-closedChan:
@@ -42,21 +121,113 @@ func (alloc *Allocator) handleHTTPAllocate(dockerCli *docker.Client, w http.Resp
 				return res
 			}
 		})
+	span.Finish(err)
 	if err != nil {
 		if _, ok := err.(*errorCancelled); ok { // cancellation is not really an error
 			common.Log.Infoln("[allocator]:", err.Error())
 			fmt.Fprint(w, "cancelled")
 			return
 		}
-		badRequest(w, err)
+		httpError(w, r, err)
 		return
 	}
+	if setupTimeout > 0 {
+		if err := alloc.AwaitSetup(ident, addr, setupTimeout); err != nil {
+			httpError(w, r, err)
+			return
+		}
+	}
 
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(alloc.allocationInfo(addr, subnet))
+		return
+	}
 	fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
 }
 
 // HandleHTTP wires up ipams HTTP endpoints to the provided mux.
 func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CIDR, dockerCli *docker.Client) {
+	router.Methods("GET").Path("/readiness").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := alloc.Readiness()
+		if readiness != Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, readiness)
+	})
+
+	router.Methods("GET").Path("/ring/stats").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(alloc.RingStats())
+	})
+
+	router.Methods("GET").Path("/ipam/audit").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := DefaultAuditTimeout
+		if timeoutStr := r.FormValue("timeout"); timeoutStr != "" {
+			var err error
+			if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+				http.Error(w, fmt.Sprint("invalid timeout: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(alloc.Audit(timeout))
+	})
+
+	router.Methods("GET").Path("/ipam/state").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, err := alloc.Export()
+		if err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+
+	router.Methods("POST").Path("/ipam/state").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var state ExportedState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		if err := alloc.Import(&state); err != nil {
+			httpError(w, r, err)
+			return
+		}
+		w.WriteHeader(204)
+	})
+
+	// Allocates, claims and frees an address, in subnet if given,
+	// reporting how each step went
+	router.Methods("POST").Path("/ipam/selftest").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subnet := defaultSubnet
+		if subnetStr := r.FormValue("subnet"); subnetStr != "" {
+			var ok bool
+			if subnet, ok = parseCIDR(w, r, subnetStr); !ok {
+				return
+			}
+		}
+		timeout := DefaultSelfTestTimeout
+		if timeoutStr := r.FormValue("timeout"); timeoutStr != "" {
+			var err error
+			if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+				http.Error(w, fmt.Sprint("invalid timeout: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		report := alloc.SelfTest(subnet.HostRange(), timeout)
+		body, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Passed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write(body)
+	})
+
 	router.Methods("GET").Path("/ipinfo/defaultsubnet").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "%s", defaultSubnet)
 	})
@@ -67,10 +238,30 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		ipStr := vars["ip"]
 		noErrorOnUnknown := r.FormValue("noErrorOnUnknown") == "true"
 		if ip, err := address.ParseIP(ipStr); err != nil {
-			badRequest(w, err)
+			httpError(w, r, err)
 			return
 		} else if err := alloc.Claim(ident, ip, noErrorOnUnknown); err != nil {
-			badRequest(w, fmt.Errorf("Unable to claim: %s", err))
+			httpError(w, r, prefixError("Unable to claim: ", err))
+			return
+		}
+
+		w.WriteHeader(204)
+	})
+
+	// Whether an address allocated with setup-timeout has been set up:
+	// status=done, or status=failed to free it
+	router.Methods("PUT").Path("/ip/{id}/{ip}/setup").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		status := r.FormValue("status")
+		if status != "done" && status != "failed" {
+			httpError(w, r, fmt.Errorf("setup status must be done or failed, not %q", status))
+			return
+		}
+		if ip, err := address.ParseIP(vars["ip"]); err != nil {
+			httpError(w, r, err)
+			return
+		} else if err := alloc.ReportSetup(vars["id"], ip, status == "done"); err != nil {
+			httpError(w, r, prefixError("Unable to report setup: ", err))
 			return
 		}
 
@@ -79,10 +270,10 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 
 	router.Methods("GET").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
+		if subnet, ok := parseCIDR(w, r, vars["ip"]+"/"+vars["prefixlen"]); ok {
 			addr, err := alloc.Lookup(vars["id"], subnet.HostRange())
 			if err != nil {
-				http.NotFound(w, r)
+				httpError(w, r, err)
 				return
 			}
 			fmt.Fprintf(w, "%s/%d", addr, subnet.PrefixLen)
@@ -92,7 +283,7 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 	router.Methods("GET").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		addr, err := alloc.Lookup(mux.Vars(r)["id"], defaultSubnet.HostRange())
 		if err != nil {
-			http.NotFound(w, r)
+			httpError(w, r, err)
 			return
 		}
 		fmt.Fprintf(w, "%s/%d", addr, defaultSubnet.PrefixLen)
@@ -100,14 +291,14 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 
 	router.Methods("POST").Path("/ip/{id}/{ip}/{prefixlen}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		if subnet, ok := parseCIDR(w, vars["ip"]+"/"+vars["prefixlen"]); ok {
-			alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", subnet)
+		if subnet, ok := parseCIDR(w, r, vars["ip"]+"/"+vars["prefixlen"]); ok {
+			alloc.handleHTTPAllocate(dockerCli, w, r, vars["id"], r.FormValue("key"), r.FormValue("check-alive") == "true", wantsJSON(r), subnet)
 		}
 	})
 
 	router.Methods("POST").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
-		alloc.handleHTTPAllocate(dockerCli, w, vars["id"], r.FormValue("check-alive") == "true", defaultSubnet)
+		alloc.handleHTTPAllocate(dockerCli, w, r, vars["id"], r.FormValue("key"), r.FormValue("check-alive") == "true", wantsJSON(r), defaultSubnet)
 	})
 
 	router.Methods("DELETE").Path("/ip/{id}/{ip}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -115,10 +306,13 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		ident := vars["id"]
 		ipStr := vars["ip"]
 		if ip, err := address.ParseIP(ipStr); err != nil {
-			badRequest(w, err)
+			httpError(w, r, err)
+			return
+		} else if err := alloc.checkRelease(ident, r.FormValue("force") == "true"); err != nil {
+			httpError(w, r, prefixError("Unable to free: ", err))
 			return
 		} else if err := alloc.Free(ident, ip); err != nil {
-			badRequest(w, fmt.Errorf("Unable to free: %s", err))
+			httpError(w, r, prefixError("Unable to free: ", err))
 			return
 		}
 
@@ -127,8 +321,12 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 
 	router.Methods("DELETE").Path("/ip/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ident := mux.Vars(r)["id"]
+		if err := alloc.checkRelease(ident, r.FormValue("force") == "true"); err != nil {
+			httpError(w, r, err)
+			return
+		}
 		if err := alloc.Delete(ident); err != nil {
-			badRequest(w, err)
+			httpError(w, r, err)
 			return
 		}
 
@@ -140,10 +338,30 @@ func (alloc *Allocator) HandleHTTP(router *mux.Router, defaultSubnet address.CID
 		w.WriteHeader(204)
 	})
 
+	router.Methods("POST").Path("/ipam/reconcile").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dockerCli == nil {
+			http.Error(w, "no Docker client to check containers with", http.StatusServiceUnavailable)
+			return
+		}
+		for _, ident := range alloc.Reconcile(dockerCli, r.FormValue("dry-run") == "true") {
+			fmt.Fprintln(w, ident)
+		}
+	})
+
+	router.Methods("POST").Path("/seed").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if err := alloc.Seed(r.Form["peer"]); err != nil {
+			httpError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(204)
+	})
+
 	router.Methods("DELETE").Path("/peer/{id}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ident := mux.Vars(r)["id"]
-		if err := alloc.AdminTakeoverRanges(ident); err != nil {
-			badRequest(w, err)
+		if err := alloc.AdminTakeoverRanges(ident, r.FormValue("force") == "true"); err != nil {
+			httpError(w, r, err)
 			return
 		}
 
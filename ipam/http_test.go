@@ -1,12 +1,15 @@
 package ipam
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/address"
+	wt "github.com/weaveworks/weave/testing"
 )
 
 func HTTPPost(t *testing.T, url string) string {
@@ -114,6 +118,39 @@ func TestHttp(t *testing.T) {
 	// See https://groups.google.com/forum/#!topic/golang-nuts/vLHWa5sHnCE
 }
 
+func TestHTTPAllocationInfo(t *testing.T) {
+	const (
+		universe = "10.0.0.0/8"
+		subnet   = "10.0.3.0/24"
+	)
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe, 1)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	allocJSON := func(containerID string) AllocationInfo {
+		req, _ := http.NewRequest("POST", allocURL(port, subnet, containerID), nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, "http response")
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var info AllocationInfo
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		return info
+	}
+
+	// No gateway until the host is exposed on the subnet
+	require.Equal(t, AllocationInfo{Address: "10.0.3.1/24", Broadcast: "10.0.3.255"}, allocJSON("deadbeef"))
+	require.Equal(t, "10.0.3.2/24", HTTPPost(t, allocURL(port, subnet, exposeIdent)))
+	require.Equal(t, AllocationInfo{Address: "10.0.3.3/24", Gateway: "10.0.3.2", Broadcast: "10.0.3.255"}, allocJSON("baddf00d"))
+	// The plain response is unchanged
+	require.Equal(t, "10.0.3.1/24", HTTPGet(t, allocURL(port, subnet, "deadbeef")))
+}
+
 func TestBadHttp(t *testing.T) {
 	var (
 		containerID = "deadbeef"
@@ -143,6 +180,90 @@ func TestBadHttp(t *testing.T) {
 	require.Equal(t, http.StatusNotFound, resp.StatusCode, "http response")
 }
 
+func TestHTTPErrorStatus(t *testing.T) {
+	const (
+		containerID = "deadbeef"
+		testCIDR1   = "10.0.0.0/8"
+	)
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", testCIDR1, 1)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(testCIDR1)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+	addr := strings.Split(HTTPPost(t, allocURL(port, testCIDR1, containerID)), "/")[0]
+
+	status := func(method, url string) int {
+		resp, err := doHTTP(method, url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, status("GET", identURL(port, "unknown")))
+	require.Equal(t, http.StatusNotFound, status("DELETE", identURL(port, "unknown")))
+	require.Equal(t, http.StatusNotFound, status("DELETE", identURL(port, "unknown/"+addr)))
+	require.Equal(t, http.StatusConflict, status("PUT", identURL(port, "other/"+addr)))
+	require.Equal(t, http.StatusBadRequest, status("POST", allocURL(port, "11.0.0.0/24", "other")))
+	require.Equal(t, http.StatusBadRequest, status("POST", allocURL(port, "10.0.0.1/24", "other")))
+
+	// Clients which accept JSON get the details as problem+json
+	req, _ := http.NewRequest("PUT", identURL(port, "other/"+addr), nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+	var problem Problem
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&problem))
+	require.Equal(t, "already-owned", problem.Type)
+	require.Equal(t, http.StatusConflict, problem.Status)
+	require.Contains(t, problem.Detail, "Unable to claim: address "+addr+" is already owned by "+containerID)
+
+	alloc.Shutdown()
+	require.Equal(t, http.StatusServiceUnavailable, status("POST", allocURL(port, testCIDR1, "other")))
+}
+
+type fakeReleaseChecker map[string]error // nil if running
+
+func (checker fakeReleaseChecker) ContainerRunning(ident string) (bool, error) {
+	err, found := checker[ident]
+	return found && err == nil, err
+}
+
+func TestHTTPVerifyRelease(t *testing.T) {
+	const testCIDR = "10.0.3.0/28"
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", testCIDR, 1)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(testCIDR)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	running := strings.Repeat("a", 64)
+	stopped := strings.Repeat("b", 64)
+	unsure := strings.Repeat("c", 64)
+	alloc.SetReleaseChecker(fakeReleaseChecker{running: nil, unsure: fmt.Errorf("Docker is down")})
+	addrs := make(map[string]string)
+	for _, ident := range []string{running, stopped, unsure, "weave:expose"} {
+		addrs[ident] = strings.Split(HTTPPost(t, allocURL(port, testCIDR, ident)), "/")[0]
+	}
+
+	status := func(method, url string) int {
+		resp, err := doHTTP(method, url)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusConflict, status("DELETE", identURL(port, running)))
+	require.Equal(t, http.StatusConflict, status("DELETE", identURL(port, running+"/"+addrs[running])))
+	require.Equal(t, http.StatusServiceUnavailable, status("DELETE", identURL(port, unsure)))
+	require.Equal(t, addrs[running]+"/28", HTTPGet(t, identURL(port, running)), "refused release freed the address")
+
+	require.Equal(t, http.StatusNoContent, status("DELETE", identURL(port, stopped)))
+	require.Equal(t, http.StatusNoContent, status("DELETE", identURL(port, "weave:expose/"+addrs["weave:expose"])))
+	require.Equal(t, http.StatusNoContent, status("DELETE", identURL(port, running+"/"+addrs[running]+"?force=true")))
+}
+
 func TestHTTPCancel(t *testing.T) {
 	var (
 		containerID = "deadbeef"
@@ -156,18 +277,317 @@ func TestHTTPCancel(t *testing.T) {
 	_, cidr, _ := address.ParseCIDR(testCIDR1)
 	port := listenHTTP(alloc, cidr)
 
-	// Ask the http server for a new address
+	// Ask the http server for a new address on another goroutine,
+	// and cancel the request once the allocator is holding it
 	req, _ := http.NewRequest("POST", allocURL(port, testCIDR1, containerID), nil)
-	// On another goroutine, wait for a bit then cancel the request
+	resChan := make(chan *http.Response)
 	go func() {
-		time.Sleep(100 * time.Millisecond)
-		common.Log.Debug("Cancelling allocate")
-		http.DefaultTransport.(*http.Transport).CancelRequest(req)
+		res, _ := http.DefaultClient.Do(req)
+		resChan <- res
 	}()
+	waitForPendingAllocates(t, alloc, 1)
+	common.Log.Debug("Cancelling allocate")
+	http.DefaultTransport.(*http.Transport).CancelRequest(req)
 
-	res, _ := http.DefaultClient.Do(req)
-	if res != nil {
+	if res := <-resChan; res != nil {
 		body, _ := ioutil.ReadAll(res.Body)
 		require.FailNow(t, "Error: Allocate returned non-nil", string(body))
 	}
 }
+
+func TestHTTPReadiness(t *testing.T) {
+	const testCIDR = "10.0.3.0/29"
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", testCIDR, 2)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(testCIDR)
+	port := listenHTTP(alloc, cidr)
+	url := fmt.Sprintf("http://localhost:%d/readiness", port)
+
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "waiting-for-peers", string(body))
+
+	// With a quorum of 2, priming starts an election which can't finish
+	ExpectBroadcastMessage(alloc, nil)
+	alloc.Prime()
+	alloc.Encode() // sync up
+	require.Equal(t, Electing, alloc.Readiness())
+	require.Equal(t, "electing", HTTPGet(t, url))
+	CheckAllExpectedMessagesSent(alloc)
+}
+
+func TestHTTPRingStats(t *testing.T) {
+	const universe = "10.0.0.0/24"
+
+	alloc1, _ := makeAllocatorWithMockGossip(t, "01:00:00:01:00:00", universe, 1)
+	defer alloc1.Stop()
+	alloc2, _ := makeAllocatorWithMockGossip(t, "02:00:00:02:00:00", universe, 1)
+	defer alloc2.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc1, cidr)
+	alloc1.claimRingForTesting(alloc2)
+	_, err := alloc1.Allocate("abcdef", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+
+	var stats RingStats
+	require.NoError(t, json.Unmarshal([]byte(HTTPGet(t, fmt.Sprintf("http://localhost:%d/ring/stats", port))), &stats))
+	require.Equal(t, cidr.Range().String(), stats.Range)
+	require.Len(t, stats.Entries, 2)
+	require.Equal(t, EntryStats{"10.0.0.0", 128, 127, 1.0 / 128, "01:00:00:01:00:00", "nick-01:00:00:01:00:00"}, stats.Entries[0])
+	require.Equal(t, "02:00:00:02:00:00", stats.Entries[1].Peer)
+	require.Len(t, stats.Peers, 2)
+	require.Equal(t, PeerStats{"01:00:00:01:00:00", "nick-01:00:00:01:00:00", 1, 128, 127, 1.0 / 128, 1, 128, 0}, stats.Peers[0])
+	require.Equal(t, 2, stats.Runs)
+	require.Equal(t, 0.0, stats.Fragmentation)
+}
+
+func TestHTTPSelfTest(t *testing.T) {
+	const (
+		universe = "10.0.0.0/22"
+		subnet   = "10.0.1.0/24"
+	)
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe, 1)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+	_, err := alloc.Allocate("abcdef", cidr.HostRange(), returnFalse)
+	require.NoError(t, err)
+
+	selfTest := func(query string) (int, SelfTestReport) {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d/ipam/selftest%s", port, query), "", nil)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var report SelfTestReport
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		return resp.StatusCode, report
+	}
+
+	status, report := selfTest("")
+	require.Equal(t, http.StatusOK, status, "%+v", report)
+	require.True(t, report.Passed)
+	require.Equal(t, "10.0.0.2", report.Address)
+	require.Len(t, report.Steps, 8)
+	status, report = selfTest("?subnet=" + subnet)
+	require.Equal(t, http.StatusOK, status, "%+v", report)
+	require.Equal(t, "10.0.1.1", report.Address)
+	// Nothing left behind
+	_, err = alloc.Lookup(report.Ident, cidr.HostRange())
+	require.Error(t, err)
+
+	// Nowhere to allocate from
+	status, report = selfTest("?subnet=10.1.0.0/24&timeout=10ms")
+	require.Equal(t, http.StatusInternalServerError, status)
+	require.False(t, report.Passed)
+	require.Len(t, report.Steps, 1)
+	require.Equal(t, "allocate", report.Steps[0].Name)
+
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/ipam/selftest?timeout=soon", port), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPSetup(t *testing.T) {
+	const (
+		universe = "10.0.0.0/8"
+		subnet   = "10.0.3.0/24"
+	)
+
+	alloc, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9a", universe, 1)
+	defer alloc.Stop()
+	_, cidr, _ := address.ParseCIDR(universe)
+	port := listenHTTP(alloc, cidr)
+	alloc.claimRingForTesting()
+
+	setupURL := func(containerID, addr, status string) string {
+		return fmt.Sprintf("http://localhost:%d/ip/%s/%s/setup?status=%s", port, containerID, addr, status)
+	}
+	require.Equal(t, "10.0.3.1/24", HTTPPost(t, allocURL(port, subnet, "deadbeef")+"?setup-timeout=1m"))
+	resp, err := doHTTP("PUT", setupURL("deadbeef", "10.0.3.1", "failed"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	// so the address is free again
+	require.Equal(t, "10.0.3.1/24", HTTPPost(t, allocURL(port, subnet, "baddf00d")+"?setup-timeout=1m"))
+	resp, err = doHTTP("PUT", setupURL("baddf00d", "10.0.3.1", "done"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, err = doHTTP("PUT", setupURL("deadbeef", "10.0.3.1", "done"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err = doHTTP("PUT", setupURL("baddf00d", "10.0.3.1", "maybe"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPExportImport(t *testing.T) {
+	const (
+		universe = "10.0.3.0/24"
+		ourName  = "08:00:27:01:c3:9a"
+	)
+	_, cidr, _ := address.ParseCIDR(universe)
+
+	old, _ := makeAllocatorWithMockGossip(t, ourName, universe, 1)
+	defer old.Stop()
+	oldPort := listenHTTP(old, cidr)
+	old.claimRingForTesting()
+	require.Equal(t, "10.0.3.1/24", HTTPPost(t, allocURL(oldPort, universe, "deadbeef")))
+	state := HTTPGet(t, fmt.Sprintf("http://localhost:%d/ipam/state", oldPort))
+
+	// A peer of another name won't take the state
+	other, _ := makeAllocatorWithMockGossip(t, "08:00:27:01:c3:9b", universe, 1)
+	defer other.Stop()
+	resp, err := http.Post(fmt.Sprintf("http://localhost:%d/ipam/state", listenHTTP(other, cidr)), "application/json", strings.NewReader(state))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// but a replacement under the same name does, container and all
+	replacement, _ := makeAllocatorWithMockGossip(t, ourName, universe, 1)
+	defer replacement.Stop()
+	port := listenHTTP(replacement, cidr)
+	ExpectBroadcastMessage(replacement, nil)
+	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/ipam/state", port), "application/json", strings.NewReader(state))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	CheckAllExpectedMessagesSent(replacement)
+	require.Equal(t, "10.0.3.1/24", HTTPGet(t, identURL(port, "deadbeef")))
+	require.Equal(t, "10.0.3.2/24", HTTPPost(t, allocURL(port, universe, "baddf00d")))
+
+	// and only once
+	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/ipam/state", port), "application/json", strings.NewReader(state))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
+
+func TestExternalSync(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		records  = map[string]string{"10.0.3.2": "someone-else"}
+		failures = 1 // the first request fails, to be retried
+	)
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		addr := strings.TrimPrefix(r.URL.Path, "/")
+		switch r.Method {
+		case "PUT":
+			var body struct{ Ident string }
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			if holder, found := records[addr]; found && holder != body.Ident {
+				http.Error(w, holder, http.StatusConflict)
+				return
+			}
+			records[addr] = body.Ident
+		case "DELETE":
+			delete(records, addr)
+		}
+	}))
+	defer external.Close()
+
+	es := NewExternalSync(NewHTTPExternalIPAM(external.URL+"/"), time.Millisecond, 10*time.Millisecond)
+	defer es.Stop()
+	addr := func(s string) address.Address {
+		a, _ := address.ParseIP(s)
+		return a
+	}
+	es.Register("container1", addr("10.0.3.1"), nil)
+	es.Register("container2", addr("10.0.3.2"), nil)
+	es.Register("container3", addr("10.0.3.3"), nil)
+	es.Deregister("container3", addr("10.0.3.3"), nil)
+	wt.AssertEventually(t, time.Second, func() bool { return es.Pending() == 0 }, "changes sent")
+
+	lock.Lock()
+	require.Equal(t, map[string]string{"10.0.3.1": "container1", "10.0.3.2": "someone-else"}, records)
+	lock.Unlock()
+	conflicts := es.Conflicts()
+	require.Len(t, conflicts, 1)
+	require.Equal(t, "container2", conflicts[0].Ident)
+	require.Equal(t, "someone-else", conflicts[0].Holder)
+}
+
+func TestWebhook(t *testing.T) {
+	const secret = "s3cret"
+	var (
+		lock     sync.Mutex
+		events   []WebhookEvent
+		failures = 1 // the first request fails, to be retried
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, CheckWebhookSignature([]byte(secret), r.Header.Get(WebhookSignatureHeader), body, time.Now()))
+		var event WebhookEvent
+		require.NoError(t, json.Unmarshal(body, &event))
+		if event.Ident == "rejected" {
+			http.Error(w, "no thanks", http.StatusBadRequest)
+			return
+		}
+		events = append(events, event)
+	}))
+	defer receiver.Close()
+
+	wh := NewWebhook(receiver.URL, secret, time.Millisecond, 10*time.Millisecond)
+	defer wh.Stop()
+	addr := func(s string) address.Address {
+		a, _ := address.ParseIP(s)
+		return a
+	}
+	// Through a MultiRegistrar, as the allocator would call it
+	registrars := MultiRegistrar{wh, NewBatchingRegistrar(1, time.Hour, func([]RegistrationEvent) {})}
+	registrars.Register("container1", addr("10.0.3.1"), map[string]string{"peer": "01:00:00:01:00:00"})
+	registrars.Register("rejected", addr("10.0.3.2"), nil)
+	registrars.Deregister("container1", addr("10.0.3.1"), nil)
+	registrars.Tombstone("02:00:00:02:00:00", []address.Range{address.NewRange(addr("10.0.3.16"), 16)}, nil)
+	wt.AssertEventually(t, time.Second, func() bool { return wh.Pending() == 0 }, "events sent")
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Len(t, events, 3)
+	require.Equal(t, WebhookEvent{Event: WebhookAllocate, Time: events[0].Time, Ident: "container1", Address: "10.0.3.1", Metadata: map[string]string{"peer": "01:00:00:01:00:00"}}, events[0])
+	require.Equal(t, WebhookFree, events[1].Event)
+	require.Equal(t, WebhookEvent{Event: WebhookTombstone, Time: events[2].Time, Peer: "02:00:00:02:00:00", Ranges: []string{"10.0.3.16-10.0.3.31"}}, events[2])
+}
+
+func TestWebhookSignature(t *testing.T) {
+	secret := []byte("s3cret")
+	body := []byte(`{"event":"allocate"}`)
+	signedAt := time.Unix(1462356900, 0)
+	header := fmt.Sprintf("t=%d,sha256=%s", signedAt.Unix(), WebhookSignature(secret, signedAt.Unix(), body))
+
+	require.NoError(t, CheckWebhookSignature(secret, header, body, signedAt))
+	require.NoError(t, CheckWebhookSignature(secret, header, body, signedAt.Add(WebhookSignatureWindow)))
+	require.NoError(t, CheckWebhookSignature(secret, header, body, signedAt.Add(-WebhookSignatureWindow)))
+
+	// Replayed after the window, or signed too far ahead of our clock
+	require.Error(t, CheckWebhookSignature(secret, header, body, signedAt.Add(WebhookSignatureWindow+time.Second)))
+	require.Error(t, CheckWebhookSignature(secret, header, body, signedAt.Add(-WebhookSignatureWindow-time.Second)))
+
+	// Tampered with: the body, the time, or signed with another secret
+	require.Error(t, CheckWebhookSignature(secret, header, []byte(`{"event":"free"}`), signedAt))
+	later := signedAt.Add(time.Hour)
+	moved := fmt.Sprintf("t=%d,sha256=%s", later.Unix(), WebhookSignature(secret, signedAt.Unix(), body))
+	require.Error(t, CheckWebhookSignature(secret, moved, body, later))
+	require.Error(t, CheckWebhookSignature([]byte("other"), header, body, signedAt))
+
+	// The body's signature alone, as sent before times were signed
+	require.Error(t, CheckWebhookSignature(secret, "sha256="+WebhookSignature(secret, 0, body), body, signedAt))
+	require.Error(t, CheckWebhookSignature(secret, "", body, signedAt))
+}
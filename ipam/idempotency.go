@@ -0,0 +1,51 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// An orchestrator retrying an allocation, perhaps for a new container
+// replacing one which failed to start, can pass the same idempotency
+// key each time. Within keyTTL of the first allocation, any request
+// with the key gets the same address, which moves to the requesting
+// ident.
+const keyTTL = 10 * time.Minute
+
+type keyedAllocation struct {
+	ident   string
+	addr    address.Address
+	expires time.Time
+}
+
+// Actor client: the address previously allocated under key, if it is
+// within r and still owned, now filed under ident.
+func (alloc *Allocator) lookupKey(key string, ident string, r address.Range) (address.Address, bool) {
+	k, found := alloc.keys[key]
+	if !found || !r.Contains(k.addr) || !alloc.owns(k.ident, k.addr) {
+		return 0, false
+	}
+	if k.ident != ident {
+		alloc.debugln("Moving", k.addr, "from", k.ident, "to", ident, "for key", key)
+		alloc.removeOwned(k.ident, k.addr)
+		alloc.addOwned(ident, k.addr)
+		k.ident = ident
+	}
+	return k.addr, true
+}
+
+// Actor client
+func (alloc *Allocator) recordKey(key string, ident string, addr address.Address) {
+	alloc.keys[key] = &keyedAllocation{ident: ident, addr: addr, expires: alloc.clock.Now().Add(keyTTL)}
+}
+
+// Actor client
+func (alloc *Allocator) removeExpiredKeys() {
+	now := alloc.clock.Now()
+	for key, k := range alloc.keys {
+		if now.After(k.expires) {
+			delete(alloc.keys, key)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Each time a peer starts, it is a new incarnation: it has a fresh
+// UID and, if its name is persisted, a count one more than last time.
+// Peers gossip the incarnations they know of, so a peer whose count
+// goes up has restarted, while one whose count drops under a name we
+// knew is a new peer reusing the name. A peer which restarts often in
+// a short time is flapping.
+
+type Incarnation struct {
+	UID      mesh.PeerUID
+	Count    uint64   // starts under this name, or 0 if not tracked
+	Started  int64    // Unix time
+	Features []string // what the peer's version supports; see rpc.go
+}
+
+const (
+	flappingWindow   = 10 * time.Minute
+	flappingRestarts = 3
+)
+
+type IncarnationStatus struct {
+	Peer           string
+	Nickname       string
+	Incarnation    uint64
+	RecentRestarts int    // within flappingWindow
+	Warning        string `json:",omitempty"`
+}
+
+// SetIncarnation sets how many times this peer has started under its
+// name, including this time. It must be called before Start; 0, the
+// default, means not tracked.
+func (alloc *Allocator) SetIncarnation(count uint64) {
+	ours := alloc.incarnations[alloc.ourName]
+	ours.Count = count
+	alloc.incarnations[alloc.ourName] = ours
+}
+
+// Actor client: merge incarnations heard in gossip
+func (alloc *Allocator) mergeIncarnations(incoming map[mesh.PeerName]Incarnation) {
+	for peer, incarnation := range incoming {
+		known, found := alloc.incarnations[peer]
+		if peer == alloc.ourName || (found && (incarnation.UID == known.UID || incarnation.Started < known.Started)) {
+			continue
+		}
+		alloc.incarnations[peer] = incarnation
+		alloc.stateVersion++
+		if !found {
+			continue
+		}
+		name := alloc.annotatePeernames([]mesh.PeerName{peer})[0]
+		if incarnation.Count > known.Count || incarnation.Count == 0 {
+			alloc.infof("Peer %s has restarted", name)
+			alloc.restarts[peer] = append(alloc.recentRestarts(peer), alloc.clock.Now())
+		} else {
+			alloc.warnf("Peer %s seems to be a new peer reusing the name of an old one (incarnation %d after %d)",
+				name, incarnation.Count, known.Count)
+		}
+	}
+}
+
+// Actor client: restarts of peer within flappingWindow
+func (alloc *Allocator) recentRestarts(peer mesh.PeerName) []time.Time {
+	cutoff := alloc.clock.Now().Add(-flappingWindow)
+	restarts := alloc.restarts[peer]
+	for len(restarts) > 0 && restarts[0].Before(cutoff) {
+		restarts = restarts[1:]
+	}
+	return restarts
+}
+
+// Actor client: forget peers which have gone, along with nicknames
+func (alloc *Allocator) removeIncarnation(peer mesh.PeerName) {
+	delete(alloc.incarnations, peer)
+	delete(alloc.restarts, peer)
+	alloc.stateVersion++
+}
+
+// Actor client
+func (alloc *Allocator) incarnationStatus() []IncarnationStatus {
+	var result []IncarnationStatus
+	for peer, incarnation := range alloc.incarnations {
+		name := alloc.annotatePeernames([]mesh.PeerName{peer})[0]
+		status := IncarnationStatus{
+			Peer:           peer.String(),
+			Nickname:       alloc.nickname(peer),
+			Incarnation:    incarnation.Count,
+			RecentRestarts: len(alloc.recentRestarts(peer)),
+		}
+		if status.RecentRestarts >= flappingRestarts {
+			status.Warning = fmt.Sprintf("peer %s has restarted %d times in the last %v", name, status.RecentRestarts, flappingWindow)
+		}
+		result = append(result, status)
+	}
+	sort.Sort(incarnationsByPeer(result))
+	return result
+}
+
+type incarnationsByPeer []IncarnationStatus
+
+func (s incarnationsByPeer) Len() int           { return len(s) }
+func (s incarnationsByPeer) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s incarnationsByPeer) Less(i, j int) bool { return s[i].Peer < s[j].Peer }
@@ -0,0 +1,117 @@
+package ipam
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/peernames"
+)
+
+// Nicknames are matched case-insensitively, since they usually come
+// from host names. Nothing stops two peers having the same one, so we
+// index them to spot collisions.
+//
+// We gossip the nicknames of the peers in the ring, and pass them on
+// to the registry shared with the rest of weave, which we in turn ask
+// about peers we have not heard of ourselves.
+
+// The source under which we tell the registry about peers
+const peerNamesSource = "ipam"
+
+// SetPeerNames makes the allocator share nicknames with the rest of
+// weave through registry. It must be called before Start.
+func (alloc *Allocator) SetPeerNames(registry *peernames.Registry) {
+	alloc.peerNames = registry
+	for peer, nickname := range alloc.nicknames {
+		registry.Set(peerNamesSource, peer, nickname)
+	}
+}
+
+// Actor client
+func (alloc *Allocator) nickname(peer mesh.PeerName) string {
+	if nickname, found := alloc.nicknames[peer]; found {
+		return nickname
+	}
+	nickname, _ := alloc.peerNames.Nickname(peer)
+	return nickname
+}
+
+func nicknameKey(nickname string) string {
+	return strings.ToLower(nickname)
+}
+
+// Actor client
+func (alloc *Allocator) setNickname(peer mesh.PeerName, nickname string) {
+	if old, found := alloc.nicknames[peer]; found {
+		if old == nickname {
+			return
+		}
+		alloc.unindexNickname(peer, old)
+	}
+	alloc.nicknames[peer] = nickname
+	alloc.stateVersion++
+	alloc.peerNames.Set(peerNamesSource, peer, nickname)
+	key := nicknameKey(nickname)
+	alloc.nicknameIndex[key] = append(alloc.nicknameIndex[key], peer)
+	if peers := alloc.nicknameIndex[key]; len(peers) > 1 {
+		alloc.warnf("Nickname %q is used by more than one peer: %v", nickname, alloc.annotatePeernames(peers))
+	}
+}
+
+// Actor client
+func (alloc *Allocator) removeNickname(peer mesh.PeerName) {
+	if nickname, found := alloc.nicknames[peer]; found {
+		alloc.unindexNickname(peer, nickname)
+		delete(alloc.nicknames, peer)
+		alloc.stateVersion++
+		alloc.peerNames.Forget(peerNamesSource, peer)
+	}
+}
+
+func (alloc *Allocator) unindexNickname(peer mesh.PeerName, nickname string) {
+	key := nicknameKey(nickname)
+	peers := alloc.nicknameIndex[key]
+	for i, name := range peers {
+		if name == peer {
+			peers = append(peers[:i:i], peers[i+1:]...)
+			break
+		}
+	}
+	if len(peers) == 0 {
+		delete(alloc.nicknameIndex, key)
+	} else {
+		alloc.nicknameIndex[key] = peers
+	}
+}
+
+// Actor client: lookup a PeerName by nickname or stringified
+// PeerName. We can't rely on the topology for this because we are
+// interested in peers that have gone away but are still in the ring,
+// which is why we maintain our own nicknames map.
+func (alloc *Allocator) lookupPeername(name string) (mesh.PeerName, error) {
+	switch peers := alloc.nicknameIndex[nicknameKey(name)]; len(peers) {
+	case 0:
+	case 1:
+		return peers[0], nil
+	default:
+		return mesh.UnknownPeerName, fmt.Errorf("Nickname '%s' is ambiguous; use one of the peer names %v", name, alloc.annotatePeernames(peers))
+	}
+	return alloc.peerNames.Resolve(name)
+}
+
+// Actor client: a description of each nickname used by more than one
+// peer, in order.
+func (alloc *Allocator) nicknameCollisions() []string {
+	var collisions []string
+	for _, peers := range alloc.nicknameIndex {
+		if len(peers) > 1 {
+			collisions = append(collisions, fmt.Sprintf("%s: %s", alloc.nicknames[peers[0]],
+				strings.Join(alloc.annotatePeernames(peers), ", ")))
+		}
+	}
+	sort.Strings(collisions)
+	return collisions
+}
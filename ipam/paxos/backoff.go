@@ -0,0 +1,41 @@
+package paxos
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Backoff decides how long a proposer waits before proposing again,
+// when its earlier proposals have not led to consensus. Proposers
+// which re-propose at the same rate can keep superseding each other's
+// proposals indefinitely, so they should back off, and not in step.
+type Backoff interface {
+	// Delay after the given number of proposals, counting from 1
+	Delay(proposals uint) time.Duration
+}
+
+// ExponentialBackoff doubles the delay after each proposal, from
+// initial up to max, and adds up to 50% jitter. The jitter comes from
+// a sequence seeded by the peer name, so peers differ from each other
+// but each is repeatable.
+type ExponentialBackoff struct {
+	initial, max time.Duration
+	rand         *rand.Rand
+}
+
+func NewExponentialBackoff(initial, max time.Duration, name mesh.PeerName) *ExponentialBackoff {
+	return &ExponentialBackoff{initial, max, rand.New(rand.NewSource(int64(name)))}
+}
+
+func (b *ExponentialBackoff) Delay(proposals uint) time.Duration {
+	delay := b.initial
+	for i := uint(1); i < proposals && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	return delay + time.Duration(b.rand.Float64()*float64(delay)/2)
+}
@@ -1,6 +1,11 @@
+// Package paxos agrees a value between peers by Paxos over gossip.
+// It is the one implementation in weave: IPAM uses it to agree which
+// peers seed the ring, and gossip.Consensus to agree values by key.
 package paxos
 
 import (
+	"time"
+
 	"github.com/weaveworks/mesh"
 )
 
@@ -44,8 +49,12 @@ type Value []mesh.PeerName
 // An AcceptedValue is a Value plus the proposal which originated that
 // Value.  The origin is not essential, but makes comparing
 // AcceptedValues easy even if comparing Values is not.
+//
+// Nodes which have been given a proposal with SetProposal agree on
+// that in Data instead, and leave Value empty.
 type AcceptedValue struct {
 	Value  Value
+	Data   []byte
 	Origin ProposalID
 }
 
@@ -66,53 +75,92 @@ func (a NodeClaims) equals(b NodeClaims) bool {
 
 type GossipState map[NodeID]NodeClaims
 
-type Node struct {
-	id     NodeID
-	quorum uint
-	knows  GossipState
-}
-
-func NewNode(name mesh.PeerName, uid mesh.PeerUID, quorum uint) *Node {
-	return &Node{
-		id:     NodeID{name, uid},
-		quorum: quorum,
-		knows:  map[NodeID]NodeClaims{},
-	}
-}
-
-func (node *Node) GossipState() GossipState {
-	return node.knows
+// Update merges from into state. Returns true if state changed.
+func (state GossipState) Update(from GossipState) bool {
+	return state.update(from, nil)
 }
 
-// Update this node's information about what other nodes know.
-// Returns true if we learned something new.
-func (node *Node) Update(from GossipState) bool {
+// Like Update, also noting in changedIDs, if not nil, the nodes whose
+// claims changed
+func (state GossipState) update(from GossipState, changedIDs map[NodeID]struct{}) bool {
 	changed := false
 
 	for i, fromClaims := range from {
-		claims, ok := node.knows[i]
+		claims, ok := state[i]
+		claimsChanged := !ok
 		if ok {
 			if claims.Promise.precedes(fromClaims.Promise) {
 				claims.Promise = fromClaims.Promise
-				changed = true
+				claimsChanged = true
 			}
 
 			if claims.Accepted.precedes(fromClaims.Accepted) {
 				claims.Accepted = fromClaims.Accepted
 				claims.AcceptedVal = fromClaims.AcceptedVal
-				changed = true
+				claimsChanged = true
 			}
 		} else {
 			claims = fromClaims
-			changed = true
 		}
 
-		node.knows[i] = claims
+		state[i] = claims
+		if claimsChanged {
+			changed = true
+			if changedIDs != nil {
+				changedIDs[i] = struct{}{}
+			}
+		}
 	}
 
 	return changed
 }
 
+type Node struct {
+	id       NodeID
+	quorum   uint
+	knows    GossipState
+	proposal []byte              // what we pick, if set; otherwise the peers we know
+	changed  map[NodeID]struct{} // whose claims changed since TakeChanges
+}
+
+func NewNode(name mesh.PeerName, uid mesh.PeerUID, quorum uint) *Node {
+	return &Node{
+		id:      NodeID{name, uid},
+		quorum:  quorum,
+		knows:   map[NodeID]NodeClaims{},
+		changed: map[NodeID]struct{}{},
+	}
+}
+
+func (node *Node) GossipState() GossipState {
+	return node.knows
+}
+
+// SetProposal sets the value this node puts forward when it gets to
+// pick one, for agreeing on something other than a set of peers.
+func (node *Node) SetProposal(data []byte) {
+	node.proposal = data
+}
+
+// Update this node's information about what other nodes know.
+// Returns true if we learned something new.
+func (node *Node) Update(from GossipState) bool {
+	return node.knows.update(from, node.changed)
+}
+
+// TakeChanges returns the claims which changed since it was last
+// called. Gossiping just those, with occasional gossip of the full
+// state to cover any which were lost, saves sending the claims of
+// every node every time.
+func (node *Node) TakeChanges() GossipState {
+	delta := make(GossipState, len(node.changed))
+	for id := range node.changed {
+		delta[id] = node.knows[id]
+	}
+	node.changed = map[NodeID]struct{}{}
+	return delta
+}
+
 func max(a uint, b uint) uint {
 	if a > b {
 		return a
@@ -138,6 +186,7 @@ func (node *Node) Propose() {
 		Proposer: node.id,
 	}
 	node.knows[node.id] = ourClaims
+	node.changed[node.id] = struct{}{}
 
 	// With a quorum of 1, we can immediately accept our proposal
 	if node.quorum == 1 {
@@ -189,7 +238,11 @@ func (node *Node) Think() bool {
 
 		if count >= node.quorum {
 			if !accepted.valid() {
-				acceptedVal.Value = node.pickValue()
+				if node.proposal != nil {
+					acceptedVal.Data = node.proposal
+				} else {
+					acceptedVal.Value = node.pickValue()
+				}
 				acceptedVal.Origin = ourClaims.Promise
 			}
 
@@ -216,6 +269,7 @@ func (node *Node) Think() bool {
 	}
 
 	node.knows[node.id] = ourClaims
+	node.changed[node.id] = struct{}{}
 	return true
 }
 
@@ -253,11 +307,15 @@ func (node *Node) Consensus() (bool, AcceptedValue) {
 type Status struct {
 	KnownNodes int
 	Quorum     uint
+	// Filled in by the proposer: how many proposals it has made, and
+	// how long it is waiting before the next one
+	Proposals uint
+	Backoff   time.Duration
 }
 
 func NewStatus(node *Node) *Status {
 	if node == nil {
 		return nil
 	}
-	return &Status{len(node.knows), node.quorum}
+	return &Status{KnownNodes: len(node.knows), Quorum: node.quorum}
 }
@@ -1,6 +1,8 @@
 package paxos
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -371,3 +373,122 @@ func TestPaxos(t *testing.T) {
 		m.validate()
 	}
 }
+
+func TestProposal(t *testing.T) {
+	a := NewNode(1, 1, 2)
+	b := NewNode(2, 2, 2)
+	a.SetProposal([]byte("a"))
+	b.SetProposal([]byte("b"))
+	a.Propose()
+	b.Propose()
+
+	// Exchange gossip until nothing changes
+	for changed := true; changed; {
+		changed = false
+		if a.Update(b.GossipState()) && a.Think() {
+			changed = true
+		}
+		if b.Update(a.GossipState()) && b.Think() {
+			changed = true
+		}
+	}
+
+	okA, valA := a.Consensus()
+	okB, valB := b.Consensus()
+	if !okA || !okB {
+		t.Fatal("Failed to converge")
+	}
+	if valA.Origin != valB.Origin || string(valA.Data) != string(valB.Data) {
+		t.Fatal("Nodes disagree about consensus")
+	}
+	if string(valA.Data) != "b" || valA.Value != nil {
+		t.Fatalf("Unexpected consensus %v", valA)
+	}
+}
+
+func TestTakeChanges(t *testing.T) {
+	a := NewNode(1, 1, 2)
+	b := NewNode(2, 2, 2)
+	a.Propose()
+	if delta := a.TakeChanges(); len(delta) != 1 {
+		t.Fatalf("Expected our own claims, got %v", delta)
+	}
+	if delta := a.TakeChanges(); len(delta) != 0 {
+		t.Fatalf("Expected no changes, got %v", delta)
+	}
+
+	// Learning about b, and promising to it, changes both
+	b.Propose()
+	if !a.Update(b.GossipState()) || !a.Think() {
+		t.Fatal("Expected a to change")
+	}
+	if delta := a.TakeChanges(); len(delta) != 2 {
+		t.Fatalf("Expected claims of both nodes, got %v", delta)
+	}
+	if a.Update(b.GossipState()) {
+		t.Fatal("Nothing new to learn")
+	}
+	if delta := a.TakeChanges(); len(delta) != 0 {
+		t.Fatalf("Expected no changes, got %v", delta)
+	}
+}
+
+// A node which knows about n others, as in a large mesh, where only
+// its own claims have changed since the last broadcast
+func makeLargeNode(n int) *Node {
+	node := NewNode(0, 0, uint(n/2+1))
+	others := GossipState{}
+	for i := 1; i <= n; i++ {
+		id := NodeID{mesh.PeerName(i), mesh.PeerUID(i)}
+		others[id] = NodeClaims{Promise: ProposalID{Round: 1, Proposer: id}}
+	}
+	node.Update(others)
+	node.TakeChanges()
+	node.Propose()
+	return node
+}
+
+func benchmarkEncode(b *testing.B, claims func(*Node) GossipState) {
+	node := makeLargeNode(1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(claims(node)); err != nil {
+			b.Fatal(err)
+		}
+		b.SetBytes(int64(buf.Len()))
+	}
+}
+
+func BenchmarkEncodeFull1000(b *testing.B) {
+	benchmarkEncode(b, func(node *Node) GossipState { return node.GossipState() })
+}
+
+func BenchmarkEncodeDelta1000(b *testing.B) {
+	benchmarkEncode(b, func(node *Node) GossipState {
+		node.changed[node.id] = struct{}{}
+		return node.TakeChanges()
+	})
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	a := NewExponentialBackoff(time.Second, 8*time.Second, 1)
+	b := NewExponentialBackoff(time.Second, 8*time.Second, 2)
+	for _, c := range []struct {
+		proposals uint
+		base      time.Duration
+	}{{1, time.Second}, {2, 2 * time.Second}, {3, 4 * time.Second}, {4, 8 * time.Second}, {10, 8 * time.Second}} {
+		delayA, delayB := a.Delay(c.proposals), b.Delay(c.proposals)
+		if delayA < c.base || delayA > c.base*3/2 || delayB < c.base || delayB > c.base*3/2 {
+			t.Fatalf("Delays %s and %s after %d proposals out of range", delayA, delayB, c.proposals)
+		}
+		if delayA == delayB {
+			t.Fatalf("Peers backing off in step after %d proposals", c.proposals)
+		}
+	}
+
+	// The same peer always backs off the same way
+	if NewExponentialBackoff(time.Second, time.Minute, 1).Delay(1) != NewExponentialBackoff(time.Second, time.Minute, 1).Delay(1) {
+		t.Fatal("Backoff not repeatable")
+	}
+}
@@ -0,0 +1,28 @@
+package ipam
+
+import "github.com/weaveworks/weave/common/supervisor"
+
+// If the allocator finds its state inconsistent, e.g. its space and
+// the ring disagree about what it owns, carrying on risks handing out
+// an address twice. Instead it goes into quarantine: it stops
+// allocating, giving away space and merging gossip, so its state stays
+// as it was for diagnosis, and logs that state. The rest of the router
+// carries on, and the health check reports IPAM as degraded.
+
+// Actor client
+func (alloc *Allocator) quarantine(reason string) {
+	if alloc.quarantined != "" {
+		return
+	}
+	alloc.quarantined = reason
+	alloc.errorf("Quarantined after an internal inconsistency: %s; no more addresses will be allocated until restart. State:\n%s\n%s",
+		reason, alloc.ring, alloc.space.String())
+	supervisor.MarkDegraded("ipam", "quarantined: "+reason)
+	alloc.snapshotStale = true
+	// fail anything waiting, now that it can't succeed
+	alloc.tryPendingOps()
+}
+
+func (alloc *Allocator) quarantineError() error {
+	return newError(ErrNotReady, "IP allocation is quarantined after an internal inconsistency: %s", alloc.quarantined)
+}
@@ -0,0 +1,26 @@
+package ipam
+
+import (
+	"strings"
+
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// SetRanges makes the allocator manage several disjoint ranges as a
+// single pool, instead of one contiguous universe, so that a pool can
+// be grown without renumbering. Every peer must be given the same
+// ranges. Must be called before Start.
+func (alloc *Allocator) SetRanges(ranges []address.Range) {
+	alloc.ring = ring.NewFromRanges(ranges, alloc.ourName)
+	alloc.universe = alloc.ring.Range()
+}
+
+// The universe, or the ranges it is made of if there are several
+func (alloc *Allocator) universeString() string {
+	var strs []string
+	for _, r := range alloc.ring.AllRanges() {
+		strs = append(strs, r.String())
+	}
+	return strings.Join(strs, ", ")
+}
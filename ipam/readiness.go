@@ -0,0 +1,87 @@
+package ipam
+
+// Readiness describes how far the allocator has got towards being able
+// to hand out addresses.
+type Readiness int
+
+const (
+	// No ring yet, and either nothing has prompted us to create one
+	// or fewer peers than expected have turned up
+	WaitingForPeers Readiness = iota
+	// Running paxos with other peers to agree on the initial ring
+	Electing
+	// The ring exists, so allocations can be served
+	Ready
+	// An internal inconsistency has stopped allocation; see quarantine.go
+	Quarantined
+)
+
+func (r Readiness) String() string {
+	switch r {
+	case WaitingForPeers:
+		return "waiting-for-peers"
+	case Electing:
+		return "electing"
+	case Ready:
+		return "ready"
+	case Quarantined:
+		return "quarantined"
+	}
+	return "unknown"
+}
+
+// Actor client
+func (alloc *Allocator) readiness() Readiness {
+	switch {
+	case alloc.quarantined != "":
+		return Quarantined
+	case !alloc.ring.Empty():
+		return Ready
+	case alloc.paxosActive:
+		return Electing
+	}
+	return WaitingForPeers
+}
+
+// Readiness reports the allocator's state as of the end of its most
+// recent action, without waiting on the actor.
+func (alloc *Allocator) Readiness() Readiness {
+	if snap, _ := alloc.snapshot.Load().(*statusSnapshot); snap != nil {
+		return snap.readiness
+	}
+	return WaitingForPeers
+}
+
+// SetInitPeerCount holds the election of the initial ring until
+// peerCount, the number of peers in the network including us, has
+// reached expected. Allocation requests and Prime made in the
+// meantime wait for it. It must be called before Start.
+func (alloc *Allocator) SetInitPeerCount(expected int, peerCount func() int) {
+	alloc.initPeerCount = expected
+	alloc.peerCount = peerCount
+}
+
+// Actor client
+func (alloc *Allocator) enoughPeers() bool {
+	if alloc.peerCount == nil {
+		return true
+	}
+	if count := alloc.peerCount(); count < alloc.initPeerCount {
+		if !alloc.awaitingPeers {
+			alloc.infof("Waiting for %d peers before agreeing the IP allocation ring; %d so far", alloc.initPeerCount, count)
+		}
+		return false
+	}
+	return true
+}
+
+// Prime (Async) - start agreeing the initial ring with other peers
+// as soon as enough of them have turned up, rather than waiting for
+// the first allocation request to trigger it.
+func (alloc *Allocator) Prime() {
+	alloc.actionChan <- func() {
+		if !alloc.shuttingDown {
+			alloc.establishRing()
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package ipam
+
+// In read-only mode, e.g. during maintenance or while looking into
+// suspected corruption of its state, the allocator carries on
+// gossiping and answering lookups, and containers' addresses are still
+// freed when they go, but nothing new is allocated or claimed.
+// Requests which would need that fail, including any already waiting.
+
+// SetReadOnly (Sync) turns read-only mode on or off.
+func (alloc *Allocator) SetReadOnly(readOnly bool) {
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		if readOnly != alloc.readOnly {
+			alloc.readOnly = readOnly
+			alloc.infof("Read-only mode %s", map[bool]string{true: "on", false: "off"}[readOnly])
+			alloc.snapshotStale = true
+			alloc.tryPendingOps()
+		}
+		close(doneChan)
+	}
+	<-doneChan
+}
+
+func (alloc *Allocator) readOnlyError() error {
+	return newError(ErrNotReady, "IP allocation is in read-only mode")
+}
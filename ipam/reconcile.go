@@ -0,0 +1,74 @@
+package ipam
+
+import (
+	"regexp"
+	"time"
+)
+
+// ContainerChecker says whether a container still exists.
+// *docker.Client is one.
+type ContainerChecker interface {
+	ContainerExists(ident string) (bool, error)
+}
+
+// Addresses are released when we hear that their container has been
+// destroyed. If we miss that, e.g. because we were not running at the
+// time, they leak. Reconciliation finds them by asking about every
+// owner. Only owners which look like Docker container IDs are checked;
+// addresses owned by weave itself, or allocated by address, are left
+// alone.
+var containerIDPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Reconcile (Sync) releases the addresses of containers which no
+// longer exist, returning their idents. With dryRun, it only reports
+// which they would be.
+func (alloc *Allocator) Reconcile(checker ContainerChecker, dryRun bool) []string {
+	identsChan := make(chan []string)
+	alloc.actionChan <- func() {
+		var idents []string
+		for ident := range alloc.owned {
+			if containerIDPattern.MatchString(ident) {
+				idents = append(idents, ident)
+			}
+		}
+		identsChan <- idents
+	}
+
+	// Don't hold up the actor while we talk to Docker
+	var gone []string
+	for _, ident := range <-identsChan {
+		exists, err := checker.ContainerExists(ident)
+		if err != nil {
+			alloc.infof("Reconcile: unable to check container %s: %s", ident, err)
+			continue
+		}
+		if !exists {
+			gone = append(gone, ident)
+		}
+	}
+
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		for _, ident := range gone {
+			if dryRun {
+				alloc.infof("Reconcile: container %s no longer exists; would release its addresses", ident)
+				continue
+			}
+			alloc.infof("Reconcile: container %s no longer exists; releasing its addresses", ident)
+			alloc.delete(ident)
+			delete(alloc.dead, ident)
+		}
+		close(doneChan)
+	}
+	<-doneChan
+	return gone
+}
+
+// ReconcileEvery runs Reconcile at the given interval, forever.
+func (alloc *Allocator) ReconcileEvery(interval time.Duration, checker ContainerChecker, dryRun bool) {
+	go func() {
+		for range time.Tick(interval) {
+			alloc.Reconcile(checker, dryRun)
+		}
+	}()
+}
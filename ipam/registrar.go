@@ -0,0 +1,165 @@
+package ipam
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Registrar is told whenever an address is filed under an ident or
+// removed from it, so that e.g. DNS can keep its records in step with
+// IPAM without polling. Metadata describes where the address lives.
+// The methods are called from the allocator's actor, so they must not
+// block or call back into the Allocator.
+type Registrar interface {
+	Register(ident string, addr address.Address, metadata map[string]string)
+	Deregister(ident string, addr address.Address, metadata map[string]string)
+}
+
+// A Registrar which is also a Tombstoner is told when we take over
+// the ranges of a removed peer, e.g. with rmpeer, since whatever that
+// peer had allocated in them goes without being deregistered.
+type Tombstoner interface {
+	Tombstone(peer string, ranges []address.Range, metadata map[string]string)
+}
+
+// MultiRegistrar passes everything on to each of its Registrars.
+type MultiRegistrar []Registrar
+
+func (mr MultiRegistrar) Register(ident string, addr address.Address, metadata map[string]string) {
+	for _, registrar := range mr {
+		registrar.Register(ident, addr, metadata)
+	}
+}
+
+func (mr MultiRegistrar) Deregister(ident string, addr address.Address, metadata map[string]string) {
+	for _, registrar := range mr {
+		registrar.Deregister(ident, addr, metadata)
+	}
+}
+
+func (mr MultiRegistrar) Tombstone(peer string, ranges []address.Range, metadata map[string]string) {
+	for _, registrar := range mr {
+		if tombstoner, ok := registrar.(Tombstoner); ok {
+			tombstoner.Tombstone(peer, ranges, metadata)
+		}
+	}
+}
+
+// SetRegistrar arranges for registrar to hear about allocations.
+// Must be called before Start.
+func (alloc *Allocator) SetRegistrar(registrar Registrar) {
+	alloc.registrar = registrar
+}
+
+// Actor client
+func (alloc *Allocator) registrationMetadata() map[string]string {
+	return map[string]string{"peer": alloc.ourName.String(), "nickname": alloc.nickname(alloc.ourName)}
+}
+
+// Actor client
+func (alloc *Allocator) register(ident string, addr address.Address) {
+	if alloc.registrar != nil {
+		alloc.registrar.Register(ident, addr, alloc.registrationMetadata())
+	}
+}
+
+// Actor client
+func (alloc *Allocator) deregister(ident string, addr address.Address) {
+	if alloc.registrar != nil {
+		alloc.registrar.Deregister(ident, addr, alloc.registrationMetadata())
+	}
+}
+
+// Actor client
+func (alloc *Allocator) tombstone(peer mesh.PeerName, ranges []address.Range) {
+	if tombstoner, ok := alloc.registrar.(Tombstoner); ok && len(ranges) > 0 {
+		tombstoner.Tombstone(peer.String(), ranges, alloc.registrationMetadata())
+	}
+}
+
+// RegistrationEvent is a single call made to a Registrar.
+type RegistrationEvent struct {
+	Registered bool // false for Deregister
+	Ident      string
+	Addr       address.Address
+	Metadata   map[string]string
+}
+
+// BatchingRegistrar is a Registrar which collects events and passes
+// them on in batches, from its own goroutine, so a slow consumer
+// doesn't hold up the allocator. A batch is flushed when it reaches
+// maxBatch events, or when it is interval old, whichever is sooner.
+type BatchingRegistrar struct {
+	sync.Mutex
+	pending  []RegistrationEvent
+	maxBatch int
+	flush    func([]RegistrationEvent)
+	wake     chan struct{}
+	stop     chan struct{}
+}
+
+func NewBatchingRegistrar(maxBatch int, interval time.Duration, flush func([]RegistrationEvent)) *BatchingRegistrar {
+	br := &BatchingRegistrar{
+		maxBatch: maxBatch,
+		flush:    flush,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	go br.loop(interval)
+	return br
+}
+
+func (br *BatchingRegistrar) Register(ident string, addr address.Address, metadata map[string]string) {
+	br.add(RegistrationEvent{true, ident, addr, metadata})
+}
+
+func (br *BatchingRegistrar) Deregister(ident string, addr address.Address, metadata map[string]string) {
+	br.add(RegistrationEvent{false, ident, addr, metadata})
+}
+
+// Stop flushes any pending events and stops the flushing goroutine.
+func (br *BatchingRegistrar) Stop() {
+	close(br.stop)
+}
+
+func (br *BatchingRegistrar) add(event RegistrationEvent) {
+	br.Lock()
+	br.pending = append(br.pending, event)
+	full := len(br.pending) >= br.maxBatch
+	br.Unlock()
+	if full {
+		select {
+		case br.wake <- struct{}{}:
+		default: // already woken
+		}
+	}
+}
+
+func (br *BatchingRegistrar) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-br.wake:
+		case <-ticker.C:
+		case <-br.stop:
+			br.flushPending()
+			return
+		}
+		br.flushPending()
+	}
+}
+
+func (br *BatchingRegistrar) flushPending() {
+	br.Lock()
+	events := br.pending
+	br.pending = nil
+	br.Unlock()
+	if len(events) > 0 {
+		br.flush(events)
+	}
+}
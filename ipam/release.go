@@ -0,0 +1,40 @@
+package ipam
+
+// A request to release a container's addresses over HTTP is taken on
+// trust, so a mistaken one, e.g. from a script given the wrong ID,
+// frees addresses which are still in use, and they can then be handed
+// to another container. With a release checker set, we first ask
+// Docker about the container, and refuse while it is still running.
+// As with reconciliation, only owners which look like Docker container
+// IDs are checked: addresses held by weave itself, or allocated by the
+// Docker plugin, whose owners are not containers, are released as
+// before, as are those of containers which no longer exist.
+
+// ReleaseChecker says whether a container is running.
+// *docker.Client is one.
+type ReleaseChecker interface {
+	ContainerRunning(ident string) (bool, error)
+}
+
+// SetReleaseChecker makes requests over HTTP to release the addresses
+// of a running container fail, unless forced. It must be called
+// before the allocator serves HTTP; nil, the default, checks nothing.
+func (alloc *Allocator) SetReleaseChecker(checker ReleaseChecker) {
+	alloc.releaseChecker = checker
+}
+
+// checkRelease returns an error if ident's addresses should not be
+// released, because its container is running or we can't tell.
+func (alloc *Allocator) checkRelease(ident string, force bool) error {
+	if alloc.releaseChecker == nil || force || !containerIDPattern.MatchString(ident) {
+		return nil
+	}
+	running, err := alloc.releaseChecker.ContainerRunning(ident)
+	switch {
+	case err != nil:
+		return newError(ErrNotReady, "unable to check container %s is not running: %s", ident, err)
+	case running:
+		return newError(ErrInUse, "container %s is still running", ident)
+	}
+	return nil
+}
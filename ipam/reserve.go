@@ -0,0 +1,50 @@
+package ipam
+
+import (
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A peer cut off from the rest of the network by a partition can only
+// allocate from the space it already owns. To make sure it has some,
+// each peer may keep an emergency reserve: a number of free addresses
+// it will not donate to others, and will only allocate itself when no
+// other peer can give it space. The reserve is ordinary owned space,
+// so nothing needs reconciling when the partition heals.
+
+// SetEmergencyReserve sets the size of the reserve, as a fraction of
+// an equal share of the range between the peers which seeded the
+// ring. It must be called before Start; 0, the default, disables the
+// reserve.
+func (alloc *Allocator) SetEmergencyReserve(fraction float64) {
+	alloc.reserveFraction = fraction
+}
+
+// Actor client: work out the size of the reserve, once we know how
+// many seeds there are
+func (alloc *Allocator) updateReserve() {
+	if alloc.reserve > 0 || alloc.reserveFraction <= 0 || len(alloc.ring.Seeds) == 0 {
+		return
+	}
+	share := float64(alloc.ring.Size()) / float64(len(alloc.ring.Seeds))
+	alloc.reserve = address.Offset(alloc.reserveFraction * share)
+	alloc.debugln("Keeping", alloc.reserve, "addresses in reserve")
+}
+
+// Actor client: are we down to our reserve?
+func (alloc *Allocator) inReserve() bool {
+	return alloc.reserve > 0 && alloc.space.NumFreeAddressesInRange(alloc.universe) <= alloc.reserve
+}
+
+// UpdateEmergencyReserve (Sync) changes the size of the reserve while
+// running. Shrinking it makes the difference available for donation
+// at once.
+func (alloc *Allocator) UpdateEmergencyReserve(fraction float64) {
+	doneChan := make(chan struct{})
+	alloc.actionChan <- func() {
+		alloc.reserveFraction = fraction
+		alloc.reserve = 0
+		alloc.updateReserve()
+		doneChan <- struct{}{}
+	}
+	<-doneChan
+}
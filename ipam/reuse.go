@@ -0,0 +1,79 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// An address handed out again straight after it is freed can be hit
+// by traffic meant for its previous owner, from hosts with stale ARP
+// entries or connection tracking state. So freed addresses can be
+// held back for a while before they are reused, oldest first. They
+// stay allocated in our space meanwhile, and one is released early
+// whenever an allocation would otherwise find no free address. A
+// container which gets its address back through affinity, or claims
+// it, need not wait.
+
+type heldAddress struct {
+	addr  address.Address
+	until time.Time
+}
+
+// SetReuseDelay sets how long freed addresses are held back before
+// they can be allocated again. It must be called before Start; 0, the
+// default, reuses them at once.
+func (alloc *Allocator) SetReuseDelay(delay time.Duration) {
+	alloc.reuseDelay = delay
+}
+
+// Actor client: free addr, which a container had, or hold it back for
+// a while
+func (alloc *Allocator) freeAddress(addr address.Address) {
+	delete(alloc.awaitingSetup, addr)
+	if alloc.reuseDelay <= 0 {
+		alloc.space.Free(addr)
+		return
+	}
+	alloc.held = append(alloc.held, heldAddress{addr, alloc.clock.Now().Add(alloc.reuseDelay)})
+}
+
+// Actor client: free the held addresses whose delay is over. They are
+// held in the order they were freed, with the same delay, so the
+// earliest to be over come first.
+func (alloc *Allocator) releaseHeldAddresses() {
+	now := alloc.clock.Now()
+	i := 0
+	for i < len(alloc.held) && !now.Before(alloc.held[i].until) {
+		alloc.space.Free(alloc.held[i].addr)
+		i++
+	}
+	alloc.held = alloc.held[i:]
+}
+
+// Actor client: free the longest held address in r, if any, because
+// there is no other free address to allocate there.
+func (alloc *Allocator) releaseHeldIn(r address.Range) bool {
+	for i, held := range alloc.held {
+		if r.Contains(held.addr) {
+			alloc.releaseHeld(i)
+			return true
+		}
+	}
+	return false
+}
+
+// Actor client: free addr now if it is held, so it can be claimed
+func (alloc *Allocator) releaseHeldAddress(addr address.Address) {
+	for i, held := range alloc.held {
+		if held.addr == addr {
+			alloc.releaseHeld(i)
+			return
+		}
+	}
+}
+
+func (alloc *Allocator) releaseHeld(i int) {
+	alloc.space.Free(alloc.held[i].addr)
+	alloc.held = append(alloc.held[:i], alloc.held[i+1:]...)
+}
@@ -0,0 +1,178 @@
+package ring
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Kinds of divergence between the rings of different peers
+const (
+	DifferentRange   = "different range"
+	DifferentSeeds   = "different seeds"
+	EmptyRing        = "empty ring"
+	ConflictingOwner = "conflicting owners"
+	StaleVersion     = "stale version"
+	MissingEntry     = "missing entry"
+)
+
+// Divergence is a way in which the rings held by some peers disagree.
+// Token is set for those which concern a single entry.
+type Divergence struct {
+	Kind   string
+	Token  *address.Address `json:",omitempty"`
+	Detail string
+}
+
+// Compare reports every way in which the given rings, as held by each
+// peer, disagree. Rings converge by gossip, so recent changes show up
+// as stale versions and missing entries until it has spread; conflicting
+// owners of the same version of an entry should never be seen.
+//
+// Entries are never deleted from a ring, so an entry missing from one
+// peer's ring is what a missing tombstone would be elsewhere.
+func Compare(rings map[mesh.PeerName]*Ring) []Divergence {
+	var result []Divergence
+	if len(rings) < 2 {
+		return result
+	}
+	peers := make([]mesh.PeerName, 0, len(rings))
+	for peer := range rings {
+		peers = append(peers, peer)
+	}
+	sort.Sort(peerNames(peers))
+
+	// Compare against the ring of the first peer which has one
+	var reference mesh.PeerName
+	var seeded []mesh.PeerName
+	var empty []string
+	for _, peer := range peers {
+		r := rings[peer]
+		if r.Empty() {
+			empty = append(empty, peer.String())
+			continue
+		}
+		if len(seeded) == 0 {
+			reference = peer
+		} else if ref := rings[reference]; r.Start != ref.Start || r.End != ref.End || !sameRanges(r.Ranges, ref.Ranges) {
+			result = append(result, Divergence{Kind: DifferentRange,
+				Detail: fmt.Sprintf("%s has %s, %s has %s", reference, describeRange(ref), peer, describeRange(r))})
+		} else if !sameSeeds(r.Seeds, ref.Seeds) {
+			result = append(result, Divergence{Kind: DifferentSeeds,
+				Detail: fmt.Sprintf("%s was seeded by %v, %s by %v", reference, ref.Seeds, peer, r.Seeds)})
+		}
+		seeded = append(seeded, peer)
+	}
+	if len(empty) > 0 && len(seeded) > 0 {
+		result = append(result, Divergence{Kind: EmptyRing, Detail: "no entries at " + strings.Join(empty, ", ")})
+	}
+
+	// Entries at each token, by peer
+	tokens := make(map[address.Address]map[mesh.PeerName]*entry)
+	for _, peer := range seeded {
+		for _, e := range rings[peer].Entries {
+			if tokens[e.Token] == nil {
+				tokens[e.Token] = make(map[mesh.PeerName]*entry)
+			}
+			tokens[e.Token][peer] = e
+		}
+	}
+	sorted := make([]address.Address, 0, len(tokens))
+	for token := range tokens {
+		sorted = append(sorted, token)
+	}
+	sort.Sort(addresses(sorted))
+
+	for _, token := range sorted {
+		held := tokens[token]
+		var latest uint32
+		for _, e := range held {
+			if e.Version > latest {
+				latest = e.Version
+			}
+		}
+		owners := make(map[mesh.PeerName][]string)
+		var stale, missing []string
+		for _, peer := range seeded {
+			e, found := held[peer]
+			switch {
+			case !found:
+				missing = append(missing, peer.String())
+			case e.Version < latest:
+				stale = append(stale, fmt.Sprintf("%s has %d", peer, e.Version))
+			default:
+				owners[e.Peer] = append(owners[e.Peer], peer.String())
+			}
+		}
+		t := token
+		if len(owners) > 1 {
+			var claims []string
+			for owner, according := range owners {
+				claims = append(claims, fmt.Sprintf("%s according to %s", owner, strings.Join(according, ", ")))
+			}
+			sort.Strings(claims)
+			result = append(result, Divergence{ConflictingOwner, &t,
+				fmt.Sprintf("version %d is owned by %s", latest, strings.Join(claims, "; "))})
+		}
+		if len(stale) > 0 {
+			result = append(result, Divergence{StaleVersion, &t,
+				fmt.Sprintf("latest is version %d; %s", latest, strings.Join(stale, ", "))})
+		}
+		if len(missing) > 0 {
+			result = append(result, Divergence{MissingEntry, &t,
+				fmt.Sprintf("not held by %s", strings.Join(missing, ", "))})
+		}
+	}
+	return result
+}
+
+func describeRange(r *Ring) string {
+	if len(r.Ranges) == 0 {
+		return r.Range().String()
+	}
+	return fmt.Sprint(r.Ranges)
+}
+
+func sameRanges(a, b []address.Range) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Like Merge, rings with no seeds recorded are taken to agree
+func sameSeeds(a, b []mesh.PeerName) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type peerNames []mesh.PeerName
+
+func (ps peerNames) Len() int           { return len(ps) }
+func (ps peerNames) Less(i, j int) bool { return ps[i] < ps[j] }
+func (ps peerNames) Swap(i, j int)      { ps[i], ps[j] = ps[j], ps[i] }
+
+type addresses []address.Address
+
+func (as addresses) Len() int           { return len(as) }
+func (as addresses) Less(i, j int) bool { return as[i] < as[j] }
+func (as addresses) Swap(i, j int)      { as[i], as[j] = as[j], as[i] }
@@ -26,6 +26,6 @@ func (i _uint32) String() string {
 
 func (r *Ring) updateExportedVariables() {
 	ringName := r.Start.String()
-	expRingSize.Set(ringName, _uint32(r.End-r.Start))
+	expRingSize.Set(ringName, _uint32(r.Size()))
 	expRingEntries.Set(ringName, _int(len(r.Entries)))
 }
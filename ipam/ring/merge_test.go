@@ -0,0 +1,93 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A ring over 10.0.0.0/8 with n entries, spread evenly and owned in
+// turn by peers 1 to 3. Its own peer owns none of them, so it can
+// merge newer versions of any.
+func makeBenchRing(n int) *Ring {
+	first, last := ParseIP("10.0.0.0"), ParseIP("11.0.0.0")
+	r := New(first, last, mesh.PeerName(0x99))
+	peers := []mesh.PeerName{peer1name, peer2name, peer3name}
+	step := address.Offset(int(last-first) / n)
+	for i := 0; i < n; i++ {
+		r.Entries = append(r.Entries, &entry{Token: address.Add(first, address.Offset(i)*step), Peer: peers[i%3], Version: 1})
+	}
+	return r
+}
+
+func (r *Ring) copyEntries() *Ring {
+	result := *r
+	result.Entries = make(entries, len(r.Entries))
+	for i, e := range r.Entries {
+		copy := *e
+		result.Entries[i] = &copy
+	}
+	return &result
+}
+
+// Steady-state gossip: the incoming ring is the same as ours
+func benchmarkMergeSame(b *testing.B, n int) {
+	ours, theirs := makeBenchRing(n), makeBenchRing(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ours.Merge(*theirs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// High churn: every entry in the incoming ring is newer than ours
+func benchmarkMergeChurn(b *testing.B, n int) {
+	base, theirs := makeBenchRing(n), makeBenchRing(n)
+	for _, e := range theirs.Entries {
+		e.Version++
+	}
+	rings := make([]*Ring, b.N)
+	for i := range rings {
+		rings[i] = base.copyEntries()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rings[i].Merge(*theirs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMergeSame10(b *testing.B)   { benchmarkMergeSame(b, 10) }
+func BenchmarkMergeSame1k(b *testing.B)   { benchmarkMergeSame(b, 1000) }
+func BenchmarkMergeSame50k(b *testing.B)  { benchmarkMergeSame(b, 50000) }
+func BenchmarkMergeChurn10(b *testing.B)  { benchmarkMergeChurn(b, 10) }
+func BenchmarkMergeChurn1k(b *testing.B)  { benchmarkMergeChurn(b, 1000) }
+func BenchmarkMergeChurn50k(b *testing.B) { benchmarkMergeChurn(b, 50000) }
+
+// The regression gate for the benchmarks above: a merge must allocate
+// a fixed number of times, however big the ring, rather than once per
+// entry.
+func TestMergeAllocations(t *testing.T) {
+	for _, n := range []int{10, 1000} {
+		ours, theirs := makeBenchRing(n), makeBenchRing(n)
+		same := testing.AllocsPerRun(10, func() {
+			require.NoError(t, ours.Merge(*theirs))
+		})
+		for _, e := range theirs.Entries {
+			e.Version++
+		}
+		churn := testing.AllocsPerRun(10, func() {
+			require.NoError(t, ours.copyEntries().Merge(*theirs))
+		}) - float64(n+1) // allocated by copyEntries
+		require.True(t, same <= 16, fmt.Sprintf("%d entries unchanged: %v allocations", n, same))
+		require.True(t, churn <= 16, fmt.Sprintf("%d entries changed: %v allocations", n, churn))
+	}
+}
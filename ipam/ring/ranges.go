@@ -0,0 +1,129 @@
+package ring
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A ring can be made of several disjoint ranges, e.g. 10.2.0.0/24 plus
+// 10.9.0.0/24, which it treats as one pool. Tokens still run from
+// Start to End, so the entry before a gap owns it, but only the
+// addresses within Ranges are handed out or counted as free.
+
+// NewFromRanges creates an empty ring belonging to peer, made of the
+// given ranges, which must not overlap.
+func NewFromRanges(ranges []address.Range, peer mesh.PeerName) *Ring {
+	common.Assert(len(ranges) > 0)
+	sorted := make([]address.Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Sort(rangesByStart(sorted))
+	for i := 1; i < len(sorted); i++ {
+		common.Assert(sorted[i-1].End <= sorted[i].Start)
+	}
+	ring := New(sorted[0].Start, sorted[len(sorted)-1].End, peer)
+	if len(sorted) > 1 {
+		ring.Ranges = sorted
+	}
+	return ring
+}
+
+// AllRanges returns the ranges the ring is made of.
+func (r *Ring) AllRanges() []address.Range {
+	if r.Ranges == nil {
+		return []address.Range{r.Range()}
+	}
+	return r.Ranges
+}
+
+// RangesString describes the ranges the ring is made of.
+func (r *Ring) RangesString() string {
+	var strs []string
+	for _, rg := range r.AllRanges() {
+		strs = append(strs, rg.AsCIDRString())
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Size returns the number of addresses in the ring.
+func (r *Ring) Size() address.Offset {
+	var size address.Offset
+	for _, rg := range r.AllRanges() {
+		size += rg.Size()
+	}
+	return size
+}
+
+// Overlaps returns true if rg contains any address in the ring.
+func (r *Ring) Overlaps(rg address.Range) bool {
+	for _, own := range r.AllRanges() {
+		if own.Overlaps(rg) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Ring) sameRanges(ranges []address.Range) bool {
+	if len(r.Ranges) != len(ranges) {
+		return false
+	}
+	for i, rg := range ranges {
+		if rg != r.Ranges[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// clip restricts ranges, which are in order, to the addresses in the
+// ring
+func (r *Ring) clip(ranges []address.Range) []address.Range {
+	if r.Ranges == nil {
+		return ranges
+	}
+	var result []address.Range
+	for _, rg := range ranges {
+		for _, own := range r.Ranges {
+			if clipped := rg.Intersect(own); !clipped.Empty() {
+				result = append(result, clipped)
+			}
+		}
+	}
+	return result
+}
+
+// usableDistance is like distance, but leaves out the gaps between
+// the ring's ranges
+func (r *Ring) usableDistance(start, end address.Address) address.Offset {
+	if r.Ranges == nil {
+		return r.distance(start, end)
+	}
+	var size address.Offset
+	for _, rg := range r.clip(r.splitRangesOverZero([]address.Range{{Start: start, End: end}})) {
+		size += rg.Size()
+	}
+	return size
+}
+
+// addressAt returns the address offset addresses into the ring,
+// skipping any gaps between its ranges
+func (r *Ring) addressAt(offset address.Offset) address.Address {
+	for _, rg := range r.AllRanges() {
+		if offset < rg.Size() {
+			return address.Add(rg.Start, offset)
+		}
+		offset -= rg.Size()
+	}
+	return r.End
+}
+
+type rangesByStart []address.Range
+
+func (a rangesByStart) Len() int           { return len(a) }
+func (a rangesByStart) Less(i, j int) bool { return a[i].Start < a[j].Start }
+func (a rangesByStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -24,6 +24,18 @@ type Ring struct {
 	Peer       mesh.PeerName   // name of peer owning this ring instance
 	Entries    entries         // list of entries sorted by token
 	Seeds      []mesh.PeerName // peers with which the ring was seeded
+	Ranges     []address.Range // if the ring is made of more than one; see ranges.go
+	version    uint64          // not gossiped; see Version
+}
+
+// Version changes whenever the ring does, so that anything worked out
+// from the ring, such as its encoding, can be kept until then.
+func (r *Ring) Version() uint64 {
+	return r.version
+}
+
+func (r *Ring) changed() {
+	r.version++
 }
 
 func (r *Ring) assertInvariants() {
@@ -118,6 +130,7 @@ func (r *Ring) GrantRangeToHost(start, end address.Address, peer mesh.PeerName)
 	r.assertInvariants()
 	defer r.assertInvariants()
 	defer r.updateExportedVariables()
+	defer r.changed()
 
 	// ----------------- Start of Checks -----------------
 
@@ -202,13 +215,33 @@ func (r *Ring) Merge(gossip Ring) error {
 		}
 	}
 
-	if r.Start != gossip.Start || r.End != gossip.End {
+	if r.Start != gossip.Start || r.End != gossip.End || !r.sameRanges(gossip.Ranges) {
 		return ErrDifferentRange
 	}
 
-	// Now merge their ring with yours, in a temporary ring.
+	// Now merge their ring with yours. Nothing is allocated until
+	// theirs turns out to have something ours lacks, which in steady
+	// state it mostly doesn't. Then result takes our entries up to
+	// that point, and everything after; entries of theirs are copied
+	// into one preallocated block, as gossip still owns them.
 	var result entries
-	addToResult := func(e entry) { result = append(result, &e) }
+	var copies []entry
+	changed := false
+	takeMine := func(e *entry) {
+		if changed {
+			result = append(result, e)
+		}
+	}
+	takeTheirs := func(e *entry, i int) {
+		if !changed {
+			changed = true
+			result = make(entries, i, len(r.Entries)+len(gossip.Entries))
+			copy(result, r.Entries[:i])
+			copies = make([]entry, 0, len(gossip.Entries))
+		}
+		copies = append(copies, *e)
+		result = append(result, &copies[len(copies)-1])
+	}
 
 	var mine, theirs *entry
 	var previousOwner *mesh.PeerName
@@ -218,7 +251,7 @@ func (r *Ring) Merge(gossip Ring) error {
 		mine, theirs = r.Entries[i], gossip.Entries[j]
 		switch {
 		case mine.Token < theirs.Token:
-			addToResult(*mine)
+			takeMine(mine)
 			previousOwner = &mine.Peer
 			i++
 		case mine.Token > theirs.Token:
@@ -226,7 +259,7 @@ func (r *Ring) Merge(gossip Ring) error {
 			if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer {
 				return ErrEntryInMyRange
 			}
-			addToResult(*theirs)
+			takeTheirs(theirs, i)
 			previousOwner = nil
 			j++
 		case mine.Token == theirs.Token:
@@ -237,13 +270,13 @@ func (r *Ring) Merge(gossip Ring) error {
 					common.Log.Debugf("Error merging entries at %s - %v != %v", mine.Token, mine, theirs)
 					return ErrInvalidEntry
 				}
-				addToResult(*mine)
+				takeMine(mine)
 				previousOwner = &mine.Peer
 			case mine.Version < theirs.Version:
 				if mine.Peer == r.Peer { // We shouldn't receive updates to our own tokens
 					return ErrNewerVersion
 				}
-				addToResult(*theirs)
+				takeTheirs(theirs, i)
 				previousOwner = nil
 			}
 			i++
@@ -255,8 +288,7 @@ func (r *Ring) Merge(gossip Ring) error {
 	// of gossip, so copy over the remaining entries.
 
 	for ; i < len(r.Entries); i++ {
-		mine = r.Entries[i]
-		addToResult(*mine)
+		takeMine(r.Entries[i])
 	}
 
 	for ; j < len(gossip.Entries); j++ {
@@ -264,14 +296,18 @@ func (r *Ring) Merge(gossip Ring) error {
 		if previousOwner != nil && *previousOwner == r.Peer && theirs.Peer != r.Peer {
 			return ErrEntryInMyRange
 		}
-		addToResult(*theirs)
+		takeTheirs(theirs, i)
 		previousOwner = nil
 	}
 
-	if len(r.Seeds) == 0 {
+	if len(r.Seeds) == 0 && len(gossip.Seeds) > 0 {
 		r.Seeds = gossip.Seeds
+		r.changed()
+	}
+	if changed {
+		r.Entries = result
+		r.changed()
 	}
-	r.Entries = result
 	return nil
 }
 
@@ -314,7 +350,7 @@ func (r *Ring) OwnedRanges() (result []address.Range) {
 		}
 	}
 
-	return r.splitRangesOverZero(result)
+	return r.clip(r.splitRangesOverZero(result))
 }
 
 // For printing status
@@ -328,7 +364,7 @@ func (r *Ring) AllRangeInfo() (result []RangeInfo) {
 	for i, entry := range r.Entries {
 		nextEntry := r.Entries.entry(i + 1)
 		ranges := []address.Range{{Start: entry.Token, End: nextEntry.Token}}
-		ranges = r.splitRangesOverZero(ranges)
+		ranges = r.clip(r.splitRangesOverZero(ranges))
 		for _, r := range ranges {
 			result = append(result, RangeInfo{entry.Peer, r, entry.Version})
 		}
@@ -336,17 +372,36 @@ func (r *Ring) AllRangeInfo() (result []RangeInfo) {
 	return
 }
 
+// EntryUsage describes the space between one token and the next
+type EntryUsage struct {
+	Peer  mesh.PeerName
+	Start address.Address
+	Size  address.Offset
+	Free  address.Offset // as last reported by Peer
+}
+
+// Usage returns an EntryUsage for each entry, in token order.
+func (r *Ring) Usage() (result []EntryUsage) {
+	for i, entry := range r.Entries {
+		nextEntry := r.Entries.entry(i + 1)
+		size := r.usableDistance(entry.Token, nextEntry.Token)
+		result = append(result, EntryUsage{entry.Peer, entry.Token, size, entry.Free})
+	}
+	return
+}
+
 // ClaimForPeers claims the entire ring for the array of peers passed
 // in.  Only works for empty rings.
 func (r *Ring) ClaimForPeers(peers []mesh.PeerName) {
 	common.Assert(r.Empty())
 	defer r.assertInvariants()
 	defer r.updateExportedVariables()
+	defer r.changed()
 
-	totalSize := r.distance(r.Start, r.End)
+	totalSize := r.Size()
 	share := totalSize/address.Offset(len(peers)) + 1
 	remainder := totalSize % address.Offset(len(peers))
-	pos := r.Start
+	var offset address.Offset
 
 	for i, peer := range peers {
 		if address.Offset(i) == remainder {
@@ -356,16 +411,17 @@ func (r *Ring) ClaimForPeers(peers []mesh.PeerName) {
 			}
 		}
 
+		pos := r.addressAt(offset)
 		if e, found := r.Entries.get(pos); found {
 			e.update(peer, share)
 		} else {
 			r.Entries.insert(entry{Token: pos, Peer: peer, Free: share})
 		}
 
-		pos += address.Address(share)
+		offset += share
 	}
 
-	common.Assert(pos == r.End)
+	common.Assert(offset == totalSize)
 
 	r.Seeds = peers
 }
@@ -389,48 +445,68 @@ func (r *Ring) String() string {
 	return buffer.String()
 }
 
+// TotalFree returns the number of free addresses in the ring, as last
+// reported by their owners.
+func (r *Ring) TotalFree() address.Offset {
+	total := address.Offset(0)
+	for _, entry := range r.Entries {
+		total += entry.Free
+	}
+	return total
+}
+
 // ReportFree is used by the allocator to tell the ring how many free
 // ips are in a given range, so that ChoosePeersToAskForSpace can make
-// more intelligent decisions.
-func (r *Ring) ReportFree(freespace map[address.Address]address.Offset) {
+// more intelligent decisions. A range may be reported in several
+// pieces, as OwnedRanges splits it around the origin and around any
+// gaps between the ring's ranges. It returns an error, having updated
+// nothing, if the report doesn't fit the ring, e.g. because it covers
+// a range which someone else owns.
+func (r *Ring) ReportFree(freespace map[address.Address]address.Offset) error {
 	r.assertInvariants()
 	defer r.assertInvariants()
 	defer r.updateExportedVariables()
 
-	common.Assert(!r.Empty())
-	entries := r.Entries
-
-	// As OwnedRanges splits around the origin, we need to
-	// detect that here and fix up freespace
-	if free, found := freespace[r.Start]; found && entries.entry(0).Token != r.Start {
-		lastToken := entries.entry(-1).Token
-		prevFree, found := freespace[lastToken]
-		common.Assert(found)
-		freespace[lastToken] = prevFree + free
-		delete(freespace, r.Start)
+	if r.Empty() {
+		return fmt.Errorf("Reporting free space on an empty ring")
 	}
+	entries := r.Entries
 
+	// Add up the pieces reported for each entry
+	totals := make(map[int]address.Offset)
 	for start, free := range freespace {
-		// Look for entry
+		// Look for the entry whose range contains start; before the
+		// first entry means the range wrapping around from the last
 		i := sort.Search(len(entries), func(j int) bool {
-			return entries[j].Token >= start
-		})
+			return entries[j].Token > start
+		}) - 1
+		if i < 0 {
+			i = len(entries) - 1
+		}
 
 		// Are you trying to report free on space I don't own?
-		common.Assert(i < len(entries) && entries[i].Token == start && entries[i].Peer == r.Peer)
+		if entries[i].Peer != r.Peer {
+			return fmt.Errorf("Reporting free space at %s, which is owned by %s", start, entries[i].Peer)
+		}
+		totals[i] += free
+	}
 
+	for i, free := range totals {
 		// Check we're not reporting more space than the range
 		entry, next := entries.entry(i), entries.entry(i+1)
-		maxSize := r.distance(entry.Token, next.Token)
-		common.Assert(free <= maxSize)
-
-		if entries[i].Free == free {
-			return
+		if maxSize := r.usableDistance(entry.Token, next.Token); free > maxSize {
+			return fmt.Errorf("Reporting %d free addresses at %s, in a range of %d", free, entry.Token, maxSize)
 		}
+	}
 
-		entries[i].Free = free
-		entries[i].Version++
+	for i, free := range totals {
+		if entries[i].Free != free {
+			entries[i].Free = free
+			entries[i].Version++
+			r.changed()
+		}
 	}
+	return nil
 }
 
 type weightedPeer struct {
@@ -446,7 +522,10 @@ func (ws weightedPeers) Swap(i, j int)      { ws[i], ws[j] = ws[j], ws[i] }
 
 // ChoosePeersToAskForSpace returns all peers we can ask for space in
 // the range [start, end), in weighted-random order.  Assumes start<end.
-func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []mesh.PeerName {
+// Peers are weighted by their free space divided by their distance,
+// which is at least 1, e.g. the number of hops to them; a nil distance
+// puts every peer at 1.
+func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address, distance func(mesh.PeerName) int) []mesh.PeerName {
 	totalSpacePerPeer := make(map[mesh.PeerName]address.Offset)
 
 	// iterate through tokens
@@ -476,7 +555,13 @@ func (r *Ring) ChoosePeersToAskForSpace(start, end address.Address) []mesh.PeerN
 	// twice as often as an item with weight 1, but it's good enough for our purposes.
 	ws := make(weightedPeers, 0, len(totalSpacePerPeer))
 	for peername, space := range totalSpacePerPeer {
-		ws = append(ws, weightedPeer{weight: float64(space) * rand.Float64(), peername: peername})
+		weight := float64(space)
+		if distance != nil {
+			if d := distance(peername); d > 1 {
+				weight /= float64(d)
+			}
+		}
+		ws = append(ws, weightedPeer{weight: weight * rand.Float64(), peername: peername})
 	}
 	sort.Sort(ws)
 	result := make([]mesh.PeerName, len(ws))
@@ -517,13 +602,19 @@ func (r *Ring) Transfer(from, to mesh.PeerName) ([]address.Range, error) {
 	if !found {
 		return nil, ErrNotFound
 	}
+	r.changed()
 
-	return r.splitRangesOverZero(newRanges), nil
+	return r.clip(r.splitRangesOverZero(newRanges)), nil
 }
 
 // Contains returns true if addr is in this ring
 func (r *Ring) Contains(addr address.Address) bool {
-	return addr >= r.Start && addr < r.End
+	for _, rg := range r.AllRanges() {
+		if rg.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 // Owner returns the peername which owns the range containing addr
@@ -12,6 +12,7 @@ import (
 
 	"github.com/weaveworks/weave/common"
 	"github.com/weaveworks/weave/net/address"
+	wt "github.com/weaveworks/weave/testing"
 )
 
 var (
@@ -352,8 +353,104 @@ func TestGossip(t *testing.T) {
 	assertRing(ring2, []*entry{{Token: start, Peer: peer1name, Free: 255}})
 }
 
+func TestSummary(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.ClaimItAll()
+	for token := start + 4; token < end-4; token += 8 {
+		ring1.GrantRangeToHost(token, token+4, peer2name)
+	}
+	ring2 := New(start, end, peer3name)
+
+	// An empty ring differs wherever there are entries
+	diffs, err := ring2.Differences(ring1.Summary())
+	require.NoError(t, err)
+	require.True(t, len(diffs) > summarySegments/2)
+
+	require.NoError(t, ring2.Merge(*ring1.Segments(diffs)))
+	require.Equal(t, ring1.Entries, ring2.Entries)
+	diffs, err = ring2.Differences(ring1.Summary())
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	// Only the segment which changed needs sending
+	ring1.GrantRangeToHost(dot250, dot250+1, peer2name)
+	diffs, err = ring2.Differences(ring1.Summary())
+	require.NoError(t, err)
+	require.Equal(t, []int{ring1.segment(dot250)}, diffs)
+	require.True(t, len(ring1.Segments(diffs).Entries) < len(ring1.Entries))
+	require.NoError(t, ring2.Merge(*ring1.Segments(diffs)))
+	require.Equal(t, ring1.Entries, ring2.Entries)
+
+	// Rings which can't be merged can't be compared either
+	ring3 := New(start, end, peer3name)
+	ring3.ClaimForPeers([]mesh.PeerName{peer3name})
+	_, err = ring3.Differences(ring1.Summary())
+	require.Equal(t, ErrDifferentSeeds, err)
+	_, err = New(dot10, end, peer3name).Differences(ring1.Summary())
+	require.Equal(t, ErrDifferentRange, err)
+}
+
+func TestSummaryRanges(t *testing.T) {
+	ranges := []address.Range{
+		{Start: ParseIP("10.2.0.0"), End: ParseIP("10.2.1.0")},
+		{Start: ParseIP("10.9.0.0"), End: ParseIP("10.9.1.0")},
+	}
+	ring1 := NewFromRanges(ranges, peer1name)
+	ring1.ClaimForPeers([]mesh.PeerName{peer1name, peer2name})
+	ring2 := NewFromRanges(ranges, peer3name)
+
+	diffs, err := ring2.Differences(ring1.Summary())
+	require.NoError(t, err)
+	require.NotEmpty(t, diffs)
+	require.NoError(t, ring2.Merge(*ring1.Segments(diffs)))
+	require.Equal(t, ring1.Entries, ring2.Entries)
+}
+
+func TestString(t *testing.T) {
+	ring := New(start, end, peer1name)
+	ring.ClaimItAll()
+	ring.GrantRangeToHost(dot10, middle, peer2name)
+	ring.GrantRangeToHost(dot245, dot250, peer3name)
+	wt.AssertGolden(t, "ring", []byte(ring.String()))
+}
+
+func TestRanges(t *testing.T) {
+	ranges := []address.Range{
+		{Start: ParseIP("10.9.0.0"), End: ParseIP("10.9.1.0")},
+		{Start: ParseIP("10.2.0.0"), End: ParseIP("10.2.1.0")},
+	}
+	ring1 := NewFromRanges(ranges, peer1name)
+	require.Equal(t, ParseIP("10.2.0.0"), ring1.Start)
+	require.Equal(t, ParseIP("10.9.1.0"), ring1.End)
+	require.Equal(t, address.Offset(512), ring1.Size())
+	require.Equal(t, "10.2.0.0/24, 10.9.0.0/24", ring1.RangesString())
+	require.True(t, ring1.Contains(ParseIP("10.9.0.1")))
+	require.False(t, ring1.Contains(ParseIP("10.5.0.1")))
+	require.False(t, ring1.Overlaps(address.Range{Start: ParseIP("10.5.0.0"), End: ParseIP("10.6.0.0")}))
+
+	// Each peer gets half of the addresses, not half of the span
+	ring1.ClaimForPeers([]mesh.PeerName{peer1name, peer2name})
+	require.Equal(t, []*entry{
+		{Token: ParseIP("10.2.0.0"), Peer: peer1name, Free: 256},
+		{Token: ParseIP("10.9.0.0"), Peer: peer2name, Free: 256},
+	}, []*entry(ring1.Entries))
+	require.Equal(t, []address.Range{ranges[1]}, ring1.OwnedRanges())
+	for _, usage := range ring1.Usage() {
+		require.Equal(t, address.Offset(256), usage.Size)
+	}
+
+	ring2 := NewFromRanges(ranges, peer2name)
+	require.NoError(t, ring2.Merge(*ring1))
+	require.Equal(t, []address.Range{ranges[0]}, ring2.OwnedRanges())
+
+	// A ring made of different ranges can't be merged, even if it
+	// spans the same addresses
+	ring3 := NewFromRanges([]address.Range{{Start: ParseIP("10.2.0.0"), End: ParseIP("10.9.1.0")}}, peer3name)
+	require.Equal(t, ErrDifferentRange, ring3.Merge(*ring1))
+}
+
 func assertPeersWithSpace(t *testing.T, ring *Ring, start, end address.Address, expected int) []mesh.PeerName {
-	peers := ring.ChoosePeersToAskForSpace(start, end)
+	peers := ring.ChoosePeersToAskForSpace(start, end, nil)
 	require.Equal(t, expected, len(peers))
 	return peers
 }
@@ -367,7 +464,7 @@ func TestFindFree(t *testing.T) {
 	assertPeersWithSpace(t, ring1, start, end, 0)
 
 	// We shouldn't return outselves
-	ring1.ReportFree(map[address.Address]address.Offset{start: 10})
+	require.NoError(t, ring1.ReportFree(map[address.Address]address.Offset{start: 10}))
 	assertPeersWithSpace(t, ring1, start, end, 0)
 
 	ring1.Entries = []*entry{{Token: start, Peer: peer1name, Free: 1},
@@ -394,6 +491,26 @@ func TestFindFree(t *testing.T) {
 	ring1.assertInvariants()
 }
 
+func TestFindFreeNearby(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.Entries = []*entry{{Token: start, Peer: peer2name, Free: 100},
+		{Token: middle, Peer: peer3name, Free: 100}}
+	distance := func(peer mesh.PeerName) int {
+		if peer == peer2name {
+			return 1
+		}
+		return 10
+	}
+	// The nearer peer comes first but one time in twenty
+	nearerFirst := 0
+	for i := 0; i < 1000; i++ {
+		if ring1.ChoosePeersToAskForSpace(start, end, distance)[0] == peer2name {
+			nearerFirst++
+		}
+	}
+	require.True(t, nearerFirst > 900, "nearer peer first %d times in 1000", nearerFirst)
+}
+
 func TestReportFree(t *testing.T) {
 	ring1 := New(start, end, peer1name)
 	ring2 := New(start, end, peer2name)
@@ -406,7 +523,12 @@ func TestReportFree(t *testing.T) {
 	for _, r := range ring2.OwnedRanges() {
 		freespace[r.Start] = 0
 	}
-	ring2.ReportFree(freespace)
+	require.NoError(t, ring2.ReportFree(freespace))
+
+	// Reports which don't fit the ring are refused, changing nothing
+	require.Error(t, ring2.ReportFree(map[address.Address]address.Offset{start: 0}))
+	require.Error(t, ring2.ReportFree(map[address.Address]address.Offset{middle: 1000}))
+	require.Error(t, New(start, end, peer1name).ReportFree(freespace))
 }
 
 func TestMisc(t *testing.T) {
@@ -489,6 +611,18 @@ func TestTransfer(t *testing.T) {
 	require.Equal(t, []address.Range{{start, dot10}, {middle, end}}, ring1.OwnedRanges())
 }
 
+func TestUsage(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	require.Nil(t, ring1.Usage())
+
+	ring1.ClaimItAll()
+	require.Equal(t, []EntryUsage{{peer1name, start, 255, 255}}, ring1.Usage())
+
+	ring1.GrantRangeToHost(middle, end, peer2name)
+	require.NoError(t, ring1.ReportFree(map[address.Address]address.Offset{start: 100}))
+	require.Equal(t, []EntryUsage{{peer1name, start, 128, 100}, {peer2name, middle, 127, 127}}, ring1.Usage())
+}
+
 func TestOwner(t *testing.T) {
 	ring1 := New(start, end, peer1name)
 	require.True(t, ring1.Contains(start), "start should be in ring")
@@ -506,6 +640,28 @@ func TestOwner(t *testing.T) {
 
 }
 
+func TestCompare(t *testing.T) {
+	ring1 := New(start, end, peer1name)
+	ring1.Entries = []*entry{{Token: start, Peer: peer1name, Version: 2}, {Token: middle, Peer: peer2name}}
+	ring2 := New(start, end, peer2name)
+	ring2.Entries = []*entry{{Token: start, Peer: peer1name, Version: 2}, {Token: middle, Peer: peer2name}}
+	require.Empty(t, Compare(map[mesh.PeerName]*Ring{peer1name: ring1, peer2name: ring2}))
+
+	ring2.Entries = []*entry{{Token: start, Peer: peer1name, Version: 1}, {Token: middle, Peer: peer3name}, {Token: dot245, Peer: peer2name}}
+	ring3 := New(start, end, peer3name)
+	require.Equal(t, []Divergence{
+		{EmptyRing, nil, "no entries at " + peer3name.String()},
+		{StaleVersion, &start, fmt.Sprintf("latest is version 2; %s has 1", peer2name)},
+		{ConflictingOwner, &middle, fmt.Sprintf("version 0 is owned by %s according to %s; %s according to %s", peer2name, peer1name, peer3name, peer2name)},
+		{MissingEntry, &dot245, "not held by " + peer1name.String()},
+	}, Compare(map[mesh.PeerName]*Ring{peer1name: ring1, peer2name: ring2, peer3name: ring3}))
+
+	ring2 = New(start, middle, peer2name)
+	ring2.Entries = []*entry{{Token: start, Peer: peer2name}}
+	divergences := Compare(map[mesh.PeerName]*Ring{peer1name: ring1, peer2name: ring2})
+	require.Equal(t, DifferentRange, divergences[0].Kind)
+}
+
 type addressSlice []address.Address
 
 func (s addressSlice) Len() int           { return len(s) }
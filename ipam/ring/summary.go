@@ -0,0 +1,115 @@
+package ring
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// The range of a ring is split into this many equal segments, which
+// are the leaves of its Summary
+const summarySegments = 64
+
+// Summary is a Merkle tree of hashes of the entries of a ring, which
+// lets two peers find the segments in which their rings differ
+// without exchanging the rings. Hashes is in heap order: the root
+// first, and the children of node i at 2i+1 and 2i+2. A segment with
+// no entries hashes to 0.
+type Summary struct {
+	Start, End address.Address
+	Peer       mesh.PeerName // of the ring summarised
+	Seeds      []mesh.PeerName
+	Ranges     []address.Range
+	Hashes     []uint64
+}
+
+func (r *Ring) segment(token address.Address) int {
+	return int(uint64(token-r.Start) * summarySegments / uint64(r.End-r.Start))
+}
+
+// Summary summarises the ring. Like Equal, it ignores free space,
+// which only changes along with the version.
+func (r *Ring) Summary() *Summary {
+	hashes := make([]uint64, 2*summarySegments-1)
+	leaves := hashes[summarySegments-1:]
+	buf := make([]byte, 16)
+	for i := 0; i < len(r.Entries); {
+		segment, h := r.segment(r.Entries[i].Token), fnv.New64a()
+		for ; i < len(r.Entries) && r.segment(r.Entries[i].Token) == segment; i++ {
+			e := r.Entries[i]
+			binary.BigEndian.PutUint32(buf[0:], uint32(e.Token))
+			binary.BigEndian.PutUint64(buf[4:], uint64(e.Peer))
+			binary.BigEndian.PutUint32(buf[12:], e.Version)
+			h.Write(buf)
+		}
+		leaves[segment] = h.Sum64()
+	}
+	for i := summarySegments - 2; i >= 0; i-- {
+		h := fnv.New64a()
+		binary.BigEndian.PutUint64(buf[0:], hashes[2*i+1])
+		binary.BigEndian.PutUint64(buf[8:], hashes[2*i+2])
+		h.Write(buf)
+		hashes[i] = h.Sum64()
+	}
+	return &Summary{Start: r.Start, End: r.End, Peer: r.Peer, Seeds: r.Seeds, Ranges: r.Ranges, Hashes: hashes}
+}
+
+// Differences returns the segments in which this ring differs from
+// the one summarised, looking only inside subtrees whose hashes
+// differ. It returns the same errors as Merge if the rings cannot be
+// compared.
+func (r *Ring) Differences(s *Summary) ([]int, error) {
+	if r.Start != s.Start || r.End != s.End || !r.sameRanges(s.Ranges) {
+		return nil, ErrDifferentRange
+	}
+	if len(s.Seeds) > 0 && len(r.Seeds) > 0 {
+		if len(s.Seeds) != len(r.Seeds) {
+			return nil, ErrDifferentSeeds
+		}
+		for i, seed := range s.Seeds {
+			if seed != r.Seeds[i] {
+				return nil, ErrDifferentSeeds
+			}
+		}
+	}
+	if len(s.Hashes) != 2*summarySegments-1 {
+		return nil, ErrInvalidEntry
+	}
+
+	ours := r.Summary().Hashes
+	var result []int
+	var walk func(i int)
+	walk = func(i int) {
+		switch {
+		case ours[i] == s.Hashes[i]:
+		case i >= summarySegments-1:
+			result = append(result, i-(summarySegments-1))
+		default:
+			walk(2*i + 1)
+			walk(2*i + 2)
+		}
+	}
+	walk(0)
+	return result, nil
+}
+
+// Segments returns a copy of the ring holding only its entries in the
+// given segments. Merging it into a ring which matched this one in
+// every other segment has the same effect as merging the whole ring.
+func (r *Ring) Segments(segments []int) *Ring {
+	wanted := make(map[int]bool, len(segments))
+	for _, segment := range segments {
+		wanted[segment] = true
+	}
+	result := &Ring{Start: r.Start, End: r.End, Peer: r.Peer, Entries: make([]*entry, 0), Seeds: r.Seeds, Ranges: r.Ranges}
+	for _, e := range r.Entries {
+		if wanted[r.segment(e.Token)] {
+			copy := *e
+			result.Entries = append(result.Entries, &copy)
+		}
+	}
+	return result
+}
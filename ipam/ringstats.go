@@ -0,0 +1,115 @@
+package ipam
+
+import (
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// RingStats describes how full each part of the ring is, e.g. to draw
+// a heatmap. Free counts are as last reported by each owner, so those
+// of other peers may be a little out of date.
+type RingStats struct {
+	Range   string
+	Entries []EntryStats
+	Peers   []PeerStats
+	// Ownership fragmentation over the whole ring; see PeerStats
+	Runs          int
+	Fragmentation float64
+}
+
+type EntryStats struct {
+	Start       string
+	Size        uint32
+	Free        uint32
+	Utilization float64 // fraction of Size in use
+	Peer        string
+	Nickname    string
+}
+
+// PeerStats aggregates the entries of one peer. A run is a contiguous
+// range of addresses owned by the peer; Fragmentation is the fraction
+// of its space outside its largest run, so 0 when all its space is in
+// one piece.
+type PeerStats struct {
+	Peer          string
+	Nickname      string
+	Entries       int
+	Size          uint32
+	Free          uint32
+	Utilization   float64
+	Runs          int
+	LargestRun    uint32
+	Fragmentation float64
+}
+
+// RingStats (Sync)
+func (alloc *Allocator) RingStats() *RingStats {
+	resultChan := make(chan *RingStats)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.ringStats()
+	}
+	return <-resultChan
+}
+
+// Actor client
+func (alloc *Allocator) ringStats() *RingStats {
+	stats := &RingStats{Range: alloc.universeString()}
+	usage := alloc.ring.Usage()
+
+	var (
+		peers      []mesh.PeerName
+		byPeer     = make(map[mesh.PeerName]*PeerStats)
+		currentRun = make(map[mesh.PeerName]uint32)
+	)
+	for i, u := range usage {
+		stats.Entries = append(stats.Entries, EntryStats{
+			Start:       u.Start.String(),
+			Size:        uint32(u.Size),
+			Free:        uint32(u.Free),
+			Utilization: utilization(u.Size, u.Free),
+			Peer:        u.Peer.String(),
+			Nickname:    alloc.nickname(u.Peer),
+		})
+
+		ps, found := byPeer[u.Peer]
+		if !found {
+			ps = &PeerStats{Peer: u.Peer.String(), Nickname: alloc.nickname(u.Peer)}
+			byPeer[u.Peer] = ps
+			peers = append(peers, u.Peer)
+		}
+		ps.Entries++
+		ps.Size += uint32(u.Size)
+		ps.Free += uint32(u.Free)
+		if i == 0 || usage[i-1].Peer != u.Peer {
+			ps.Runs++
+			currentRun[u.Peer] = 0
+		}
+		currentRun[u.Peer] += uint32(u.Size)
+		if currentRun[u.Peer] > ps.LargestRun {
+			ps.LargestRun = currentRun[u.Peer]
+		}
+	}
+
+	var total, inLargestRuns uint32
+	for _, peer := range peers {
+		ps := byPeer[peer]
+		ps.Utilization = utilization(address.Offset(ps.Size), address.Offset(ps.Free))
+		ps.Fragmentation = 1 - float64(ps.LargestRun)/float64(ps.Size)
+		stats.Peers = append(stats.Peers, *ps)
+		stats.Runs += ps.Runs
+		total += ps.Size
+		inLargestRuns += ps.LargestRun
+	}
+	if total > 0 {
+		stats.Fragmentation = 1 - float64(inLargestRuns)/float64(total)
+	}
+	return stats
+}
+
+func utilization(size, free address.Offset) float64 {
+	if size == 0 {
+		return 0
+	}
+	return 1 - float64(free)/float64(size)
+}
@@ -0,0 +1,83 @@
+package ipam
+
+import (
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/gossip"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A request for space is answered by the donor with its ring, which
+// tells the requester of any space it was given, and with a separate
+// message if there was none to give. Between peers which both support
+// it, the request is instead made as a call over gossip.RPC, and the
+// ring and the denial come back as its response, so a request which
+// is never answered can be told apart from one which is. Peers learn
+// what each other supports from the Features of their incarnations;
+// until we have heard a peer's, we assume it supports nothing.
+
+const (
+	featureRPC = "rpc"
+
+	rpcSpaceRequest = "space-request"
+	rpcDenied       = "denied" // the code of the error when no space is given
+)
+
+var ourFeatures = []string{featureRPC, featureNack}
+
+// Actor client
+func (alloc *Allocator) peerHasFeature(peer mesh.PeerName, feature string) bool {
+	for _, f := range alloc.incarnations[peer].Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func (alloc *Allocator) sendRPC(dest mesh.PeerName, msg []byte) error {
+	return alloc.gossip.GossipUnicast(dest, append([]byte{msgRPC}, msg...))
+}
+
+// Actor client: answer a call from another peer
+func (alloc *Allocator) handleRPC(sender mesh.PeerName, method string, request []byte) ([]byte, error) {
+	switch method {
+	case rpcSpaceRequest:
+		r, trace, err := decodeSpaceRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		if !alloc.donateTracedSpace(r, sender, trace) {
+			err = &gossip.RPCError{Code: rpcDenied, Message: r.String()}
+		}
+		return alloc.encode(), err
+	}
+	return nil, &gossip.RPCError{Code: gossip.RPCUnknownMethod, Message: method}
+}
+
+// Actor client
+func (alloc *Allocator) callSpaceRequest(donor mesh.PeerName, r address.Range, traceparent string) error {
+	deadline := alloc.clock.Now().Add(spaceRequestTimeout)
+	return alloc.rpc.Call(donor, rpcSpaceRequest, encodeSpaceRequest(r, traceparent), deadline, func(ring []byte, err error) {
+		alloc.spaceRequestAnswered(donor, r, ring, err)
+	})
+}
+
+// Actor client
+func (alloc *Allocator) spaceRequestAnswered(donor mesh.PeerName, r address.Range, ring []byte, err error) {
+	if !gossip.IsRPCError(err, gossip.RPCTimeout) {
+		alloc.spaceRequestAnsweredBy(donor)
+	}
+	switch {
+	case err == nil:
+	case gossip.IsRPCError(err, rpcDenied):
+		alloc.spaceRequestDenied(donor, r)
+	default:
+		alloc.debugf("Request to %s for space in %s failed: %s", donor, r, err)
+	}
+	if len(ring) > 0 {
+		if err := alloc.unicastUpdate(donor, ring); err != nil {
+			alloc.warnf("Ring from %s: %s", donor, err)
+		}
+	}
+}
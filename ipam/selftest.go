@@ -0,0 +1,107 @@
+package ipam
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// The self-test checks a running allocator from end to end, e.g.
+// after deploying it: it allocates an address for an ident of its
+// own, asks for it again, claims it and frees it, checking the number
+// of available addresses as it goes. It goes through the same paths
+// as any other request, so hooks, registrars and webhooks hear about
+// it too.
+
+const (
+	selfTestIdentPrefix    = "weave:selftest-"
+	DefaultSelfTestTimeout = 10 * time.Second
+)
+
+// SelfTestStep is the outcome of one step of a self-test.
+type SelfTestStep struct {
+	Name   string
+	OK     bool
+	Detail string `json:",omitempty"`
+}
+
+// SelfTestReport is the outcome of a self-test.
+type SelfTestReport struct {
+	Ident   string
+	Address string `json:",omitempty"`
+	Passed  bool
+	Steps   []SelfTestStep
+}
+
+func (report *SelfTestReport) step(name string, err error, detail string) bool {
+	s := SelfTestStep{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		s.Detail = err.Error()
+		report.Passed = false
+	}
+	report.Steps = append(report.Steps, s)
+	return err == nil
+}
+
+// SelfTest allocates, claims and frees an address in r, giving up on
+// the allocation after timeout.
+func (alloc *Allocator) SelfTest(r address.Range, timeout time.Duration) *SelfTestReport {
+	ident := fmt.Sprintf("%s%d", selfTestIdentPrefix, time.Now().UnixNano())
+	report := &SelfTestReport{Ident: ident, Passed: true}
+	deadline := time.Now().Add(timeout)
+	cancelled := func() bool { return time.Now().After(deadline) }
+
+	before := alloc.availableAddresses()
+	addr, err := alloc.Allocate(ident, r, cancelled)
+	if !report.step("allocate", err, addr.String()) {
+		return report
+	}
+	report.Address = addr.String()
+	defer func() {
+		if !report.Passed {
+			alloc.Delete(ident) // don't leave it behind
+		}
+	}()
+
+	again, err := alloc.Allocate(ident, r, cancelled)
+	if err == nil && again != addr {
+		err = fmt.Errorf("got %s the second time", again)
+	}
+	report.step("allocate again", err, "")
+	found, err := alloc.Lookup(ident, r)
+	if err == nil && found != addr {
+		err = fmt.Errorf("found %s", found)
+	}
+	report.step("lookup", err, "")
+	report.step("claim", alloc.Claim(ident, addr, false), "")
+	report.step("count after allocate", checkCount(before-1, alloc.availableAddresses()), "")
+
+	if !report.step("free", alloc.Free(ident, addr), "") {
+		return report
+	}
+	if _, err := alloc.Lookup(ident, r); err == nil {
+		report.step("lookup after free", fmt.Errorf("still allocated"), "")
+	} else {
+		report.step("lookup after free", nil, "")
+	}
+	report.step("count after free", checkCount(before, alloc.availableAddresses()), "")
+	return report
+}
+
+func checkCount(expected, actual address.Offset) error {
+	if expected != actual {
+		return fmt.Errorf("expected %d addresses available, found %d", expected, actual)
+	}
+	return nil
+}
+
+// availableAddresses (Sync) returns the number of addresses free in
+// our ranges, including those held back from reuse.
+func (alloc *Allocator) availableAddresses() address.Offset {
+	resultChan := make(chan address.Offset)
+	alloc.actionChan <- func() {
+		resultChan <- alloc.space.NumFreeAddressesInRange(alloc.universe) + address.Offset(len(alloc.held))
+	}
+	return <-resultChan
+}
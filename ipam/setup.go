@@ -0,0 +1,68 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Whatever plumbs an address into a container, having allocated it,
+// can fail part way, e.g. because the container died while starting,
+// and never free the address. So an allocation can be made to await
+// word of its setup: the address is freed as soon as setup is
+// reported to have failed, or if it has not been reported done by a
+// deadline.
+
+type awaitingSetup struct {
+	ident    string
+	deadline time.Time
+}
+
+type setupDeadlines map[address.Address]awaitingSetup
+
+// AwaitSetup (Sync) frees addr, allocated to ident, unless
+// ReportSetup says it has been set up within timeout.
+func (alloc *Allocator) AwaitSetup(ident string, addr address.Address, timeout time.Duration) error {
+	errChan := make(chan error)
+	alloc.actionChan <- func() {
+		if !alloc.owns(ident, addr) {
+			errChan <- newError(ErrNotOwned, "address %s not found for %s", addr, ident)
+			return
+		}
+		alloc.awaitingSetup[addr] = awaitingSetup{ident, alloc.clock.Now().Add(timeout)}
+		errChan <- nil
+	}
+	return <-errChan
+}
+
+// ReportSetup (Sync) says whether addr has been set up for ident. If
+// not, it is freed.
+func (alloc *Allocator) ReportSetup(ident string, addr address.Address, ok bool) error {
+	errChan := make(chan error)
+	alloc.actionChan <- func() {
+		if !alloc.owns(ident, addr) {
+			errChan <- newError(ErrNotOwned, "address %s not found for %s", addr, ident)
+			return
+		}
+		delete(alloc.awaitingSetup, addr)
+		if !ok {
+			alloc.infof("Setup of %s for %s failed; freeing it", addr, ident)
+			alloc.removeOwned(ident, addr)
+			alloc.freeAddress(addr)
+		}
+		errChan <- nil
+	}
+	return <-errChan
+}
+
+// Actor client: free the addresses whose setup was not reported in time
+func (alloc *Allocator) removeUnsetup() {
+	now := alloc.clock.Now()
+	for addr, awaiting := range alloc.awaitingSetup {
+		if now.After(awaiting.deadline) {
+			alloc.infof("Setup of %s for %s not reported in time; freeing it", addr, awaiting.ident)
+			alloc.removeOwned(awaiting.ident, addr)
+			alloc.freeAddress(addr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package space
+
+import (
+	"sort"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A space which has seen a lot of churn can have thousands of free
+// chunks, and the allocator asks how many addresses are free, and
+// where the biggest chunk is, far more often than the chunks come and
+// go: several times for each request, for reserves, watermarks and
+// donations. So answers come from an index of the chunks: a Fenwick
+// tree of their sizes, for the number of free addresses before any
+// chunk, and a tree of the biggest chunk in each span of chunks.
+// Each answer takes time logarithmic in the number of chunks.
+//
+// Most changes make one chunk bigger or smaller, and the index is
+// updated in the same time. Changes which add or remove chunks
+// renumber those after them, so the index is rebuilt, in place, when
+// next needed; that costs about as much as the copy the change makes.
+
+type freeIndex struct {
+	valid bool
+	sums  []address.Offset // Fenwick tree of chunk sizes, from 1
+	tree  []int32          // biggest chunk under each node; chunk i is at n+i
+}
+
+func (s *Space) chunk(i int) address.Range {
+	return address.Range{Start: s.free[2*i], End: s.free[2*i+1]}
+}
+
+func (s *Space) numChunks() int {
+	return len(s.free) / 2
+}
+
+func (s *Space) addFree(start, end address.Address) {
+	s.changeFree(start, end, 0)
+}
+
+func (s *Space) subtractFree(start, end address.Address) {
+	s.changeFree(start, end, 1)
+}
+
+func (s *Space) changeFree(start, end address.Address, sense int) {
+	chunks := s.numChunks()
+	s.free = addSub(s.free, start, end, sense)
+	if !s.index.valid {
+		return
+	}
+	if s.numChunks() != chunks {
+		s.index.valid = false
+		return
+	}
+	// Only the chunk at start can have changed
+	if i := sort.Search(chunks, func(i int) bool { return s.free[2*i+1] >= start }); i < chunks {
+		s.updateIndex(i)
+	}
+}
+
+func (s *Space) freeIndex() *freeIndex {
+	index := &s.index
+	if index.valid {
+		return index
+	}
+	n := s.numChunks()
+	if cap(index.sums) < n+1 {
+		index.sums = make([]address.Offset, n+1)
+		index.tree = make([]int32, 2*n)
+	}
+	index.sums, index.tree = index.sums[:n+1], index.tree[:2*n]
+	index.sums[0] = 0
+	for i := 0; i < n; i++ {
+		index.sums[i+1] = s.chunk(i).Size()
+		index.tree[n+i] = int32(i)
+	}
+	for i := 1; i <= n; i++ {
+		if parent := i + i&-i; parent <= n {
+			index.sums[parent] += index.sums[i]
+		}
+	}
+	for node := n - 1; node > 0; node-- {
+		index.tree[node] = s.bigger(index.tree[2*node], index.tree[2*node+1])
+	}
+	index.valid = true
+	return index
+}
+
+// updateIndex catches the index up with a change in the size of chunk i.
+func (s *Space) updateIndex(i int) {
+	index := &s.index
+	n := s.numChunks()
+	delta := s.chunk(i).Size() - (s.freeBefore(i+1) - s.freeBefore(i)) // may wrap around, harmlessly
+	for j := i + 1; j <= n; j += j & -j {
+		index.sums[j] += delta
+	}
+	for node := (n + i) / 2; node > 0; node /= 2 {
+		index.tree[node] = s.bigger(index.tree[2*node], index.tree[2*node+1])
+	}
+}
+
+// freeBefore returns the number of free addresses in the chunks before chunk i.
+func (s *Space) freeBefore(i int) (res address.Offset) {
+	sums := s.freeIndex().sums
+	for ; i > 0; i -= i & -i {
+		res += sums[i]
+	}
+	return
+}
+
+// bigger returns whichever of two chunks is bigger, or the later if
+// they are the same size, as a scan would; -1 stands for no chunk.
+func (s *Space) bigger(i, j int32) int32 {
+	if i < 0 || j < 0 {
+		if i > j {
+			return i
+		}
+		return j
+	}
+	sizeI, sizeJ := s.free[2*i+1]-s.free[2*i], s.free[2*j+1]-s.free[2*j]
+	if sizeI > sizeJ || (sizeI == sizeJ && i > j) {
+		return i
+	}
+	return j
+}
+
+// biggestChunk returns the biggest of chunks [lo, hi), or -1.
+func (s *Space) biggestChunk(lo, hi int) int {
+	tree, n := s.freeIndex().tree, s.numChunks()
+	biggest := int32(-1)
+	for lo, hi = lo+n, hi+n; lo < hi; lo, hi = lo/2, hi/2 {
+		if lo&1 == 1 {
+			biggest = s.bigger(biggest, tree[lo])
+			lo++
+		}
+		if hi&1 == 1 {
+			hi--
+			biggest = s.bigger(biggest, tree[hi])
+		}
+	}
+	return int(biggest)
+}
+
+// chunksIn returns the chunks [lo, hi) which overlap r.
+func (s *Space) chunksIn(r address.Range) (lo, hi int) {
+	n := s.numChunks()
+	lo = sort.Search(n, func(i int) bool { return s.free[2*i+1] > r.Start })
+	hi = sort.Search(n, func(i int) bool { return s.free[2*i] >= r.End })
+	return
+}
+
+func clip(chunk, r address.Range) address.Range {
+	if chunk.Start < r.Start {
+		chunk.Start = r.Start
+	}
+	if chunk.End > r.End {
+		chunk.End = r.End
+	}
+	return chunk
+}
+
+func (s *Space) NumFreeAddressesInRange(r address.Range) address.Offset {
+	if r.Start >= r.End {
+		return 0
+	}
+	lo, hi := s.chunksIn(r)
+	if lo >= hi {
+		return 0
+	}
+	res := s.freeBefore(hi) - s.freeBefore(lo)
+	if first := s.chunk(lo); first.Start < r.Start {
+		res -= address.Subtract(r.Start, first.Start)
+	}
+	if last := s.chunk(hi - 1); last.End > r.End {
+		res -= address.Subtract(last.End, r.End)
+	}
+	return res
+}
+
+// biggestFreeRange returns the biggest free part of r, the last of
+// them if there are several of that size.
+func (s *Space) biggestFreeRange(r address.Range) (biggest address.Range) {
+	if r.Start >= r.End {
+		return
+	}
+	lo, hi := s.chunksIn(r)
+	if lo >= hi {
+		return
+	}
+	// The chunks at the ends may stick out of r; those in between don't
+	biggest = clip(s.chunk(lo), r)
+	if middle := s.biggestChunk(lo+1, hi-1); middle >= 0 && s.chunk(middle).Size() >= biggest.Size() {
+		biggest = s.chunk(middle)
+	}
+	if hi-1 > lo {
+		if last := clip(s.chunk(hi-1), r); last.Size() >= biggest.Size() {
+			biggest = last
+		}
+	}
+	return
+}
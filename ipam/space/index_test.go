@@ -0,0 +1,121 @@
+package space
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A space of n free chunks of varying sizes, separated by allocated
+// addresses, as after a long run of containers coming and going
+func makeFragmentedSpace(n int) (*Space, address.Range) {
+	rnd := rand.New(rand.NewSource(int64(n)))
+	start := ip("10.0.0.0")
+	s := New()
+	addr := start
+	for i := 0; i < n; i++ {
+		size := address.Offset(1 + rnd.Intn(8))
+		s.free = append(s.free, addr, address.Add(addr, size))
+		addr = address.Add(addr, size)
+		s.ours = append(s.ours, addr, addr+1)
+		addr++
+	}
+	return s, address.Range{Start: start, End: addr}
+}
+
+func benchmarkNumFree(b *testing.B, n int) {
+	s, r := makeFragmentedSpace(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.NumFreeAddressesInRange(r)
+	}
+}
+
+// Deciding what to donate, without the donation itself
+func benchmarkBiggestFreeRange(b *testing.B, n int) {
+	s, r := makeFragmentedSpace(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.biggestFreeRange(r)
+	}
+}
+
+// Donating, then taking the donation back
+func benchmarkDonate(b *testing.B, n int) {
+	s, r := makeFragmentedSpace(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		donated, _ := s.Donate(r)
+		s.AddRanges([]address.Range{donated})
+	}
+}
+
+// The allocator's pattern: check for free space, then allocate, and
+// later free
+func benchmarkAllocateFree(b *testing.B, n int) {
+	s, r := makeFragmentedSpace(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.NumFreeAddressesInRange(r)
+		_, addr := s.Allocate(r)
+		s.Free(addr)
+	}
+}
+
+func BenchmarkNumFree10(b *testing.B)           { benchmarkNumFree(b, 10) }
+func BenchmarkNumFree10k(b *testing.B)          { benchmarkNumFree(b, 10000) }
+func BenchmarkBiggestFreeRange10(b *testing.B)  { benchmarkBiggestFreeRange(b, 10) }
+func BenchmarkBiggestFreeRange10k(b *testing.B) { benchmarkBiggestFreeRange(b, 10000) }
+func BenchmarkDonate10(b *testing.B)            { benchmarkDonate(b, 10) }
+func BenchmarkDonate10k(b *testing.B)           { benchmarkDonate(b, 10000) }
+func BenchmarkAllocateFree10(b *testing.B)      { benchmarkAllocateFree(b, 10) }
+func BenchmarkAllocateFree10k(b *testing.B)     { benchmarkAllocateFree(b, 10000) }
+
+// The answers must be those of a scan of every free chunk
+func TestFreeIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	s, universe := makeFragmentedSpace(100)
+	for i := 0; i < 1000; i++ {
+		start := address.Add(universe.Start, address.Offset(rnd.Intn(int(universe.Size()))))
+		r := address.Range{Start: start, End: address.Add(start, address.Offset(rnd.Intn(100)))}
+		require.Equal(t, s.scanNumFree(r), s.NumFreeAddressesInRange(r), "%s in %s", r, s)
+		require.Equal(t, s.scanBiggestFreeRange(r), s.biggestFreeRange(r), "%s in %s", r, s)
+		// and keep them right as the space changes
+		switch rnd.Intn(3) {
+		case 0:
+			s.Allocate(r)
+		case 1:
+			s.Free(start)
+		case 2:
+			s.Donate(r)
+		}
+		s.assertInvariants()
+	}
+}
+
+func (s *Space) scanNumFree(r address.Range) address.Offset {
+	res := address.Offset(0)
+	s.walkFree(r, func(chunk address.Range) bool {
+		res += chunk.Size()
+		return false
+	})
+	return res
+}
+
+func (s *Space) scanBiggestFreeRange(r address.Range) (biggest address.Range) {
+	biggestSize := address.Offset(0)
+	s.walkFree(r, func(chunk address.Range) bool {
+		if size := chunk.Size(); size >= biggestSize {
+			biggest = chunk
+			biggestSize = size
+		}
+		return false
+	})
+	return
+}
@@ -0,0 +1,84 @@
+package space
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// RangeSet is an immutable set of addresses, held as normalized
+// ranges; the algebra is that of the net/address range functions. The
+// zero value is the empty set.
+type RangeSet struct {
+	ranges []address.Range
+}
+
+func NewRangeSet(ranges ...address.Range) RangeSet {
+	return RangeSet{address.NormalizeRanges(ranges)}
+}
+
+// setOf converts a boundary array, as used by Space, to a RangeSet.
+func setOf(addrs []address.Address) RangeSet {
+	ranges := make([]address.Range, 0, len(addrs)/2)
+	for i := 0; i < len(addrs); i += 2 {
+		ranges = append(ranges, address.Range{Start: addrs[i], End: addrs[i+1]})
+	}
+	return RangeSet{ranges}
+}
+
+func (a RangeSet) Union(b RangeSet) RangeSet {
+	return RangeSet{address.UnionRanges(a.ranges, b.ranges)}
+}
+
+func (a RangeSet) Subtract(b RangeSet) RangeSet {
+	return RangeSet{address.SubtractRanges(a.ranges, b.ranges)}
+}
+
+func (a RangeSet) Intersect(b RangeSet) RangeSet {
+	return RangeSet{address.IntersectRanges(a.ranges, b.ranges)}
+}
+
+func (a RangeSet) Contains(addr address.Address) bool {
+	i := sort.Search(len(a.ranges), func(i int) bool { return a.ranges[i].End > addr })
+	return i < len(a.ranges) && a.ranges[i].Contains(addr)
+}
+
+func (a RangeSet) Empty() bool {
+	return len(a.ranges) == 0
+}
+
+// Size returns the number of addresses in the set.
+func (a RangeSet) Size() address.Offset {
+	size := address.Offset(0)
+	for _, r := range a.ranges {
+		size += r.Size()
+	}
+	return size
+}
+
+// Ranges returns the set as maximal non-overlapping ranges, in order.
+func (a RangeSet) Ranges() []address.Range {
+	return append([]address.Range{}, a.ranges...)
+}
+
+func (a RangeSet) String() string {
+	var buf bytes.Buffer
+	for i, r := range a.ranges {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(r.String())
+	}
+	return buf.String()
+}
+
+// OwnedSet returns all the addresses in the space, free or not.
+func (s *Space) OwnedSet() RangeSet {
+	return setOf(s.everything())
+}
+
+// FreeSet returns the addresses in the space available for allocation.
+func (s *Space) FreeSet() RangeSet {
+	return setOf(s.free)
+}
@@ -0,0 +1,53 @@
+package space
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/weave/net/address"
+)
+
+func rng(start, end string) address.Range {
+	return address.Range{Start: ip(start), End: ip(end)}
+}
+
+func TestRangeSetAlgebra(t *testing.T) {
+	a := NewRangeSet(rng("10.0.0.0", "10.0.0.16"), rng("10.0.0.32", "10.0.0.48"), rng("10.0.0.16", "10.0.0.20"))
+	b := NewRangeSet(rng("10.0.0.8", "10.0.0.40"))
+
+	require.Equal(t, []address.Range{rng("10.0.0.0", "10.0.0.20"), rng("10.0.0.32", "10.0.0.48")}, a.Ranges())
+	require.Equal(t, address.Offset(36), a.Size())
+	require.Equal(t, "10.0.0.0-10.0.0.19 10.0.0.32-10.0.0.47", a.String())
+
+	require.Equal(t, []address.Range{rng("10.0.0.0", "10.0.0.48")}, a.Union(b).Ranges())
+	require.Equal(t, []address.Range{rng("10.0.0.8", "10.0.0.20"), rng("10.0.0.32", "10.0.0.40")}, a.Intersect(b).Ranges())
+	require.Equal(t, []address.Range{rng("10.0.0.0", "10.0.0.8"), rng("10.0.0.40", "10.0.0.48")}, a.Subtract(b).Ranges())
+	require.True(t, a.Subtract(a).Empty())
+	require.True(t, a.Intersect(RangeSet{}).Empty())
+
+	require.True(t, a.Contains(ip("10.0.0.19")))
+	require.False(t, a.Contains(ip("10.0.0.20")))
+
+	// operations don't modify their operands
+	require.Equal(t, address.Offset(36), a.Size())
+	require.Equal(t, address.Offset(32), b.Size())
+}
+
+func TestSpaceSets(t *testing.T) {
+	s := makeSpace(ip("10.0.1.0"), 16)
+	ok, addr := s.Allocate(rng("10.0.1.0", "10.0.1.16"))
+	require.True(t, ok)
+
+	require.Equal(t, []address.Range{rng("10.0.1.0", "10.0.1.16")}, s.OwnedSet().Ranges())
+	free := s.FreeSet()
+	require.False(t, free.Contains(addr))
+	require.Equal(t, address.Offset(15), free.Size())
+
+	// e.g. free addresses within an allowed range
+	allowed := NewRangeSet(rng("10.0.1.0", "10.0.1.4"))
+	require.Equal(t, []address.Range{rng("10.0.1.1", "10.0.1.4")}, free.Intersect(allowed).Ranges())
+
+	// the returned sets are copies
+	require.NoError(t, s.Free(addr))
+	require.False(t, free.Contains(addr))
+}
@@ -1,8 +1,12 @@
+// Package space keeps track of the addresses a peer owns and which of
+// them are free. It is the only implementation of this in weave; sets
+// of ranges in other forms are RangeSets, which share its algebra.
 package space
 
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"sort"
 
 	"github.com/weaveworks/weave/common"
@@ -19,6 +23,11 @@ type Space struct {
 	// repetition.
 	ours []address.Address
 	free []address.Address
+
+	strategy Strategy // see strategy.go
+	rand     *rand.Rand
+	history  freeHistory
+	index    freeIndex // see index.go
 }
 
 func New() *Space {
@@ -26,13 +35,15 @@ func New() *Space {
 }
 
 func (s *Space) Add(start address.Address, size address.Offset) {
-	s.free = add(s.free, start, address.Add(start, size))
+	s.addFree(start, address.Add(start, size))
 }
 
 // Clear removes all spaces from this space set.  Used during node shutdown.
 func (s *Space) Clear() {
 	s.free = s.free[:0]
+	s.index.valid = false
 	s.ours = s.ours[:0]
+	s.history = freeHistory{}
 }
 
 // Walk down the free list calling f() on the in-range portions, until
@@ -41,11 +52,9 @@ func (s *Space) walkFree(r address.Range, f func(address.Range) bool) bool {
 	if r.Start >= r.End { // degenerate case
 		return false
 	}
-	for i := 0; i < len(s.free); i += 2 {
+	first, _ := s.chunksIn(r) // skip the chunks before the range
+	for i := 2 * first; i < len(s.free); i += 2 {
 		chunk := address.Range{Start: s.free[i], End: s.free[i+1]}
-		if chunk.End <= r.Start { // this chunk comes before the range
-			continue
-		}
 		if chunk.Start >= r.End {
 			// all remaining free space is completely after range
 			break
@@ -68,14 +77,17 @@ func (s *Space) walkFree(r address.Range, f func(address.Range) bool) bool {
 	return false
 }
 
+// Allocate takes a free address in r, chosen according to the
+// strategy; see strategy.go.
 func (s *Space) Allocate(r address.Range) (bool, address.Address) {
-	var result address.Address
-	return s.walkFree(r, func(chunk address.Range) bool {
-		result = chunk.Start
-		s.ours = add(s.ours, result, result+1)
-		s.free = subtract(s.free, result, result+1)
-		return true
-	}), result
+	result, ok := s.choose(r)
+	if !ok {
+		return false, result
+	}
+	s.ours = add(s.ours, result, result+1)
+	s.subtractFree(result, result+1)
+	s.history.taken(result)
+	return true, result
 }
 
 func (s *Space) Claim(addr address.Address) error {
@@ -84,19 +96,11 @@ func (s *Space) Claim(addr address.Address) error {
 	}
 
 	s.ours = add(s.ours, addr, addr+1)
-	s.free = subtract(s.free, addr, addr+1)
+	s.subtractFree(addr, addr+1)
+	s.history.taken(addr)
 	return nil
 }
 
-func (s *Space) NumFreeAddressesInRange(r address.Range) address.Offset {
-	res := address.Offset(0)
-	s.walkFree(r, func(chunk address.Range) bool {
-		res += chunk.Size()
-		return false
-	})
-	return res
-}
-
 func (s *Space) Free(addr address.Address) error {
 	if !contains(s.ours, addr) {
 		return fmt.Errorf("Address %v is not ours", addr)
@@ -106,22 +110,13 @@ func (s *Space) Free(addr address.Address) error {
 	}
 
 	s.ours = subtract(s.ours, addr, addr+1)
-	s.free = add(s.free, addr, addr+1)
+	s.addFree(addr, addr+1)
+	if s.strategy == LeastRecentlyUsed {
+		s.history.freed(addr)
+	}
 	return nil
 }
 
-func (s *Space) biggestFreeRange(r address.Range) (biggest address.Range) {
-	biggestSize := address.Offset(0)
-	s.walkFree(r, func(chunk address.Range) bool {
-		if size := chunk.Size(); size >= biggestSize {
-			biggest = chunk
-			biggestSize = size
-		}
-		return false
-	})
-	return
-}
-
 func (s *Space) Donate(r address.Range) (address.Range, bool) {
 	biggest := s.biggestFreeRange(r)
 
@@ -134,7 +129,8 @@ func (s *Space) Donate(r address.Range) (address.Range, bool) {
 	biggest.Start = address.Add(biggest.Start, biggest.Size()/2)
 
 	s.ours = subtract(s.ours, biggest.Start, biggest.End)
-	s.free = subtract(s.free, biggest.Start, biggest.End)
+	s.subtractFree(biggest.Start, biggest.End)
+	s.history.takenRange(biggest.Start, biggest.End)
 	return biggest, true
 }
 
@@ -161,26 +157,37 @@ func subtract(addrs []address.Address, start address.Address, end address.Addres
 	return addSub(addrs, start, end, 1)
 }
 
+// addSub changes addrs in place, so the result must be assigned back
+// to it, and no other slice of the same array may be held on to.
 func addSub(addrs []address.Address, start address.Address, end address.Address, sense int) []address.Address {
 	startPos := firstGreaterOrEq(addrs, start)
 	endPos := firstGreater(addrs[startPos:], end) + startPos
 
-	// Boundaries up to startPos are unaffected
-	res := make([]address.Address, startPos, len(addrs)+2)
-	copy(res, addrs)
-
 	// Include start and end as new boundaries if they lie
 	// outside/inside existing ranges (according to sense).
+	var boundaries [2]address.Address
+	n := 0
 	if startPos&1 == sense {
-		res = append(res, start)
+		boundaries[n] = start
+		n++
 	}
-
 	if endPos&1 == sense {
-		res = append(res, end)
+		boundaries[n] = end
+		n++
 	}
 
-	// Boundaries after endPos are unaffected
-	return append(res, addrs[endPos:]...)
+	// Boundaries up to startPos and after endPos are unaffected; the
+	// ones in between are replaced by the new ones
+	if addrs == nil {
+		addrs = []address.Address{}
+	}
+	newLen := len(addrs) + n - (endPos - startPos)
+	if newLen > len(addrs) {
+		addrs = append(addrs, boundaries[:newLen-len(addrs)]...)
+	}
+	copy(addrs[startPos+n:], addrs[endPos:])
+	copy(addrs[startPos:], boundaries[:n])
+	return addrs[:newLen]
 }
 
 func (s *Space) String() string {
@@ -203,15 +210,27 @@ func (s *Space) String() string {
 	return buf.String()
 }
 
-type addressSlice []address.Address
-
-func (p addressSlice) Len() int           { return len(p) }
-func (p addressSlice) Less(i, j int) bool { return p[i] < p[j] }
-func (p addressSlice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+// Is addrs a well-formed boundary array, i.e. an even number of
+// strictly increasing addresses? Strictly, because a repeated
+// address would mean an empty range or two ranges which should have
+// been coalesced.
+func coalesced(addrs []address.Address) bool {
+	if len(addrs)%2 != 0 {
+		return false
+	}
+	for i := 1; i < len(addrs); i++ {
+		if addrs[i-1] >= addrs[i] {
+			return false
+		}
+	}
+	return true
+}
 
 func (s *Space) assertInvariants() {
-	common.Assert(sort.IsSorted(addressSlice(s.ours)))
-	common.Assert(sort.IsSorted(addressSlice(s.free)))
+	common.Assert(coalesced(s.ours))
+	common.Assert(coalesced(s.free))
+	// an address is either allocated or free, never both
+	common.Assert(setOf(s.ours).Intersect(setOf(s.free)).Empty())
 }
 
 // Return a slice representing everything we own, whether it is free or not
@@ -227,18 +246,13 @@ func (s *Space) everything() []address.Address {
 // OwnedRanges returns slice of Ranges, ordered by IP, gluing together
 // contiguous sequences of owned and free addresses
 func (s *Space) OwnedRanges() []address.Range {
-	everything := s.everything()
-	result := make([]address.Range, len(everything)/2)
-	for i := 0; i < len(everything); i += 2 {
-		result[i/2] = address.Range{Start: everything[i], End: everything[i+1]}
-	}
-	return result
+	return s.OwnedSet().Ranges()
 }
 
 // Create a Space that has free space in all the supplied Ranges.
 func (s *Space) AddRanges(ranges []address.Range) {
 	for _, r := range ranges {
-		s.free = add(s.free, r.Start, r.End)
+		s.addFree(r.Start, r.End)
 	}
 }
 
@@ -253,6 +267,6 @@ func (s *Space) UpdateRanges(ranges []address.Range) {
 		new = subtract(new, current[i], current[i+1])
 	}
 	for i := 0; i < len(new); i += 2 {
-		s.free = add(s.free, new[i], new[i+1])
+		s.addFree(new[i], new[i+1])
 	}
 }
@@ -1,6 +1,7 @@
 package space
 
 import (
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -259,5 +260,111 @@ func TestDonateHard(t *testing.T) {
 	expected := New()
 	expected.Add(start, 23)
 	expected.ours = add(nil, ip("10.0.1.47"), ip("10.0.1.48"))
-	require.Equal(t, expected, spaceset)
+	require.Equal(t, expected.free, spaceset.free)
+	require.Equal(t, expected.ours, spaceset.ours)
+}
+
+func TestCoalescing(t *testing.T) {
+	require.True(t, coalesced([]address.Address{}))
+	require.True(t, coalesced([]address.Address{1, 2, 4, 8}))
+	require.False(t, coalesced([]address.Address{1}))
+	require.False(t, coalesced([]address.Address{1, 2, 2, 8}), "abutting ranges")
+	require.False(t, coalesced([]address.Address{1, 1}), "empty range")
+	require.False(t, coalesced([]address.Address{4, 8, 1, 2}), "unsorted")
+
+	// Fragment the space with a random pattern of allocations and
+	// frees; once everything is freed again there must be exactly one
+	// free range and nothing owned.
+	const size = 256
+	start := ip("10.0.4.0")
+	s := makeSpace(start, size)
+	r := address.NewRange(start, size)
+	rnd := rand.New(rand.NewSource(42))
+	var allocated []address.Address
+	for i := 0; i < 2000; i++ {
+		if len(allocated) == 0 || (len(allocated) < size && rnd.Intn(2) == 0) {
+			ok, addr := s.Allocate(r)
+			require.True(t, ok)
+			allocated = append(allocated, addr)
+		} else {
+			j := rnd.Intn(len(allocated))
+			require.NoError(t, s.Free(allocated[j]))
+			allocated = append(allocated[:j], allocated[j+1:]...)
+		}
+		s.assertInvariants()
+	}
+	for _, addr := range allocated {
+		require.NoError(t, s.Free(addr))
+		s.assertInvariants()
+	}
+	require.Equal(t, []address.Address{start, address.Add(start, size)}, s.free)
+	require.Len(t, s.ours, 0)
+}
+
+func TestAllocationStrategies(t *testing.T) {
+	start := ip("10.0.1.0")
+	r := address.NewRange(start, 8)
+	allocateAll := func(s *Space) []address.Address {
+		var addrs []address.Address
+		for {
+			ok, addr := s.Allocate(r)
+			if !ok {
+				return addrs
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+
+	// Sequential always hands the lowest back
+	s := makeSpace(start, 8)
+	require.Len(t, allocateAll(s), 8)
+	require.NoError(t, s.Free(ip("10.0.1.5")))
+	require.NoError(t, s.Free(ip("10.0.1.2")))
+	_, addr := s.Allocate(r)
+	require.Equal(t, "10.0.1.2", addr.String())
+
+	// Least recently used prefers addresses not used yet, and then
+	// those freed longest ago
+	s = makeSpace(start, 8)
+	s.SetStrategy(LeastRecentlyUsed)
+	for i := 0; i < 4; i++ {
+		s.Allocate(r)
+	}
+	require.NoError(t, s.Free(ip("10.0.1.3")))
+	require.NoError(t, s.Free(ip("10.0.1.1")))
+	var got []string
+	for i := 0; i < 6; i++ {
+		_, addr := s.Allocate(r)
+		got = append(got, addr.String())
+	}
+	require.Equal(t, []string{"10.0.1.4", "10.0.1.5", "10.0.1.6", "10.0.1.7", "10.0.1.3", "10.0.1.1"}, got)
+	s.assertInvariants()
+	require.NoError(t, s.Free(ip("10.0.1.6")))
+	require.NoError(t, s.Free(ip("10.0.1.2")))
+	donated, _ := s.Donate(r)
+	require.Equal(t, address.Range{Start: ip("10.0.1.6"), End: ip("10.0.1.7")}, donated)
+	_, addr = s.Allocate(r)
+	require.Equal(t, "10.0.1.2", addr.String(), "the donated address is no longer ours to hand out")
+
+	// Random hands out every address in the range exactly once
+	s = makeSpace(start, 8)
+	s.SetStrategy(Random)
+	s.rand = rand.New(rand.NewSource(1))
+	addrs := allocateAll(s)
+	require.Len(t, addrs, 8)
+	seen := make(map[address.Address]bool)
+	for _, addr := range addrs {
+		require.True(t, r.Contains(addr))
+		seen[addr] = true
+	}
+	require.Len(t, seen, 8)
+	s.assertInvariants()
+
+	for _, strategy := range []Strategy{Sequential, Random, LeastRecentlyUsed} {
+		parsed, err := ParseStrategy(strategy.String())
+		require.NoError(t, err)
+		require.Equal(t, strategy, parsed)
+	}
+	_, err := ParseStrategy("fifo")
+	require.Error(t, err)
 }
@@ -0,0 +1,168 @@
+package space
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Strategy is how Allocate chooses among the free addresses in a
+// range. Always taking the lowest concentrates churn at the low end of
+// the range, so that an address is handed out again soon after it is
+// freed, when stale ARP entries and connection tracking state for its
+// previous owner are most likely to linger.
+type Strategy int
+
+const (
+	// Sequential takes the lowest free address.
+	Sequential Strategy = iota
+	// Random takes any free address, with equal chances.
+	Random
+	// LeastRecentlyUsed takes an address which has not been used
+	// since we got it if there is one, the lowest first, and
+	// otherwise the one freed longest ago.
+	LeastRecentlyUsed
+)
+
+var strategyNames = []string{"sequential", "random", "lru"}
+
+func (strategy Strategy) String() string {
+	if int(strategy) < len(strategyNames) {
+		return strategyNames[strategy]
+	}
+	return fmt.Sprintf("Strategy(%d)", int(strategy))
+}
+
+// ParseStrategy returns the Strategy of the given name: "sequential",
+// "random" or "lru".
+func ParseStrategy(name string) (Strategy, error) {
+	for i, n := range strategyNames {
+		if n == name {
+			return Strategy(i), nil
+		}
+	}
+	return Sequential, fmt.Errorf("unknown allocation strategy %q; expected one of %v", name, strategyNames)
+}
+
+// SetStrategy sets how Allocate chooses addresses; Sequential is the
+// default.
+func (s *Space) SetStrategy(strategy Strategy) {
+	s.strategy = strategy
+	if strategy == Random && s.rand == nil {
+		s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// For LeastRecentlyUsed, free addresses which have been used before
+// are remembered in the order they were freed. Entries for addresses
+// which have been allocated again since, or given away, are skipped and
+// dropped when we get to them.
+type freedAddress struct {
+	addr address.Address
+	seq  uint64
+}
+
+type freeHistory struct {
+	freedAt map[address.Address]uint64 // free, used before; by sequence number
+	order   []freedAddress             // oldest first, including stale entries
+	seq     uint64
+}
+
+func (h *freeHistory) freed(addr address.Address) {
+	if h.freedAt == nil {
+		h.freedAt = make(map[address.Address]uint64)
+	}
+	h.seq++
+	h.freedAt[addr] = h.seq
+	h.order = append(h.order, freedAddress{addr, h.seq})
+}
+
+func (h *freeHistory) taken(addr address.Address) {
+	delete(h.freedAt, addr)
+	if len(h.order) > 2*len(h.freedAt)+100 {
+		h.compact()
+	}
+}
+
+func (h *freeHistory) takenRange(start, end address.Address) {
+	for addr := range h.freedAt {
+		if addr >= start && addr < end {
+			delete(h.freedAt, addr)
+		}
+	}
+	h.compact()
+}
+
+func (h *freeHistory) current(f freedAddress) bool {
+	seq, found := h.freedAt[f.addr]
+	return found && seq == f.seq
+}
+
+func (h *freeHistory) compact() {
+	order := h.order[:0]
+	for _, f := range h.order {
+		if h.current(f) {
+			order = append(order, f)
+		}
+	}
+	h.order = order
+}
+
+// Actor client: choose a free address in r, or return false if there
+// is none
+func (s *Space) choose(r address.Range) (address.Address, bool) {
+	switch s.strategy {
+	case Random:
+		return s.chooseRandom(r)
+	case LeastRecentlyUsed:
+		return s.chooseLeastRecentlyUsed(r)
+	}
+	var result address.Address
+	return result, s.walkFree(r, func(chunk address.Range) bool {
+		result = chunk.Start
+		return true
+	})
+}
+
+func (s *Space) chooseRandom(r address.Range) (address.Address, bool) {
+	n := s.NumFreeAddressesInRange(r)
+	if n == 0 {
+		return 0, false
+	}
+	var result address.Address
+	skip := address.Offset(s.rand.Int63n(int64(n)))
+	s.walkFree(r, func(chunk address.Range) bool {
+		if skip < chunk.Size() {
+			result = address.Add(chunk.Start, skip)
+			return true
+		}
+		skip -= chunk.Size()
+		return false
+	})
+	return result, true
+}
+
+func (s *Space) chooseLeastRecentlyUsed(r address.Range) (address.Address, bool) {
+	// Look for one we haven't used; each address we pass over has been
+	// used, so this takes no longer than a scan of the history.
+	var result address.Address
+	if s.walkFree(r, func(chunk address.Range) bool {
+		for addr := chunk.Start; addr < chunk.End; addr++ {
+			if _, used := s.history.freedAt[addr]; !used {
+				result = addr
+				return true
+			}
+		}
+		return false
+	}) {
+		return result, true
+	}
+	for _, f := range s.history.order {
+		if s.history.current(f) && r.Contains(f.addr) {
+			return f.addr, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,132 @@
+package ipam
+
+import (
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/tracing"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Donors are chosen at random, weighted by how much free space they
+// have, and, if SetPeerHops has been called, by how near they are, so
+// that space tends to move between nearby peers rather than across
+// the whole network.
+//
+// A peer which has asked another for space waits for the answer
+// rather than asking again each time it tries the allocations waiting
+// for space, but not for ever: the donor may have crashed since we
+// chose it. A request with no answer within spaceRequestTimeout is
+// made again of another peer, if there is one we have not yet asked,
+// up to maxSpaceRequestAttempts times in all. After that, the
+// allocations waiting for space in the range fail, unless they can
+// come out of our reserve.
+
+const (
+	spaceRequestTimeout     = 3 * tickInterval
+	maxSpaceRequestAttempts = 3
+)
+
+type spaceRequest struct {
+	donor    mesh.PeerName
+	deadline time.Time
+	attempts int
+	tried    []mesh.PeerName // including donor
+}
+
+type spaceRequests map[address.Range]*spaceRequest
+
+// Actor client: ask a peer for space in r, unless we are waiting for
+// an answer already, returning false if there was no one to ask. trace
+// is the span of the allocation which needs the space, if it is being
+// traced.
+func (alloc *Allocator) askForSpace(r address.Range, trace tracing.SpanContext) bool {
+	req, found := alloc.spaceRequests[r]
+	if found && alloc.clock.Now().Before(req.deadline) {
+		return true
+	}
+	if req == nil {
+		req = &spaceRequest{}
+	} else {
+		alloc.infof("No answer from %s to request for space in %s; asking again", alloc.annotatePeernames([]mesh.PeerName{req.donor})[0], r)
+	}
+	var distance func(mesh.PeerName) int
+	if alloc.peerHops != nil {
+		distance = alloc.donorDistance
+	}
+	donors := alloc.ring.ChoosePeersToAskForSpace(r.Start, r.End, distance)
+	for _, donor := range append(untried(donors, req.tried), donors...) {
+		if err := alloc.sendTracedSpaceRequest(donor, r, trace); err != nil {
+			alloc.debugln("Problem asking peer", donor, "for space:", err)
+			continue
+		}
+		alloc.debugln("Decided to ask peer", donor, "for space in range", r)
+		req.donor = donor
+		req.deadline = alloc.clock.Now().Add(spaceRequestTimeout)
+		req.attempts++
+		if len(untried([]mesh.PeerName{donor}, req.tried)) > 0 {
+			req.tried = append(req.tried, donor)
+		}
+		alloc.spaceRequests[r] = req
+		return true
+	}
+	delete(alloc.spaceRequests, r)
+	return false
+}
+
+// SetPeerHops gives the allocator a way to find the number of hops to
+// a peer, 0 meaning there is no route, so that it can prefer nearby
+// peers when asking for space. It must be called before Start.
+func (alloc *Allocator) SetPeerHops(hops func(mesh.PeerName) int) {
+	alloc.peerHops = hops
+}
+
+// Actor client
+func (alloc *Allocator) donorDistance(peer mesh.PeerName) int {
+	if hops := alloc.peerHops(peer); hops > 0 {
+		return hops
+	}
+	return len(alloc.nicknames) // further than any route
+}
+
+func untried(peers, tried []mesh.PeerName) []mesh.PeerName {
+	var result []mesh.PeerName
+outer:
+	for _, peer := range peers {
+		for _, t := range tried {
+			if peer == t {
+				continue outer
+			}
+		}
+		result = append(result, peer)
+	}
+	return result
+}
+
+// Actor client: donor has answered our requests, with space or without
+func (alloc *Allocator) spaceRequestAnsweredBy(donor mesh.PeerName) {
+	for r, req := range alloc.spaceRequests {
+		if req.donor == donor {
+			delete(alloc.spaceRequests, r)
+		}
+	}
+}
+
+// Actor client: give up on space for the allocations whose requests
+// have gone unanswered too many times
+func (alloc *Allocator) expireSpaceRequests() {
+	now := alloc.clock.Now()
+	for r, req := range alloc.spaceRequests {
+		if now.Before(req.deadline) || req.attempts < maxSpaceRequestAttempts {
+			continue // the next try asks someone else
+		}
+		alloc.warnf("No answer from any of %s to requests for space in %s", alloc.annotatePeernames(req.tried), r)
+		delete(alloc.spaceRequests, r)
+		for _, op := range alloc.pendingAllocates {
+			if allocate := op.(*allocate); allocate.r.Overlaps(r) {
+				allocate.unanswered = true
+			}
+		}
+	}
+}
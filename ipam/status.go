@@ -2,18 +2,35 @@ package ipam
 
 import (
 	"fmt"
+
+	"github.com/weaveworks/mesh"
+
 	"github.com/weaveworks/weave/ipam/paxos"
 	"github.com/weaveworks/weave/net/address"
 )
 
 type Status struct {
 	Paxos            *paxos.Status
+	Readiness        string
 	Range            string
 	RangeNumIPs      int
 	DefaultSubnet    string
 	Entries          []EntryStatus
 	PendingClaims    []ClaimStatus
 	PendingAllocates []string
+	// Nicknames shared by several peers, which rmpeer can't resolve
+	NicknameCollisions []string
+	// Free space below the low watermarks
+	LowSpace []string
+	// As last measured from each peer's gossip
+	ClockSkew    []ClockSkewStatus
+	Incarnations []IncarnationStatus
+	// Addresses in the range which are not handed out
+	Exclusions []Exclusion
+	// Why allocation has stopped, if it has
+	Quarantined string
+	// Whether new allocations are refused; see readonly.go
+	ReadOnly bool
 }
 
 type EntryStatus struct {
@@ -30,50 +47,111 @@ type ClaimStatus struct {
 	Address address.Address
 }
 
+// NewStatus reports the allocator's state as of the end of its most
+// recent action. It reads a snapshot rather than queuing on the actor
+// loop, so status stays available even if an action is slow or hung.
 func NewStatus(allocator *Allocator, defaultSubnet address.CIDR) *Status {
 	if allocator == nil {
 		return nil
 	}
 
-	var paxosStatus *paxos.Status
-	if allocator.paxosActive {
-		paxosStatus = paxos.NewStatus(allocator.paxos)
+	snap, _ := allocator.snapshot.Load().(*statusSnapshot)
+	if snap == nil { // not started yet
+		snap = &statusSnapshot{}
 	}
 
-	resultChan := make(chan *Status)
-	allocator.actionChan <- func() {
-		resultChan <- &Status{
-			paxosStatus,
-			allocator.universe.String(),
-			int(allocator.universe.Size()),
-			defaultSubnet.String(),
-			newEntryStatusSlice(allocator),
-			newClaimStatusSlice(allocator),
-			newAllocateIdentSlice(allocator)}
+	// Whether peers are known is up to the router, so ask it now
+	// rather than when the snapshot was taken
+	entries := make([]EntryStatus, len(snap.entries))
+	for i, entry := range snap.entries {
+		entries[i] = entry
+		entries[i].IsKnownPeer = allocator.isKnownPeer(snap.entryPeers[i])
 	}
 
-	return <-resultChan
+	return &Status{
+		snap.paxos,
+		snap.readiness.String(),
+		allocator.universeString(),
+		int(allocator.ring.Size()),
+		defaultSubnet.String(),
+		entries,
+		snap.pendingClaims,
+		snap.pendingAllocates,
+		snap.nicknameCollisions,
+		snap.lowSpace,
+		snap.clockSkew,
+		snap.incarnations,
+		exclusionStatus(allocator.ring.AllRanges(), defaultSubnet, snap.exclusions),
+		snap.quarantined,
+		snap.readOnly}
+}
+
+// The parts of Status which can only be computed by the actor
+type statusSnapshot struct {
+	paxos              *paxos.Status
+	readiness          Readiness
+	entries            []EntryStatus
+	entryPeers         []mesh.PeerName // the owner of each entry
+	pendingClaims      []ClaimStatus
+	pendingAllocates   []string
+	nicknameCollisions []string
+	lowSpace           []string
+	clockSkew          []ClockSkewStatus
+	incarnations       []IncarnationStatus
+	exclusions         []Exclusion
+	quarantined        string
+	readOnly           bool
 }
 
-func newEntryStatusSlice(allocator *Allocator) []EntryStatus {
-	var slice []EntryStatus
+// Actor client: called when the actor's state may have changed, to
+// publish a fresh snapshot
+func (alloc *Allocator) updateSnapshot() {
+	var paxosStatus *paxos.Status
+	if alloc.paxosActive {
+		paxosStatus = paxos.NewStatus(alloc.paxos)
+		paxosStatus.Proposals = alloc.proposals
+		paxosStatus.Backoff = alloc.proposalDelay
+	}
+	entries, entryPeers := newEntryStatusSlice(alloc)
+	alloc.snapshot.Store(&statusSnapshot{
+		paxos:              paxosStatus,
+		readiness:          alloc.readiness(),
+		entries:            entries,
+		entryPeers:         entryPeers,
+		pendingClaims:      newClaimStatusSlice(alloc),
+		pendingAllocates:   newAllocateIdentSlice(alloc),
+		nicknameCollisions: alloc.nicknameCollisions(),
+		lowSpace:           alloc.lowSpaceStatus(),
+		clockSkew:          alloc.clockSkewStatus(),
+		incarnations:       alloc.incarnationStatus(),
+		exclusions:         alloc.hostExclusionStatus(),
+		quarantined:        alloc.quarantined,
+		readOnly:           alloc.readOnly,
+	})
+}
+
+func newEntryStatusSlice(allocator *Allocator) ([]EntryStatus, []mesh.PeerName) {
+	var (
+		slice []EntryStatus
+		peers []mesh.PeerName
+	)
 
 	if allocator.ring.Empty() {
-		return slice
+		return slice, peers
 	}
 
 	for _, r := range allocator.ring.AllRangeInfo() {
 		slice = append(slice, EntryStatus{
-			Token:       r.Start.String(),
-			Size:        uint32(r.Size()),
-			Peer:        r.Peer.String(),
-			Nickname:    allocator.nicknames[r.Peer],
-			IsKnownPeer: allocator.isKnownPeer(r.Peer),
-			Version:     r.Version,
+			Token:    r.Start.String(),
+			Size:     uint32(r.Size()),
+			Peer:     r.Peer.String(),
+			Nickname: allocator.nickname(r.Peer),
+			Version:  r.Version,
 		})
+		peers = append(peers, r.Peer)
 	}
 
-	return slice
+	return slice, peers
 }
 
 func newClaimStatusSlice(allocator *Allocator) []ClaimStatus {
@@ -0,0 +1,12 @@
+package ipam
+
+import (
+	"github.com/weaveworks/weave/ipam/space"
+)
+
+// SetAllocationStrategy sets how addresses are chosen from our free
+// space: the lowest free one, the default, one at random, or the one
+// freed longest ago. It must be called before Start.
+func (alloc *Allocator) SetAllocationStrategy(strategy space.Strategy) {
+	alloc.space.SetStrategy(strategy)
+}
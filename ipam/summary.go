@@ -0,0 +1,71 @@
+package ipam
+
+import (
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/ipam/ring"
+)
+
+// Periodic gossip of a large ring carries only a Merkle summary of it
+// (see ring.Summary). A peer whose ring differs unicasts back its
+// entries in the segments which differ, along with its own summary,
+// and the first peer answers in the same way with whatever the second
+// still lacks. Smaller rings are cheap enough to send whole.
+
+// Rings with fewer entries than this are always gossiped in full
+var summariseRingsFrom = 128
+
+// Gossip returns a GossipData implementation for periodic gossip,
+// which like ipamGossipData returns the latest state when encoded
+func (alloc *Allocator) Gossip() mesh.GossipData {
+	return &ipamSummaryData{alloc}
+}
+
+type ipamSummaryData struct {
+	alloc *Allocator
+}
+
+func (d *ipamSummaryData) Merge(other mesh.GossipData) mesh.GossipData {
+	if _, isFull := other.(*ipamGossipData); isFull {
+		return other
+	}
+	return d
+}
+
+func (d *ipamSummaryData) Encode() [][]byte {
+	resultChan := make(chan []byte)
+	d.alloc.actionChan <- func() {
+		if len(d.alloc.ring.Entries) < summariseRingsFrom {
+			resultChan <- d.alloc.encode()
+		} else {
+			resultChan <- d.alloc.encodeState(gossipState{Summary: d.alloc.ring.Summary()})
+		}
+	}
+	return [][]byte{<-resultChan}
+}
+
+// Actor client: send the peer whose ring is summarised our entries in
+// the segments where our rings differ, and if withSummary is set our
+// own summary, so it can reply with the entries we lack.
+func (alloc *Allocator) answerSummary(summary *ring.Summary, withSummary bool) {
+	if summary.Peer == alloc.ourName {
+		return
+	}
+	diffs, err := alloc.ring.Differences(summary)
+	if err != nil {
+		// let the peer find out what is wrong by merging our ring
+		alloc.debugln("Cannot compare ring summary from", summary.Peer, ":", err)
+		alloc.sendRingUpdate(summary.Peer)
+		return
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	alloc.debugln("Ring differs from", summary.Peer, "in", len(diffs), "segments")
+	data := gossipState{Ring: alloc.ring.Segments(diffs)}
+	if withSummary {
+		data.Summary = alloc.ring.Summary()
+	}
+	msg := append([]byte{msgRingUpdate}, alloc.encodeState(data)...)
+	alloc.gossip.GossipUnicast(summary.Peer, msg)
+}
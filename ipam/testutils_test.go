@@ -10,7 +10,9 @@ import (
 	"github.com/weaveworks/mesh"
 
 	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/weave/common/clock"
 	"github.com/weaveworks/weave/net/address"
+	wt "github.com/weaveworks/weave/testing"
 	"github.com/weaveworks/weave/testing/gossip"
 )
 
@@ -149,6 +151,35 @@ func makeAllocatorWithMockGossip(t *testing.T, name string, universeCIDR string,
 	return alloc, subnet
 }
 
+// Like makeAllocatorWithMockGossip, but the allocator runs on virtual
+// time, which only moves when the test advances the returned clock.
+func makeAllocatorWithVirtualClock(t *testing.T, name string, universeCIDR string, quorum uint, start time.Time) (*Allocator, address.Range, *clock.Virtual) {
+	alloc, subnet := makeAllocator(name, universeCIDR, quorum)
+	clk := clock.NewVirtual(start)
+	alloc.clock = clk
+	alloc.SetInterfaces(&mockGossipComms{T: t, name: name})
+	alloc.Start()
+	return alloc, subnet, clk
+}
+
+// Wait until the actor has finished with everything sent to it so far
+func (alloc *Allocator) syncActor() {
+	done := make(chan struct{})
+	alloc.actionChan <- func() { close(done) }
+	<-done
+}
+
+// Wait until n allocations, made on other goroutines, have reached
+// the actor and are being held there
+func waitForPendingAllocates(t *testing.T, alloc *Allocator, n int) {
+	pending := func() bool {
+		count := make(chan int)
+		alloc.actionChan <- func() { count <- len(alloc.pendingAllocates) }
+		return <-count >= n
+	}
+	wt.AssertEventually(t, 5*time.Second, pending, "allocations never became pending")
+}
+
 func (alloc *Allocator) claimRingForTesting(allocs ...*Allocator) {
 	peers := []mesh.PeerName{alloc.ourName}
 	for _, alloc2 := range allocs {
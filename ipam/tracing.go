@@ -0,0 +1,70 @@
+package ipam
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/bufpool"
+	"github.com/weaveworks/weave/common/tracing"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// An allocation is traced from the HTTP request, through the time it
+// spends with the actor, to any request for space which it makes of
+// another peer and that peer's handling of it. A space request carries
+// the requester's span context after the range, as a second gob value,
+// which peers that don't trace never read.
+
+// Actor client: ask donor for space in r, on behalf of the allocation
+// whose span is trace, if any
+func (alloc *Allocator) sendTracedSpaceRequest(donor mesh.PeerName, r address.Range, trace tracing.SpanContext) error {
+	if !trace.IsValid() {
+		return alloc.sendSpaceRequest(donor, r, "")
+	}
+	span := tracing.Start("ipam.space-request", trace)
+	span.SetAttribute("donor", donor)
+	span.SetAttribute("range", r)
+	err := alloc.sendSpaceRequest(donor, r, span.Context.String())
+	span.Finish(err)
+	return err
+}
+
+func encodeSpaceRequest(r address.Range, traceparent string) []byte {
+	values := []interface{}{r}
+	if traceparent != "" {
+		values = append(values, traceparent)
+	}
+	msg, err := bufpool.GobEncode(values...)
+	if err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+func decodeSpaceRequest(msg []byte) (address.Range, tracing.SpanContext, error) {
+	var r address.Range
+	var traceparent string
+	decoder := gob.NewDecoder(bytes.NewReader(msg))
+	if err := decoder.Decode(&r); err != nil {
+		return r, tracing.SpanContext{}, err
+	}
+	decoder.Decode(&traceparent) // absent if the requester doesn't trace
+	return r, tracing.Parse(traceparent), nil
+}
+
+// Actor client: donate space to a peer which asked for it, tracing
+// that if the peer is tracing the request
+func (alloc *Allocator) donateTracedSpace(r address.Range, to mesh.PeerName, trace tracing.SpanContext) bool {
+	if !trace.IsValid() {
+		return alloc.donateSpace(r, to)
+	}
+	span := tracing.Start("ipam.donate", trace)
+	span.SetAttribute("peer", alloc.ourName)
+	span.SetAttribute("requester", to)
+	span.SetAttribute("range", r)
+	donated := alloc.donateSpace(r, to)
+	span.Finish(nil)
+	return donated
+}
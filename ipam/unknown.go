@@ -0,0 +1,38 @@
+package ipam
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/weaveworks/mesh"
+)
+
+// A peer of a later version may unicast us a kind of message we don't
+// know. Peers only send a new kind of message to those whose
+// incarnation Features say they can handle it, so one reaching us is
+// a bug or a peer which is lying about its features. We count it, and
+// tell the sender with a msgUnknown if it understands one, so that the
+// problem shows up at both ends.
+
+const featureNack = "nack"
+
+// Number of unicasts of kinds we don't know received, by kind
+var expUnknownMessages = expvar.NewMap("ipam.unknownMessages")
+
+// Actor client
+func (alloc *Allocator) unknownMessage(sender mesh.PeerName, kind byte) error {
+	expUnknownMessages.Add(fmt.Sprint(kind), 1)
+	if alloc.peerHasFeature(sender, featureNack) {
+		alloc.gossip.GossipUnicast(sender, []byte{msgUnknown, kind})
+	}
+	return fmt.Errorf("unknown kind of message %d from %s", kind, alloc.annotatePeernames([]mesh.PeerName{sender})[0])
+}
+
+// Actor client: sender did not know a kind of message we sent it
+func (alloc *Allocator) unknownMessageNacked(sender mesh.PeerName, msg []byte) error {
+	if len(msg) != 1 {
+		return fmt.Errorf("malformed nack from %s", sender)
+	}
+	alloc.warnf("Peer %s did not understand a message of kind %d that we sent it", alloc.annotatePeernames([]mesh.PeerName{sender})[0], msg[0])
+	return nil
+}
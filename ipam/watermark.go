@@ -0,0 +1,68 @@
+package ipam
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/weaveworks/weave/net/address"
+)
+
+// Number of times free space has dropped below the low watermark,
+// keyed by "local" or "mesh"
+var expLowWatermarkCrossings = expvar.NewMap("ipam.lowWatermarkCrossings")
+
+// SetLowWatermarks sets thresholds, as fractions, below which the free
+// space we own and that in the whole ring are considered low. Crossing
+// one is logged, counted and shown in status, so that exhaustion is
+// noticed before allocations start to wait. It must be called before
+// Start; 0, the default, disables a threshold.
+func (alloc *Allocator) SetLowWatermarks(local, mesh float64) {
+	alloc.lowWatermarks = [2]float64{local, mesh}
+}
+
+const (
+	localWatermark = iota
+	meshWatermark
+)
+
+var watermarkNames = [2]string{"local", "mesh"}
+
+// Actor client: compare free space against the watermarks, noting
+// any crossings
+func (alloc *Allocator) checkWatermarks() {
+	if alloc.ring.Empty() {
+		return
+	}
+	var owned address.Offset
+	for _, r := range alloc.ring.OwnedRanges() {
+		owned += r.Size()
+	}
+	free := [2]address.Offset{alloc.space.NumFreeAddressesInRange(alloc.universe), alloc.ring.TotalFree()}
+	size := [2]address.Offset{owned, alloc.ring.Size()}
+
+	for i, threshold := range alloc.lowWatermarks {
+		low := threshold > 0 && size[i] > 0 && float64(free[i]) < threshold*float64(size[i])
+		switch {
+		case low && alloc.lowSpace[i] == "":
+			expLowWatermarkCrossings.Add(watermarkNames[i], 1)
+			alloc.warnf("Free %s IP addresses have fallen below %.0f%%", watermarkNames[i], threshold*100)
+		case !low && alloc.lowSpace[i] != "":
+			alloc.infof("Free %s IP addresses are back above %.0f%%", watermarkNames[i], threshold*100)
+		}
+		alloc.lowSpace[i] = ""
+		if low {
+			alloc.lowSpace[i] = fmt.Sprintf("%s: %d of %d addresses free", watermarkNames[i], free[i], size[i])
+		}
+	}
+}
+
+// Actor client
+func (alloc *Allocator) lowSpaceStatus() []string {
+	var result []string
+	for _, low := range alloc.lowSpace {
+		if low != "" {
+			result = append(result, low)
+		}
+	}
+	return result
+}
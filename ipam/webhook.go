@@ -0,0 +1,253 @@
+package ipam
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/net/address"
+)
+
+// A Webhook tells some other system, e.g. a CMDB or monitoring, about
+// allocations as they happen, by POSTing a JSON WebhookEvent to a URL
+// for each. Events are sent in order from a goroutine of its own, and
+// retried, backing off, while the URL is unreachable or answers with a
+// server error; any other error drops the event, since sending it
+// again would get the same answer. If a secret is given, each body is
+// signed with it, along with the time, so that the receiver can tell
+// the events are ours and refuse old ones played back to it.
+
+// Kinds of WebhookEvent
+const (
+	WebhookAllocate  = "allocate"
+	WebhookFree      = "free"
+	WebhookTombstone = "tombstone" // the ranges of a removed peer were taken over
+)
+
+// WebhookSignatureHeader carries "t=" and the Unix time the POST was
+// signed at, then ",sha256=" and the hex HMAC-SHA256, keyed with the
+// webhook's secret, of that time, a "." and the body.
+const WebhookSignatureHeader = "X-Weave-Signature"
+
+// WebhookSignatureWindow is how far from the receiver's clock, either
+// way, the time a POST was signed at may be for CheckWebhookSignature
+// to accept it. Each retry is signed afresh, so only clock skew and
+// the time taken to deliver the POST count against it.
+const WebhookSignatureWindow = 5 * time.Minute
+
+const maxWebhookQueue = 10000 // beyond which the oldest events are dropped
+
+// WebhookEvent is the body of each POST.
+type WebhookEvent struct {
+	Event    string            `json:"event"`
+	Time     time.Time         `json:"time"`
+	Ident    string            `json:"ident,omitempty"`
+	Address  string            `json:"address,omitempty"`
+	Peer     string            `json:"peer,omitempty"`   // removed, of a tombstone
+	Ranges   []string          `json:"ranges,omitempty"` // taken over, of a tombstone
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Webhook is a Registrar and Tombstoner which POSTs events to a URL.
+type Webhook struct {
+	sync.Mutex
+	URL         string
+	Client      *http.Client
+	secret      []byte
+	pending     []WebhookEvent
+	removed     uint64        // from the head of pending, sent or dropped
+	dropped     int           // since pending was last empty
+	minInterval time.Duration // between retries, doubling up to maxInterval
+	maxInterval time.Duration
+	wake        chan struct{}
+	stop        chan struct{}
+}
+
+func NewWebhook(url, secret string, minInterval, maxInterval time.Duration) *Webhook {
+	wh := &Webhook{
+		URL:         url,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		secret:      []byte(secret),
+		minInterval: minInterval,
+		maxInterval: maxInterval,
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	go wh.loop()
+	return wh
+}
+
+func (wh *Webhook) Register(ident string, addr address.Address, metadata map[string]string) {
+	wh.add(WebhookEvent{Event: WebhookAllocate, Ident: ident, Address: addr.String(), Metadata: metadata})
+}
+
+func (wh *Webhook) Deregister(ident string, addr address.Address, metadata map[string]string) {
+	wh.add(WebhookEvent{Event: WebhookFree, Ident: ident, Address: addr.String(), Metadata: metadata})
+}
+
+func (wh *Webhook) Tombstone(peer string, ranges []address.Range, metadata map[string]string) {
+	event := WebhookEvent{Event: WebhookTombstone, Peer: peer, Metadata: metadata}
+	for _, r := range ranges {
+		event.Ranges = append(event.Ranges, r.String())
+	}
+	wh.add(event)
+}
+
+// Stop stops sending; events not yet sent are dropped.
+func (wh *Webhook) Stop() {
+	close(wh.stop)
+}
+
+// Pending returns the number of events not yet sent.
+func (wh *Webhook) Pending() int {
+	wh.Lock()
+	defer wh.Unlock()
+	return len(wh.pending)
+}
+
+func (wh *Webhook) add(event WebhookEvent) {
+	event.Time = time.Now().UTC()
+	wh.Lock()
+	wh.pending = append(wh.pending, event)
+	if len(wh.pending) > maxWebhookQueue {
+		wh.pending = wh.pending[1:]
+		wh.removed++
+		if wh.dropped++; wh.dropped == 1 {
+			common.Log.Warnf("[webhook] More than %d events queued for %s; dropping the oldest", maxWebhookQueue, wh.URL)
+		}
+	}
+	wh.Unlock()
+	select {
+	case wh.wake <- struct{}{}:
+	default: // already woken
+	}
+}
+
+func (wh *Webhook) loop() {
+	interval := wh.minInterval
+	for {
+		select {
+		case <-wh.wake:
+		case <-wh.stop:
+			return
+		}
+		for {
+			wh.Lock()
+			if len(wh.pending) == 0 {
+				wh.dropped = 0
+				wh.Unlock()
+				break
+			}
+			event, head := wh.pending[0], wh.removed
+			wh.Unlock()
+
+			if err := wh.send(event); err != nil {
+				// Retry the same event, so they stay in order
+				common.Log.Warnf("[webhook] %s; retrying in %s", err, interval)
+				select {
+				case <-time.After(interval):
+				case <-wh.stop:
+					return
+				}
+				if interval *= 2; interval > wh.maxInterval {
+					interval = wh.maxInterval
+				}
+				continue
+			}
+			interval = wh.minInterval
+			wh.Lock()
+			if wh.removed == head { // not dropped while we were sending it
+				wh.pending = wh.pending[1:]
+				wh.removed++
+			}
+			wh.Unlock()
+		}
+	}
+}
+
+// Sends event, returning an error if it is to be retried
+func (wh *Webhook) send(event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		signed := time.Now().Unix()
+		req.Header.Set(WebhookSignatureHeader, fmt.Sprintf("t=%d,sha256=%s", signed, WebhookSignature(wh.secret, signed, body)))
+	}
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == 429 /* Too Many Requests */ :
+		return fmt.Errorf("POST %s: %s %s", wh.URL, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	common.Log.Errorf("[webhook] Dropping %s event for %s: POST %s: %s %s", event.Event, event.Ident+event.Peer, wh.URL, resp.Status, strings.TrimSpace(string(respBody)))
+	return nil
+}
+
+// WebhookSignature returns the hex HMAC-SHA256, keyed with secret, of
+// signed, the Unix time an event was signed at, and its body.
+func WebhookSignature(secret []byte, signed int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", signed)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckWebhookSignature checks header, the WebhookSignatureHeader of
+// an event received at now, against its body. The signature must
+// match, and have been made within WebhookSignatureWindow of now. To
+// refuse an event replayed within the window too, a receiver can
+// remember the signatures it has accepted for that long.
+func CheckWebhookSignature(secret []byte, header string, body []byte, now time.Time) error {
+	var (
+		signed    int64
+		signature string
+	)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("malformed signature %q", header)
+		}
+		switch kv[0] {
+		case "t":
+			var err error
+			if signed, err = strconv.ParseInt(kv[1], 10, 64); err != nil {
+				return fmt.Errorf("malformed signature time %q", kv[1])
+			}
+		case "sha256":
+			signature = kv[1]
+		}
+	}
+	if signed == 0 || signature == "" {
+		return fmt.Errorf("signature %q lacks a time or an HMAC", header)
+	}
+	if !hmac.Equal([]byte(signature), []byte(WebhookSignature(secret, signed, body))) {
+		return fmt.Errorf("signature does not match")
+	}
+	if age := now.Sub(time.Unix(signed, 0)); age > WebhookSignatureWindow || age < -WebhookSignatureWindow {
+		return fmt.Errorf("signed %s from now, outside the window of %s", age, WebhookSignatureWindow)
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/weaveworks/mesh"
 
+	"github.com/weaveworks/weave/common/bufpool"
 	"github.com/weaveworks/weave/net/address"
 )
 
@@ -269,11 +270,11 @@ func (g *GossipData) Decode(msg []byte) error {
 func (g *GossipData) Encode() [][]byte {
 	g2 := g.copy()
 	sort.Sort(CaseSensitive(g2.Entries))
-	buf := &bytes.Buffer{}
-	if err := gob.NewEncoder(buf).Encode(g2); err != nil {
+	msg, err := bufpool.GobEncode(g2)
+	if err != nil {
 		panic(err)
 	}
-	return [][]byte{buf.Bytes()}
+	return [][]byte{msg}
 }
 
 func (g *GossipData) copy() *GossipData {
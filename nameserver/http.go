@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/miekg/dns"
@@ -89,6 +90,32 @@ func (n *Nameserver) HandleHTTP(router *mux.Router, dockerCli *docker.Client) {
 	router.Methods("DELETE").Path("/name/{container}").HandlerFunc(deleteHandler)
 	router.Methods("DELETE").Path("/name").HandlerFunc(deleteHandler)
 
+	router.Methods("GET").Path("/name/tombstones").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json, _ := json.MarshalIndent(n.TombstoneStats(), "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
+	// Prune tombstones now, optionally younger ones than usual; see PruneTombstones
+	router.Methods("POST").Path("/name/tombstones/prune").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxAge := tombstoneTimeout
+		if s := r.FormValue("max-age"); s != "" {
+			var err error
+			if maxAge, err = time.ParseDuration(s); err != nil {
+				n.badRequest(w, fmt.Errorf("Invalid max-age %q: %v", s, err))
+				return
+			}
+		}
+		n.infof("pruning tombstones older than %v on request", maxAge)
+		result := struct {
+			Pruned int
+			TombstoneStats
+		}{n.PruneTombstones(maxAge), n.TombstoneStats()}
+		json, _ := json.MarshalIndent(result, "", "    ")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
 	router.Methods("GET").Path("/name").Headers("Accept", "application/json").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		n.RLock()
 		defer n.RUnlock()
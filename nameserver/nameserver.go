@@ -39,6 +39,7 @@ type Nameserver struct {
 	gossip      mesh.Gossip
 	entries     Entries
 	isKnownPeer func(mesh.PeerName) bool
+	pruned      uint64 // tombstones; see tombstones.go
 	quit        chan struct{}
 }
 
@@ -57,7 +58,7 @@ func (n *Nameserver) SetGossip(gossip mesh.Gossip) {
 
 func (n *Nameserver) Start() {
 	go func() {
-		ticker := time.Tick(tombstoneTimeout)
+		ticker := time.Tick(tombstonePruneInterval)
 		for {
 			select {
 			case <-n.quit:
@@ -171,15 +172,6 @@ func (n *Nameserver) Delete(hostname, containerid, ipStr string, ip address.Addr
 	return n.broadcastEntries(entries...)
 }
 
-func (n *Nameserver) deleteTombstones() {
-	n.Lock()
-	defer n.Unlock()
-	now := time.Now().Unix()
-	n.entries.filter(func(e *Entry) bool {
-		return e.Tombstone == 0 || now-e.Tombstone <= int64(tombstoneTimeout/time.Second)
-	})
-}
-
 func (n *Nameserver) Gossip() mesh.GossipData {
 	n.RLock()
 	defer n.RUnlock()
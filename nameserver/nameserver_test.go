@@ -270,3 +270,28 @@ func TestTombstoneDeletion(t *testing.T) {
 	nameserver.deleteTombstones()
 	require.Equal(t, Entries{}, nameserver.entries)
 }
+
+func TestTombstoneStats(t *testing.T) {
+	oldNow := now
+	defer func() { now = oldNow }()
+	now = func() int64 { return 1234 }
+
+	peername, err := mesh.PeerNameFromString("00:00:00:02:00:00")
+	require.Nil(t, err)
+	nameserver := makeNameserver(peername)
+	require.Equal(t, TombstoneStats{}, nameserver.TombstoneStats())
+
+	require.Nil(t, nameserver.AddEntry("hostname1", "containerid1", peername, address.Address(1)))
+	require.Nil(t, nameserver.AddEntry("hostname2", "containerid2", peername, address.Address(2)))
+	require.Nil(t, nameserver.Delete("hostname1", "containerid1", "*", address.Address(0)))
+	now = func() int64 { return 1334 }
+	require.Equal(t, TombstoneStats{Live: 1, Tombstones: 1, NextExpiry: int64(tombstoneTimeout/time.Second) - 100},
+		nameserver.TombstoneStats())
+
+	// Nothing is old enough to prune yet, unless we say so
+	nameserver.deleteTombstones()
+	require.Equal(t, 1, nameserver.TombstoneStats().Tombstones)
+	require.Equal(t, 0, nameserver.PruneTombstones(time.Hour))
+	require.Equal(t, 1, nameserver.PruneTombstones(time.Minute))
+	require.Equal(t, TombstoneStats{Live: 1, Pruned: 1}, nameserver.TombstoneStats())
+}
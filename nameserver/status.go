@@ -1,11 +1,12 @@
 package nameserver
 
 type Status struct {
-	Domain   string
-	Upstream []string
-	Address  string
-	TTL      uint32
-	Entries  []EntryStatus
+	Domain     string
+	Upstream   []string
+	Address    string
+	TTL        uint32
+	Entries    []EntryStatus
+	Tombstones TombstoneStats
 }
 
 type EntryStatus struct {
@@ -22,6 +23,7 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 		return nil
 	}
 
+	tombstones := ns.TombstoneStats()
 	ns.RLock()
 	defer ns.RUnlock()
 
@@ -41,5 +43,6 @@ func NewStatus(ns *Nameserver, dnsServer *DNSServer) *Status {
 		dnsServer.upstream.Servers,
 		dnsServer.address,
 		dnsServer.ttl,
-		entryStatusSlice}
+		entryStatusSlice,
+		tombstones}
 }
@@ -0,0 +1,75 @@
+package nameserver
+
+import (
+	"expvar"
+	"time"
+)
+
+// Tombstones are pruned once they are older than tombstoneTimeout.
+// We look for ones to prune every tombstonePruneInterval, whatever
+// else is going on, so none outstays the timeout by more than that.
+const tombstonePruneInterval = time.Minute
+
+var expTombstonesPruned = expvar.NewInt("nameserver.tombstonesPruned")
+
+// TombstoneStats counts the live and tombstoned entries, for
+// operators wondering where their entries have gone, or why the
+// nameserver's gossip is so big.
+type TombstoneStats struct {
+	Live       int
+	Tombstones int
+	NextExpiry int64  // seconds until the oldest tombstone may be pruned, if there are any
+	Pruned     uint64 // since we started
+}
+
+// TombstoneStats returns the counts as they are now.
+func (n *Nameserver) TombstoneStats() TombstoneStats {
+	n.RLock()
+	defer n.RUnlock()
+	stats := TombstoneStats{Pruned: n.pruned}
+	oldest := int64(0)
+	for _, e := range n.entries {
+		if e.Tombstone == 0 {
+			stats.Live++
+			continue
+		}
+		stats.Tombstones++
+		if oldest == 0 || e.Tombstone < oldest {
+			oldest = e.Tombstone
+		}
+	}
+	if oldest != 0 {
+		stats.NextExpiry = oldest + int64(tombstoneTimeout/time.Second) - now()
+		if stats.NextExpiry < 0 {
+			stats.NextExpiry = 0
+		}
+	}
+	return stats
+}
+
+// PruneTombstones prunes tombstones older than maxAge straight away,
+// rather than waiting for the next regular pruning, and returns how
+// many it pruned. A maxAge shorter than tombstoneTimeout must allow
+// for gossip to reach every peer, and for the clock skew between
+// them, or peers which have not heard of a delete will bring the
+// entry back.
+func (n *Nameserver) PruneTombstones(maxAge time.Duration) int {
+	n.Lock()
+	defer n.Unlock()
+	cutoff := now() - int64(maxAge/time.Second)
+	before := len(n.entries)
+	n.entries.filter(func(e *Entry) bool {
+		return e.Tombstone == 0 || e.Tombstone >= cutoff
+	})
+	pruned := before - len(n.entries)
+	n.pruned += uint64(pruned)
+	expTombstonesPruned.Add(int64(pruned))
+	if pruned > 0 {
+		n.debugf("pruned %d tombstones", pruned)
+	}
+	return pruned
+}
+
+func (n *Nameserver) deleteTombstones() {
+	n.PruneTombstones(tombstoneTimeout)
+}
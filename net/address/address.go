@@ -3,6 +3,7 @@ package address
 import (
 	"fmt"
 	"net"
+	"sort"
 
 	"github.com/weaveworks/weave/common"
 )
@@ -22,18 +23,141 @@ func (r Range) Size() Offset               { return Subtract(r.End, r.Start) }
 func (r Range) String() string             { return fmt.Sprintf("%s-%s", r.Start, r.End-1) }
 func (r Range) Overlaps(or Range) bool     { return !(r.Start >= or.End || r.End <= or.Start) }
 func (r Range) Contains(addr Address) bool { return addr >= r.Start && addr < r.End }
+func (r Range) Empty() bool                { return r.Start >= r.End }
+
+// Intersect returns the addresses in both r and or; the result is
+// Empty if they do not overlap.
+func (r Range) Intersect(or Range) Range {
+	result := Range{Start: r.Start, End: r.End}
+	if or.Start > result.Start {
+		result.Start = or.Start
+	}
+	if or.End < result.End {
+		result.End = or.End
+	}
+	if result.Empty() {
+		return Range{}
+	}
+	return result
+}
+
+// Each calls f on every address in the range, in order, stopping
+// early if f returns false.
+func (r Range) Each(f func(Address) bool) {
+	for addr := r.Start; addr < r.End; addr++ {
+		if !f(addr) {
+			return
+		}
+	}
+}
+
+// CIDRs returns the smallest list of CIDR blocks exactly covering r.
+// Like every Range, r cannot reach the top of the address space: End
+// would wrap round to 0, making r Empty, so e.g. the Range of
+// 255.255.255.0/24 has no CIDRs.
+func (r Range) CIDRs() []CIDR {
+	var result []CIDR
+	for start := r.Start; start < r.End; {
+		// largest block aligned at start which fits in what's left
+		prefixLen := 32
+		for prefixLen > 0 {
+			size := Offset(1) << uint(32-prefixLen+1)
+			if size == 0 || start&Address(size-1) != 0 || size > Subtract(r.End, start) {
+				break
+			}
+			prefixLen--
+		}
+		cidr := CIDR{Start: start, PrefixLen: prefixLen}
+		result = append(result, cidr)
+		start = Add(start, cidr.Size())
+	}
+	return result
+}
 
 func (r Range) AsCIDRString() string {
-	prefixLen := 32
-	for size := r.Size(); size > 1; size = size / 2 {
-		if size%2 != 0 { // Size not a power of two; cannot be expressed as a CIDR.
-			return r.String()
+	if cidrs := r.CIDRs(); len(cidrs) == 1 {
+		return cidrs[0].String()
+	}
+	return r.String() // cannot be expressed as a single CIDR
+}
+
+// NormalizeRanges sorts ranges and merges any which overlap or abut,
+// dropping empty ones.
+func NormalizeRanges(ranges []Range) []Range {
+	sorted := make([]Range, 0, len(ranges))
+	for _, r := range ranges {
+		if !r.Empty() {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Sort(byStart(sorted))
+	var result []Range
+	for _, r := range sorted {
+		if n := len(result); n > 0 && r.Start <= result[n-1].End {
+			if r.End > result[n-1].End {
+				result[n-1].End = r.End
+			}
+			continue
 		}
-		prefixLen--
+		result = append(result, r)
 	}
-	return CIDR{Start: r.Start, PrefixLen: prefixLen}.String()
+	return result
 }
 
+// UnionRanges returns the normalized union of a and b.
+func UnionRanges(a, b []Range) []Range {
+	return NormalizeRanges(append(append([]Range{}, a...), b...))
+}
+
+// IntersectRanges returns the normalized intersection of a and b.
+func IntersectRanges(a, b []Range) []Range {
+	a, b = NormalizeRanges(a), NormalizeRanges(b)
+	var result []Range
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if r := a[i].Intersect(b[j]); !r.Empty() {
+			result = append(result, r)
+		}
+		if a[i].End < b[j].End {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
+
+// SubtractRanges returns the normalized set of addresses in a but not
+// in b.
+func SubtractRanges(a, b []Range) []Range {
+	a, b = NormalizeRanges(a), NormalizeRanges(b)
+	var result []Range
+	j := 0
+	for _, r := range a {
+		for j < len(b) && b[j].End <= r.Start {
+			j++
+		}
+		start := r.Start
+		for k := j; k < len(b) && b[k].Start < r.End; k++ {
+			if b[k].Start > start {
+				result = append(result, Range{Start: start, End: b[k].Start})
+			}
+			if b[k].End > start {
+				start = b[k].End
+			}
+		}
+		if start < r.End {
+			result = append(result, Range{Start: start, End: r.End})
+		}
+	}
+	return result
+}
+
+type byStart []Range
+
+func (rs byStart) Len() int           { return len(rs) }
+func (rs byStart) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs byStart) Less(i, j int) bool { return rs[i].Start < rs[j].Start }
+
 type CIDR struct {
 	Start     Address
 	PrefixLen int
@@ -41,6 +165,9 @@ type CIDR struct {
 
 func ParseIP(s string) (Address, error) {
 	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() == nil {
+			return 0, &net.ParseError{Type: "Non-IPv4 address not supported", Text: s}
+		}
 		return FromIP4(ip), nil
 	}
 	return 0, &net.ParseError{Type: "IP Address", Text: s}
@@ -59,6 +186,8 @@ func ParseCIDR(s string) (Address, CIDR, error) {
 
 func (cidr CIDR) Size() Offset { return 1 << uint(32-cidr.PrefixLen) }
 
+func (cidr CIDR) Contains(addr Address) bool { return cidr.Range().Contains(addr) }
+
 func (cidr CIDR) Range() Range {
 	return NewRange(cidr.Start, cidr.Size())
 }
@@ -67,6 +196,11 @@ func (cidr CIDR) HostRange() Range {
 	return NewRange(cidr.Start+1, cidr.Size()-2)
 }
 
+// Broadcast returns the last address in the CIDR.
+func (cidr CIDR) Broadcast() Address {
+	return Add(cidr.Start, cidr.Size()-1)
+}
+
 func (cidr CIDR) String() string {
 	return fmt.Sprintf("%s/%d", cidr.Start.String(), cidr.PrefixLen)
 }
@@ -0,0 +1,106 @@
+package address
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ip(s string) Address {
+	addr, err := ParseIP(s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func r(start, end string) Range {
+	return Range{Start: ip(start), End: ip(end)}
+}
+
+func TestParse(t *testing.T) {
+	addr, err := ParseIP("10.0.1.2")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.1.2", addr.String())
+	_, err = ParseIP("fe80::1")
+	require.Error(t, err, "IPv6 is not supported")
+	_, err = ParseIP("bogus")
+	require.Error(t, err)
+
+	addr, cidr, err := ParseCIDR("10.0.1.2/24")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.1.2", addr.String())
+	require.Equal(t, "10.0.1.0/24", cidr.String())
+	require.Equal(t, Offset(256), cidr.Size())
+	require.Equal(t, r("10.0.1.1", "10.0.1.255"), cidr.HostRange())
+	require.True(t, cidr.Contains(ip("10.0.1.255")))
+	require.False(t, cidr.Contains(ip("10.0.2.0")))
+}
+
+func TestRangeBasics(t *testing.T) {
+	a := r("10.0.0.0", "10.0.0.16")
+	require.Equal(t, Offset(16), a.Size())
+	require.True(t, a.Contains(ip("10.0.0.15")))
+	require.False(t, a.Contains(ip("10.0.0.16")))
+	require.Equal(t, "10.0.0.0/28", a.AsCIDRString())
+	require.True(t, a.Overlaps(r("10.0.0.15", "10.0.0.20")))
+	require.False(t, a.Overlaps(r("10.0.0.16", "10.0.0.20")))
+
+	require.Equal(t, r("10.0.0.8", "10.0.0.16"), a.Intersect(r("10.0.0.8", "10.0.1.0")))
+	require.True(t, a.Intersect(r("10.0.0.16", "10.0.1.0")).Empty())
+
+	var seen []string
+	r("10.0.0.254", "10.0.1.2").Each(func(addr Address) bool {
+		seen = append(seen, addr.String())
+		return len(seen) < 3
+	})
+	require.Equal(t, []string{"10.0.0.254", "10.0.0.255", "10.0.1.0"}, seen)
+}
+
+func TestCIDRs(t *testing.T) {
+	cidrStrings := func(rg Range) []string {
+		var result []string
+		for _, cidr := range rg.CIDRs() {
+			result = append(result, cidr.String())
+		}
+		return result
+	}
+	require.Equal(t, []string{"10.0.0.0/24"}, cidrStrings(r("10.0.0.0", "10.0.1.0")))
+	require.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29"},
+		cidrStrings(r("10.0.0.1", "10.0.0.16")))
+	require.Equal(t, []string{"10.0.0.16/28", "10.0.0.32/32"}, cidrStrings(r("10.0.0.16", "10.0.0.33")))
+	require.Nil(t, cidrStrings(Range{}))
+	// as close to the top of the address space as a Range can get
+	require.Equal(t, []string{"255.255.255.0/25", "255.255.255.128/26", "255.255.255.192/27", "255.255.255.224/28",
+		"255.255.255.240/29", "255.255.255.248/30", "255.255.255.252/31", "255.255.255.254/32"},
+		cidrStrings(r("255.255.255.0", "255.255.255.255")))
+	_, cidr, err := ParseCIDR("255.255.255.0/24")
+	require.NoError(t, err)
+	require.True(t, cidr.Range().Empty())
+	require.Equal(t, "255.255.255.255", cidr.Broadcast().String())
+	require.Nil(t, cidrStrings(cidr.Range()))
+}
+
+func TestRangeSets(t *testing.T) {
+	a := []Range{r("10.0.0.32", "10.0.0.48"), r("10.0.0.0", "10.0.0.16"), r("10.0.0.16", "10.0.0.20")}
+	b := []Range{r("10.0.0.8", "10.0.0.40"), {}}
+
+	require.Equal(t, []Range{r("10.0.0.0", "10.0.0.20"), r("10.0.0.32", "10.0.0.48")}, NormalizeRanges(a))
+	require.Equal(t, []Range{r("10.0.0.0", "10.0.0.48")}, UnionRanges(a, b))
+	require.Equal(t, []Range{r("10.0.0.8", "10.0.0.20"), r("10.0.0.32", "10.0.0.40")}, IntersectRanges(a, b))
+	require.Equal(t, []Range{r("10.0.0.0", "10.0.0.8"), r("10.0.0.40", "10.0.0.48")}, SubtractRanges(a, b))
+	require.Equal(t, []Range{r("10.0.0.20", "10.0.0.32")}, SubtractRanges(b, a))
+	require.Nil(t, SubtractRanges(a, a))
+	require.Nil(t, IntersectRanges(a, nil))
+}
+
+func TestReverse(t *testing.T) {
+	require.Equal(t, "4.3.2.1", ip("1.2.3.4").Reverse().String())
+}
+
+func TestAsCIDRString(t *testing.T) {
+	require.Equal(t, "10.0.0.0/24", r("10.0.0.0", "10.0.1.0").AsCIDRString())
+	// power-of-two size, but not aligned
+	require.Equal(t, "10.0.0.8-10.0.0.23", r("10.0.0.8", "10.0.0.24").AsCIDRString())
+	require.Equal(t, "10.0.0.1-10.0.0.2", r("10.0.0.1", "10.0.0.3").AsCIDRString())
+}
@@ -18,6 +18,26 @@ func CheckNetworkFree(subnet *net.IPNet, ignoreIfaceNames map[string]struct{}) e
 	})
 }
 
+// OverlappingRoutes describes each route on this host which overlaps
+// subnet, leaving out those through the interfaces named.
+func OverlappingRoutes(subnet *net.IPNet, ignoreIfaceNames map[string]struct{}) ([]string, error) {
+	var overlapping []string
+	err := forEachRoute(ignoreIfaceNames, func(route netlink.Route) error {
+		if route.Dst != nil && overlaps(route.Dst, subnet) {
+			overlapping = append(overlapping, describeRoute(route))
+		}
+		return nil
+	})
+	return overlapping, err
+}
+
+func describeRoute(route netlink.Route) string {
+	if iface, err := net.InterfaceByIndex(route.LinkIndex); err == nil {
+		return fmt.Sprintf("%s dev %s", route.Dst, iface.Name)
+	}
+	return route.Dst.String()
+}
+
 // Two networks overlap if the start-point of one is inside the other.
 func overlaps(n1, n2 *net.IPNet) bool {
 	return n1.Contains(n2.IP) || n2.Contains(n1.IP)
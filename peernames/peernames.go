@@ -0,0 +1,120 @@
+// Package peernames maps peer names to nicknames, for every subsystem
+// which shows peers to people, so that they all show the same
+// nickname for a peer and accept it in place of the name.
+//
+// Several sources tell the registry about peers: the router from the
+// topology, and subsystems such as IPAM which gossip about peers that
+// may have left it. A peer is remembered until every source which
+// told the registry about it has forgotten it. The registry is safe
+// for concurrent use.
+package peernames
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+type entry struct {
+	nickname string
+	sources  map[string]struct{}
+}
+
+type Registry struct {
+	sync.RWMutex
+	entries map[mesh.PeerName]*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[mesh.PeerName]*entry)}
+}
+
+// Set records, on behalf of source, that peer has nickname. A later
+// nickname replaces an earlier one, whichever source gave it.
+func (reg *Registry) Set(source string, peer mesh.PeerName, nickname string) {
+	reg.Lock()
+	defer reg.Unlock()
+	e, found := reg.entries[peer]
+	if !found {
+		e = &entry{sources: make(map[string]struct{})}
+		reg.entries[peer] = e
+	}
+	e.nickname = nickname
+	e.sources[source] = struct{}{}
+}
+
+// Forget records that source no longer knows of peer.
+func (reg *Registry) Forget(source string, peer mesh.PeerName) {
+	reg.Lock()
+	defer reg.Unlock()
+	if e, found := reg.entries[peer]; found {
+		delete(e.sources, source)
+		if len(e.sources) == 0 {
+			delete(reg.entries, peer)
+		}
+	}
+}
+
+// Nickname returns the nickname of peer, if it is known.
+func (reg *Registry) Nickname(peer mesh.PeerName) (string, bool) {
+	reg.RLock()
+	defer reg.RUnlock()
+	e, found := reg.entries[peer]
+	if !found {
+		return "", false
+	}
+	return e.nickname, true
+}
+
+// Annotate returns peer's name followed by its nickname, if known, in
+// the form used throughout weave's logs and status, e.g.
+// "ae:25:bb:6c:aa:42(host1)".
+func (reg *Registry) Annotate(peer mesh.PeerName) string {
+	if nickname, found := reg.Nickname(peer); found {
+		return fmt.Sprint(peer, "(", nickname, ")")
+	}
+	return peer.String()
+}
+
+// Resolve returns the peer with the given name, or with the given
+// nickname, matched case-insensitively. It is an error for a nickname
+// to belong to more than one peer.
+func (reg *Registry) Resolve(name string) (mesh.PeerName, error) {
+	var matches []string
+	var match mesh.PeerName
+	reg.RLock()
+	for peer, e := range reg.entries {
+		if strings.EqualFold(e.nickname, name) {
+			match = peer
+			matches = append(matches, fmt.Sprint(peer, "(", e.nickname, ")"))
+		}
+	}
+	reg.RUnlock()
+	switch len(matches) {
+	case 0:
+	case 1:
+		return match, nil
+	default:
+		sort.Strings(matches)
+		return mesh.UnknownPeerName, fmt.Errorf("Nickname '%s' is ambiguous; use one of the peer names %v", name, matches)
+	}
+	peer, err := mesh.PeerNameFromString(name)
+	if err != nil {
+		return mesh.UnknownPeerName, fmt.Errorf("Cannot find peer '%s'", name)
+	}
+	return peer, nil
+}
+
+// Nicknames returns every known nickname, by peer name.
+func (reg *Registry) Nicknames() map[string]string {
+	reg.RLock()
+	defer reg.RUnlock()
+	nicknames := make(map[string]string, len(reg.entries))
+	for peer, e := range reg.entries {
+		nicknames[peer.String()] = e.nickname
+	}
+	return nicknames
+}
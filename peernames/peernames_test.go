@@ -0,0 +1,43 @@
+package peernames
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry()
+	peer1, _ := mesh.PeerNameFromString("01:00:00:01:00:00")
+	peer2, _ := mesh.PeerNameFromString("02:00:00:02:00:00")
+
+	reg.Set("topology", peer1, "host1")
+	reg.Set("ipam", peer1, "host1")
+	reg.Set("ipam", peer2, "HOST2")
+	require.Equal(t, "01:00:00:01:00:00(host1)", reg.Annotate(peer1))
+	require.Equal(t, map[string]string{"01:00:00:01:00:00": "host1", "02:00:00:02:00:00": "HOST2"}, reg.Nicknames())
+
+	name, err := reg.Resolve("host2")
+	require.NoError(t, err)
+	require.Equal(t, peer2, name)
+	name, err = reg.Resolve("01:00:00:01:00:00")
+	require.NoError(t, err)
+	require.Equal(t, peer1, name)
+	_, err = reg.Resolve("host3")
+	require.Error(t, err)
+
+	// A peer is remembered until all its sources forget it
+	reg.Forget("topology", peer1)
+	_, found := reg.Nickname(peer1)
+	require.True(t, found)
+	reg.Forget("ipam", peer1)
+	_, found = reg.Nickname(peer1)
+	require.False(t, found)
+	require.Equal(t, "01:00:00:01:00:00", reg.Annotate(peer1))
+
+	// Nicknames shared by two peers are ambiguous
+	reg.Set("topology", peer1, "host2")
+	_, err = reg.Resolve("host2")
+	require.Error(t, err)
+}
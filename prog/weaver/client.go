@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/docker/docker/pkg/mflag"
+
+	"github.com/weaveworks/weave/api"
+	"github.com/weaveworks/weave/ipam"
+	weave "github.com/weaveworks/weave/router"
+)
+
+// Commands which query a running router instead of starting one, e.g.
+// "weaver status". They fetch the router's JSON and render it with the
+// same templates as its /status endpoints.
+var clientCommands = map[string]func(client *api.Client) error{
+	"status":      reportCommand(statusTemplate),
+	"connections": reportCommand(connectionsTemplate),
+	"peers":       reportCommand(peersTemplate),
+	"dns":         reportCommand(dnsEntriesTemplate),
+	"ring":        ringCommand,
+	"probe":       probeCommand,
+}
+
+var ringTemplate = defTemplate("ring", `\
+          Range: {{.Range}}
+  Fragmentation: {{printf "%.2f" .Fragmentation}} ({{.Runs}} runs)
+
+{{printf "%-37v" "PEER"}} {{printf "%6v" "RANGES"}} {{printf "%10v" "SIZE"}} {{printf "%10v" "FREE"}} {{printf "%6v" "USED"}} {{printf "%6v" "RUNS"}} {{printf "%8v" "FRAG"}}
+{{range .Peers}}\
+{{$nameNickName := printf "%v(%v)" .Peer .Nickname}}{{printf "%-37v" $nameNickName}} \
+{{printf "%6d" .Entries}} {{printf "%10d" .Size}} {{printf "%10d" .Free}} \
+{{printf "%5.1f%%" (percent .Utilization)}} {{printf "%6d" .Runs}} {{printf "%8.2f" .Fragmentation}}
+{{end}}\
+`)
+
+var probeTemplate = defTemplate("probe", `\
+{{range .}}\
+{{$nameNickName := printf "%v(%v)" .Peer .NickName}}{{printf "%-37v" $nameNickName}} \
+{{if .DataPath}}\
+{{printf "%-6v" .Overlay}} rtt {{.RTT}} mtu {{.MTU}}
+{{else}}\
+control plane only: {{.Error}}
+{{end}}\
+{{end}}\
+`)
+
+// runClientCommand runs the command named by args[0], exiting with
+// an error status if it fails
+func runClientCommand(args []string) {
+	var httpAddr string
+	flags := mflag.NewFlagSet("weaver "+args[0], mflag.ExitOnError)
+	flags.StringVar(&httpAddr, []string{"-http-addr"}, fmt.Sprintf("127.0.0.1:%d", api.WeaveHTTPPort), "address of the router's HTTP interface (absolute path indicates unix domain socket)")
+	flags.Parse(args[1:])
+	if err := clientCommands[args[0]](api.NewClientForHTTPAddr(httpAddr)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func reportCommand(tmpl *template.Template) func(*api.Client) error {
+	return func(client *api.Client) error {
+		report, err := client.Report()
+		if err != nil {
+			return err
+		}
+		var status WeaveStatus
+		if err := json.Unmarshal([]byte(report), &status); err != nil {
+			return err
+		}
+		return tmpl.Execute(os.Stdout, status)
+	}
+}
+
+func ringCommand(client *api.Client) error {
+	body, err := client.RingStats()
+	if err != nil {
+		return err
+	}
+	var stats ipam.RingStats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		return err
+	}
+	return ringTemplate.Execute(os.Stdout, stats)
+}
+
+func probeCommand(client *api.Client) error {
+	body, err := client.ProbeDataPaths()
+	if err != nil {
+		return err
+	}
+	var results []weave.ProbeResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		return err
+	}
+	return probeTemplate.Execute(os.Stdout, results)
+}
@@ -12,6 +12,11 @@ import (
 	"github.com/weaveworks/mesh"
 
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/diagnostics"
+	"github.com/weaveworks/weave/common/errorlog"
+	"github.com/weaveworks/weave/common/mflagext"
+	"github.com/weaveworks/weave/common/supervisor"
+	"github.com/weaveworks/weave/gossip"
 	"github.com/weaveworks/weave/ipam"
 	"github.com/weaveworks/weave/nameserver"
 	"github.com/weaveworks/weave/net/address"
@@ -115,6 +120,9 @@ var rootTemplate = template.New("root").Funcs(map[string]interface{}{
 		return "disabled"
 	},
 	"trimSuffix": strings.TrimSuffix,
+	"percent": func(fraction float64) float64 {
+		return fraction * 100
+	},
 })
 
 // Print counts in a specified order
@@ -140,6 +148,15 @@ func defTemplate(name string, text string) *template.Template {
 
 var statusTemplate = defTemplate("status", `\
         Version: {{.Version}}
+{{range .Degraded}}\
+       Degraded: {{.}}
+{{end}}\
+{{range $name, $value := .Tuned}}\
+          Tuned: {{$name}} {{$value}}
+{{end}}\
+{{with .Errors}}\
+         Errors: recent errors in {{len .}} subsystems - see 'weave status errors'
+{{end}}\
 
         Service: router
        Protocol: {{.Router.Protocol}} \
@@ -155,24 +172,48 @@ var statusTemplate = defTemplate("status", `\
     Connections: {{len .Router.Connections}}{{with printConnectionCounts .Router.Connections}} ({{.}}){{end}}
           Peers: {{len .Router.Peers}}{{with printPeerConnectionCounts .Router.Peers}} (with {{.}} connections){{end}}
  TrustedSubnets: {{printList .Router.TrustedSubnets}}
+{{if .Router.ReadOnly}}\
+      Read-only: not changing connection targets
+{{end}}\
 {{if .IPAM}}\
 
         Service: ipam
-{{if .IPAM.Entries}}\
+{{if .IPAM.Quarantined}}\
+         Status: quarantined - {{.IPAM.Quarantined}}; restart to resume allocation
+{{else if .IPAM.ReadOnly}}\
+         Status: read-only - not allocating new addresses
+{{else if .IPAM.Entries}}\
 {{if allIPAMOwnersUnreachable .IPAM}}\
          Status: all IP ranges owned by unreachable peers - use 'rmpeer' if they are dead
 {{else if len .IPAM.PendingAllocates}}\
          Status: waiting for IP range grant from peers
+{{else if .IPAM.LowSpace}}\
+         Status: degraded - running low on free IP addresses
 {{else}}\
          Status: ready
 {{end}}\
 {{else if .IPAM.Paxos}}\
-         Status: awaiting consensus (quorum: {{.IPAM.Paxos.Quorum}}, known: {{.IPAM.Paxos.KnownNodes}})
+         Status: awaiting consensus (quorum: {{.IPAM.Paxos.Quorum}}, known: {{.IPAM.Paxos.KnownNodes}}, proposals: {{.IPAM.Paxos.Proposals}}, next in: {{.IPAM.Paxos.Backoff}})
 {{else}}\
          Status: idle
 {{end}}\
           Range: {{.IPAM.Range}}
   DefaultSubnet: {{.IPAM.DefaultSubnet}}
+{{with .IPAM.Exclusions}}\
+       Excluded: {{len .}} addresses
+{{end}}\
+{{range .IPAM.LowSpace}}\
+       Low space: {{.}}
+{{end}}\
+{{range .IPAM.NicknameCollisions}}\
+        Warning: nickname shared by several peers - {{.}}
+{{end}}\
+{{range .IPAM.ClockSkew}}{{with .Warning}}\
+        Warning: {{.}}
+{{end}}{{end}}\
+{{range .IPAM.Incarnations}}{{with .Warning}}\
+        Warning: {{.}}
+{{end}}{{end}}\
 {{end}}\
 {{if .DNS}}\
 
@@ -181,6 +222,7 @@ var statusTemplate = defTemplate("status", `\
        Upstream: {{printList .DNS.Upstream}}
             TTL: {{.DNS.TTL}}
         Entries: {{countDNSEntries .DNS.Entries}}
+     Tombstones: {{.DNS.Tombstones.Tombstones}}
 {{end}}\
 `)
 
@@ -216,23 +258,84 @@ var dnsEntriesTemplate = defTemplate("dnsEntries", `\
 {{end}}\
 `)
 
+var errorsTemplate = defTemplate("errorsTemplate", `\
+{{range .Errors}}\
+{{.Name}}
+{{range .Errors}}\
+   {{.Time.Format "2006/01/02 15:04:05"}} {{.Error}}
+{{end}}\
+{{end}}\
+`)
+
 var ipamTemplate = defTemplate("ipamTemplate", `{{printIPAMRanges .Router .IPAM}}`)
 
 type WeaveStatus struct {
-	Version string
-	Router  *weave.NetworkRouterStatus `json:"Router,omitempty"`
-	IPAM    *ipam.Status               `json:"IPAM,omitempty"`
-	DNS     *nameserver.Status         `json:"DNS,omitempty"`
+	Version  string
+	Router   *weave.NetworkRouterStatus `json:"Router,omitempty"`
+	IPAM     *ipam.Status               `json:"IPAM,omitempty"`
+	DNS      *nameserver.Status         `json:"DNS,omitempty"`
+	Degraded []string                   `json:"Degraded,omitempty"`
+	Tuned    map[string]string          `json:"Tuned,omitempty"`
+	Errors   []errorlog.Subsystem       `json:"Errors,omitempty"`
 }
 
-func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer) {
-	status := func() WeaveStatus {
+func statusFunc(version string, router *weave.NetworkRouter, allocator *ipam.Allocator, defaultSubnet address.CIDR, ns *nameserver.Nameserver, dnsserver *nameserver.DNSServer, settings *runtimeSettings) func() WeaveStatus {
+	return func() WeaveStatus {
 		return WeaveStatus{
 			version,
 			weave.NewNetworkRouterStatus(router),
 			ipam.NewStatus(allocator, defaultSubnet),
-			nameserver.NewStatus(ns, dnsserver)}
+			nameserver.NewStatus(ns, dnsserver),
+			supervisor.Degraded(),
+			settings.Changed(),
+			errorlog.Recent()}
+	}
+}
+
+// Describe the state of the router, peers and IPAM ring on SIGUSR1
+func registerStatusDumps(status func() WeaveStatus) {
+	for _, dump := range []struct {
+		name     string
+		template *template.Template
+	}{{"status", statusTemplate}, {"peers", peersTemplate}, {"ipam ring", ipamTemplate}} {
+		tmpl := dump.template
+		OnDump(dump.name, func() string {
+			var buf bytes.Buffer
+			if err := tmpl.Execute(&buf, status()); err != nil {
+				return err.Error()
+			}
+			return buf.String()
+		})
 	}
+}
+
+// Queue lengths and goroutines, to find where things are stuck
+func handleDiagnosticsHTTP(muxRouter *mux.Router) {
+	muxRouter.Methods("GET").Path("/diagnostics").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json, err := json.MarshalIndent(diagnostics.Collect(), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+}
+
+// Counts of the gossip messages received, by peer, channel and type
+func handleGossipStatsHTTP(muxRouter *mux.Router, stats *gossip.StatsMonitor) {
+	muxRouter.Methods("GET").Path("/gossip/stats").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json, err := json.MarshalIndent(stats.Stats(), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+}
+
+func HandleHTTP(muxRouter *mux.Router, status func() WeaveStatus) {
 	muxRouter.Methods("GET").Path("/report").Headers("Accept", "application/json").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			json, err := json.MarshalIndent(status(), "", "    ")
@@ -245,6 +348,18 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 			w.Write(json)
 		})
 
+	// The value of every setting, however it was arrived at
+	muxRouter.Methods("GET").Path("/config").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			json, err := json.MarshalIndent(elideSecrets(mflagext.EffectiveValues()), "", "    ")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(json)
+		})
+
 	muxRouter.Methods("GET").Path("/report").Queries("format", "{format}").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			funcs := template.FuncMap{
@@ -280,5 +395,18 @@ func HandleHTTP(muxRouter *mux.Router, version string, router *weave.NetworkRout
 	defHandler("/status/peers", peersTemplate)
 	defHandler("/status/dns", dnsEntriesTemplate)
 	defHandler("/status/ipam", ipamTemplate)
+	defHandler("/status/errors", errorsTemplate)
+
+	// 503 once any goroutine has panicked and could not be restarted
+	muxRouter.Methods("GET").Path("/health").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			degraded := supervisor.Degraded()
+			if len(degraded) > 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				fmt.Fprintln(w, strings.Join(degraded, "\n"))
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
 
 }
@@ -10,22 +10,46 @@ import (
 	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/davecheney/profile"
 	"github.com/docker/docker/pkg/mflag"
 	"github.com/gorilla/mux"
 	"github.com/weaveworks/mesh"
 
+	"github.com/weaveworks/weave/bootstrap"
 	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/diagnostics"
 	"github.com/weaveworks/weave/common/docker"
+	"github.com/weaveworks/weave/common/mflagext"
+	"github.com/weaveworks/weave/common/supervisor"
+	"github.com/weaveworks/weave/common/tracing"
+	"github.com/weaveworks/weave/election"
+	"github.com/weaveworks/weave/gossip"
 	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/ipam/space"
 	"github.com/weaveworks/weave/nameserver"
 	weavenet "github.com/weaveworks/weave/net"
 	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/peernames"
 	weave "github.com/weaveworks/weave/router"
 )
 
 var version = "(unreleased version)"
 
+// Prefix of the environment variables which settings can be given in
+const configEnvPrefix = "WEAVER_"
+
+// How often the coordinator election catches up with the peers known
+// to the router.
+const coordinatorRefreshInterval = 5 * time.Second
+
+// How often IPAM catches up with the addresses on the host's interfaces
+const hostAddressInterval = time.Minute
+
+// The bridge containers are attached to, as named by the weave script;
+// routes through it are ours
+const weaveBridgeName = "weave"
+
 type dnsConfig struct {
 	Domain                 string
 	ListenAddress          string
@@ -35,6 +59,15 @@ type dnsConfig struct {
 }
 
 func main() {
+	// A command, rather than peers to connect to, means query a
+	// running router; see client.go
+	if len(os.Args) > 1 {
+		if _, found := clientCommands[os.Args[1]]; found {
+			runClientCommand(os.Args[1:])
+			return
+		}
+	}
+
 	procs := runtime.NumCPU()
 	// packet sniffing can block an OS thread, so we need one thread
 	// for that plus at least one more.
@@ -50,6 +83,9 @@ func main() {
 		protocolMinVersion int
 		ifaceName          string
 		routerName         string
+		nameSource         string
+		nameFile           string
+		regenerateName     bool
 		nickName           string
 		password           string
 		pktdebug           bool
@@ -61,12 +97,41 @@ func main() {
 		iprangeCIDR        string
 		ipsubnetCIDR       string
 		peerCount          int
+		manualSeed         bool
+		ipReserve          float64
+		ipLowWatermark     float64
+		ipMeshLowWatermark float64
+		reconcileInterval  time.Duration
+		routeCheckInterval time.Duration
+		reconcileDryRun    bool
+		verifyRelease      bool
+		affinityTTL        time.Duration
+		reuseDelay         time.Duration
+		allocStrategy      string
+		externalIPAM       string
+		webhookURLs        []string
+		webhookSecret      string
+		maxProposalWait    time.Duration
 		dockerAPI          string
 		peers              []string
 		noDNS              bool
 		dnsConfig          dnsConfig
 		datapathName       string
 		trustedSubnetStr   string
+		advertiseAddress   string
+		establishTimeout   time.Duration
+		maxPeers           int
+		logGossip          bool
+		gossipPacing       gossip.Pacing
+		maxGossipSize      int
+		gossipCompress     int
+		traceEndpoint      string
+		configFile         string
+		settingsToken      string
+		readOnly           bool
+		bootstrapStore     string
+		bootstrapAddress   string
+		bootstrapInterval  time.Duration
 
 		defaultDockerHost = "unix:///var/run/docker.sock"
 	)
@@ -76,22 +141,46 @@ func main() {
 	}
 
 	mflag.BoolVar(&justVersion, []string{"#version", "-version"}, false, "print version and exit")
+	mflag.StringVar(&configFile, []string{"-config-file"}, "", "JSON file of settings, overridden by WEAVER_* environment variables and then by the command line")
 	mflag.IntVar(&config.Port, []string{"#port", "-port"}, mesh.Port, "router port")
 	mflag.IntVar(&protocolMinVersion, []string{"-min-protocol-version"}, mesh.ProtocolMinVersion, "minimum weave protocol version")
 	mflag.StringVar(&ifaceName, []string{"#iface", "-iface"}, "", "name of interface to capture/inject from (disabled if blank)")
 	mflag.StringVar(&routerName, []string{"#name", "-name"}, "", "name of router (defaults to MAC of interface)")
+	mflag.StringVar(&nameSource, []string{"-name-source"}, nameSourceMAC, "how to derive the router name when --name is not given ("+strings.Join(nameSources(), ", ")+")")
+	mflag.StringVar(&nameFile, []string{"-name-file"}, "", "file in which to persist the router name across restarts (disabled if blank)")
+	mflag.BoolVar(&regenerateName, []string{"-regenerate-name"}, false, "ignore any name persisted in --name-file and derive a new one")
 	mflag.StringVar(&nickName, []string{"#nickname", "-nickname"}, "", "nickname of peer (defaults to hostname)")
 	mflag.StringVar(&password, []string{"#password", "-password"}, "", "network password")
 	mflag.StringVar(&logLevel, []string{"-log-level"}, "info", "logging level (debug, info, warning, error)")
 	mflag.BoolVar(&pktdebug, []string{"#pktdebug", "#-pktdebug", "-pkt-debug"}, false, "enable per-packet debug logging")
 	mflag.StringVar(&prof, []string{"#profile", "-profile"}, "", "enable profiling and write profiles to given path")
+	mflag.DurationVar(&establishTimeout, []string{"-conn-establish-timeout"}, weave.DefaultEstablishTimeout, "tear down connections whose UDP path is not established within this time (0 to wait indefinitely)")
+	mflag.DurationVar(&weave.SlowEstablish, []string{"-conn-establish-slo"}, weave.SlowEstablish, "count and log connections which take longer than this to establish")
 	mflag.IntVar(&config.ConnLimit, []string{"#connlimit", "#-connlimit", "-conn-limit"}, 30, "connection limit (0 for unlimited)")
+	mflag.IntVar(&maxPeers, []string{"-max-peers"}, 0, "refuse connections which would grow the network beyond this many peers (0 for unlimited)")
 	mflag.BoolVar(&noDiscovery, []string{"#nodiscovery", "#-nodiscovery", "-no-discovery"}, false, "disable peer discovery")
 	mflag.IntVar(&bufSzMB, []string{"#bufsz", "-bufsz"}, 8, "capture buffer size in MB")
 	mflag.StringVar(&httpAddr, []string{"#httpaddr", "#-httpaddr", "-http-addr"}, "", "address to bind HTTP interface to (disabled if blank, absolute path indicates unix domain socket)")
-	mflag.StringVar(&iprangeCIDR, []string{"#iprange", "#-iprange", "-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation")
+	mflag.StringVar(&settingsToken, []string{"-http-settings-token"}, "", "token to present, as 'Authorization: Bearer <token>', to change settings via POST /settings (disabled if blank)")
+	mflag.BoolVar(&readOnly, []string{"-read-only"}, false, "refuse new IP allocations and changes to connection targets, e.g. during maintenance (can be changed at runtime)")
+	mflag.StringVar(&iprangeCIDR, []string{"#iprange", "#-iprange", "-ipalloc-range"}, "", "IP address range reserved for automatic allocation, in CIDR notation; several disjoint ranges, separated by commas, form a single pool")
 	mflag.StringVar(&ipsubnetCIDR, []string{"#ipsubnet", "#-ipsubnet", "-ipalloc-default-subnet"}, "", "subnet to allocate within by default, in CIDR notation")
 	mflag.IntVar(&peerCount, []string{"#initpeercount", "#-initpeercount", "-init-peer-count"}, 0, "number of peers in network (for IP address allocation)")
+	mflag.BoolVar(&manualSeed, []string{"-ipalloc-manual-seed"}, false, "don't agree IP allocation with other peers automatically; wait for an administrator to POST /seed (use on all peers or none)")
+	mflag.Float64Var(&ipReserve, []string{"-ipalloc-reserve"}, 0, "fraction of an equal share of the IP allocation range which each peer keeps for when it is partitioned from the rest")
+	mflag.Float64Var(&ipLowWatermark, []string{"-ipalloc-low-watermark"}, 0, "warn when the fraction of this peer's IP addresses which are free falls below this (0 to disable)")
+	mflag.Float64Var(&ipMeshLowWatermark, []string{"-ipalloc-mesh-low-watermark"}, 0, "warn when the fraction of the whole IP allocation range which is free falls below this (0 to disable)")
+	mflag.DurationVar(&routeCheckInterval, []string{"-route-conflict-interval"}, time.Minute, "how often to check the host's routes for ones overlapping the allocation range, which are reported as unhealthy (0 to disable)")
+	mflag.DurationVar(&reconcileInterval, []string{"-ipalloc-reconcile-interval"}, 0, "how often to release IP addresses of containers which no longer exist, in case we missed them being destroyed (0 to disable)")
+	mflag.BoolVar(&reconcileDryRun, []string{"-ipalloc-reconcile-dry-run"}, false, "only log which IP addresses reconciliation would release")
+	mflag.BoolVar(&verifyRelease, []string{"-ipalloc-verify-release"}, false, "refuse requests to release the IP addresses of containers which Docker says are still running, unless forced")
+	mflag.DurationVar(&affinityTTL, []string{"-ipalloc-affinity-ttl"}, 0, "for how long a container which frees an IP address gets it back if it allocates again (0 to disable)")
+	mflag.DurationVar(&reuseDelay, []string{"-ipalloc-reuse-delay"}, 0, "how long a freed IP address is held back before it is allocated to another container, unless there is no other (0 to reuse at once)")
+	mflag.StringVar(&allocStrategy, []string{"-ipalloc-strategy"}, "sequential", "which free IP address to allocate: the lowest (sequential), any (random), or the one freed longest ago (lru)")
+	mflag.StringVar(&externalIPAM, []string{"-ipalloc-external-url"}, "", "base URL of an external IPAM system to mirror allocations into")
+	mflagext.ListVar(&webhookURLs, []string{"-ipalloc-webhook-url"}, nil, "URL to POST IP allocation events to, as JSON (may be repeated)")
+	mflag.StringVar(&webhookSecret, []string{"-ipalloc-webhook-secret"}, "", "secret with which to sign the events POSTed to --ipalloc-webhook-url")
+	mflag.DurationVar(&maxProposalWait, []string{"-ipalloc-max-proposal-interval"}, ipam.DefaultMaxProposalInterval, "longest to wait between proposals while agreeing IP allocation with other peers, backing off exponentially up to it")
 	mflag.StringVar(&dockerAPI, []string{"#api", "#-api", "-docker-api"}, defaultDockerHost, "Docker API endpoint")
 	mflag.BoolVar(&noDNS, []string{"-no-dns"}, false, "disable DNS server")
 	mflag.StringVar(&dnsConfig.Domain, []string{"-dns-domain"}, nameserver.DefaultDomain, "local domain to server requests for")
@@ -99,9 +188,19 @@ func main() {
 	mflag.IntVar(&dnsConfig.TTL, []string{"-dns-ttl"}, nameserver.DefaultTTL, "TTL for DNS request from our domain")
 	mflag.DurationVar(&dnsConfig.ClientTimeout, []string{"-dns-fallback-timeout"}, nameserver.DefaultClientTimeout, "timeout for fallback DNS requests")
 	mflag.StringVar(&dnsConfig.EffectiveListenAddress, []string{"-dns-effective-listen-address"}, "", "address DNS will actually be listening, after Docker port mapping")
+	mflag.BoolVar(&logGossip, []string{"-log-gossip"}, false, "log every gossip message sent or received, at debug level")
+	mflag.DurationVar(&gossipPacing.Min, []string{"-gossip-interval-min"}, 0, "interval between periodic gossip of IPAM and DNS state after a change, at least mesh's own of 30s")
+	mflag.IntVar(&maxGossipSize, []string{"-max-gossip-message-size"}, gossip.DefaultMaxMessageSize, "largest IPAM or DNS gossip message to accept from a peer, in bytes; a peer sending a larger one is disconnected (0 for unlimited)")
+	mflag.DurationVar(&gossipPacing.Max, []string{"-gossip-interval-max"}, 0, "interval which periodic gossip backs off to while nothing changes (0 to gossip every 30s)")
+	mflag.IntVar(&gossipCompress, []string{"-gossip-compress-threshold"}, 0, "compress IPAM and DNS gossip messages longer than this many bytes (0 to send none compressed); only set this once all peers are of a version which accepts them")
+	mflag.StringVar(&traceEndpoint, []string{"-trace-endpoint"}, "", "URL of an OpenTelemetry collector to send IP allocation traces to, as OTLP JSON, e.g. http://collector:4318/v1/traces (disabled if blank)")
 	mflag.StringVar(&datapathName, []string{"-datapath"}, "", "ODP datapath name")
 
 	mflag.StringVar(&trustedSubnetStr, []string{"-trusted-subnets"}, "", "Command separated list of trusted subnets in CIDR notation")
+	mflag.StringVar(&bootstrapStore, []string{"-bootstrap-store"}, "", "URL of a store shared by the peers, in which to record our address and find theirs, e.g. consul://localhost:8500/weave/mycluster, etcd://localhost:2379/weave/mycluster or file:///shared/weave")
+	mflag.StringVar(&bootstrapAddress, []string{"-bootstrap-address"}, "", "IP address, and optionally port, to record in --bootstrap-store for other peers to connect to (defaults to --advertise-address)")
+	mflag.DurationVar(&bootstrapInterval, []string{"-bootstrap-interval"}, time.Minute, "how often to refresh our record in --bootstrap-store and look for other peers there")
+	mflag.StringVar(&advertiseAddress, []string{"-advertise-address"}, "", "IP address, and optionally port, at which peers should send us overlay traffic, e.g. the public address of a host behind 1:1 NAT (defaults to the address they connect to)")
 
 	// crude way of detecting that we probably have been started in a
 	// container, with `weave launch` --> suppress misleading paths in
@@ -113,6 +212,11 @@ func main() {
 
 	mflag.Parse()
 
+	configOptions, err := mflagext.LoadConfig(configFile, configEnvPrefix)
+	if err != nil {
+		Log.Fatal(err)
+	}
+
 	peers = mflag.Args()
 
 	SetLogLevel(logLevel)
@@ -123,6 +227,9 @@ func main() {
 	}
 
 	Log.Println("Command line options:", options())
+	if len(configOptions) > 0 {
+		Log.Println("Config file and environment options:", elideSecrets(configOptions))
+	}
 	Log.Println("Command line peers:", peers)
 
 	if prof != "" {
@@ -143,10 +250,30 @@ func main() {
 		networkConfig.PacketLogging = nopPacketLogging{}
 	}
 
-	overlay, bridge := createOverlay(datapathName, ifaceName, config.Port, bufSzMB)
+	networkConfig.Log = logrus.NewEntry(Log)
+	overlay, bridge := createOverlay(datapathName, ifaceName, config.Port, bufSzMB, establishTimeout, networkConfig.Log)
 	networkConfig.Bridge = bridge
+	if maxPeers > 0 {
+		overlay = weave.NewPeerLimitOverlay(overlay, maxPeers)
+	}
+	if advertiseAddress != "" {
+		address, err := weave.ParseAdvertisedAddress(advertiseAddress, config.Port)
+		checkFatal(err)
+		advertiseAddress = address
+	}
+	overlay = weave.NewAdvertiseOverlay(overlay, advertiseAddress, networkConfig.Log)
 
-	name := peerName(routerName, bridge.Interface())
+	if nameSource != nameSourceMAC && routerName == "" && nameFile == "" {
+		// a fresh name on every restart would orphan the IPAM ranges
+		// owned by the previous one
+		Log.Fatalf("--name-source=%s requires --name-file", nameSource)
+	}
+	name, err := persistentPeerName(nameFile, regenerateName || routerName != "", func() mesh.PeerName {
+		return peerName(routerName, nameSource, bridge.Interface())
+	})
+	checkFatal(err)
+	incarnation, err := persistentIncarnation(nameFile, name)
+	checkFatal(err)
 
 	if nickName == "" {
 		var err error
@@ -161,6 +288,10 @@ func main() {
 	router := weave.NewNetworkRouter(config, networkConfig, name, nickName, overlay)
 	Log.Println("Our name is", router.Ourself)
 
+	if traceEndpoint != "" {
+		tracing.SetExporter(tracing.NewOTLPExporter(traceEndpoint, "weave", router.Ourself.Name.String()))
+	}
+
 	var dockerCli *docker.Client
 	if dockerAPI != "" {
 		dc, err := docker.NewClient(dockerAPI)
@@ -178,19 +309,52 @@ func main() {
 			}
 		}
 	}
-	isKnownPeer := func(name mesh.PeerName) bool {
-		return router.Peers.Fetch(name) != nil
+	isKnownPeer := router.IsKnownPeer
+	gossipTap := gossip.NewTap()
+	if logGossip {
+		gossipTap.AddMonitor(gossip.LogMonitor{})
 	}
+	gossipStats := gossip.NewStatsMonitor()
+	gossipTap.AddReceivedMonitor(gossipStats)
+	router.Peers.OnGC(func(peer *mesh.Peer) { gossipStats.Forget(peer.Name) })
+	gossipRouter := gossip.Bound(gossip.Compress(gossip.Pace(router, gossipPacing), gossipCompress, maxGossipSize), maxGossipSize)
 
 	var (
 		allocator     *ipam.Allocator
 		defaultSubnet address.CIDR
 	)
 	if iprangeCIDR != "" {
-		allocator, defaultSubnet = createAllocator(router.Router, iprangeCIDR, ipsubnetCIDR, determineQuorum(peerCount, peers), isKnownPeer)
+		quorum := determineQuorum(peerCount, peers)
+		// Hold the election of the ring until the peers we were told
+		// to expect have turned up, or failing that enough of them to
+		// make a quorum
+		initPeerCount := peerCount
+		if initPeerCount == 0 {
+			initPeerCount = int(quorum)
+		}
+		countPeers := func() int { return len(router.Topology().Peers) }
+		allocator, defaultSubnet = createAllocator(router.Router, gossipRouter, gossipTap, iprangeCIDR, ipsubnetCIDR, quorum, initPeerCount, countPeers, manualSeed, ipReserve, ipLowWatermark, ipMeshLowWatermark, affinityTTL, reuseDelay, maxProposalWait, allocStrategy, externalIPAM, webhookURLs, webhookSecret, incarnation, isKnownPeer, router.Hops, router.PeerNames)
 		observeContainers(allocator)
+		excludeHostAddresses(allocator)
+		if routeCheckInterval > 0 {
+			watchRouteConflicts(iprangeCIDR, bridge.Interface(), routeCheckInterval)
+		}
+		if reconcileInterval > 0 {
+			if dockerCli == nil {
+				Log.Fatal("--ipalloc-reconcile-interval needs a Docker API endpoint")
+			}
+			allocator.ReconcileEvery(reconcileInterval, dockerCli, reconcileDryRun)
+		}
+		if verifyRelease {
+			if dockerCli == nil {
+				Log.Fatal("--ipalloc-verify-release needs a Docker API endpoint")
+			}
+			allocator.SetReleaseChecker(dockerCli)
+		}
 	} else if peerCount > 0 {
 		Log.Fatal("--init-peer-count flag specified without --ipalloc-range")
+	} else if manualSeed {
+		Log.Fatal("--ipalloc-manual-seed flag specified without --ipalloc-range")
 	}
 
 	var (
@@ -198,7 +362,7 @@ func main() {
 		dnsserver *nameserver.DNSServer
 	)
 	if !noDNS {
-		ns, dnsserver = createDNSServer(dnsConfig, router.Router, isKnownPeer)
+		ns, dnsserver = createDNSServer(dnsConfig, router.Router, gossipRouter, gossipTap, isKnownPeer)
 		observeContainers(ns)
 		ns.Start()
 		defer ns.Stop()
@@ -206,10 +370,24 @@ func main() {
 		defer dnsserver.Stop()
 	}
 
-	router.Start()
+	manager := weave.NewManager()
+	checkFatal(manager.Add("default", router))
+	manager.Start()
 	if errors := router.ConnectionMaker.InitiateConnections(peers, false); len(errors) > 0 {
 		Log.Fatal(ErrorMessages(errors))
 	}
+	if bootstrapStore != "" {
+		startBootstrap(router, bootstrapStore, bootstrapAddress, advertiseAddress, config.Port, bootstrapInterval)
+	}
+	startCoordinator(router, allocator)
+	if readOnly {
+		setReadOnly(router, allocator, true)
+	}
+
+	settings := newRuntimeSettings(settingsToken, logLevel, router, allocator, ipReserve, readOnly)
+	OnReload("settings", func() error { return settings.Reload(configFile) })
+	status := statusFunc(version, router, allocator, defaultSubnet, ns, dnsserver, settings)
+	registerStatusDumps(status)
 
 	// The weave script always waits for a status call to succeed,
 	// so there is no point in doing "weave launch --http-addr ''".
@@ -223,35 +401,81 @@ func main() {
 			ns.HandleHTTP(muxRouter, dockerCli)
 		}
 		router.HandleHTTP(muxRouter)
-		HandleHTTP(muxRouter, version, router, allocator, defaultSubnet, ns, dnsserver)
+		manager.HandleHTTP(muxRouter)
+		settings.HandleHTTP(muxRouter)
+		handleGossipStatsHTTP(muxRouter, gossipStats)
+		handleDiagnosticsHTTP(muxRouter)
+		HandleHTTP(muxRouter, status)
 		http.Handle("/", muxRouter)
 		Log.Println("Listening for HTTP control messages on", httpAddr)
 		go listenAndServeHTTP(httpAddr, muxRouter)
 	}
 
-	SignalHandlerLoop(router)
+	SignalHandlerLoop(manager)
+}
+
+// Find the other peers through a shared store, rather than a list of
+// them on the command line
+func startBootstrap(router *weave.NetworkRouter, storeURL, address, advertiseAddress string, port int, interval time.Duration) {
+	store, err := bootstrap.NewStore(storeURL)
+	checkFatal(err)
+	if address == "" {
+		address = advertiseAddress
+	}
+	if address == "" {
+		Log.Fatal("--bootstrap-store needs --bootstrap-address or --advertise-address, for other peers to connect to")
+	}
+	address, err = weave.ParseAdvertisedAddress(address, port)
+	checkFatal(err)
+	bootstrap.New(store, router.Ourself.Name.String(), address, interval, func(addresses []string) {
+		if errors := router.ConnectionMaker.InitiateConnections(addresses, false); len(errors) > 0 {
+			Log.Warningln("[bootstrap]", ErrorMessages(errors))
+		}
+	}).Start()
+}
+
+// The peer with the lowest name coordinates. It starts agreeing the
+// IPAM ring as soon as enough peers have turned up, rather than on the
+// first allocation request; if it goes away, its successor takes
+// over. Priming is harmless when a proposal is already under way or
+// the ring exists.
+func startCoordinator(router *weave.NetworkRouter, allocator *ipam.Allocator) {
+	coordinator := election.New(router.Ourself.Name)
+	lead := func(term election.Term) {
+		if term.Leader != router.Ourself.Name {
+			return
+		}
+		if allocator != nil {
+			allocator.Prime()
+		}
+	}
+	coordinator.Observe(func(term election.Term) {
+		Log.Debugf("Coordinator term %d: %s", term.Number, term.Leader)
+		lead(term)
+	})
+	lead(coordinator.Term())
+	supervisor.Go("coordinator refresh", func() {
+		for range time.Tick(coordinatorRefreshInterval) {
+			coordinator.SetMembersFromPeers(router.Peers)
+		}
+	})
 }
 
 func options() map[string]string {
 	options := make(map[string]string)
 	mflag.Visit(func(f *mflag.Flag) {
-		value := f.Value.String()
-		name := canonicalName(f)
-		if name == "password" {
-			value = "<elided>"
-		}
-		options[name] = value
+		options[mflagext.CanonicalName(f)] = f.Value.String()
 	})
-	return options
+	return elideSecrets(options)
 }
 
-func canonicalName(f *mflag.Flag) string {
-	for _, n := range f.Names {
-		if n[0] != '#' {
-			return strings.TrimLeft(n, "#-")
+func elideSecrets(options map[string]string) map[string]string {
+	for _, name := range []string{"password", "http-settings-token"} {
+		if _, found := options[name]; found {
+			options[name] = "<elided>"
 		}
 	}
-	return ""
+	return options
 }
 
 type packetLogging struct{}
@@ -272,26 +496,26 @@ func (nopPacketLogging) LogPacket(string, weave.PacketKey) {
 func (nopPacketLogging) LogForwardPacket(string, weave.ForwardPacketKey) {
 }
 
-func createOverlay(datapathName string, ifaceName string, port int, bufSzMB int) (weave.NetworkOverlay, weave.Bridge) {
-	overlay := weave.NewOverlaySwitch()
+func createOverlay(datapathName string, ifaceName string, port int, bufSzMB int, establishTimeout time.Duration, log *logrus.Entry) (weave.NetworkOverlay, weave.Bridge) {
+	overlay := weave.NewOverlaySwitch(log)
 	var bridge weave.Bridge
 	switch {
 	case datapathName != "" && ifaceName != "":
 		Log.Fatal("At most one of --datapath and --iface must be specified.")
 	case datapathName != "":
-		fastdp, err := weave.NewFastDatapath(datapathName, port)
+		fastdp, err := weave.NewFastDatapath(datapathName, port, log)
 		checkFatal(err)
 		bridge = fastdp.Bridge()
 		overlay.Add("fastdp", fastdp.Overlay())
 	case ifaceName != "":
 		iface, err := weavenet.EnsureInterface(ifaceName)
 		checkFatal(err)
-		bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024) // bufsz flag is in MB
+		bridge, err = weave.NewPcap(iface, bufSzMB*1024*1024, log) // bufsz flag is in MB
 		checkFatal(err)
 	default:
 		bridge = weave.NullBridge{}
 	}
-	sleeve := weave.NewSleeveOverlay(port)
+	sleeve := weave.NewSleeveOverlay(port, establishTimeout, log)
 	overlay.Add("sleeve", sleeve)
 	overlay.SetCompatOverlay(sleeve)
 	return overlay, bridge
@@ -307,27 +531,169 @@ func parseAndCheckCIDR(cidrStr string) address.CIDR {
 	return cidr
 }
 
-func createAllocator(router *mesh.Router, ipRangeStr string, defaultSubnetStr string, quorum uint, isKnownPeer func(mesh.PeerName) bool) (*ipam.Allocator, address.CIDR) {
-	ipRange := parseAndCheckCIDR(ipRangeStr)
-	defaultSubnet := ipRange
+func createAllocator(router *mesh.Router, gossipRouter gossip.Router, gossipTap *gossip.Tap, ipRangeStr string, defaultSubnetStr string, quorum uint, initPeerCount int, countPeers func() int, manualSeed bool, reserve, lowWatermark, meshLowWatermark float64, affinityTTL, reuseDelay, maxProposalWait time.Duration, allocStrategy, externalIPAM string, webhookURLs []string, webhookSecret string, incarnation uint64, isKnownPeer func(mesh.PeerName) bool, peerHops func(mesh.PeerName) int, peerNames *peernames.Registry) (*ipam.Allocator, address.CIDR) {
+	var cidrs []address.CIDR
+	for _, cidrStr := range strings.Split(ipRangeStr, ",") {
+		cidrs = append(cidrs, parseAndCheckCIDR(strings.TrimSpace(cidrStr)))
+	}
+	ranges := make([]address.Range, len(cidrs))
+	for i, cidr := range cidrs {
+		ranges[i] = cidr.Range()
+		for _, other := range ranges[:i] {
+			if ranges[i].Overlaps(other) {
+				Log.Fatalf("IP address allocation ranges overlap: %s", ipRangeStr)
+			}
+		}
+	}
+	// by default, allocate within the first range
+	defaultSubnet := cidrs[0]
 	if defaultSubnetStr != "" {
 		defaultSubnet = parseAndCheckCIDR(defaultSubnetStr)
-		if !ipRange.Range().Overlaps(defaultSubnet.Range()) {
-			Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", defaultSubnet, ipRange)
+		overlaps := false
+		for _, r := range ranges {
+			overlaps = overlaps || r.Overlaps(defaultSubnet.Range())
+		}
+		if !overlaps {
+			Log.Fatalf("IP address allocation default subnet %s does not overlap with allocation range %s", defaultSubnet, ipRangeStr)
 		}
 	}
-	allocator := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, ipRange.Range(), quorum, isKnownPeer)
+	allocator := ipam.NewAllocator(router.Ourself.Peer.Name, router.Ourself.Peer.UID, router.Ourself.Peer.NickName, ranges[0], quorum, isKnownPeer)
+	if len(ranges) > 1 {
+		allocator.SetRanges(ranges)
+	}
 
-	allocator.SetInterfaces(router.NewGossip("IPallocation", allocator))
+	allocator.SetInterfaces(gossipTap.NewGossip(gossipRouter, "IPallocation", allocator))
+	if manualSeed {
+		allocator.RequireManualSeed()
+	}
+	allocator.SetInitPeerCount(initPeerCount, countPeers)
+	if reserve < 0 || reserve >= 1 {
+		Log.Fatalf("IP allocation reserve must be at least 0 and less than 1: %v", reserve)
+	}
+	allocator.SetEmergencyReserve(reserve)
+	allocator.SetLowWatermarks(lowWatermark, meshLowWatermark)
+	allocator.SetAffinityTTL(affinityTTL)
+	allocator.SetReuseDelay(reuseDelay)
+	strategy, err := space.ParseStrategy(allocStrategy)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	allocator.SetAllocationStrategy(strategy)
+	allocator.SetMaxProposalInterval(maxProposalWait)
+	allocator.SetIncarnation(incarnation)
+	allocator.SetPeerHops(peerHops)
+	allocator.SetPeerNames(peerNames)
+	var registrars ipam.MultiRegistrar
+	if externalIPAM != "" {
+		externalSync := ipam.NewExternalSync(ipam.NewHTTPExternalIPAM(externalIPAM), time.Second, time.Minute)
+		diagnostics.RegisterQueue("ipam external sync", externalSync.Pending, nil)
+		registrars = append(registrars, externalSync)
+	}
+	for _, url := range webhookURLs {
+		webhook := ipam.NewWebhook(url, webhookSecret, time.Second, time.Minute)
+		diagnostics.RegisterQueue("ipam webhook "+url, webhook.Pending, nil)
+		registrars = append(registrars, webhook)
+	}
+	if len(registrars) > 0 {
+		allocator.SetRegistrar(registrars)
+	}
 	allocator.Start()
 
 	return allocator, defaultSubnet
 }
 
-func createDNSServer(config dnsConfig, router *mesh.Router, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
+// Keep the addresses on the host's interfaces, e.g. a bridge address
+// set by hand, out of allocation
+func excludeHostAddresses(allocator *ipam.Allocator) {
+	update := func() {
+		reasons, err := hostAddresses()
+		if err != nil {
+			Log.Warningf("Unable to list host addresses to exclude from allocation: %s", err)
+			return
+		}
+		allocator.SetHostExclusions(reasons)
+	}
+	update()
+	supervisor.Go("host address exclusions", func() {
+		for range time.Tick(hostAddressInterval) {
+			update()
+		}
+	})
+}
+
+// Watch for routes on the host which overlap the allocation range, and
+// so take traffic meant for containers somewhere else, e.g. a VPN or
+// another container network set up after weave. They are reported
+// through the health check rather than stopping anything, as they can
+// come and go while weave is running.
+func watchRouteConflicts(ipRangeStr string, bridgeIface *net.Interface, interval time.Duration) {
+	ignoreIfaceNames := map[string]struct{}{weaveBridgeName: {}}
+	if bridgeIface != nil {
+		ignoreIfaceNames[bridgeIface.Name] = struct{}{}
+	}
+	var subnets []*net.IPNet
+	for _, cidrStr := range strings.Split(ipRangeStr, ",") {
+		if _, subnet, err := net.ParseCIDR(strings.TrimSpace(cidrStr)); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	var last string
+	check := func() {
+		var conflicts []string
+		for _, subnet := range subnets {
+			routes, err := weavenet.OverlappingRoutes(subnet, ignoreIfaceNames)
+			if err != nil {
+				Log.Warningf("Unable to list host routes to check for conflicts: %s", err)
+				return
+			}
+			for _, route := range routes {
+				conflicts = append(conflicts, fmt.Sprintf("%s overlaps %s", route, subnet))
+			}
+		}
+		reason := strings.Join(conflicts, ", ")
+		switch {
+		case reason == last:
+		case reason == "":
+			Log.Infof("Host routes no longer conflict with the allocation range")
+			supervisor.ClearDegraded("routes")
+		default:
+			Log.Warningf("Host routes conflict with the allocation range; traffic to containers may go astray: %s", reason)
+			supervisor.MarkDegraded("routes", "host route "+reason)
+		}
+		last = reason
+	}
+	check()
+	supervisor.Go("route conflicts", func() {
+		for range time.Tick(interval) {
+			check()
+		}
+	})
+}
+
+func hostAddresses() (map[address.Address]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	reasons := make(map[address.Address]string)
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				reasons[address.FromIP4(ipnet.IP.To4())] = "on host interface " + iface.Name
+			}
+		}
+	}
+	return reasons, nil
+}
+
+func createDNSServer(config dnsConfig, router *mesh.Router, gossipRouter gossip.Router, gossipTap *gossip.Tap, isKnownPeer func(mesh.PeerName) bool) (*nameserver.Nameserver, *nameserver.DNSServer) {
 	ns := nameserver.New(router.Ourself.Peer.Name, config.Domain, isKnownPeer)
 	router.Peers.OnGC(func(peer *mesh.Peer) { ns.PeerGone(peer.Name) })
-	ns.SetGossip(router.NewGossip("nameserver", ns))
+	ns.SetGossip(gossipTap.NewGossip(gossipRouter, "nameserver", ns))
 	dnsserver, err := nameserver.NewDNSServer(ns, config.Domain, config.ListenAddress,
 		config.EffectiveListenAddress, uint32(config.TTL), config.ClientTimeout)
 	if err != nil {
@@ -373,12 +739,22 @@ func determinePassword(password string) []byte {
 	return []byte(password)
 }
 
-func peerName(routerName string, iface *net.Interface) mesh.PeerName {
+func peerName(routerName, nameSource string, iface *net.Interface) mesh.PeerName {
 	if routerName == "" {
-		if iface == nil {
-			Log.Fatal("Either an interface must be specified with --datapath or --iface, or a name with --name")
+		random, found := randomNameSources[nameSource]
+		switch {
+		case nameSource == nameSourceMAC:
+			if iface == nil {
+				Log.Fatal("Either an interface must be specified with --datapath or --iface, or a name with --name")
+			}
+			routerName = iface.HardwareAddr.String()
+		case found:
+			var err error
+			routerName, err = random()
+			checkFatal(err)
+		default:
+			Log.Fatalf("Unknown --name-source %q; this build supports %s", nameSource, strings.Join(nameSources(), ", "))
 		}
-		routerName = iface.HardwareAddr.String()
 	}
 	name, err := mesh.PeerNameFromUserInput(routerName)
 	checkFatal(err)
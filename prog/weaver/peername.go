@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+
+	. "github.com/weaveworks/weave/common"
+)
+
+const (
+	nameSourceMAC    = "mac"
+	nameSourceRandom = "random"
+)
+
+// How to make up a name for each source other than the MAC. Sources
+// which only some peer name flavours can use are added by the files
+// built for those flavours, e.g. peername_uuid.go.
+var randomNameSources = map[string]func() (string, error){
+	nameSourceRandom: randomPeerName,
+}
+
+// nameSources returns the name sources this build supports.
+func nameSources() []string {
+	sources := []string{nameSourceMAC}
+	for source := range randomNameSources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources[1:])
+	return sources
+}
+
+// randomPeerName returns a random, locally administered, unicast MAC
+// address in string form. It is suitable as input to
+// mesh.PeerNameFromUserInput whichever peer name flavour mesh was
+// built with, and avoids the collisions seen when cloned VMs share
+// an interface MAC.
+func randomPeerName() (string, error) {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[0] = (buf[0] | 0x02) & 0xfe // locally administered, unicast
+	return net.HardwareAddr(buf).String(), nil
+}
+
+// persistentPeerName returns the name stored in nameFile, if there is
+// one and regenerate is false. Otherwise it obtains a name from derive
+// and stores it in nameFile, so that a restarted router keeps its
+// identity, and with it ownership of its IPAM ranges.
+//
+// Only the name is persisted. The peer UID is deliberately fresh on
+// every start: other peers rely on it to tell a restarted peer from
+// stale gossip about its previous incarnation.
+func persistentPeerName(nameFile string, regenerate bool, derive func() mesh.PeerName) (mesh.PeerName, error) {
+	if nameFile == "" {
+		return derive(), nil
+	}
+	if !regenerate {
+		if content, err := ioutil.ReadFile(nameFile); err == nil {
+			name, err := mesh.PeerNameFromString(strings.TrimSpace(string(content)))
+			if err == nil {
+				Log.Println("Using router name", name, "from", nameFile)
+				return name, nil
+			}
+			Log.Warningf("Ignoring unparseable router name in %s: %s", nameFile, err)
+		} else if !os.IsNotExist(err) {
+			return mesh.UnknownPeerName, err
+		}
+	}
+	name := derive()
+	return name, writeFileAtomic(nameFile, []byte(name.String()+"\n"), 0644)
+}
+
+// persistentIncarnation counts the starts of the router called name,
+// in a file next to nameFile, so that other peers can tell how often
+// we restart. The count starts again from 1 when the name changes. It
+// is 0, meaning unknown, if the name isn't persisted.
+func persistentIncarnation(nameFile string, name mesh.PeerName) (uint64, error) {
+	if nameFile == "" {
+		return 0, nil
+	}
+	incarnationFile := nameFile + ".incarnation"
+	count := uint64(1)
+	if content, err := ioutil.ReadFile(incarnationFile); err == nil {
+		var (
+			storedName  string
+			storedCount uint64
+		)
+		if _, err := fmt.Sscan(string(content), &storedName, &storedCount); err != nil {
+			Log.Warningf("Ignoring unparseable incarnation in %s: %s", incarnationFile, err)
+		} else if storedName == name.String() {
+			count = storedCount + 1
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	return count, writeFileAtomic(incarnationFile, []byte(fmt.Sprintf("%s %d\n", name, count)), 0644)
+}
+
+// writeFileAtomic writes via a temporary file in the same directory,
+// so that a crash part way through leaves either the old contents or
+// the new ones, never a truncated file.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestRandomPeerName(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		str, err := randomPeerName()
+		require.NoError(t, err)
+		mac, err := net.ParseMAC(str)
+		require.NoError(t, err)
+		require.Equal(t, byte(0x02), mac[0]&0x02, "locally administered bit not set in %s", str)
+		require.Equal(t, byte(0), mac[0]&0x01, "multicast bit set in %s", str)
+		name, err := mesh.PeerNameFromUserInput(str)
+		require.NoError(t, err)
+		require.NotEqual(t, mesh.UnknownPeerName, name)
+		require.False(t, seen[str])
+		seen[str] = true
+	}
+}
+
+func TestPersistentPeerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weave-peername")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	nameFile := filepath.Join(dir, "name")
+
+	derived := 0
+	derive := func(str string) func() mesh.PeerName {
+		return func() mesh.PeerName {
+			derived++
+			name, err := mesh.PeerNameFromString(str)
+			require.NoError(t, err)
+			return name
+		}
+	}
+	first, _ := mesh.PeerNameFromString("02:00:00:00:00:01")
+	second, _ := mesh.PeerNameFromString("02:00:00:00:00:02")
+
+	// no file: derive and persist
+	name, err := persistentPeerName(nameFile, false, derive("02:00:00:00:00:01"))
+	require.NoError(t, err)
+	require.Equal(t, first, name)
+	require.Equal(t, 1, derived)
+
+	// restart: reuse without deriving
+	name, err = persistentPeerName(nameFile, false, derive("02:00:00:00:00:02"))
+	require.NoError(t, err)
+	require.Equal(t, first, name)
+	require.Equal(t, 1, derived)
+
+	// forced regeneration overwrites the file
+	name, err = persistentPeerName(nameFile, true, derive("02:00:00:00:00:02"))
+	require.NoError(t, err)
+	require.Equal(t, second, name)
+	name, err = persistentPeerName(nameFile, false, derive("02:00:00:00:00:01"))
+	require.NoError(t, err)
+	require.Equal(t, second, name)
+
+	// garbage in the file is replaced
+	require.NoError(t, ioutil.WriteFile(nameFile, []byte("garbage"), 0644))
+	name, err = persistentPeerName(nameFile, false, derive("02:00:00:00:00:01"))
+	require.NoError(t, err)
+	require.Equal(t, first, name)
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
+
+func TestPersistentIncarnation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weave-peername")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	nameFile := filepath.Join(dir, "name")
+	first, _ := mesh.PeerNameFromString("02:00:00:00:00:01")
+	second, _ := mesh.PeerNameFromString("02:00:00:00:00:02")
+
+	count, err := persistentIncarnation("", first)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), count)
+
+	for i := uint64(1); i <= 3; i++ {
+		count, err = persistentIncarnation(nameFile, first)
+		require.NoError(t, err)
+		require.Equal(t, i, count)
+	}
+
+	// a new name starts counting again
+	count, err = persistentIncarnation(nameFile, second)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), count)
+}
@@ -0,0 +1,28 @@
+// +build peer_name_alternative
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Only the alternative peer name flavours of mesh, selected by the same
+// build tag, can turn a UUID into a peer name; the default MAC flavour
+// can't.
+const nameSourceUUID = "uuid"
+
+func init() {
+	randomNameSources[nameSourceUUID] = randomUUID
+}
+
+// randomUUID returns a random (version 4) UUID in canonical form.
+func randomUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40 // version 4
+	buf[8] = (buf[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
@@ -0,0 +1,19 @@
+// +build peer_name_alternative
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRandomUUID(t *testing.T) {
+	uuidRE := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for i := 0; i < 100; i++ {
+		str, err := randomUUID()
+		require.NoError(t, err)
+		require.Regexp(t, uuidRE, str)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+
+	. "github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/mflagext"
+	"github.com/weaveworks/weave/ipam"
+	weave "github.com/weaveworks/weave/router"
+)
+
+// A setting which can safely be changed while running. parse checks a
+// new value and returns a function to put it into effect, so that a
+// request to change several settings can be checked in full before
+// any of them is changed.
+type tunable struct {
+	value string
+	parse func(value string) (apply func(), err error)
+}
+
+// The settings which can be changed at runtime via POST /settings.
+// Changing them needs the token given by --http-settings-token; with
+// none given, they can only be read.
+type runtimeSettings struct {
+	sync.Mutex
+	token    string
+	tunables map[string]*tunable
+	changed  map[string]string
+}
+
+func newRuntimeSettings(token string, logLevel string, router *weave.NetworkRouter, allocator *ipam.Allocator, ipReserve float64, readOnly bool) *runtimeSettings {
+	settings := &runtimeSettings{
+		token:    token,
+		changed:  make(map[string]string),
+		tunables: make(map[string]*tunable),
+	}
+	settings.tunables["log-level"] = &tunable{logLevel, func(value string) (func(), error) {
+		level, err := logrus.ParseLevel(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() { Log.Level = level }, nil
+	}}
+	settings.tunables["heartbeat-interval"] = &tunable{weave.SlowHeartbeat.String(), func(value string) (func(), error) {
+		interval, err := time.ParseDuration(value)
+		if err == nil {
+			err = weave.CheckSlowHeartbeat(interval)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return func() { weave.SetSlowHeartbeat(interval) }, nil
+	}}
+	settings.tunables["debug-connections"] = &tunable{"", func(value string) (func(), error) {
+		return func() { weave.SetDebugConnections(strings.Split(value, ",")) }, nil
+	}}
+	settings.tunables["read-only"] = &tunable{strconv.FormatBool(readOnly), func(value string) (func(), error) {
+		readOnly, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return func() { setReadOnly(router, allocator, readOnly) }, nil
+	}}
+	if allocator != nil {
+		settings.tunables["ipalloc-reserve"] = &tunable{fmt.Sprint(ipReserve), func(value string) (func(), error) {
+			fraction, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			if fraction < 0 || fraction > 1 {
+				return nil, fmt.Errorf("reserve must be between 0 and 1")
+			}
+			return func() { allocator.UpdateEmergencyReserve(fraction) }, nil
+		}}
+	}
+	return settings
+}
+
+// In read-only mode the router keeps its connections and gossip going,
+// but refuses new IP allocations and changes to its connection targets.
+func setReadOnly(router *weave.NetworkRouter, allocator *ipam.Allocator, readOnly bool) {
+	router.SetReadOnly(readOnly)
+	if allocator != nil {
+		allocator.SetReadOnly(readOnly)
+	}
+	Log.Infoln("Read-only mode:", readOnly)
+}
+
+// Values returns the current value of every runtime setting
+func (settings *runtimeSettings) Values() map[string]string {
+	settings.Lock()
+	defer settings.Unlock()
+	values := make(map[string]string, len(settings.tunables))
+	for name, tunable := range settings.tunables {
+		values[name] = tunable.value
+	}
+	return values
+}
+
+// Changed returns the settings which have been changed since startup
+func (settings *runtimeSettings) Changed() map[string]string {
+	settings.Lock()
+	defer settings.Unlock()
+	changed := make(map[string]string, len(settings.changed))
+	for name, value := range settings.changed {
+		changed[name] = value
+	}
+	return changed
+}
+
+// Update changes all of the given settings, or, if any value is
+// unacceptable, none of them.
+func (settings *runtimeSettings) Update(values map[string]string) error {
+	settings.Lock()
+	defer settings.Unlock()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var applies []func()
+	for _, name := range names {
+		tunable, found := settings.tunables[name]
+		if !found {
+			return fmt.Errorf("%s cannot be changed at runtime", name)
+		}
+		apply, err := tunable.parse(values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", values[name], name, err)
+		}
+		applies = append(applies, apply)
+	}
+	for i, name := range names {
+		applies[i]()
+		settings.tunables[name].value = values[name]
+		settings.changed[name] = values[name]
+	}
+	return nil
+}
+
+// Reload re-reads the settings which can be changed at runtime from
+// the config file and environment, as at startup, and changes those
+// which differ. Ones given on the command line are left alone.
+func (settings *runtimeSettings) Reload(configFile string) error {
+	config, err := mflagext.ReadConfig(configFile, configEnvPrefix)
+	if err != nil {
+		return err
+	}
+	current := settings.Values()
+	values := make(map[string]string)
+	for name, value := range current {
+		if reloaded, found := config[name]; found && reloaded[len(reloaded)-1] != value {
+			values[name] = reloaded[len(reloaded)-1]
+		}
+	}
+	if len(values) > 0 {
+		Log.Infoln("Settings changed on reload:", values)
+	}
+	return settings.Update(values)
+}
+
+func (settings *runtimeSettings) authorized(r *http.Request) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return settings.token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(settings.token)) == 1
+}
+
+func (settings *runtimeSettings) HandleHTTP(router *mux.Router) {
+	reply := func(w http.ResponseWriter) {
+		json, err := json.MarshalIndent(settings.Values(), "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	}
+
+	router.Methods("GET").Path("/settings").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply(w)
+	})
+
+	// Takes settings as form values, e.g. log-level=debug
+	router.Methods("POST").Path("/settings").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !settings.authorized(r) {
+			http.Error(w, "changing settings needs the token given by --http-settings-token", http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values := make(map[string]string)
+		for name := range r.Form {
+			values[name] = r.FormValue(name)
+		}
+		if err := settings.Update(values); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Log.Infoln("Settings changed at runtime:", values)
+		reply(w)
+	})
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/weaveworks/mesh"
+)
+
+// AdvertiseOverlay tells peers, during the handshake, the address to
+// send our overlay traffic to, in place of the one they dialled. A
+// host behind 1:1 NAT binds to its private address but is reachable
+// over UDP only at its public one. Peers which connect to it through
+// something else, e.g. a TCP proxy or an address which is only
+// routable inside its network, then send it heartbeats and data at
+// the advertised address.
+//
+// Every peer needs to be wrapped, to take notice of what others
+// advertise, whether or not it advertises an address of its own.
+type AdvertiseOverlay struct {
+	NetworkOverlay
+	address string // "ip:port", or empty if we advertise nothing
+	log     *logrus.Entry
+}
+
+const advertisedAddressFeature = "AdvertisedAddress"
+
+func NewAdvertiseOverlay(overlay NetworkOverlay, address string, log *logrus.Entry) *AdvertiseOverlay {
+	return &AdvertiseOverlay{NetworkOverlay: overlay, address: address, log: log}
+}
+
+// ParseAdvertisedAddress checks an address given as "ip" or "ip:port",
+// the port defaulting to ours, and returns it as "ip:port".
+func ParseAdvertisedAddress(address string, defaultPort int) (string, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(defaultPort))
+	}
+	addr, err := advertisedTCPAddr(address)
+	if err != nil {
+		return "", fmt.Errorf("invalid advertised address: %s", err)
+	}
+	return addr.String(), nil
+}
+
+func (ao *AdvertiseOverlay) AddFeaturesTo(features map[string]string) {
+	ao.NetworkOverlay.AddFeaturesTo(features)
+	if ao.address != "" {
+		features[advertisedAddressFeature] = ao.address
+	}
+}
+
+// Only the connecting side uses what the other advertises; the other
+// learns our address from the heartbeats we send.
+func (ao *AdvertiseOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if advertised, present := params.Features[advertisedAddressFeature]; present && params.Outbound {
+		if addr, err := advertisedTCPAddr(advertised); err != nil {
+			ao.log.Warnf("Ignoring address advertised by %s: %s", params.RemotePeer, err)
+		} else {
+			params.RemoteAddr = addr
+		}
+	}
+	return ao.NetworkOverlay.PrepareConnection(params)
+}
+
+func (ao *AdvertiseOverlay) ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult {
+	if prober, ok := ao.NetworkOverlay.(DataPathProber); ok {
+		return prober.ProbeDataPaths(timeout)
+	}
+	return nil
+}
+
+// Peers are expected to advertise "ip:port", but it is checked all the same
+func advertisedTCPAddr(address string) (*net.TCPAddr, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %q", address)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
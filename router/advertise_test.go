@@ -0,0 +1,35 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAdvertisedAddress(t *testing.T) {
+	for _, c := range []struct{ given, expected string }{
+		{"203.0.113.7", "203.0.113.7:6783"},
+		{"203.0.113.7:7000", "203.0.113.7:7000"},
+		{"2001:db8::1", "[2001:db8::1]:6783"},
+		{"[2001:db8::1]:7000", "[2001:db8::1]:7000"},
+	} {
+		address, err := ParseAdvertisedAddress(c.given, 6783)
+		require.NoError(t, err, c.given)
+		require.Equal(t, c.expected, address)
+	}
+	for _, given := range []string{"", "host.example.com", "203.0.113.7:0", "203.0.113.7:http", "203.0.113.7:70000"} {
+		_, err := ParseAdvertisedAddress(given, 6783)
+		require.Error(t, err, given)
+	}
+}
+
+func TestAdvertisedTCPAddr(t *testing.T) {
+	addr, err := advertisedTCPAddr("203.0.113.7:6783")
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7", addr.IP.String())
+	require.Equal(t, 6783, addr.Port)
+
+	// what peers send has to have a port
+	_, err = advertisedTCPAddr("203.0.113.7")
+	require.Error(t, err)
+}
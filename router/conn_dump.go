@@ -0,0 +1,130 @@
+package router
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/errorlog"
+)
+
+// A dump is everything known about the connection to one peer, so
+// that a single problematic link can be looked into without turning
+// on debug logging for all of them. It is gathered on demand, from
+// mesh's status and from the overlay forwarders, each of which
+// describes itself.
+
+type ConnectionDump struct {
+	Peer        string
+	Address     string
+	Outbound    bool
+	Established bool
+	// From the handshake, as the overlay switch was given them
+	ConnUID    uint64            `json:",omitempty"`
+	Features   map[string]string `json:",omitempty"`
+	SessionKey string            `json:",omitempty"` // fingerprint, the same at both ends
+	Overlay    string            `json:",omitempty"` // the forwarder in use
+	Forwarders []ForwarderDump   `json:",omitempty"`
+	// Errors which ended this and earlier connections to the peer
+	Errors []errorlog.Error `json:",omitempty"`
+}
+
+type ForwarderDump struct {
+	Overlay     string
+	Established bool
+	Stopped     bool
+	State       interface{} `json:",omitempty"`
+}
+
+// An OverlayForwarder which can describe its state
+type dumpingForwarder interface {
+	dump() interface{}
+}
+
+// DumpConnection describes our connection to peer, given by name or
+// nickname. The errors of earlier connections are included even if
+// there is no connection now.
+func (router *NetworkRouter) DumpConnection(peer string) (*ConnectionDump, error) {
+	var dump *ConnectionDump
+	for _, status := range mesh.NewStatus(router.Router).Peers {
+		if status.Name != router.Ourself.Name.String() {
+			continue
+		}
+		for _, conn := range status.Connections {
+			if conn.Name == peer || conn.NickName == peer {
+				dump = &ConnectionDump{Peer: conn.Name, Address: conn.Address, Outbound: conn.Outbound, Established: conn.Established}
+				break
+			}
+		}
+	}
+	if dump == nil {
+		dump = &ConnectionDump{Peer: peer}
+	}
+	name, err := mesh.PeerNameFromString(dump.Peer)
+	if err != nil {
+		return nil, fmt.Errorf("no connection to %s", peer)
+	}
+	remote := router.Peers.Fetch(name)
+	if remote == nil {
+		return nil, fmt.Errorf("no connection to %s", peer)
+	}
+	dump.Errors = errorlog.For("connection " + remote.String())
+
+	if conn, found := router.Ourself.ConnectionTo(name); found {
+		switch fwd := conn.(*mesh.LocalConnection).OverlayConn.(type) {
+		case *overlaySwitchForwarder:
+			fwd.dumpInto(dump)
+		case dumpingForwarder: // the compat overlay, for peers without the switch
+			dump.Forwarders = []ForwarderDump{{Overlay: "sleeve", Established: dump.Established, State: fwd.dump()}}
+		}
+	}
+	return dump, nil
+}
+
+func (fwd *overlaySwitchForwarder) dumpInto(dump *ConnectionDump) {
+	dump.ConnUID = fwd.params.ConnUID
+	dump.Features = fwd.params.Features
+	if key := fwd.params.SessionKey; key != nil {
+		sum := sha256.Sum256(key[:])
+		dump.SessionKey = fmt.Sprintf("%x", sum[:8])
+	}
+
+	fwd.lock.Lock()
+	defer fwd.lock.Unlock()
+	if fwd.best >= 0 {
+		dump.Overlay = fwd.forwarders[fwd.best].overlayName
+	}
+	for _, subFwd := range fwd.forwarders {
+		fd := ForwarderDump{Overlay: subFwd.overlayName, Established: subFwd.established, Stopped: subFwd.fwd == nil}
+		if dumper, ok := subFwd.fwd.(dumpingForwarder); ok {
+			fd.State = dumper.dump()
+		}
+		dump.Forwarders = append(dump.Forwarders, fd)
+	}
+}
+
+func (fwd *sleeveForwarder) dump() interface{} {
+	return struct {
+		SleeveConnectionStats
+		// Frames waiting for the forwarder goroutine
+		QueuedFrames   int
+		QueuedFramesDF int
+		QueuedSpecial  int
+		QueuedControl  int
+	}{fwd.connectionStats(),
+		len(fwd.aggregatorChan), len(fwd.aggregatorDFChan), len(fwd.specialChan), len(fwd.controlMsgChan)}
+}
+
+func (fwd *fastDatapathForwarder) dump() interface{} {
+	fwd.lock.RLock()
+	defer fwd.lock.RUnlock()
+	return struct {
+		RemoteAddr        *net.UDPAddr
+		VxlanVport        uint32
+		Confirmed         bool
+		HeartbeatInterval string
+		AckedHeartbeat    bool
+	}{fwd.remoteAddr, uint32(fwd.vxlanVportID), fwd.confirmed, fwd.heartbeatInterval.String(), fwd.ackedHeartbeat}
+}
@@ -0,0 +1,30 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestDumpOverlaySwitchForwarder(t *testing.T) {
+	key := [32]byte{1, 2, 3}
+	fwd := &overlaySwitchForwarder{
+		params: mesh.OverlayConnectionParams{ConnUID: 42, SessionKey: &key, Features: map[string]string{"Overlays": "fastdp sleeve"}},
+		best:   1,
+		forwarders: []subForwarder{
+			{overlayName: "fastdp"},
+			{overlayName: "sleeve", established: true, fwd: &sleeveForwarder{remotePeer: &mesh.Peer{}, mtu: 1410, stats: newSleeveStats()}},
+		},
+	}
+	var dump ConnectionDump
+	fwd.dumpInto(&dump)
+	require.Equal(t, uint64(42), dump.ConnUID)
+	require.Equal(t, "fastdp sleeve", dump.Features["Overlays"])
+	require.Len(t, dump.SessionKey, 16)
+	require.Equal(t, "sleeve", dump.Overlay)
+	require.Len(t, dump.Forwarders, 2)
+	require.Equal(t, ForwarderDump{Overlay: "fastdp", Stopped: true}, dump.Forwarders[0])
+	require.True(t, dump.Forwarders[1].Established)
+	require.NotNil(t, dump.Forwarders[1].State)
+}
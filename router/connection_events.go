@@ -0,0 +1,162 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/supervisor"
+)
+
+// The ConnectionMaker, in mesh, decides which peers to connect to and
+// when to try again, but tells nobody; what it is doing about each
+// address shows only in its status. That is polled, and the changes
+// turned into events, so that something which discovers peers can
+// tell when one it was given cannot be reached. A state which lasts
+// less than the polling interval can be missed.
+
+const (
+	connectionEventsInterval = 2 * time.Second
+	connectionEventsKept     = 100
+)
+
+// Kinds of ConnectionEvent
+const (
+	TargetAdded           = "target added"
+	TargetRemoved         = "target removed"
+	AttemptStarted        = "attempt started"
+	AttemptFailed         = "attempt failed"
+	ConnectionEstablished = "connection established"
+	ConnectionLost        = "connection lost"
+)
+
+// A ConnectionEvent is about a target, as given to 'weave connect', or
+// about the address of an outbound connection, as resolved from one.
+// Info is mesh's description: the reason for a failure, or the
+// overlay and peer of a connection.
+type ConnectionEvent struct {
+	Time    time.Time
+	Kind    string
+	Address string
+	Info    string `json:",omitempty"`
+}
+
+type connectionEvents struct {
+	sync.Mutex
+	recent   []ConnectionEvent // oldest first
+	watchers map[chan<- ConnectionEvent]struct{}
+	targets  map[string]struct{}
+	conns    map[string]mesh.LocalConnectionStatus // outbound, by address
+}
+
+func newConnectionEvents() *connectionEvents {
+	return &connectionEvents{
+		watchers: make(map[chan<- ConnectionEvent]struct{}),
+		targets:  make(map[string]struct{}),
+		conns:    make(map[string]mesh.LocalConnectionStatus),
+	}
+}
+
+func (events *connectionEvents) start(router *mesh.Router) {
+	supervisor.Go("connection events", func() {
+		for range time.Tick(connectionEventsInterval) {
+			status := mesh.NewStatus(router)
+			events.update(time.Now(), status.Targets, status.Connections)
+		}
+	})
+}
+
+// Compare the ConnectionMaker's status with what it was last time
+func (events *connectionEvents) update(now time.Time, targets []string, conns []mesh.LocalConnectionStatus) {
+	events.Lock()
+	defer events.Unlock()
+	emit := func(kind, address, info string) {
+		events.emit(ConnectionEvent{Time: now, Kind: kind, Address: address, Info: info})
+	}
+
+	current := make(map[string]struct{}, len(targets))
+	for _, target := range targets {
+		current[target] = struct{}{}
+		if _, found := events.targets[target]; !found {
+			emit(TargetAdded, target, "")
+		}
+	}
+	for target := range events.targets {
+		if _, found := current[target]; !found {
+			emit(TargetRemoved, target, "")
+		}
+	}
+	events.targets = current
+
+	currentConns := make(map[string]mesh.LocalConnectionStatus, len(conns))
+	for _, conn := range conns {
+		if !conn.Outbound {
+			continue
+		}
+		currentConns[conn.Address] = conn
+		previous, found := events.conns[conn.Address]
+		if found && previous.State == conn.State && previous.Info == conn.Info {
+			continue
+		}
+		switch conn.State {
+		case "connecting":
+			emit(AttemptStarted, conn.Address, "")
+			attemptStarted(conn.Address, now)
+		case "retrying":
+			// so the attempt before this one failed, with Info
+			if !found || previous.State != "failed" || previous.Info != conn.Info {
+				emit(AttemptFailed, conn.Address, conn.Info)
+			}
+			emit(AttemptStarted, conn.Address, "")
+			attemptStarted(conn.Address, now)
+		case "failed":
+			emit(AttemptFailed, conn.Address, conn.Info)
+		case "established":
+			if !found || previous.State != "established" {
+				emit(ConnectionEstablished, conn.Address, conn.Info)
+			}
+			attemptOver(conn.Address) // in case it was seen after the handshake
+		}
+	}
+	for address, previous := range events.conns {
+		conn, found := currentConns[address]
+		if previous.State == "established" && (!found || conn.State != "established") {
+			emit(ConnectionLost, address, previous.Info)
+		}
+		if !found {
+			attemptOver(address) // the ConnectionMaker has given up on it
+		}
+	}
+	events.conns = currentConns
+}
+
+func (events *connectionEvents) emit(event ConnectionEvent) {
+	if len(events.recent) == connectionEventsKept {
+		events.recent = events.recent[1:]
+	}
+	events.recent = append(events.recent, event)
+	for watcher := range events.watchers {
+		select {
+		case watcher <- event:
+		default: // a watcher which doesn't keep up misses events
+		}
+	}
+}
+
+// Recent events, and, if watch is not nil, all later ones, until
+// the returned function is called
+func (events *connectionEvents) watch(watch chan<- ConnectionEvent) ([]ConnectionEvent, func()) {
+	events.Lock()
+	defer events.Unlock()
+	recent := append([]ConnectionEvent(nil), events.recent...)
+	if watch == nil {
+		return recent, func() {}
+	}
+	events.watchers[watch] = struct{}{}
+	return recent, func() {
+		events.Lock()
+		defer events.Unlock()
+		delete(events.watchers, watch)
+	}
+}
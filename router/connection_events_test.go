@@ -0,0 +1,67 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestConnectionEvents(t *testing.T) {
+	events := newConnectionEvents()
+	watch := make(chan ConnectionEvent, connectionEventsKept)
+	_, stop := events.watch(watch)
+	defer stop()
+
+	const target, addr = "host1", "10.0.0.1:6783"
+	outbound := func(state, info string) mesh.LocalConnectionStatus {
+		return mesh.LocalConnectionStatus{Address: addr, Outbound: true, State: state, Info: info}
+	}
+	inbound := mesh.LocalConnectionStatus{Address: "10.0.0.2:4567", State: "established"}
+	kinds := func() []string {
+		var result []string
+		for {
+			select {
+			case event := <-watch:
+				result = append(result, event.Kind+" "+event.Address+" "+event.Info)
+			default:
+				return result
+			}
+		}
+	}
+	now := time.Now()
+
+	events.update(now, []string{target}, []mesh.LocalConnectionStatus{outbound("connecting", ""), inbound})
+	require.Equal(t, []string{"target added host1 ", "attempt started 10.0.0.1:6783 "}, kinds())
+
+	events.update(now, []string{target}, []mesh.LocalConnectionStatus{outbound("failed", "refused, retry: soon")})
+	require.Equal(t, []string{"attempt failed 10.0.0.1:6783 refused, retry: soon"}, kinds())
+
+	// No change, no events
+	events.update(now, []string{target}, []mesh.LocalConnectionStatus{outbound("failed", "refused, retry: soon")})
+	require.Empty(t, kinds())
+
+	// An attempt which failed between polls shows as retrying
+	events.update(now, []string{target}, []mesh.LocalConnectionStatus{outbound("retrying", "timed out")})
+	require.Equal(t, []string{"attempt failed 10.0.0.1:6783 timed out", "attempt started 10.0.0.1:6783 "}, kinds())
+
+	events.update(now, []string{target}, []mesh.LocalConnectionStatus{outbound("established", "sleeve peer1")})
+	require.Equal(t, []string{"connection established 10.0.0.1:6783 sleeve peer1"}, kinds())
+
+	events.update(now, nil, nil)
+	require.Equal(t, []string{"target removed host1 ", "connection lost 10.0.0.1:6783 sleeve peer1"}, kinds())
+
+	recent, _ := events.watch(nil)
+	require.Len(t, recent, 8)
+}
+
+func TestConnectionEventsKept(t *testing.T) {
+	events := newConnectionEvents()
+	for i := 0; i < connectionEventsKept+10; i++ {
+		events.emit(ConnectionEvent{Kind: TargetAdded, Address: string(rune('a' + i%26))})
+	}
+	recent, _ := events.watch(nil)
+	require.Len(t, recent, connectionEventsKept)
+	require.Equal(t, string(rune('a'+10%26)), recent[0].Address)
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/errorlog"
+)
+
+// Each overlay connection logs with fields naming the overlay, the
+// remote peer, the connection's UID and which end initiated it, so
+// that one connection's messages can be picked out of the log. Debug
+// messages can be turned on for the connections to chosen peers while
+// running, without turning them on for everything else. Errors which
+// can repeat for every packet, e.g. from decrypting stray packets
+// while a connection flaps, are throttled.
+
+// How often a connection logs the same error
+const connLogThrottleInterval = time.Minute
+
+var debugConns = struct {
+	sync.RWMutex
+	peers map[string]struct{} // peer names and nicknames
+}{}
+
+// SetDebugConnections logs debug messages for the connections to the
+// given peers, identified by name or nickname, whatever the log
+// level, until it is called again. An empty list turns this off.
+func SetDebugConnections(peers []string) {
+	set := make(map[string]struct{})
+	for _, peer := range peers {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			set[peer] = struct{}{}
+		}
+	}
+	debugConns.Lock()
+	defer debugConns.Unlock()
+	debugConns.peers = set
+}
+
+func debuggingConnection(peer *mesh.Peer) bool {
+	debugConns.RLock()
+	defer debugConns.RUnlock()
+	_, byName := debugConns.peers[peer.Name.String()]
+	_, byNickName := debugConns.peers[peer.NickName]
+	return byName || byNickName
+}
+
+type connLog struct {
+	log      *logrus.Entry // of the router
+	peer     *mesh.Peer
+	fields   logrus.Fields
+	throttle *common.Throttle
+}
+
+func newConnLog(log *logrus.Entry, overlay string, params mesh.OverlayConnectionParams) connLog {
+	direction := "inbound"
+	if params.Outbound {
+		direction = "outbound"
+	}
+	return connLog{log, params.RemotePeer, logrus.Fields{
+		"overlay":   overlay,
+		"peer":      params.RemotePeer,
+		"conn":      params.ConnUID,
+		"direction": direction,
+	}, common.NewThrottle(connLogThrottleInterval)}
+}
+
+// entry returns the logger to use for the connection now, which logs
+// at debug level if the connection is being debugged.
+func (l connLog) entry() *logrus.Entry {
+	entry := l.log
+	if base := entry.Logger; debuggingConnection(l.peer) && base.Level < logrus.DebugLevel {
+		entry = logrus.NewEntry(&logrus.Logger{Out: base.Out, Formatter: base.Formatter, Hooks: base.Hooks, Level: logrus.DebugLevel}).WithFields(entry.Data)
+	}
+	return entry.WithFields(l.fields)
+}
+
+// record keeps err, which ended the connection, in the peer's error
+// history for the status report
+func (l connLog) record(err error) {
+	errorlog.Record("connection "+l.peer.String(), fmt.Errorf("%s: %s", l.fields["overlay"], err))
+}
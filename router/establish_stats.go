@@ -0,0 +1,116 @@
+package router
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// How long connections take to become established, in three phases:
+//
+//  - connect: from the ConnectionMaker starting an attempt to the end
+//    of the handshake. Only outbound connections have this phase, and
+//    its start is as seen by connectionEvents, so it is only accurate
+//    to within the interval at which they are polled. Retries count
+//    from the first attempt.
+//  - confirm: from the end of the handshake to mesh confirming the
+//    connection, once it has checked it against the others.
+//  - heartbeat: from then until the first of the overlays has
+//    exchanged heartbeats with the peer.
+//
+// The totals go into a histogram, exported with expvar, and
+// establishments slower than SlowEstablish are counted and logged
+// with their breakdown.
+
+// Upper bounds of the establishment time histogram buckets
+var establishBuckets = []time.Duration{
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second, 30 * time.Second,
+}
+
+var (
+	expEstablishTimes = expvar.NewMap("router.establishTimes")
+	expSlowEstablish  = expvar.NewInt("router.slowEstablish")
+)
+
+// SlowEstablish is the objective for establishing a connection
+var SlowEstablish = 5 * time.Second
+
+func init() {
+	for i := 0; i <= len(establishBuckets); i++ {
+		expEstablishTimes.Add(establishBucketLabel(i), 0)
+	}
+}
+
+func establishBucketLabel(i int) string {
+	if i < len(establishBuckets) {
+		return fmt.Sprintf("<=%s", establishBuckets[i])
+	}
+	return fmt.Sprintf(">%s", establishBuckets[len(establishBuckets)-1])
+}
+
+// When the ConnectionMaker started its current attempt on each address
+var attempts = struct {
+	sync.Mutex
+	started map[string]time.Time
+}{started: make(map[string]time.Time)}
+
+func attemptStarted(address string, at time.Time) {
+	attempts.Lock()
+	defer attempts.Unlock()
+	if _, found := attempts.started[address]; !found {
+		attempts.started[address] = at
+	}
+}
+
+func attemptOver(address string) (started time.Time, found bool) {
+	attempts.Lock()
+	defer attempts.Unlock()
+	started, found = attempts.started[address]
+	delete(attempts.started, address)
+	return
+}
+
+type establishTimes struct {
+	attempted, handshaken, confirmed time.Time
+}
+
+func newEstablishTimes(params mesh.OverlayConnectionParams) *establishTimes {
+	times := &establishTimes{handshaken: time.Now()}
+	if params.Outbound && params.RemoteAddr != nil {
+		times.attempted, _ = attemptOver(params.RemoteAddr.String())
+	}
+	return times
+}
+
+// Returns a description of the phases if it was slow
+func (times *establishTimes) record(established time.Time) (slow string) {
+	start := times.handshaken
+	if !times.attempted.IsZero() && times.attempted.Before(start) {
+		start = times.attempted
+	}
+	total := established.Sub(start)
+	i := 0
+	for i < len(establishBuckets) && total > establishBuckets[i] {
+		i++
+	}
+	expEstablishTimes.Add(establishBucketLabel(i), 1)
+	if total <= SlowEstablish {
+		return ""
+	}
+	expSlowEstablish.Add(1)
+	confirmed := times.confirmed
+	if confirmed.IsZero() { // established before mesh got round to it
+		confirmed = established
+	}
+	slow = fmt.Sprintf("took %s to establish", total)
+	if start != times.handshaken {
+		slow += fmt.Sprintf(": connect %s,", times.handshaken.Sub(start))
+	} else {
+		slow += ":"
+	}
+	return slow + fmt.Sprintf(" confirm %s, heartbeat %s", confirmed.Sub(times.handshaken), established.Sub(confirmed))
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestEstablishTimes(t *testing.T) {
+	bucket := func(i int) int64 {
+		return expEstablishTimes.Get(establishBucketLabel(i)).(*expvar.Int).Value()
+	}
+	start := time.Now()
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6783}
+
+	// Inbound, so from the handshake
+	times := newEstablishTimes(mesh.OverlayConnectionParams{})
+	before := bucket(0)
+	require.Equal(t, "", times.record(times.handshaken.Add(50*time.Millisecond)))
+	require.Equal(t, before+1, bucket(0))
+
+	// Outbound, from the first attempt on the address
+	attemptStarted(addr.String(), start.Add(-20*time.Second))
+	attemptStarted(addr.String(), start.Add(-10*time.Second)) // a retry
+	times = newEstablishTimes(mesh.OverlayConnectionParams{Outbound: true, RemoteAddr: addr})
+	times.handshaken, times.confirmed = start, start.Add(time.Second)
+	slow := expSlowEstablish.Value()
+	before = bucket(len(establishBuckets) - 1)
+	require.Equal(t, "took 30s to establish: connect 20s, confirm 1s, heartbeat 9s", times.record(start.Add(10*time.Second)))
+	require.Equal(t, slow+1, expSlowEstablish.Value())
+	require.Equal(t, before+1, bucket(len(establishBuckets)-1))
+
+	// which is over once it has been used
+	_, found := attemptOver(addr.String())
+	require.False(t, found)
+}
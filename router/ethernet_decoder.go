@@ -2,6 +2,7 @@ package router
 
 import (
 	"bytes"
+	"encoding/binary"
 	"net"
 
 	"github.com/google/gopacket"
@@ -11,13 +12,14 @@ import (
 type EthernetDecoder struct {
 	Eth     layers.Ethernet
 	IP      layers.IPv4
+	IPv6    layers.IPv6
 	decoded []gopacket.LayerType
 	parser  *gopacket.DecodingLayerParser
 }
 
 func NewEthernetDecoder() *EthernetDecoder {
 	dec := &EthernetDecoder{}
-	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.IP)
+	dec.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &dec.Eth, &dec.IP, &dec.IPv6)
 	return dec
 }
 
@@ -35,7 +37,30 @@ func (dec *EthernetDecoder) PacketKey() (key PacketKey) {
 	return
 }
 
+// IsIPv4 and IsIPv6 tell which kind of IP packet, if any, the frame holds.
+func (dec *EthernetDecoder) IsIPv4() bool {
+	return len(dec.decoded) == 2 && dec.decoded[1] == layers.LayerTypeIPv4
+}
+
+func (dec *EthernetDecoder) IsIPv6() bool {
+	return len(dec.decoded) == 2 && dec.decoded[1] == layers.LayerTypeIPv6
+}
+
+// IPs returns the source and destination of the frame's IP packet.
+func (dec *EthernetDecoder) IPs() (src, dst net.IP) {
+	if dec.IsIPv6() {
+		return dec.IPv6.SrcIP, dec.IPv6.DstIP
+	}
+	return dec.IP.SrcIP, dec.IP.DstIP
+}
+
+// makeICMPFragNeeded makes the message telling the sender of the
+// frame's IP packet that it is too big for mtu: for IPv4, a
+// "fragmentation needed", and for IPv6, a "packet too big".
 func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
+	if dec.IsIPv6() {
+		return dec.makeICMPv6PacketTooBig(mtu)
+	}
 	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{
 		FixLengths:       true,
@@ -66,7 +91,52 @@ func (dec *EthernetDecoder) makeICMPFragNeeded(mtu int) ([]byte, error) {
 		return nil, err
 	}
 
-	log.Printf("Sending ICMP 3,4 (%v -> %v): PMTU=%v", dec.IP.DstIP, dec.IP.SrcIP, mtu)
+	return buf.Bytes(), nil
+}
+
+const (
+	ipv6MinMTU         = 1280
+	ipv6HeaderSize     = 40
+	icmpv6PacketTooBig = 0x200 // type 2, code 0
+	icmpv6HeaderSize   = 8     // including the MTU
+	icmpv6MaxInvoking  = ipv6MinMTU - ipv6HeaderSize - icmpv6HeaderSize
+)
+
+func (dec *EthernetDecoder) makeICMPv6PacketTooBig(mtu int) ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true}
+	// The MTU, then as much of the packet as fits without making the
+	// message bigger than the smallest MTU IPv6 allows
+	invoking := dec.Eth.BaseLayer.Payload
+	if len(invoking) > icmpv6MaxInvoking {
+		invoking = invoking[:icmpv6MaxInvoking]
+	}
+	payload := make(gopacket.Payload, 4+len(invoking))
+	binary.BigEndian.PutUint32(payload, uint32(mtu))
+	copy(payload[4:], invoking)
+	ip := &layers.IPv6{
+		Version:      6,
+		TrafficClass: dec.IPv6.TrafficClass,
+		NextHeader:   layers.IPProtocolICMPv6,
+		HopLimit:     64,
+		DstIP:        dec.IPv6.SrcIP,
+		SrcIP:        dec.IPv6.DstIP}
+	icmp := &layers.ICMPv6{TypeCode: icmpv6PacketTooBig}
+	if err := icmp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{
+			SrcMAC:       dec.Eth.DstMAC,
+			DstMAC:       dec.Eth.SrcMAC,
+			EthernetType: dec.Eth.EthernetType},
+		ip, icmp, &payload)
+	if err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -79,6 +149,8 @@ func (dec *EthernetDecoder) IsSpecial() bool {
 		bytes.Equal(zeroMAC, dec.Eth.SrcMAC) && bytes.Equal(zeroMAC, dec.Eth.DstMAC)
 }
 
+// DF tells whether the frame's IP packet must not be fragmented on
+// the way, which IPv6 packets never are.
 func (dec *EthernetDecoder) DF() bool {
-	return len(dec.decoded) == 2 && (dec.IP.Flags&layers.IPv4DontFragment != 0)
+	return dec.IsIPv6() || (dec.IsIPv4() && dec.IP.Flags&layers.IPv4DontFragment != 0)
 }
@@ -0,0 +1,55 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func makeIPv6Frame(t *testing.T, payloadSize int) []byte {
+	srcMAC, _ := net.ParseMAC("02:00:00:00:00:01")
+	dstMAC, _ := net.ParseMAC("02:00:00:00:00:02")
+	buf := gopacket.NewSerializeBuffer()
+	payload := gopacket.Payload(make([]byte, payloadSize))
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv6},
+		&layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolUDP,
+			HopLimit:   64,
+			SrcIP:      net.ParseIP("fd00::1"),
+			DstIP:      net.ParseIP("fd00::2")},
+		&payload)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func TestICMPv6PacketTooBig(t *testing.T) {
+	dec := NewEthernetDecoder()
+	dec.DecodeLayers(makeIPv6Frame(t, 9000))
+	require.True(t, dec.IsIPv6())
+	require.True(t, dec.DF(), "IPv6 packets are never fragmented on the way")
+
+	msg, err := dec.makeICMPFragNeeded(1400)
+	require.NoError(t, err)
+	require.Equal(t, EthernetOverhead+ipv6MinMTU, len(msg), "as much of the packet as fits in the minimum MTU")
+
+	packet := gopacket.NewPacket(msg, layers.LayerTypeEthernet, gopacket.Default)
+	ip := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	require.Equal(t, "fd00::2", ip.SrcIP.String())
+	require.Equal(t, "fd00::1", ip.DstIP.String())
+	icmp := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6)
+	require.Equal(t, layers.ICMPv6TypeCode(icmpv6PacketTooBig), icmp.TypeCode)
+	mtu := msg[EthernetOverhead+ipv6HeaderSize+4:]
+	require.Equal(t, uint32(1400), binary.BigEndian.Uint32(mtu))
+
+	// The message goes back the way the packet came, and isn't too
+	// big for any link which carries IPv6
+	dec.DecodeLayers(msg)
+	require.True(t, dec.IsIPv6())
+	require.False(t, frameTooBig(msg, ipv6MinMTU))
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/gossip"
+)
+
+// A peer which has been decommissioned, or compromised, can be
+// evicted: its connections are torn down, and every peer refuses it
+// from then on, whatever credentials it presents. Evictions are
+// replicated to every peer on a gossip channel of their own, so a peer
+// which hears of one late still refuses the evicted peer. They are
+// kept in memory, so are forgotten once every peer has restarted.
+//
+// Removing the peer from the topology is left to mesh, which forgets
+// peers once nothing is connected to them; its IPAM ranges are taken
+// over with 'weave rmpeer', which 'weave evict' does next.
+
+const evictionsChannel = "evictions"
+
+type evictOverlay struct {
+	NetworkOverlay
+	evictions *gossip.Map
+}
+
+func (eo *evictOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if how, found := eo.evictions.Get(params.RemotePeer.Name.String()); found {
+		return nil, fmt.Errorf("%s was evicted %s", params.RemotePeer, how)
+	}
+	return eo.NetworkOverlay.PrepareConnection(params)
+}
+
+func (eo *evictOverlay) ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult {
+	if prober, ok := eo.NetworkOverlay.(DataPathProber); ok {
+		return prober.ProbeDataPaths(timeout)
+	}
+	return nil
+}
+
+// Evict evicts peer, given by name or nickname, returning its name.
+func (router *NetworkRouter) Evict(peer string) (mesh.PeerName, error) {
+	if router.ReadOnly() {
+		return mesh.UnknownPeerName, ErrReadOnly
+	}
+	name, err := router.PeerNames.Resolve(peer)
+	if err != nil {
+		return name, err
+	}
+	if name == router.Ourself.Name {
+		return name, fmt.Errorf("cannot evict ourself")
+	}
+	how := fmt.Sprintf("by %s at %s", router.Ourself, time.Now().UTC().Format(time.RFC3339))
+	if err := router.evictions.Set(name.String(), []byte(how)); err != nil {
+		return name, err
+	}
+	router.disconnectEvicted(name, how)
+	return name, nil
+}
+
+// Evictions returns how each evicted peer was evicted, by name.
+func (router *NetworkRouter) Evictions() map[string]string {
+	result := make(map[string]string)
+	for _, name := range router.evictions.Keys() {
+		if how, found := router.evictions.Get(name); found {
+			result[name] = string(how)
+		}
+	}
+	return result
+}
+
+func (router *NetworkRouter) onEviction(key string, value []byte, deleted bool) {
+	name, err := mesh.PeerNameFromString(key)
+	if err != nil || deleted {
+		return
+	}
+	if name == router.Ourself.Name {
+		router.Log.Errorf("We have been evicted %s; other peers will refuse our connections", value)
+		return
+	}
+	router.disconnectEvicted(name, string(value))
+}
+
+func (router *NetworkRouter) disconnectEvicted(name mesh.PeerName, how string) {
+	conn, found := router.Ourself.ConnectionTo(name)
+	if !found {
+		return
+	}
+	err := fmt.Errorf("%s was evicted %s", conn.Remote(), how)
+	switch fwd := conn.(*mesh.LocalConnection).OverlayConn.(type) {
+	case *overlaySwitchForwarder:
+		fwd.fail(err)
+	default:
+		router.Log.Warnf("Unable to tear down connection: %s", err)
+	}
+}
@@ -0,0 +1,24 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/gossip"
+)
+
+func TestEvictOverlayRefusesEvictedPeers(t *testing.T) {
+	evictions := gossip.NewMap(1)
+	eo := &evictOverlay{NetworkOverlay: NullNetworkOverlay{}, evictions: evictions}
+	peer := &mesh.Peer{}
+	peer.Name, peer.NickName = 2, "host2"
+
+	_, err := eo.PrepareConnection(mesh.OverlayConnectionParams{RemotePeer: peer})
+	require.NoError(t, err)
+
+	require.NoError(t, evictions.Set(peer.Name.String(), []byte("by host1")))
+	_, err = eo.PrepareConnection(mesh.OverlayConnectionParams{RemotePeer: peer})
+	require.EqualError(t, err, "00:00:00:00:00:02(host2) was evicted by host1")
+}
@@ -9,8 +9,12 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/weaveworks/go-odp/odp"
 	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/errorlog"
+	"github.com/weaveworks/weave/common/supervisor"
 )
 
 // The virtual bridge accepts packets from ODP vports and the router
@@ -29,6 +33,7 @@ type missHandler func(fks odp.FlowKeys, lock *fastDatapathLock) FlowOp
 
 type FastDatapath struct {
 	dpname           string
+	log              *logrus.Entry
 	lock             sync.Mutex // guards state and synchronises use of dpif
 	dpif             *odp.Dpif
 	dp               odp.DatapathHandle
@@ -61,7 +66,7 @@ type FastDatapath struct {
 	forwarders map[mesh.PeerName]*fastDatapathForwarder
 }
 
-func NewFastDatapath(dpName string, port int) (*FastDatapath, error) {
+func NewFastDatapath(dpName string, port int, log *logrus.Entry) (*FastDatapath, error) {
 	dpif, err := odp.NewDpif()
 	if err != nil {
 		return nil, err
@@ -86,6 +91,7 @@ func NewFastDatapath(dpName string, port int) (*FastDatapath, error) {
 
 	fastdp := &FastDatapath{
 		dpname:        dpName,
+		log:           log,
 		dpif:          dpif,
 		dp:            dp,
 		iface:         iface,
@@ -304,17 +310,17 @@ func (fastdp *FastDatapath) Overlay() NetworkOverlay {
 }
 
 func (fastdp fastDatapathOverlay) InvalidateRoutes() {
-	log.Debug("InvalidateRoutes")
+	fastdp.log.Debug("InvalidateRoutes")
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
-	checkWarn(fastdp.deleteFlows())
+	checkWarn(fastdp.log, fastdp.deleteFlows())
 }
 
 func (fastdp fastDatapathOverlay) InvalidateShortIDs() {
-	log.Debug("InvalidateShortIDs")
+	fastdp.log.Debug("InvalidateShortIDs")
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
-	checkWarn(fastdp.deleteFlows())
+	checkWarn(fastdp.log, fastdp.deleteFlows())
 }
 
 func (fastDatapathOverlay) AddFeaturesTo(features map[string]string) {
@@ -365,14 +371,14 @@ func (fastdp fastDatapathOverlay) Diagnostics() interface{} {
 	defer lock.unlock()
 
 	vports, err := fastdp.dp.EnumerateVports()
-	checkWarn(err)
+	checkWarn(fastdp.log, err)
 	vportStatuses := make([]VportStatus, 0, len(vports))
 	for _, vport := range vports {
 		vportStatuses = append(vportStatuses, VportStatus(vport))
 	}
 
 	flows, err := fastdp.dp.EnumerateFlows()
-	checkWarn(err)
+	checkWarn(fastdp.log, err)
 	flowStatuses := make([]FlowStatus, 0, len(flows))
 	for _, flow := range flows {
 		flowStatuses = append(flowStatuses, FlowStatus(flow))
@@ -409,7 +415,7 @@ func (fastdp *FastDatapath) getVxlanVportIDHarder(udpPort int, retries int, dura
 		if err == nil || err != odp.NetlinkError(syscall.EADDRINUSE) {
 			return vxlanVportID, err
 		}
-		log.Warning("Address already in use creating vxlan vport ", udpPort, " - retrying")
+		fastdp.log.Warning("Address already in use creating vxlan vport ", udpPort, " - retrying")
 		time.Sleep(duration)
 	}
 	return 0, err
@@ -506,6 +512,7 @@ type fastDatapathForwarder struct {
 	localIP        [4]byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	log            connLog
 	vxlanVportID   odp.VportID
 
 	lock              sync.RWMutex
@@ -557,6 +564,7 @@ func (fastdp fastDatapathOverlay) PrepareConnection(params mesh.OverlayConnectio
 		localIP:        localIP,
 		sendControlMsg: params.SendControlMessage,
 		connUID:        params.ConnUID,
+		log:            newConnLog(fastdp.log, "fastdp", params),
 		vxlanVportID:   vxlanVportID,
 
 		remoteAddr:        remoteAddr,
@@ -580,8 +588,8 @@ func ipv4Bytes(ip net.IP) (res [4]byte, err error) {
 	return
 }
 
-func (fwd *fastDatapathForwarder) logPrefix() string {
-	return fmt.Sprintf("fastdp ->[%s|%s]: ", fwd.remoteAddr, fwd.remotePeer)
+func (fwd *fastDatapathForwarder) logger() *logrus.Entry {
+	return fwd.log.entry().WithField("addr", fwd.remoteAddr)
 }
 
 func (fwd *fastDatapathForwarder) Confirm() {
@@ -589,10 +597,10 @@ func (fwd *fastDatapathForwarder) Confirm() {
 	defer fwd.lock.Unlock()
 
 	if fwd.confirmed {
-		log.Fatal(fwd.logPrefix(), "already confirmed")
+		fwd.logger().Fatal("already confirmed")
 	}
 
-	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.logger().Debug("confirmed")
 	fwd.fastdp.addForwarder(fwd.remotePeer.Name, fwd)
 	fwd.confirmed = true
 
@@ -617,6 +625,7 @@ func (fwd *fastDatapathForwarder) ErrorChannel() <-chan error {
 }
 
 func (fwd *fastDatapathForwarder) doHeartbeats() {
+	defer supervisor.Recover("fastdp heartbeats")
 	var err error
 
 	for err == nil {
@@ -647,6 +656,7 @@ func (fwd *fastDatapathForwarder) handleError(err error) {
 		return
 	}
 
+	fwd.log.record(err)
 	select {
 	case fwd.errorChan <- err:
 	default:
@@ -661,7 +671,7 @@ func (fwd *fastDatapathForwarder) handleError(err error) {
 
 func (fwd *fastDatapathForwarder) sendHeartbeat() {
 	fwd.lock.RLock()
-	log.Debug(fwd.logPrefix(), "sendHeartbeat")
+	fwd.logger().Debug("sendHeartbeat")
 
 	// the heartbeat payload consists of the 64-bit connection uid
 	// followed by the 16-bit packet size.
@@ -691,11 +701,11 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
-	log.Debug(fwd.logPrefix(), "handleVxlanSpecialPacket")
+	fwd.logger().Debug("handleVxlanSpecialPacket")
 
 	// the only special packet type is a heartbeat
 	if len(frame) < EthernetOverhead+10 {
-		log.Warning(fwd.logPrefix(), "short vxlan special packet: ", len(frame), " bytes")
+		fwd.log.throttle.Logf(fwd.logger().Warningf, "short vxlan special packet: %d bytes", len(frame))
 		return
 	}
 
@@ -711,7 +721,7 @@ func (fwd *fastDatapathForwarder) handleVxlanSpecialPacket(frame []byte, sender
 			fwd.heartbeatTimer.Reset(0)
 		}
 	} else if !udpAddrsEqual(fwd.remoteAddr, sender) {
-		log.Info(fwd.logPrefix(), "Peer IP address changed to ", sender)
+		fwd.logger().Info("Peer IP address changed to ", sender)
 		fwd.remoteAddr = sender
 	}
 
@@ -736,7 +746,7 @@ func (fwd *fastDatapathForwarder) ControlMessage(tag byte, msg []byte) {
 		fwd.handleHeartbeatAck()
 
 	default:
-		log.Info(fwd.logPrefix(), "Ignoring unknown control message: ", tag)
+		fwd.logger().Info("Ignoring unknown control message: ", tag)
 	}
 }
 
@@ -745,11 +755,11 @@ func (fwd *fastDatapathForwarder) DisplayName() string {
 }
 
 func (fwd *fastDatapathForwarder) handleHeartbeatAck() {
-	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
+	fwd.logger().Debug("handleHeartbeatAck")
 
-	if fwd.heartbeatInterval != SlowHeartbeat {
+	if fwd.heartbeatInterval <= FastHeartbeat {
 		close(fwd.establishedChan)
-		fwd.heartbeatInterval = SlowHeartbeat
+		fwd.heartbeatInterval = slowHeartbeat()
 		if fwd.heartbeatTimer != nil {
 			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
 		}
@@ -774,7 +784,7 @@ func (fwd *fastDatapathForwarder) Forward(key ForwardPacketKey) FlowOp {
 
 	remoteIP, err := ipv4Bytes(fwd.remoteAddr.IP)
 	if err != nil {
-		log.Error(err)
+		fwd.logger().Error(err)
 		return DiscardingFlowOp{}
 	}
 
@@ -868,6 +878,7 @@ func (fastdp *FastDatapath) deleteVxlanVports() error {
 }
 
 func (fastdp *FastDatapath) run() {
+	defer supervisor.Recover("fastdp")
 	expireMACsCh := time.Tick(10 * time.Minute)
 	expireFlowsCh := time.Tick(5 * time.Minute)
 
@@ -900,11 +911,11 @@ func (fastdp *FastDatapath) expireFlows() {
 	defer lock.unlock()
 
 	flows, err := fastdp.dp.EnumerateFlows()
-	checkWarn(err)
+	checkWarn(fastdp.log, err)
 
 	for _, flow := range flows {
 		if flow.Used == 0 {
-			log.Debug("Expiring flow ", flow.FlowSpec)
+			fastdp.log.Debug("Expiring flow ", flow.FlowSpec)
 			err = fastdp.dp.DeleteFlow(flow.FlowKeys)
 		} else {
 			fastdp.touchFlow(flow.FlowKeys, &lock)
@@ -912,7 +923,7 @@ func (fastdp *FastDatapath) expireFlows() {
 		}
 
 		if err != nil && !odp.IsNoSuchFlowError(err) {
-			log.Warn(err)
+			fastdp.log.Warn(err)
 		}
 	}
 }
@@ -938,15 +949,16 @@ func (fastdp *FastDatapath) touchFlow(fks odp.FlowKeys, lock *fastDatapathLock)
 
 func (fastdp *FastDatapath) Error(err error, stopped bool) {
 	if stopped {
-		log.Fatal("Error while listeniing on ODP datapath: ", err)
+		fastdp.log.Fatal("Error while listeniing on ODP datapath: ", err)
 	}
 
-	log.Error("Error while listening on ODP datapath: ", err)
+	fastdp.log.Error("Error while listening on ODP datapath: ", err)
+	errorlog.Record("fastdp", err)
 }
 
 func (fastdp *FastDatapath) Miss(packet []byte, fks odp.FlowKeys) error {
 	ingress := fks[odp.OVS_KEY_ATTR_IN_PORT].(odp.InPortFlowKey).VportID()
-	log.Debug("ODP miss ", fks, " on port ", ingress)
+	fastdp.log.Debug("ODP miss ", fks, " on port ", ingress)
 
 	lock := fastdp.startLock()
 	defer lock.unlock()
@@ -973,7 +985,7 @@ func (fastdp *FastDatapath) getMissHandler(ingress odp.VportID) missHandler {
 	if handler == nil {
 		vport, err := fastdp.dp.LookupVport(ingress)
 		if err != nil {
-			log.Error(err)
+			fastdp.log.Error(err)
 			return nil
 		}
 
@@ -1027,7 +1039,7 @@ func (fastdp *FastDatapath) makeBridgeVport(vport odp.Vport) {
 
 	// Delete flows, in order to recalculate flows for broadcasts
 	// on the bridge.
-	checkWarn(fastdp.deleteFlows())
+	checkWarn(fastdp.log, fastdp.deleteFlows())
 
 	// Packets coming from the netdev are processed by the bridge
 	fastdp.missHandlers[vportID] = func(flowKeys odp.FlowKeys, lock *fastDatapathLock) FlowOp {
@@ -1107,7 +1119,7 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 
 	if len(flow.Actions) != 0 {
 		lock.relock()
-		checkWarn(fastdp.dp.Execute(frame, nil, flow.Actions))
+		checkWarn(fastdp.log, fastdp.dp.Execute(frame, nil, flow.Actions))
 	}
 
 	if createFlow {
@@ -1118,8 +1130,8 @@ func (fastdp *FastDatapath) send(fops FlowOp, frame []byte, lock *fastDatapathLo
 		// to handle one packet like that, but it would be bad
 		// to introduce a stale flow.
 		if lock.deleteFlowsCount == fastdp.deleteFlowsCount {
-			log.Debug("Creating ODP flow ", flow)
-			checkWarn(fastdp.dp.CreateFlow(flow))
+			fastdp.log.Debug("Creating ODP flow ", flow)
+			checkWarn(fastdp.log, fastdp.dp.CreateFlow(flow))
 		}
 	}
 }
@@ -1157,7 +1169,7 @@ func (fop odpActionsFlowOp) Process(frame []byte, dec *EthernetDecoder, broadcas
 	fastdp := fop.fastdp
 	fastdp.lock.Lock()
 	defer fastdp.lock.Unlock()
-	checkWarn(fastdp.dp.Execute(frame, nil, fop.actions))
+	checkWarn(fastdp.log, fastdp.dp.Execute(frame, nil, fop.actions))
 }
 
 // A vetoFlowCreationFlowOp flags that no flow should be created
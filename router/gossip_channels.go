@@ -0,0 +1,96 @@
+package router
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/weaveworks/mesh"
+)
+
+// Peers tell each other, during the handshake, which gossip channels
+// they host. mesh relays gossip on a channel a peer doesn't host
+// without handing it to anything, so a peer lacking one we rely on,
+// e.g. with IPAM enabled on only one side, is warned about when it
+// connects rather than found out about later. Peers which don't send
+// the list are taken to host what we do.
+
+const gossipChannelsFeature = "GossipChannels"
+
+type gossipChannels struct {
+	sync.Mutex
+	names []string // sorted
+}
+
+func (gc *gossipChannels) add(name string) {
+	gc.Lock()
+	defer gc.Unlock()
+	i := sort.SearchStrings(gc.names, name)
+	if i < len(gc.names) && gc.names[i] == name {
+		return
+	}
+	gc.names = append(gc.names, "")
+	copy(gc.names[i+1:], gc.names[i:])
+	gc.names[i] = name
+}
+
+func (gc *gossipChannels) String() string {
+	gc.Lock()
+	defer gc.Unlock()
+	return strings.Join(gc.names, ",")
+}
+
+// missing returns the channels we host which aren't in remote, a
+// list as sent in the handshake.
+func (gc *gossipChannels) missing(remote string) []string {
+	theirs := make(map[string]struct{})
+	for _, name := range strings.Split(remote, ",") {
+		theirs[name] = struct{}{}
+	}
+	gc.Lock()
+	defer gc.Unlock()
+	var missing []string
+	for _, name := range gc.names {
+		if _, found := theirs[name]; !found {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// NewGossip registers a gossip channel, as mesh.Router's does, and
+// notes its name to tell peers about. Channels must be registered
+// before the router is started for every peer to hear of them.
+func (router *NetworkRouter) NewGossip(channel string, gossiper mesh.Gossiper) mesh.Gossip {
+	router.gossipChannels.add(channel)
+	return router.Router.NewGossip(channel, gossiper)
+}
+
+type gossipChannelsOverlay struct {
+	NetworkOverlay
+	channels *gossipChannels
+	log      *logrus.Entry
+}
+
+func (gco *gossipChannelsOverlay) AddFeaturesTo(features map[string]string) {
+	gco.NetworkOverlay.AddFeaturesTo(features)
+	features[gossipChannelsFeature] = gco.channels.String()
+}
+
+func (gco *gossipChannelsOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	if remote, present := params.Features[gossipChannelsFeature]; present {
+		if missing := gco.channels.missing(remote); len(missing) > 0 {
+			gco.log.Warnf("%s does not host gossip channels %s; it will drop our gossip on them. Check that it was launched with the same options as us", params.RemotePeer, strings.Join(missing, ", "))
+		}
+	}
+	return gco.NetworkOverlay.PrepareConnection(params)
+}
+
+func (gco *gossipChannelsOverlay) ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult {
+	if prober, ok := gco.NetworkOverlay.(DataPathProber); ok {
+		return prober.ProbeDataPaths(timeout)
+	}
+	return nil
+}
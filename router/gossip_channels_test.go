@@ -0,0 +1,20 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGossipChannels(t *testing.T) {
+	gc := &gossipChannels{}
+	gc.add("nameserver")
+	gc.add("IPallocation")
+	gc.add("evictions")
+	gc.add("nameserver")
+	require.Equal(t, "IPallocation,evictions,nameserver", gc.String())
+
+	require.Empty(t, gc.missing(gc.String()))
+	require.Empty(t, gc.missing("IPallocation,evictions,nameserver,other"), "extra channels are fine")
+	require.Equal(t, []string{"IPallocation", "nameserver"}, gc.missing("evictions"))
+}
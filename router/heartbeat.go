@@ -0,0 +1,39 @@
+package router
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// The interval between heartbeats on an established connection, in
+// nanoseconds. Accessed atomically, since it can be changed while
+// running.
+var slowHeartbeatNanos = int64(SlowHeartbeat)
+
+func slowHeartbeat() time.Duration {
+	return time.Duration(atomic.LoadInt64(&slowHeartbeatNanos))
+}
+
+// CheckSlowHeartbeat says whether interval may be passed to
+// SetSlowHeartbeat. It can't be longer than SlowHeartbeat, because
+// other peers time connections out assuming heartbeats are at least
+// that frequent, nor as short as FastHeartbeat, which is how
+// forwarders tell they aren't established yet.
+func CheckSlowHeartbeat(interval time.Duration) error {
+	if interval <= FastHeartbeat || interval > SlowHeartbeat {
+		return fmt.Errorf("heartbeat interval must be more than %s and at most %s", FastHeartbeat, SlowHeartbeat)
+	}
+	return nil
+}
+
+// SetSlowHeartbeat changes the interval between heartbeats, e.g. to
+// have a failed path noticed sooner, for connections established from
+// now on.
+func SetSlowHeartbeat(interval time.Duration) error {
+	if err := CheckSlowHeartbeat(interval); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&slowHeartbeatNanos, int64(interval))
+	return nil
+}
@@ -1,8 +1,10 @@
 package router
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/weaveworks/weave/common"
@@ -11,6 +13,10 @@ import (
 func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 
 	muxRouter.Methods("POST").Path("/connect").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if router.ReadOnly() {
+			http.Error(w, ErrReadOnly.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
 		}
@@ -20,10 +26,96 @@ func (router *NetworkRouter) HandleHTTP(muxRouter *mux.Router) {
 	})
 
 	muxRouter.Methods("POST").Path("/forget").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if router.ReadOnly() {
+			http.Error(w, ErrReadOnly.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		if err := r.ParseForm(); err != nil {
 			http.Error(w, fmt.Sprint("unable to parse form: ", err), http.StatusBadRequest)
 		}
 		router.ConnectionMaker.ForgetConnections(r.Form["peer"])
 	})
 
+	muxRouter.Methods("POST").Path("/probe").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := DefaultProbeTimeout
+		if timeoutStr := r.FormValue("timeout"); timeoutStr != "" {
+			var err error
+			if timeout, err = time.ParseDuration(timeoutStr); err != nil {
+				http.Error(w, fmt.Sprint("invalid timeout: ", err), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(router.ProbeDataPaths(timeout))
+	})
+
+	muxRouter.Methods("POST").Path("/evict/{peer}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, err := router.Evict(mux.Vars(r)["peer"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, name)
+	})
+
+	// The nickname of every peer known to weave, by name
+	muxRouter.Methods("GET").Path("/peernames").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(router.PeerNames.Nicknames())
+	})
+
+	muxRouter.Methods("GET").Path("/evictions").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(router.Evictions())
+	})
+
+	muxRouter.Methods("GET").Path("/connections/dump").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump, err := router.DumpConnection(r.FormValue("peer"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json, err := json.MarshalIndent(dump, "", "    ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json)
+	})
+
+	// One JSON event per line; with follow=true, the response goes on
+	// with later events until the client hangs up.
+	muxRouter.Methods("GET").Path("/connections/events").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var watch chan ConnectionEvent
+		if r.FormValue("follow") == "true" {
+			watch = make(chan ConnectionEvent, connectionEventsKept)
+		}
+		recent, stop := router.connEvents.watch(watch)
+		defer stop()
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		for _, event := range recent {
+			encoder.Encode(event)
+		}
+		if watch == nil {
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		closedChan := w.(http.CloseNotifier).CloseNotify()
+		for {
+			if flusher != nil {
+				flusher.Flush()
+			}
+			select {
+			case event := <-watch:
+				if err := encoder.Encode(event); err != nil {
+					return
+				}
+			case <-closedChan:
+				return
+			}
+		}
+	})
+
 }
@@ -0,0 +1,131 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Manager hosts several independent NetworkRouters in one process,
+// e.g. to join a production mesh and a management mesh at the same
+// time. Each router keeps its own peers, overlay and bridge; the
+// manager only tracks them by name and fans out lifecycle calls.
+//
+// To tell the routers apart in the logs, give each one its own
+// NetworkConfig.Log, e.g. common.Log.WithField("mesh", name).
+type Manager struct {
+	sync.Mutex
+	routers map[string]*managedRouter
+}
+
+type managedRouter struct {
+	*NetworkRouter
+	name    string
+	handler *mux.Router
+}
+
+func NewManager() *Manager {
+	return &Manager{routers: make(map[string]*managedRouter)}
+}
+
+// Add registers router under name. Names must be unique.
+func (m *Manager) Add(name string, router *NetworkRouter) error {
+	handler := mux.NewRouter()
+	router.HandleHTTP(handler.PathPrefix("/mesh/" + name).Subrouter())
+	m.Lock()
+	defer m.Unlock()
+	if _, found := m.routers[name]; found {
+		return fmt.Errorf("router %q already registered", name)
+	}
+	m.routers[name] = &managedRouter{router, name, handler}
+	return nil
+}
+
+// Remove stops the named router and forgets about it.
+func (m *Manager) Remove(name string) error {
+	m.Lock()
+	router, found := m.routers[name]
+	delete(m.routers, name)
+	m.Unlock()
+	if !found {
+		return fmt.Errorf("no router named %q", name)
+	}
+	return router.Stop()
+}
+
+// Router returns the named router, or nil if there is none.
+func (m *Manager) Router(name string) *NetworkRouter {
+	m.Lock()
+	defer m.Unlock()
+	if router, found := m.routers[name]; found {
+		return router.NetworkRouter
+	}
+	return nil
+}
+
+// Names returns the names of all registered routers, sorted.
+func (m *Manager) Names() []string {
+	routers := m.sorted()
+	names := make([]string, len(routers))
+	for i, router := range routers {
+		names[i] = router.name
+	}
+	return names
+}
+
+// Copy the routers out, so that lifecycle calls don't hold the lock
+// and don't trip over a concurrent Remove.
+func (m *Manager) sorted() []*managedRouter {
+	m.Lock()
+	routers := make([]*managedRouter, 0, len(m.routers))
+	for _, router := range m.routers {
+		routers = append(routers, router)
+	}
+	m.Unlock()
+	sort.Sort(byName(routers))
+	return routers
+}
+
+func (m *Manager) Start() {
+	for _, router := range m.sorted() {
+		router.Log.Println("Starting router", router.name)
+		router.Start()
+	}
+}
+
+// Stop stops every registered router, returning the first error
+// encountered. Makes Manager usable as a common.SignalReceiver.
+func (m *Manager) Stop() error {
+	var firstErr error
+	for _, router := range m.sorted() {
+		if err := router.Stop(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("stopping router %q: %s", router.name, err)
+		}
+	}
+	return firstErr
+}
+
+// HandleHTTP serves each router's endpoints under /mesh/<name>, so
+// that e.g. POST /mesh/mgmt/connect talks to the "mgmt" router.
+// Routers added later are picked up too.
+func (m *Manager) HandleHTTP(muxRouter *mux.Router) {
+	muxRouter.PathPrefix("/mesh/{name}/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		router, found := m.routers[mux.Vars(r)["name"]]
+		m.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		router.handler.ServeHTTP(w, r)
+	})
+}
+
+type byName []*managedRouter
+
+func (rs byName) Len() int           { return len(rs) }
+func (rs byName) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+func (rs byName) Less(i, j int) bool { return rs[i].name < rs[j].name }
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func makeManagedRouter(name mesh.PeerName) *NetworkRouter {
+	return NewNetworkRouter(mesh.Config{}, NetworkConfig{}, name, "", nil)
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager()
+	prod, mgmt := makeManagedRouter(1), makeManagedRouter(2)
+	require.NoError(t, m.Add("prod", prod))
+	require.NoError(t, m.Add("mgmt", mgmt))
+	require.Error(t, m.Add("prod", makeManagedRouter(3)))
+	require.Equal(t, []string{"mgmt", "prod"}, m.Names())
+	require.Equal(t, mgmt, m.Router("mgmt"))
+
+	muxRouter := mux.NewRouter()
+	m.HandleHTTP(muxRouter)
+	server := httptest.NewServer(muxRouter)
+	defer server.Close()
+	forget := func(name string) int {
+		resp, err := http.PostForm(server.URL+"/mesh/"+name+"/forget", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, forget("mgmt"))
+	require.Equal(t, http.StatusNotFound, forget("dev"))
+
+	// routers added after HandleHTTP are served too
+	require.NoError(t, m.Add("dev", makeManagedRouter(4)))
+	require.Equal(t, http.StatusOK, forget("dev"))
+
+	require.NoError(t, m.Remove("prod"))
+	require.Error(t, m.Remove("prod"))
+	require.Nil(t, m.Router("prod"))
+	require.Equal(t, http.StatusNotFound, forget("prod"))
+	require.Equal(t, []string{"dev", "mgmt"}, m.Names())
+
+	require.NoError(t, m.Stop())
+}
@@ -1,13 +1,18 @@
 package router
 
 import (
+	"fmt"
 	"math"
 	"net"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/weaveworks/mesh"
 
 	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/errorlog"
+	"github.com/weaveworks/weave/gossip"
+	"github.com/weaveworks/weave/peernames"
 )
 
 const (
@@ -24,16 +29,18 @@ const (
 	macMaxAge = 10 * time.Minute
 )
 
-var (
-	log        = common.Log
-	checkFatal = common.CheckFatal
-	checkWarn  = common.CheckWarn
-)
+// Log err, if any, as a warning
+func checkWarn(log *logrus.Entry, err error) {
+	if err != nil {
+		log.Warnln(err)
+	}
+}
 
 type NetworkConfig struct {
 	BufSz         int
 	PacketLogging PacketLogging
 	Bridge        Bridge
+	Log           *logrus.Entry // defaults to common.Log
 }
 
 type PacketLogging interface {
@@ -44,7 +51,13 @@ type PacketLogging interface {
 type NetworkRouter struct {
 	*mesh.Router
 	NetworkConfig
-	Macs *MacCache
+	Macs           *MacCache
+	PeerNames      *peernames.Registry
+	connEvents     *connectionEvents
+	evictions      *gossip.Map
+	topology       topologyCache
+	gossipChannels *gossipChannels
+	readOnly       int32 // accessed atomically; see readonly.go
 }
 
 func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh.PeerName, nickName string, overlay NetworkOverlay) *NetworkRouter {
@@ -54,25 +67,45 @@ func NewNetworkRouter(config mesh.Config, networkConfig NetworkConfig, name mesh
 	if networkConfig.Bridge == nil {
 		networkConfig.Bridge = NullBridge{}
 	}
+	if networkConfig.Log == nil {
+		networkConfig.Log = logrus.NewEntry(common.Log)
+	}
 
-	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay), NetworkConfig: networkConfig}
+	evictions := gossip.NewMap(name)
+	channels := &gossipChannels{}
+	overlay = &gossipChannelsOverlay{NetworkOverlay: overlay, channels: channels, log: networkConfig.Log}
+	overlay = &evictOverlay{NetworkOverlay: overlay, evictions: evictions}
+
+	router := &NetworkRouter{Router: mesh.NewRouter(config, name, nickName, overlay), NetworkConfig: networkConfig, PeerNames: peernames.NewRegistry(), connEvents: newConnectionEvents(), evictions: evictions, gossipChannels: channels}
+	evictions.SetGossip(router.NewGossip(evictionsChannel, evictions))
+	evictions.OnChange(router.onEviction)
 	router.Peers.OnInvalidateShortIDs(overlay.InvalidateShortIDs)
 	router.Routes.OnChange(overlay.InvalidateRoutes)
+	router.Routes.OnChange(router.invalidateTopology)
+	router.Routes.OnChange(router.updatePeerNames)
 	router.Macs = NewMacCache(macMaxAge,
 		func(mac net.HardwareAddr, peer *mesh.Peer) {
-			log.Println("Expired MAC", mac, "at", peer)
+			router.Log.Println("Expired MAC", mac, "at", peer)
 		})
 	router.Peers.OnGC(func(peer *mesh.Peer) { router.Macs.Delete(peer) })
+	router.Peers.OnGC(router.forgetPeerName)
+	router.Peers.OnGC(func(*mesh.Peer) { router.invalidateTopology() })
+	router.updatePeerNames()
 	return router
 }
 
 // Start listening for TCP connections, locally captured packets, and
 // forwarded packets.
 func (router *NetworkRouter) Start() {
-	log.Println("Sniffing traffic on", router.Bridge)
-	checkFatal(router.Bridge.StartConsumingPackets(router.handleCapturedPacket))
-	checkFatal(router.Overlay.(NetworkOverlay).StartConsumingPackets(router.Ourself.Peer, router.Peers, router.handleForwardedPacket))
+	router.Log.Println("Sniffing traffic on", router.Bridge)
+	if err := router.Bridge.StartConsumingPackets(router.handleCapturedPacket); err != nil {
+		router.Log.Fatal(err)
+	}
+	if err := router.Overlay.(NetworkOverlay).StartConsumingPackets(router.Ourself.Peer, router.Peers, router.handleForwardedPacket); err != nil {
+		router.Log.Fatal(err)
+	}
 	router.Router.Start()
+	router.connEvents.start(router.Router)
 }
 
 func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
@@ -81,14 +114,15 @@ func (router *NetworkRouter) handleCapturedPacket(key PacketKey) FlowOp {
 
 	switch newSrcMac, conflictPeer := router.Macs.Add(srcMac, router.Ourself.Peer); {
 	case newSrcMac:
-		log.Println("Discovered local MAC", srcMac)
+		router.Log.Println("Discovered local MAC", srcMac)
 
 	case conflictPeer != nil:
 		// The MAC cache has an entry for the source MAC
 		// associated with another peer.  This probably means
 		// we are seeing a frame we injected ourself.  That
 		// shouldn't happen, but discard it just in case.
-		log.Error("Captured frame from MAC (", srcMac, ") associated with another peer ", conflictPeer)
+		router.Log.Error("Captured frame from MAC (", srcMac, ") associated with another peer ", conflictPeer)
+		errorlog.Record("router", fmt.Errorf("captured frame from MAC (%s) associated with another peer %s", srcMac, conflictPeer))
 		return DiscardingFlowOp{}
 	}
 
@@ -136,9 +170,9 @@ func (router *NetworkRouter) handleForwardedPacket(key ForwardPacketKey) FlowOp
 
 	switch newSrcMac, conflictPeer := router.Macs.AddForced(srcMac, key.SrcPeer); {
 	case newSrcMac:
-		log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer)
+		router.Log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer)
 	case conflictPeer != nil:
-		log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer, " (was at ", conflictPeer, ")")
+		router.Log.Print("Discovered remote MAC ", srcMac, " at ", key.SrcPeer, " (was at ", conflictPeer, ")")
 		// We need to clear out any flows destined to the MAC
 		// that forward to the old peer.
 		router.Overlay.(NetworkOverlay).InvalidateRoutes()
@@ -173,14 +207,14 @@ func (router *NetworkRouter) relay(key ForwardPacketKey) FlowOp {
 	if !found {
 		// Not necessarily an error as there could be a race with the
 		// dst disappearing whilst the frame is in flight
-		log.Println("Received packet for unknown destination:", key.DstPeer)
+		router.Log.Println("Received packet for unknown destination:", key.DstPeer)
 		return DiscardingFlowOp{}
 	}
 
 	conn, found := router.Ourself.ConnectionTo(relayPeerName)
 	if !found {
 		// Again, could just be a race, not necessarily an error
-		log.Println("Unable to find connection to relay peer", relayPeerName)
+		router.Log.Println("Unable to find connection to relay peer", relayPeerName)
 		return DiscardingFlowOp{}
 	}
 
@@ -11,6 +11,7 @@ type NetworkRouterStatus struct {
 	Interface    string
 	CaptureStats map[string]int
 	MACs         []MACStatus
+	ReadOnly     bool
 }
 
 type MACStatus struct {
@@ -25,7 +26,8 @@ func NewNetworkRouterStatus(router *NetworkRouter) *NetworkRouterStatus {
 		mesh.NewStatus(router.Router),
 		router.Bridge.String(),
 		router.Bridge.Stats(),
-		NewMACStatusSlice(router.Macs)}
+		NewMACStatusSlice(router.Macs),
+		router.ReadOnly()}
 }
 
 func NewMACStatusSlice(cache *MacCache) []MACStatus {
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common/supervisor"
 )
 
 // OverlaySwitch selects which overlay to use, from a set of
@@ -15,19 +19,20 @@ import (
 // uses the best one that seems to be working.
 
 type OverlaySwitch struct {
+	log           *logrus.Entry
 	overlays      map[string]NetworkOverlay
 	overlayNames  []string
 	compatOverlay NetworkOverlay
 }
 
-func NewOverlaySwitch() *OverlaySwitch {
-	return &OverlaySwitch{overlays: make(map[string]NetworkOverlay)}
+func NewOverlaySwitch(log *logrus.Entry) *OverlaySwitch {
+	return &OverlaySwitch{log: log, overlays: make(map[string]NetworkOverlay)}
 }
 
 func (osw *OverlaySwitch) Add(name string, overlay NetworkOverlay) {
 	// check for repeated names
 	if _, present := osw.overlays[name]; present {
-		log.Fatal("OverlaySwitch: repeated overlay name")
+		osw.log.Fatal("OverlaySwitch: repeated overlay name")
 	}
 
 	osw.overlays[name] = overlay
@@ -40,6 +45,9 @@ func (osw *OverlaySwitch) SetCompatOverlay(overlay NetworkOverlay) {
 
 func (osw *OverlaySwitch) AddFeaturesTo(features map[string]string) {
 	features["Overlays"] = strings.Join(osw.overlayNames, " ")
+	for _, overlay := range osw.overlays {
+		overlay.AddFeaturesTo(features)
+	}
 }
 
 func (osw *OverlaySwitch) Diagnostics() interface{} {
@@ -121,6 +129,8 @@ func (osw *OverlaySwitch) commonOverlays(params mesh.OverlayConnectionParams) ([
 
 type overlaySwitchForwarder struct {
 	remotePeer *mesh.Peer
+	params     mesh.OverlayConnectionParams // for dumps
+	log        connLog
 
 	lock sync.Mutex
 
@@ -136,6 +146,7 @@ type overlaySwitchForwarder struct {
 	alreadyEstablished bool
 	establishedChan    chan struct{}
 	errorChan          chan error
+	times              *establishTimes
 }
 
 // A subsidiary forwarder
@@ -181,6 +192,8 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 
 	fwd := &overlaySwitchForwarder{
 		remotePeer: params.RemotePeer,
+		params:     params,
+		log:        newConnLog(osw.log, "overlay_switch", params),
 
 		best:       -1,
 		forwarders: make([]subForwarder, len(overlays)),
@@ -188,6 +201,7 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 
 		establishedChan: make(chan struct{}),
 		errorChan:       make(chan error, 1),
+		times:           newEstablishTimes(params),
 	}
 
 	origSendControlMessage := params.SendControlMessage
@@ -204,11 +218,7 @@ func (osw *OverlaySwitch) PrepareConnection(params mesh.OverlayConnectionParams)
 
 		subConn, err := overlay.PrepareConnection(params)
 		if err != nil {
-			log.Infof("Unable to use %s for connection to %s(%s): %s",
-				overlay.name,
-				params.RemotePeer.Name,
-				params.RemotePeer.NickName,
-				err)
+			fwd.logger().Infof("Unable to use %s: %s", overlay.name, err)
 			// failed to start subforwarder - record overlay name and continue
 			fwd.forwarders[i] = subForwarder{
 				overlayName: overlay.name,
@@ -264,6 +274,7 @@ loop:
 }
 
 func (fwd *overlaySwitchForwarder) run(eventsChan <-chan subForwarderEvent, stopChan <-chan struct{}) {
+	defer supervisor.Recover("overlay switch forwarder")
 loop:
 	for {
 		select {
@@ -294,24 +305,37 @@ func (fwd *overlaySwitchForwarder) established(index int) {
 	if !fwd.alreadyEstablished {
 		fwd.alreadyEstablished = true
 		close(fwd.establishedChan)
+		if slow := fwd.times.record(time.Now()); slow != "" {
+			fwd.logger().Warn(slow)
+		}
 	}
 
 	fwd.chooseBest()
 }
 
-func (fwd *overlaySwitchForwarder) logPrefix() string {
-	return fmt.Sprintf("overlay_switch ->[%s] ", fwd.remotePeer)
+func (fwd *overlaySwitchForwarder) logger() *logrus.Entry {
+	return fwd.log.entry()
 }
 
 func (fwd *overlaySwitchForwarder) error(index int, err error) {
 	fwd.lock.Lock()
 	defer fwd.lock.Unlock()
 
-	log.Info(fwd.logPrefix(), fwd.forwarders[index].overlayName, " ", err)
+	fwd.logger().Info(fwd.forwarders[index].overlayName, " ", err)
 	fwd.forwarders[index].fwd = nil
 	fwd.chooseBest()
 }
 
+// fail tears the connection down, as mesh does on any error from the
+// forwarder
+func (fwd *overlaySwitchForwarder) fail(err error) {
+	fwd.log.record(err)
+	select {
+	case fwd.errorChan <- err:
+	default:
+	}
+}
+
 func (fwd *overlaySwitchForwarder) stopFrom(index int) {
 	for index < len(fwd.forwarders) {
 		subFwd := &fwd.forwarders[index]
@@ -347,8 +371,10 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 	best := bestEstablished
 	if best < 0 {
 		if bestWorking < 0 {
+			err := fmt.Errorf("no working forwarders to %s", fwd.remotePeer)
+			fwd.log.record(err)
 			select {
-			case fwd.errorChan <- fmt.Errorf("no working forwarders to %s", fwd.remotePeer):
+			case fwd.errorChan <- err:
 			default:
 			}
 
@@ -360,7 +386,7 @@ func (fwd *overlaySwitchForwarder) chooseBest() {
 
 	if fwd.best != best {
 		fwd.best = best
-		log.Info(fwd.logPrefix(), "using ", fwd.forwarders[best].overlayName)
+		fwd.logger().Info("using ", fwd.forwarders[best].overlayName)
 	}
 }
 
@@ -368,6 +394,7 @@ func (fwd *overlaySwitchForwarder) Confirm() {
 	var forwarders []OverlayForwarder
 
 	fwd.lock.Lock()
+	fwd.times.confirmed = time.Now()
 	for _, subFwd := range fwd.forwarders {
 		if subFwd.fwd != nil {
 			forwarders = append(forwarders, subFwd.fwd)
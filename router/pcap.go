@@ -5,6 +5,7 @@ import (
 	"net"
 	"sync"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/google/gopacket/pcap"
 )
 
@@ -13,6 +14,7 @@ type Pcap struct {
 
 	iface *net.Interface
 	bufSz int
+	log   *logrus.Entry
 
 	// The libpcap handle for writing packets. It's possible that a
 	// single handle could be used for reading and writing, but
@@ -27,13 +29,13 @@ type Pcap struct {
 	readHandle *pcap.Handle
 }
 
-func NewPcap(iface *net.Interface, bufSz int) (Bridge, error) {
+func NewPcap(iface *net.Interface, bufSz int, log *logrus.Entry) (Bridge, error) {
 	wh, err := newPcapHandle(iface.Name, false, 0, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Pcap{iface: iface, bufSz: bufSz, writeHandle: wh}, nil
+	return &Pcap{iface: iface, bufSz: bufSz, log: log, writeHandle: wh}, nil
 }
 
 func (p *Pcap) StartConsumingPackets(consumer BridgeConsumer) error {
@@ -119,7 +121,7 @@ func (p *Pcap) InjectPacket(PacketKey) FlowOp {
 func (p *Pcap) Process(frame []byte, dec *EthernetDecoder, broadcast bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	checkWarn(p.writeHandle.WritePacketData(frame))
+	checkWarn(p.log, p.writeHandle.WritePacketData(frame))
 }
 
 func (p *Pcap) sniff(readHandle *pcap.Handle, consumer BridgeConsumer) {
@@ -131,7 +133,9 @@ func (p *Pcap) sniff(readHandle *pcap.Handle, consumer BridgeConsumer) {
 			continue
 		}
 
-		checkFatal(err)
+		if err != nil {
+			p.log.Fatal(err)
+		}
 		dec.DecodeLayers(pkt)
 		if len(dec.decoded) == 0 {
 			continue
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// PeerLimitOverlay refuses connections which would take the number of
+// peers in the mesh beyond a limit, so that an accidentally unbounded
+// mesh cannot swamp a small host. mesh consults the overlay after the
+// handshake, so the refusal tears the connection down with an error
+// naming the limit.
+type PeerLimitOverlay struct {
+	NetworkOverlay
+	maxPeers int
+
+	sync.Mutex
+	peers *mesh.Peers
+}
+
+func NewPeerLimitOverlay(overlay NetworkOverlay, maxPeers int) *PeerLimitOverlay {
+	return &PeerLimitOverlay{NetworkOverlay: overlay, maxPeers: maxPeers}
+}
+
+func (plo *PeerLimitOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
+	plo.Lock()
+	plo.peers = peers
+	plo.Unlock()
+	return plo.NetworkOverlay.StartConsumingPackets(localPeer, peers, consumer)
+}
+
+func (plo *PeerLimitOverlay) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	plo.Lock()
+	peers := plo.peers
+	plo.Unlock()
+	if peers != nil {
+		var known []mesh.PeerName
+		peers.ForEach(func(peer *mesh.Peer) { known = append(known, peer.Name) })
+		if peerLimitExceeded(known, params.RemotePeer.Name, plo.maxPeers) {
+			return nil, fmt.Errorf("connecting to %s would exceed the limit of %d peers", params.RemotePeer, plo.maxPeers)
+		}
+	}
+	return plo.NetworkOverlay.PrepareConnection(params)
+}
+
+// known includes ourself, and may or may not already include the
+// remote peer, depending on how far the handshake has got.
+func peerLimitExceeded(known []mesh.PeerName, remote mesh.PeerName, maxPeers int) bool {
+	count := len(known) + 1
+	for _, name := range known {
+		if name == remote {
+			count--
+			break
+		}
+	}
+	return count > maxPeers
+}
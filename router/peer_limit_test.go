@@ -0,0 +1,17 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestPeerLimitExceeded(t *testing.T) {
+	known := []mesh.PeerName{1, 2, 3}
+	require.False(t, peerLimitExceeded(known, 4, 4))
+	require.True(t, peerLimitExceeded(known, 4, 3))
+	// reconnecting a peer we already know about doesn't grow the mesh
+	require.False(t, peerLimitExceeded(known, 3, 3))
+	require.True(t, peerLimitExceeded(known, 3, 2))
+}
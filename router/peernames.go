@@ -0,0 +1,22 @@
+package router
+
+import (
+	"github.com/weaveworks/mesh"
+)
+
+// The nicknames of the peers in the topology go into a registry shared
+// with IPAM and the rest of weave, so that everything shows the same
+// nickname for a peer. IPAM adds those of peers which have left the
+// topology but still own addresses.
+
+const topologySource = "topology"
+
+func (router *NetworkRouter) updatePeerNames() {
+	router.Peers.ForEach(func(peer *mesh.Peer) {
+		router.PeerNames.Set(topologySource, peer.Name, peer.NickName)
+	})
+}
+
+func (router *NetworkRouter) forgetPeerName(peer *mesh.Peer) {
+	router.PeerNames.Forget(topologySource, peer.Name)
+}
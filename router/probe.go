@@ -0,0 +1,132 @@
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// A probe checks the overlay data path to a peer, as distinct from
+// the TCP connection which carries control messages and gossip, so
+// that a peer we can talk to but not forward packets to stands out.
+//
+// A sleeve probe is a full-sized PMTU verification frame, sent over
+// UDP with DF set, which the peer acknowledges over TCP like any
+// other, so it needs nothing new of the peer. Its RTT is therefore
+// one way over UDP and back over TCP.
+
+const DefaultProbeTimeout = 2 * time.Second
+
+type ProbeResult struct {
+	Peer     string
+	NickName string
+	Overlay  string        `json:",omitempty"`
+	DataPath bool          // false if only the control plane works
+	RTT      time.Duration `json:",omitempty"`
+	MTU      int           `json:",omitempty"`
+	Error    string        `json:",omitempty"`
+}
+
+// A NetworkOverlay which can probe its data path to peers
+type DataPathProber interface {
+	// Probe every peer there's a data path to, waiting up to
+	// timeout for the answers.
+	ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult
+}
+
+// ProbeDataPaths probes the data path to every peer we have an
+// established connection to.
+func (router *NetworkRouter) ProbeDataPaths(timeout time.Duration) []ProbeResult {
+	var probed map[mesh.PeerName]ProbeResult
+	if prober, ok := router.Overlay.(DataPathProber); ok {
+		probed = prober.ProbeDataPaths(timeout)
+	}
+	var results []ProbeResult
+	ourself, _ := router.Topology().Peer(router.Ourself.Name.String())
+	for _, conn := range ourself.Connections {
+		if !conn.Established {
+			continue
+		}
+		name, err := mesh.PeerNameFromString(conn.Name)
+		if err != nil {
+			continue
+		}
+		result, found := probed[name]
+		if !found {
+			result.Error = "no data path"
+		}
+		result.Peer, result.NickName = conn.Name, conn.NickName
+		results = append(results, result)
+	}
+	return results
+}
+
+func (osw *OverlaySwitch) ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult {
+	results := make(map[mesh.PeerName]ProbeResult)
+	for _, name := range osw.overlayNames {
+		prober, ok := osw.overlays[name].(DataPathProber)
+		if !ok {
+			continue
+		}
+		for peer, result := range prober.ProbeDataPaths(timeout) {
+			if existing, found := results[peer]; !found || !existing.DataPath {
+				results[peer] = result
+			}
+		}
+	}
+	return results
+}
+
+func (sleeve *SleeveOverlay) ProbeDataPaths(timeout time.Duration) map[mesh.PeerName]ProbeResult {
+	sleeve.lock.Lock()
+	forwarders := make(map[mesh.PeerName]*sleeveForwarder, len(sleeve.forwarders))
+	for peer, fwd := range sleeve.forwarders {
+		forwarders[peer] = fwd
+	}
+	sleeve.lock.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	replies := make(map[mesh.PeerName]chan ProbeResult)
+	for peer, fwd := range forwarders {
+		reply := make(chan ProbeResult, 1)
+		select {
+		case fwd.probeChan <- reply:
+			replies[peer] = reply
+		case <-fwd.finishedChan:
+		}
+	}
+
+	results := make(map[mesh.PeerName]ProbeResult)
+	for peer, reply := range replies {
+		select {
+		case result := <-reply:
+			results[peer] = result
+		case <-time.After(deadline.Sub(time.Now())):
+			results[peer] = ProbeResult{Overlay: "sleeve", Error: fmt.Sprintf("no answer within %s", timeout)}
+		}
+	}
+	return results
+}
+
+// Send a probe at the current MTU. Probes already awaiting an answer
+// are answered along with this one.
+func (fwd *sleeveForwarder) sendProbe(reply chan<- ProbeResult) error {
+	if fwd.remoteAddr == nil {
+		reply <- ProbeResult{Overlay: "sleeve", Error: "peer's UDP address not known yet"}
+		return nil
+	}
+	fwd.probeReplies = append(fwd.probeReplies, reply)
+	fwd.probeSent = time.Now()
+	fwd.probeMTU = fwd.mtu
+	return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, make([]byte, fwd.probeMTU+EthernetOverhead))
+}
+
+func (fwd *sleeveForwarder) answerProbes() {
+	result := ProbeResult{Overlay: "sleeve", DataPath: true, RTT: time.Since(fwd.probeSent), MTU: fwd.probeMTU}
+	for _, reply := range fwd.probeReplies {
+		reply <- result
+	}
+	fwd.probeReplies = nil
+	fwd.probeMTU = 0
+}
@@ -0,0 +1,27 @@
+package router
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// In read-only mode the router carries on with its connections and
+// gossip, and still reconnects to the targets it has, but refuses to
+// change them or to evict peers. See also ipam's read-only mode.
+
+// ErrReadOnly is returned for changes refused in read-only mode.
+var ErrReadOnly = fmt.Errorf("router is in read-only mode")
+
+// SetReadOnly turns read-only mode on or off.
+func (router *NetworkRouter) SetReadOnly(readOnly bool) {
+	var v int32
+	if readOnly {
+		v = 1
+	}
+	atomic.StoreInt32(&router.readOnly, v)
+}
+
+// ReadOnly returns whether the router is in read-only mode.
+func (router *NetworkRouter) ReadOnly() bool {
+	return atomic.LoadInt32(&router.readOnly) != 0
+}
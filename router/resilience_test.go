@@ -0,0 +1,201 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/gossip"
+	wt "github.com/weaveworks/weave/testing"
+	"github.com/weaveworks/weave/testing/netem"
+)
+
+// These tests run two routers in-process, talking sleeve to each other
+// through netem proxies on both the TCP and the UDP path. Sleeve sends
+// DF packets on a raw socket, so they need to run as root.
+
+type nopPacketLogging struct{}
+
+func (nopPacketLogging) LogPacket(string, PacketKey)               {}
+func (nopPacketLogging) LogForwardPacket(string, ForwardPacketKey) {}
+
+type testPeer struct {
+	*NetworkRouter
+	sleeve *SleeveOverlay
+	data   *gossip.Map
+	port   int
+}
+
+// A port which is free for both TCP and UDP, since routers use the
+// same number for both.
+func freePort(t *testing.T) int {
+	for {
+		listener, err := net.Listen("tcp", ":0")
+		require.NoError(t, err)
+		port := listener.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		listener.Close()
+		if err == nil {
+			conn.Close()
+			return port
+		}
+	}
+}
+
+func startTestPeer(t *testing.T, mac string) *testPeer {
+	name, err := mesh.PeerNameFromString(mac)
+	require.NoError(t, err)
+	port := freePort(t)
+	log := common.Log.WithField("peer", mac)
+	sleeve := NewSleeveOverlay(port, DefaultEstablishTimeout, log).(*SleeveOverlay)
+	config := mesh.Config{Port: port, ConnLimit: 10, PeerDiscovery: false}
+	router := NewNetworkRouter(config, NetworkConfig{PacketLogging: nopPacketLogging{}, Log: log}, name, mac, sleeve)
+	data := gossip.NewMap(name)
+	data.SetGossip(router.NewGossip("resilience", data))
+	router.Start()
+	return &testPeer{router, sleeve, data, port}
+}
+
+func (peer *testPeer) connectedTo(other *testPeer) bool {
+	for _, status := range mesh.NewStatus(peer.Router).Peers {
+		if status.Name != peer.Ourself.Name.String() {
+			continue
+		}
+		for _, conn := range status.Connections {
+			if conn.Name == other.Ourself.Name.String() && conn.Established {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The MTU of the established sleeve connection, or 0 if there isn't
+// one yet.
+func (peer *testPeer) sleeveMTU() int {
+	for _, stats := range peer.sleeve.Diagnostics().([]SleeveConnectionStats) {
+		return stats.MTU
+	}
+	return 0
+}
+
+func converged(key string, value string, peers ...*testPeer) func() bool {
+	return func() bool {
+		for _, peer := range peers {
+			if got, found := peer.data.Get(key); !found || string(got) != value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func agreed(key string, peer1, peer2 *testPeer) func() bool {
+	return func() bool {
+		value1, found1 := peer1.data.Get(key)
+		value2, found2 := peer2.data.Get(key)
+		return found1 && found2 && string(value1) == string(value2)
+	}
+}
+
+// Start two routers, with the first connecting to the second via a
+// pair of proxies.
+func startProxiedPeers(t *testing.T) (*testPeer, *testPeer, *netem.TCPProxy, *netem.UDPProxy) {
+	if testing.Short() {
+		t.Skip("skipping router resilience test in short mode")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("router resilience tests need to run as root")
+	}
+	peer1 := startTestPeer(t, "02:00:00:00:00:01")
+	peer2 := startTestPeer(t, "02:00:00:00:00:02")
+	tcpProxy, udpProxy, err := netem.NewProxyPair(fmt.Sprintf("127.0.0.1:%d", peer2.port))
+	require.NoError(t, err)
+	return peer1, peer2, tcpProxy, udpProxy
+}
+
+func stopProxiedPeers(peer1, peer2 *testPeer, tcpProxy *netem.TCPProxy, udpProxy *netem.UDPProxy) {
+	tcpProxy.Close()
+	udpProxy.Close()
+	peer1.Stop()
+	peer2.Stop()
+}
+
+func TestReconnectAfterReset(t *testing.T) {
+	peer1, peer2, tcpProxy, udpProxy := startProxiedPeers(t)
+	defer stopProxiedPeers(peer1, peer2, tcpProxy, udpProxy)
+
+	require.Empty(t, peer1.ConnectionMaker.InitiateConnections([]string{tcpProxy.Addr()}, false))
+	wt.AssertEventually(t, 10*time.Second, func() bool { return peer1.connectedTo(peer2) && peer2.connectedTo(peer1) },
+		"connection not established")
+	require.NoError(t, peer1.data.Set("before", []byte("1")))
+	wt.AssertEventually(t, 5*time.Second, converged("before", "1", peer1, peer2), "gossip did not converge")
+
+	// Updates made while the connection is down are exchanged once
+	// it is re-established
+	tcpProxy.ResetConnections()
+	require.NoError(t, peer1.data.Set("during", []byte("1")))
+	require.NoError(t, peer2.data.Set("during", []byte("2")))
+	wt.AssertEventually(t, 30*time.Second, func() bool { return peer1.connectedTo(peer2) && peer2.connectedTo(peer1) },
+		"connection not re-established after reset")
+	wt.AssertEventually(t, 5*time.Second, agreed("during", peer1, peer2), "gossip did not converge after reset")
+}
+
+func TestEstablishDespiteLossAndLatency(t *testing.T) {
+	peer1, peer2, tcpProxy, udpProxy := startProxiedPeers(t)
+	defer stopProxiedPeers(peer1, peer2, tcpProxy, udpProxy)
+
+	tcpProxy.SetFaults(netem.Faults{Latency: 50 * time.Millisecond})
+	udpProxy.SetFaults(netem.Faults{Latency: 50 * time.Millisecond, DropRate: 0.3})
+	require.Empty(t, peer1.ConnectionMaker.InitiateConnections([]string{tcpProxy.Addr()}, false))
+	wt.AssertEventually(t, 30*time.Second, func() bool { return peer1.connectedTo(peer2) && peer2.connectedTo(peer1) },
+		"connection not established over lossy path")
+	require.NoError(t, peer2.data.Set("key", []byte("value")))
+	wt.AssertEventually(t, 5*time.Second, converged("key", "value", peer1, peer2), "gossip did not converge")
+}
+
+func TestPMTURediscoveryAfterReset(t *testing.T) {
+	peer1, peer2, tcpProxy, udpProxy := startProxiedPeers(t)
+	defer stopProxiedPeers(peer1, peer2, tcpProxy, udpProxy)
+
+	require.Empty(t, peer1.ConnectionMaker.InitiateConnections([]string{tcpProxy.Addr()}, false))
+	wt.AssertEventually(t, 10*time.Second, func() bool { return peer1.connectedTo(peer2) }, "connection not established")
+	require.True(t, peer1.sleeveMTU() > 1400)
+
+	// The path shrinks. Reconnecting must discover the new PMTU,
+	// prompted by the ICMP "fragmentation needed" from the "router"
+	// dropping the oversized PMTU discovery packet.
+	const maxDatagram = 1400
+	udpProxy.SetFaults(netem.Faults{MaxDatagram: maxDatagram, FragNeeded: true})
+	tcpProxy.ResetConnections()
+	wt.AssertEventually(t, 30*time.Second, func() bool {
+		mtu := peer1.sleeveMTU()
+		return mtu > MinMTU && mtu < maxDatagram
+	}, "PMTU not rediscovered")
+	wt.AssertEventually(t, 10*time.Second, func() bool { return peer1.connectedTo(peer2) }, "connection not re-established")
+}
+
+func TestProbeDataPath(t *testing.T) {
+	peer1, peer2, tcpProxy, udpProxy := startProxiedPeers(t)
+	defer stopProxiedPeers(peer1, peer2, tcpProxy, udpProxy)
+
+	require.Empty(t, peer1.ConnectionMaker.InitiateConnections([]string{tcpProxy.Addr()}, false))
+	wt.AssertEventually(t, 10*time.Second, func() bool { return peer1.connectedTo(peer2) && peer1.sleeveMTU() > 0 },
+		"connection not established")
+	results := peer1.ProbeDataPaths(DefaultProbeTimeout)
+	require.Len(t, results, 1)
+	require.True(t, results[0].DataPath, results[0].Error)
+	require.Equal(t, peer2.Ourself.Name.String(), results[0].Peer)
+
+	// With UDP gone, only the control plane works
+	udpProxy.SetFaults(netem.Faults{DropRate: 1})
+	results = peer1.ProbeDataPaths(100 * time.Millisecond)
+	require.Len(t, results, 1)
+	require.False(t, results[0].DataPath)
+}
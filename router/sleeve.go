@@ -6,7 +6,6 @@
 package router
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -16,9 +15,14 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/common/diagnostics"
+	"github.com/weaveworks/weave/common/supervisor"
 )
 
 // This diagram explains the various arithmetic and variables related
@@ -34,7 +38,7 @@ import (
 //
 //            <-------------------------- sleeveForwarder.maxPayload ->
 //
-// <---------->                                             UDPOverhead
+// <---------->                               UDPOverhead or UDPOverheadIPv6
 //
 //            <-------->                       Encryptor.PacketOverhead
 //
@@ -49,12 +53,18 @@ import (
 const (
 	EthernetOverhead  = 14
 	UDPOverhead       = 28 // 20 bytes for IPv4, 8 bytes for UDP
+	UDPOverheadIPv6   = 48 // 40 bytes for IPv6, 8 bytes for UDP
 	DefaultMTU        = 65535
+	MinMTU            = 552 // assumed to get through any path
 	FragTestSize      = 60001
 	PMTUDiscoverySize = 60000
 	FragTestInterval  = 5 * time.Minute
 	MTUVerifyAttempts = 8
 	MTUVerifyTimeout  = 10 * time.Millisecond // doubled with each attempt
+	// How long a new connection may take to get its UDP path working,
+	// measured from when the forwarder is created. Well under
+	// HeartbeatTimeout, so that an unusable path is retried sooner.
+	DefaultEstablishTimeout = 30 * time.Second
 
 	ProtocolConnectionEstablished = mesh.ProtocolReserved1
 	ProtocolFragmentationReceived = mesh.ProtocolReserved2
@@ -62,7 +72,9 @@ const (
 )
 
 type SleeveOverlay struct {
-	localPort int
+	localPort        int
+	establishTimeout time.Duration
+	log              *logrus.Entry
 
 	// These fields are set in StartConsumingPackets, and not
 	// subsequently modified
@@ -74,19 +86,27 @@ type SleeveOverlay struct {
 
 	lock       sync.Mutex
 	forwarders map[mesh.PeerName]*sleeveForwarder
+
+	logThrottle *common.Throttle // for errors not yet tied to a connection
 }
 
-func NewSleeveOverlay(localPort int) NetworkOverlay {
-	return &SleeveOverlay{localPort: localPort}
+// NewSleeveOverlay creates a sleeve overlay on the given UDP port.
+// Connections which have not been established within
+// establishTimeout are torn down, leaving mesh to retry them; zero
+// disables the deadline.
+func NewSleeveOverlay(localPort int, establishTimeout time.Duration, log *logrus.Entry) NetworkOverlay {
+	return &SleeveOverlay{localPort: localPort, establishTimeout: establishTimeout, log: log, logThrottle: common.NewThrottle(connLogThrottleInterval)}
 }
 
 func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *mesh.Peers, consumer OverlayConsumer) error {
-	localAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprint(":", sleeve.localPort))
+	// Where the host has IPv6, this is a dual-stack socket, which
+	// talks to peers over IPv4 and IPv6 alike
+	localAddr, err := net.ResolveUDPAddr("udp", fmt.Sprint(":", sleeve.localPort))
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.ListenUDP("udp4", localAddr)
+	conn, err := net.ListenUDP("udp", localAddr)
 	if err != nil {
 		return err
 	}
@@ -100,11 +120,23 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 	fd := int(f.Fd())
 
 	// This makes sure all packets we send out do not have DF set
-	// on them.
+	// on them, and that IPv6 ones get fragmented as necessary.
 	err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
 	if err != nil {
 		return err
 	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return err
+	}
+	_, ipv6 := sa.(*syscall.SockaddrInet6)
+	if ipv6 {
+		// The IPV6_PMTUDISC values are the same as the IP_PMTUDISC ones
+		err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IP_PMTUDISC_DONT)
+		if err != nil {
+			return err
+		}
+	}
 
 	sleeve.lock.Lock()
 	defer sleeve.lock.Unlock()
@@ -121,6 +153,10 @@ func (sleeve *SleeveOverlay) StartConsumingPackets(localPeer *mesh.Peer, peers *
 	sleeve.conn = conn
 	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
 	go sleeve.readUDP()
+	go sleeve.listenICMP("ip4:icmp", parseICMPFragNeeded)
+	if ipv6 {
+		go sleeve.listenICMP("ip6:ipv6-icmp", parseICMPv6PacketTooBig)
+	}
 	return nil
 }
 
@@ -132,12 +168,10 @@ func (*SleeveOverlay) InvalidateShortIDs() {
 	// no cached information, so nothing to do
 }
 
-func (*SleeveOverlay) AddFeaturesTo(map[string]string) {
-	// No features to be provided, to facilitate compatibility
-}
-
-func (*SleeveOverlay) Diagnostics() interface{} {
-	return nil
+func (*SleeveOverlay) AddFeaturesTo(features map[string]string) {
+	// Only sent via the OverlaySwitch; peers which predate it get
+	// nothing, to facilitate compatibility
+	features[heartbeatSeqFeature] = "1"
 }
 
 func (sleeve *SleeveOverlay) lookupForwarder(peer mesh.PeerName) *sleeveForwarder {
@@ -170,10 +204,10 @@ func (sleeve *SleeveOverlay) readUDP() {
 		if err == io.EOF {
 			return
 		} else if err != nil {
-			log.Print("ignoring UDP read error ", err)
+			sleeve.logThrottle.Logf(sleeve.log.Printf, "ignoring UDP read error %s", err)
 			continue
 		} else if n < NameSize {
-			log.Print("ignoring too short UDP packet from ", sender)
+			sleeve.logThrottle.Logf(sleeve.log.Printf, "ignoring too short UDP packet from %s", sender)
 			continue
 		}
 
@@ -205,7 +239,7 @@ func (sleeve *SleeveOverlay) readUDP() {
 			// will typically result in missed heartbeats
 			// and the connection getting shut down
 			// because of that.
-			log.Print(fwd.logPrefixFor(sender), err)
+			fwd.log.throttle.Logf(fwd.loggerFor(sender).Printf, "%s", err)
 		}
 	}
 }
@@ -299,8 +333,8 @@ func newSleeveCrypto(name []byte, sessionKey *[32]byte, outbound bool) sleeveCry
 	}
 }
 
-func (crypto sleeveCrypto) Overhead() int {
-	return UDPOverhead + crypto.EncDF.PacketOverhead() + crypto.EncDF.FrameOverhead() + EthernetOverhead
+func (crypto sleeveCrypto) Overhead(udpOverhead int) int {
+	return udpOverhead + crypto.EncDF.PacketOverhead() + crypto.EncDF.FrameOverhead() + EthernetOverhead
 }
 
 type sleeveForwarder struct {
@@ -310,12 +344,15 @@ type sleeveForwarder struct {
 	remotePeerBin  []byte
 	sendControlMsg func(byte, []byte) error
 	connUID        uint64
+	log            connLog
 
 	// Channels to communicate with the aggregator goroutine
 	aggregatorChan   chan<- aggregatorFrame
 	aggregatorDFChan chan<- aggregatorFrame
 	specialChan      chan<- specialFrame
 	controlMsgChan   chan<- controlMessage
+	pmtuHintChan     chan<- int
+	probeChan        chan<- chan<- ProbeResult
 	confirmedChan    chan<- struct{}
 	finishedChan     <-chan struct{}
 
@@ -324,8 +361,9 @@ type sleeveForwarder struct {
 	errorChan       chan error
 
 	// Explicitly locked state
-	lock       sync.RWMutex
-	remoteAddr *net.UDPAddr
+	lock          sync.RWMutex
+	remoteAddr    *net.UDPAddr
+	heartbeatLoss heartbeatLoss
 
 	// These fields are accessed and updated independently, so no
 	// locking needed.
@@ -333,9 +371,10 @@ type sleeveForwarder struct {
 	stackFrag bool
 
 	// State only used within the forwarder goroutine
-	crypto     sleeveCrypto
-	senderDF   *udpSenderDF
-	maxPayload int
+	crypto      sleeveCrypto
+	senderDF    *udpSenderDF
+	maxPayload  int
+	udpOverhead int // of the IP version we talk to the peer over
 
 	// How many bytes of overhead it takes to turn an IP packet on
 	// the overlay network into an encapsulated packet on the underlay
@@ -345,14 +384,24 @@ type sleeveForwarder struct {
 	heartbeatInterval time.Duration
 	heartbeatTimer    *time.Timer
 	heartbeatTimeout  *time.Timer
+	establishTimeout  *time.Timer
 	fragTestTicker    *time.Ticker
 	ackedHeartbeat    bool
+	heartbeatSeqs     bool // whether the peer understands them
+	heartbeatSeq      uint64
+
+	stats *sleeveStats
 
 	mtuTestTimeout *time.Timer
 	mtuTestsSent   uint
 	mtuHighestGood int
 	mtuLowestBad   int
 	mtuCandidate   int
+
+	// Data path probes awaiting an answer; see probe.go
+	probeSent    time.Time
+	probeMTU     int
+	probeReplies []chan<- ProbeResult
 }
 
 type aggregatorFrame struct {
@@ -378,6 +427,8 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 	aggDFChan := make(chan aggregatorFrame, ChannelSize)
 	specialChan := make(chan specialFrame, 1)
 	controlMsgChan := make(chan controlMessage, 1)
+	pmtuHintChan := make(chan int, 1)
+	probeChan := make(chan chan<- ProbeResult)
 	confirmedChan := make(chan struct{})
 	finishedChan := make(chan struct{})
 
@@ -387,6 +438,7 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 	}
 
 	crypto := newSleeveCrypto(sleeve.localPeer.NameByte, params.SessionKey, params.Outbound)
+	udpOverhead := udpOverheadFor(params.LocalAddr.IP)
 
 	fwd := &sleeveForwarder{
 		sleeve:           sleeve,
@@ -394,10 +446,13 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remotePeerBin:    params.RemotePeer.NameByte,
 		sendControlMsg:   params.SendControlMessage,
 		connUID:          params.ConnUID,
+		log:              newConnLog(sleeve.log, "sleeve", params),
 		aggregatorChan:   aggChan,
 		aggregatorDFChan: aggDFChan,
 		specialChan:      specialChan,
 		controlMsgChan:   controlMsgChan,
+		pmtuHintChan:     pmtuHintChan,
+		probeChan:        probeChan,
 		confirmedChan:    confirmedChan,
 		finishedChan:     finishedChan,
 		establishedChan:  make(chan struct{}),
@@ -405,28 +460,53 @@ func (sleeve *SleeveOverlay) PrepareConnection(params mesh.OverlayConnectionPara
 		remoteAddr:       remoteAddr,
 		mtu:              DefaultMTU,
 		crypto:           crypto,
-		maxPayload:       DefaultMTU - UDPOverhead,
-		overheadDF:       crypto.Overhead(),
-		senderDF:         newUDPSenderDF(params.LocalAddr.IP, sleeve.localPort),
+		maxPayload:       DefaultMTU - udpOverhead,
+		udpOverhead:      udpOverhead,
+		overheadDF:       crypto.Overhead(udpOverhead),
+		senderDF:         newUDPSenderDF(params.LocalAddr.IP, sleeve.localPort, sleeve.log),
+		heartbeatSeqs:    params.Features[heartbeatSeqFeature] != "",
+		stats:            newSleeveStats(),
+	}
+	if sleeve.establishTimeout > 0 {
+		fwd.establishTimeout = time.NewTimer(sleeve.establishTimeout)
 	}
 
-	go fwd.run(aggChan, aggDFChan, specialChan, controlMsgChan, confirmedChan, finishedChan)
+	fwd.registerQueues()
+	go fwd.run(aggChan, aggDFChan, specialChan, controlMsgChan, pmtuHintChan, probeChan, confirmedChan, finishedChan)
 	return fwd, nil
 }
 
-func (fwd *sleeveForwarder) logPrefixFor(sender *net.UDPAddr) string {
-	return fmt.Sprintf("sleeve ->[%s|%s]: ", sender, fwd.remotePeer)
+// The frames waiting to be sent on the connection are reported by
+// the diagnostics endpoint while the forwarder runs
+func (fwd *sleeveForwarder) queueName(kind string) string {
+	return fmt.Sprintf("sleeve %s conn %d %s", fwd.remotePeer, fwd.connUID, kind)
+}
+
+func (fwd *sleeveForwarder) registerQueues() {
+	for kind, ch := range map[string]chan<- aggregatorFrame{"frames": fwd.aggregatorChan, "DF frames": fwd.aggregatorDFChan} {
+		ch := ch
+		diagnostics.RegisterQueue(fwd.queueName(kind), func() int { return len(ch) }, func() int { return cap(ch) })
+	}
+}
+
+func (fwd *sleeveForwarder) unregisterQueues() {
+	diagnostics.UnregisterQueue(fwd.queueName("frames"))
+	diagnostics.UnregisterQueue(fwd.queueName("DF frames"))
+}
+
+func (fwd *sleeveForwarder) loggerFor(sender *net.UDPAddr) *logrus.Entry {
+	return fwd.log.entry().WithField("addr", sender)
 }
 
-func (fwd *sleeveForwarder) logPrefix() string {
+func (fwd *sleeveForwarder) logger() *logrus.Entry {
 	fwd.lock.RLock()
 	remoteAddr := fwd.remoteAddr
 	fwd.lock.RUnlock()
-	return fwd.logPrefixFor(remoteAddr)
+	return fwd.loggerFor(remoteAddr)
 }
 
 func (fwd *sleeveForwarder) Confirm() {
-	log.Debug(fwd.logPrefix(), "Confirm")
+	fwd.logger().Debug("Confirm")
 	select {
 	case fwd.confirmedChan <- struct{}{}:
 	case <-fwd.finishedChan:
@@ -460,12 +540,13 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	fwd.lock.RUnlock()
 
 	if !haveContact {
-		log.Print(fwd.logPrefix(), "Cannot forward frame yet - awaiting contact")
+		fwd.logger().Print("Cannot forward frame yet - awaiting contact")
 		return
 	}
 
 	srcName := f.key.SrcPeer.NameByte
 	dstName := f.key.DstPeer.NameByte
+	fwd.stats.recordFrame(len(frame))
 
 	// We could use non-blocking channel sends here, i.e. drop frames
 	// on the floor when the forwarder is busy. This would allow our
@@ -489,26 +570,36 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 		// non-broadcast frames can be broadcast, if the
 		// destination MAC was not in our MAC cache.
 		if broadcast {
-			log.Print(fwd.logPrefix(), "dropping too big DF broadcast frame (", dec.IP.SrcIP, " -> ", dec.IP.DstIP, "): MTU=", mtu)
+			count(&fwd.stats.tooBigDropped)
+			srcIP, dstIP := dec.IPs()
+			fwd.logger().Print("dropping too big DF broadcast frame (", srcIP, " -> ", dstIP, "): MTU=", mtu)
 			return
 		}
 
 		// Send an ICMP back to where the frame came from
 		fragNeededPacket, err := dec.makeICMPFragNeeded(mtu)
 		if err != nil {
-			log.Print(fwd.logPrefix(), err)
+			fwd.logger().Print(err)
 			return
 		}
+		srcIP, dstIP := dec.IPs()
+		kind := "ICMP 3,4"
+		if dec.IsIPv6() {
+			kind = "ICMPv6 2,0"
+		}
+		fwd.logger().Printf("Sending %s (%v -> %v): PMTU=%v", kind, dstIP, srcIP, mtu)
+		count(&fwd.stats.fragNeededSent)
 
 		dec.DecodeLayers(fragNeededPacket)
 
-		// The frag-needed packet does not have DF set, so the
-		// potential recursion here is bounded.
+		// The frag-needed packet does not have DF set, and the
+		// IPv6 packet-too-big is no bigger than the smallest
+		// MTU, so the potential recursion here is bounded.
 		fwd.sleeve.sendToConsumer(f.key.DstPeer, f.key.SrcPeer, fragNeededPacket, dec)
 		return
 	}
 
-	if stackFrag || len(dec.decoded) < 2 {
+	if stackFrag || !dec.IsIPv4() {
 		fwd.aggregate(fwd.aggregatorChan, srcName, dstName, frame)
 		return
 	}
@@ -523,8 +614,10 @@ func (f curriedForward) Process(frame []byte, dec *EthernetDecoder, broadcast bo
 	// We can't trust the stack to fragment, we have IP, and we
 	// have a frame that's too big for the MTU, so we have to
 	// fragment it ourself.
-	checkWarn(fragment(dec.Eth, dec.IP, mtu,
+	count(&fwd.stats.fragmented)
+	checkWarn(fwd.logger(), fragment(dec.Eth, dec.IP, mtu,
 		func(segFrame []byte) {
+			count(&fwd.stats.fragments)
 			fwd.aggregate(fwd.aggregatorDFChan, srcName, dstName, segFrame)
 		}))
 }
@@ -621,16 +714,20 @@ func (fwd *sleeveForwarder) run(aggChan <-chan aggregatorFrame,
 	aggDFChan <-chan aggregatorFrame,
 	specialChan <-chan specialFrame,
 	controlMsgChan <-chan controlMessage,
+	pmtuHintChan <-chan int,
+	probeChan <-chan chan<- ProbeResult,
 	confirmedChan <-chan struct{},
 	finishedChan chan<- struct{}) {
 	defer close(finishedChan)
+	defer fwd.unregisterQueues()
+	defer supervisor.Recover("sleeve forwarder")
 
 	var err error
 loop:
 	for err == nil {
 		select {
 		case frame := <-aggChan:
-			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-UDPOverhead)
+			err = fwd.aggregateAndSend(frame, aggChan, fwd.crypto.Enc, fwd.sleeve, MaxUDPPacketSize-fwd.udpOverhead)
 
 		case frame := <-aggDFChan:
 			err = fwd.aggregateAndSend(frame, aggDFChan, fwd.crypto.EncDF, fwd.senderDF, fwd.maxPayload)
@@ -641,6 +738,12 @@ loop:
 		case cm := <-controlMsgChan:
 			err = fwd.handleControlMessage(cm)
 
+		case pmtu := <-pmtuHintChan:
+			err = fwd.handlePMTUHint(pmtu)
+
+		case reply := <-probeChan:
+			err = fwd.sendProbe(reply)
+
 		case _, ok := <-confirmedChan:
 			if !ok {
 				// confirmedChan is closed to indicate
@@ -656,6 +759,9 @@ loop:
 		case <-timerChan(fwd.heartbeatTimeout):
 			err = fmt.Errorf("timed out waiting for UDP heartbeat")
 
+		case <-timerChan(fwd.establishTimeout):
+			err = fmt.Errorf("timed out waiting for connection to be established")
+
 		case <-tickerChan(fwd.fragTestTicker):
 			err = fwd.sendFragTest()
 
@@ -670,6 +776,9 @@ loop:
 	if fwd.heartbeatTimeout != nil {
 		fwd.heartbeatTimeout.Stop()
 	}
+	if fwd.establishTimeout != nil {
+		fwd.establishTimeout.Stop()
+	}
 	if fwd.fragTestTicker != nil {
 		fwd.fragTestTicker.Stop()
 	}
@@ -677,12 +786,13 @@ loop:
 		fwd.mtuTestTimeout.Stop()
 	}
 
-	checkWarn(fwd.senderDF.close())
+	checkWarn(fwd.logger(), fwd.senderDF.close())
 
 	fwd.lock.RLock()
 	defer fwd.lock.RUnlock()
 
 	// this is the only place we send an error to errorChan
+	fwd.log.record(err)
 	fwd.errorChan <- err
 }
 
@@ -694,7 +804,8 @@ func (fwd *sleeveForwarder) aggregateAndSend(frame aggregatorFrame, aggChan <-ch
 	for {
 		// Adding the first frame to an empty buffer
 		if !fits(frame, enc, limit) {
-			log.Print(fwd.logPrefix(), "Dropping too big frame during forwarding: frame len ", len(frame.frame), ", limit ", limit)
+			count(&fwd.stats.tooBigDropped)
+			fwd.logger().Print("Dropping too big frame during forwarding: frame len ", len(frame.frame), ", limit ", limit)
 			return nil
 		}
 
@@ -753,7 +864,7 @@ func (fwd *sleeveForwarder) sendSpecial(enc Encryptor, sender udpSender, data []
 func (fwd *sleeveForwarder) handleSpecialFrame(special specialFrame) error {
 	// The special frame types are distinguished by length
 	switch len(special.frame) {
-	case EthernetOverhead + 8:
+	case EthernetOverhead + 8, EthernetOverhead + 16:
 		return fwd.handleHeartbeat(special)
 
 	case FragTestSize:
@@ -776,13 +887,13 @@ func (fwd *sleeveForwarder) handleControlMessage(cm controlMessage) error {
 		return fwd.handleMTUTestAck(cm.msg)
 
 	default:
-		log.Print(fwd.logPrefix(), "Ignoring unknown control message tag: ", cm.tag)
+		fwd.logger().Print("Ignoring unknown control message tag: ", cm.tag)
 		return nil
 	}
 }
 
 func (fwd *sleeveForwarder) confirmed() error {
-	log.Debug(fwd.logPrefix(), "confirmed")
+	fwd.logger().Debug("confirmed")
 
 	if fwd.heartbeatInterval != 0 {
 		// already confirmed
@@ -808,14 +919,19 @@ func (fwd *sleeveForwarder) confirmed() error {
 }
 
 func (fwd *sleeveForwarder) sendHeartbeat() error {
-	log.Debug(fwd.logPrefix(), "sendHeartbeat")
+	fwd.logger().Debug("sendHeartbeat")
 
 	// Prime the timer for the next heartbeat.  We don't use a
 	// ticker because the interval is not constant.
 	fwd.heartbeatTimer = setTimer(fwd.heartbeatTimer, fwd.heartbeatInterval)
 
-	buf := make([]byte, EthernetOverhead+8)
+	buf := make([]byte, EthernetOverhead+8, EthernetOverhead+16)
 	binary.BigEndian.PutUint64(buf[EthernetOverhead:], fwd.connUID)
+	if fwd.heartbeatSeqs {
+		fwd.heartbeatSeq++
+		buf = buf[:EthernetOverhead+16]
+		binary.BigEndian.PutUint64(buf[EthernetOverhead+8:], fwd.heartbeatSeq)
+	}
 	return fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, buf)
 }
 
@@ -825,7 +941,13 @@ func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 		return nil
 	}
 
-	log.Debug(fwd.logPrefix(), "handleHeartbeat")
+	fwd.logger().Debug("handleHeartbeat")
+
+	if len(special.frame) == EthernetOverhead+16 {
+		fwd.lock.Lock()
+		fwd.heartbeatLoss.seen(binary.BigEndian.Uint64(special.frame[EthernetOverhead+8:]))
+		fwd.lock.Unlock()
+	}
 
 	if fwd.remoteAddr == nil {
 		fwd.setRemoteAddr(special.sender)
@@ -835,7 +957,7 @@ func (fwd *sleeveForwarder) handleHeartbeat(special specialFrame) error {
 			}
 		}
 	} else if !udpAddrsEqual(fwd.remoteAddr, special.sender) {
-		log.Print(fwd.logPrefix(), "Peer UDP address changed to ", special.sender)
+		fwd.logger().Print("Peer UDP address changed to ", special.sender)
 		fwd.setRemoteAddr(special.sender)
 	}
 
@@ -866,16 +988,20 @@ func (fwd *sleeveForwarder) setRemoteAddr(addr *net.UDPAddr) {
 }
 
 func (fwd *sleeveForwarder) handleHeartbeatAck() error {
-	log.Debug(fwd.logPrefix(), "handleHeartbeatAck")
+	fwd.logger().Debug("handleHeartbeatAck")
 
-	if fwd.heartbeatInterval != SlowHeartbeat {
-		fwd.heartbeatInterval = SlowHeartbeat
+	if fwd.heartbeatInterval <= FastHeartbeat {
+		fwd.heartbeatInterval = slowHeartbeat()
 		if fwd.heartbeatTimer != nil {
 			fwd.heartbeatTimer.Reset(fwd.heartbeatInterval)
 		}
 
 		// The connection is now regarded as established
 		close(fwd.establishedChan)
+		if fwd.establishTimeout != nil {
+			fwd.establishTimeout.Stop()
+			fwd.establishTimeout = nil
+		}
 	}
 
 	fwd.fragTestTicker = time.NewTicker(FragTestInterval)
@@ -890,7 +1016,7 @@ func (fwd *sleeveForwarder) handleHeartbeatAck() error {
 }
 
 func (fwd *sleeveForwarder) sendFragTest() error {
-	log.Debug(fwd.logPrefix(), "sendFragTest")
+	fwd.logger().Debug("sendFragTest")
 	fwd.stackFrag = false
 	return fwd.sendSpecial(fwd.crypto.Enc, fwd.sleeve, make([]byte, FragTestSize))
 }
@@ -904,7 +1030,7 @@ func (fwd *sleeveForwarder) handleFragTest(frame []byte) error {
 }
 
 func (fwd *sleeveForwarder) handleFragTestAck() error {
-	log.Debug(fwd.logPrefix(), "handleFragTestAck")
+	fwd.logger().Debug("handleFragTestAck")
 	fwd.stackFrag = true
 	return nil
 }
@@ -916,11 +1042,12 @@ func (fwd *sleeveForwarder) processSendError(err error) error {
 			return nil
 		}
 
-		fwd.mtuHighestGood = 552
+		count(&fwd.stats.pmtuDiscoveries)
+		fwd.mtuHighestGood = MinMTU
 		fwd.mtuLowestBad = mtu + 1
 		fwd.mtuCandidate = mtu
 		fwd.mtuTestsSent = 0
-		fwd.maxPayload = mtbe.underlayPMTU - UDPOverhead
+		fwd.maxPayload = mtbe.underlayPMTU - fwd.udpOverhead
 		fwd.mtu = mtu
 		return fwd.sendMTUTest()
 	}
@@ -929,7 +1056,7 @@ func (fwd *sleeveForwarder) processSendError(err error) error {
 }
 
 func (fwd *sleeveForwarder) sendMTUTest() error {
-	log.Debug(fwd.logPrefix(), "sendMTUTest: mtu candidate ", fwd.mtuCandidate)
+	fwd.logger().Debug("sendMTUTest: mtu candidate ", fwd.mtuCandidate)
 
 	err := fwd.sendSpecial(fwd.crypto.EncDF, fwd.senderDF, make([]byte, fwd.mtuCandidate+EthernetOverhead))
 	if err != nil {
@@ -949,12 +1076,15 @@ func (fwd *sleeveForwarder) handleMTUTest(frame []byte) error {
 
 func (fwd *sleeveForwarder) handleMTUTestAck(msg []byte) error {
 	if len(msg) < 2 {
-		log.Print(fwd.logPrefix(), "Received truncated MTUTestAck")
+		fwd.logger().Print("Received truncated MTUTestAck")
 		return nil
 	}
 
 	mtu := int(binary.BigEndian.Uint16(msg))
-	log.Debug(fwd.logPrefix(), "handleMTUTestAck: for mtu candidate ", mtu)
+	fwd.logger().Debug("handleMTUTestAck: for mtu candidate ", mtu)
+	if mtu == fwd.probeMTU {
+		fwd.answerProbes()
+	}
 	if mtu != fwd.mtuCandidate {
 		return nil
 	}
@@ -968,17 +1098,17 @@ func (fwd *sleeveForwarder) handleMTUTestFailure() error {
 		return fwd.sendMTUTest()
 	}
 
-	log.Debug(fwd.logPrefix(), "handleMTUTestFailure")
+	fwd.logger().Debug("handleMTUTestFailure")
 	fwd.mtuLowestBad = fwd.mtuCandidate
 	return fwd.searchMTU()
 }
 
 func (fwd *sleeveForwarder) searchMTU() error {
-	log.Debug(fwd.logPrefix(), "searchMTU: ", fwd.mtuHighestGood, fwd.mtuLowestBad)
+	fwd.logger().Debug("searchMTU: ", fwd.mtuHighestGood, fwd.mtuLowestBad)
 
 	if fwd.mtuHighestGood+1 >= fwd.mtuLowestBad {
 		mtu := fwd.mtuHighestGood
-		log.Print(fwd.logPrefix(), "Effective MTU verified at ", mtu)
+		fwd.logger().Print("Effective MTU verified at ", mtu)
 
 		if fwd.mtuTestTimeout != nil {
 			fwd.mtuTestTimeout.Stop()
@@ -986,7 +1116,7 @@ func (fwd *sleeveForwarder) searchMTU() error {
 		}
 
 		fwd.mtuCandidate = 0
-		fwd.maxPayload = mtu + fwd.overheadDF - UDPOverhead
+		fwd.maxPayload = mtu + fwd.overheadDF - fwd.udpOverhead
 		fwd.mtu = mtu
 		return nil
 	}
@@ -1002,19 +1132,22 @@ type udpSenderDF struct {
 	udpHeader *layers.UDP
 	localIP   net.IP
 	remoteIP  net.IP
+	ipv6      bool // whether remoteIP is
 	socket    *net.IPConn
+	log       *logrus.Entry
 }
 
-func newUDPSenderDF(localIP net.IP, localPort int) *udpSenderDF {
+func newUDPSenderDF(localIP net.IP, localPort int, log *logrus.Entry) *udpSenderDF {
 	return &udpSenderDF{
+		log:   log,
 		ipBuf: gopacket.NewSerializeBuffer(),
 		opts: gopacket.SerializeOptions{
 			FixLengths: true,
 			// UDP header is calculated with a phantom IP
 			// header. Yes, it's totally nuts. Thankfully,
 			// for UDP over IPv4, the checksum is
-			// optional. It's not optional for IPv6, but
-			// we'll ignore that for now. TODO
+			// optional. It's not optional for IPv6, so
+			// dial turns it on for that.
 			ComputeChecksums: false,
 		},
 		udpHeader: &layers.UDP{SrcPort: layers.UDPPort(localPort)},
@@ -1033,7 +1166,24 @@ func (sender *udpSenderDF) dial() error {
 
 	laddr := &net.IPAddr{IP: sender.localIP}
 	raddr := &net.IPAddr{IP: sender.remoteIP}
-	s, err := net.DialIP("ip4:UDP", laddr, raddr)
+	network, level, option := "ip4:UDP", syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER
+	sender.ipv6 = sender.remoteIP.To4() == nil
+	sender.opts.ComputeChecksums = sender.ipv6
+	if sender.ipv6 {
+		network, level, option = "ip6:UDP", syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER
+		err := sender.udpHeader.SetNetworkLayerForChecksum(&layers.IPv6{
+			SrcIP:      sender.localIP,
+			DstIP:      sender.remoteIP,
+			NextHeader: layers.IPProtocolUDP,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	s, err := net.DialIP(network, laddr, raddr)
+	if err != nil {
+		return err
+	}
 
 	f, err := s.File()
 	if err != nil {
@@ -1042,8 +1192,9 @@ func (sender *udpSenderDF) dial() error {
 
 	defer f.Close()
 
-	// This makes sure all packets we send out have DF set on them.
-	err = syscall.SetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+	// This makes sure all packets we send out have DF set on them,
+	// or for IPv6 are never fragmented by us.
+	err = syscall.SetsockoptInt(int(f.Fd()), level, option, syscall.IP_PMTUDISC_DO)
 	if err != nil {
 		return err
 	}
@@ -1054,7 +1205,7 @@ func (sender *udpSenderDF) dial() error {
 
 func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
 	// Ensure we have a socket sending to the right IP address
-	if sender.socket == nil || !bytes.Equal(sender.remoteIP, raddr.IP) {
+	if sender.socket == nil || !sender.remoteIP.Equal(raddr.IP) {
 		sender.remoteIP = raddr.IP
 		if err := sender.dial(); err != nil {
 			return err
@@ -1080,8 +1231,12 @@ func (sender *udpSenderDF) send(msg []byte, raddr *net.UDPAddr) error {
 	}
 	defer f.Close()
 
-	log.Print("EMSGSIZE on send, expecting PMTU update (IP packet was ", len(packet), " bytes, payload was ", len(msg), " bytes)")
-	pmtu, err := syscall.GetsockoptInt(int(f.Fd()), syscall.IPPROTO_IP, syscall.IP_MTU)
+	sender.log.Print("EMSGSIZE on send, expecting PMTU update (IP packet was ", len(packet), " bytes, payload was ", len(msg), " bytes)")
+	level, option := syscall.IPPROTO_IP, syscall.IP_MTU
+	if sender.ipv6 {
+		level, option = syscall.IPPROTO_IPV6, syscall.IPV6_MTU
+	}
+	pmtu, err := syscall.GetsockoptInt(int(f.Fd()), level, option)
 	if err != nil {
 		return err
 	}
@@ -1105,8 +1260,17 @@ func (sender *udpSenderDF) close() error {
 	return sender.socket.Close()
 }
 
+// A dual-stack socket gives IPv4 addresses in their IPv6 form, so
+// they are compared with Equal, which knows both forms.
 func udpAddrsEqual(a *net.UDPAddr, b *net.UDPAddr) bool {
-	return bytes.Equal(a.IP, b.IP) && a.Port == b.Port && a.Zone == b.Zone
+	return a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
+
+func udpOverheadFor(ip net.IP) int {
+	if ip.To4() == nil {
+		return UDPOverheadIPv6
+	}
+	return UDPOverhead
 }
 
 func allZeros(s []byte) bool {
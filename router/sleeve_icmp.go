@@ -0,0 +1,128 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	icmpDestUnreachable = 3
+	icmpFragNeeded      = 4
+	icmpv6TooBig        = 2
+	ipProtoUDP          = 17
+)
+
+type icmpParser func(msg []byte) (raddr *net.UDPAddr, srcPort int, pmtu int, ok bool)
+
+// Routers along the path tell us about a reduced path MTU by sending
+// an ICMP "fragmentation needed" message in response to one of our DF
+// packets, or for IPv6, where every packet is DF, a "packet too big".
+// Listening for these lets us restart PMTU discovery as soon as the
+// path changes, instead of waiting for the next EMSGSIZE.
+func (sleeve *SleeveOverlay) listenICMP(network string, parse icmpParser) {
+	conn, err := net.ListenIP(network, nil)
+	if err != nil {
+		sleeve.log.Print("Unable to listen for ICMP; relying on probes alone for PMTU discovery: ", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, MaxUDPPacketSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			sleeve.log.Print("ICMP read error, no longer listening: ", err)
+			return
+		}
+		raddr, srcPort, pmtu, ok := parse(buf[:n])
+		if !ok || srcPort != sleeve.localPort {
+			continue
+		}
+		if fwd := sleeve.lookupForwarderByAddr(raddr); fwd != nil {
+			fwd.pmtuHint(pmtu)
+		}
+	}
+}
+
+// parseICMPFragNeeded extracts the destination of the offending UDP
+// packet, its source port, and the next-hop MTU from an ICMPv4
+// message (without IP header). ok is false for anything else,
+// including messages from routers too old to report an MTU.
+func parseICMPFragNeeded(msg []byte) (raddr *net.UDPAddr, srcPort int, pmtu int, ok bool) {
+	if len(msg) < 8 || msg[0] != icmpDestUnreachable || msg[1] != icmpFragNeeded {
+		return nil, 0, 0, false
+	}
+	pmtu = int(binary.BigEndian.Uint16(msg[6:8]))
+	orig := msg[8:]
+	if pmtu == 0 || len(orig) < 20 || orig[0]>>4 != 4 || orig[9] != ipProtoUDP {
+		return nil, 0, 0, false
+	}
+	ihl := int(orig[0]&0x0f) * 4
+	if len(orig) < ihl+8 {
+		return nil, 0, 0, false
+	}
+	udp := orig[ihl:]
+	raddr = &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), orig[16:20]...)),
+		Port: int(binary.BigEndian.Uint16(udp[2:4])),
+	}
+	return raddr, int(binary.BigEndian.Uint16(udp[0:2])), pmtu, true
+}
+
+// parseICMPv6PacketTooBig is parseICMPFragNeeded for an ICMPv6
+// "packet too big" message. We don't send packets with extension
+// headers, so UDP follows the IPv6 header directly in ours.
+func parseICMPv6PacketTooBig(msg []byte) (raddr *net.UDPAddr, srcPort int, pmtu int, ok bool) {
+	if len(msg) < 8 || msg[0] != icmpv6TooBig || msg[1] != 0 {
+		return nil, 0, 0, false
+	}
+	pmtu = int(binary.BigEndian.Uint32(msg[4:8]))
+	orig := msg[8:]
+	if pmtu == 0 || len(orig) < 40+8 || orig[0]>>4 != 6 || orig[6] != ipProtoUDP {
+		return nil, 0, 0, false
+	}
+	udp := orig[40:]
+	raddr = &net.UDPAddr{
+		IP:   net.IP(append([]byte(nil), orig[24:40]...)),
+		Port: int(binary.BigEndian.Uint16(udp[2:4])),
+	}
+	return raddr, int(binary.BigEndian.Uint16(udp[0:2])), pmtu, true
+}
+
+func (sleeve *SleeveOverlay) lookupForwarderByAddr(raddr *net.UDPAddr) *sleeveForwarder {
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+	for _, fwd := range sleeve.forwarders {
+		fwd.lock.RLock()
+		match := fwd.remoteAddr != nil && udpAddrsEqual(fwd.remoteAddr, raddr)
+		fwd.lock.RUnlock()
+		if match {
+			return fwd
+		}
+	}
+	return nil
+}
+
+// pmtuHint passes an underlay PMTU reported via ICMP to the forwarder
+// goroutine. Hints are dropped if one is already pending.
+func (fwd *sleeveForwarder) pmtuHint(pmtu int) {
+	select {
+	case fwd.pmtuHintChan <- pmtu:
+	default:
+	}
+}
+
+func (fwd *sleeveForwarder) handlePMTUHint(pmtu int) error {
+	mtu := pmtu - fwd.overheadDF
+	if mtu >= fwd.mtu {
+		return nil
+	}
+	// Unlike the kernel's EMSGSIZE, which never reports a PMTU below
+	// its own floor, ICMP can claim anything, and can be spoofed.
+	if mtu < MinMTU {
+		fwd.logger().Print("Ignoring ICMP report of implausibly small path MTU ", pmtu)
+		return nil
+	}
+	fwd.logger().Print("ICMP reports reduced path MTU ", pmtu)
+	return fwd.processSendError(msgTooBigError{underlayPMTU: pmtu})
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// An ICMP fragmentation-needed message quoting a UDP packet from
+// srcPort to dst, with the quoted IP header ihl words long.
+func makeFragNeeded(pmtu int, dst *net.UDPAddr, srcPort int, ihl int) []byte {
+	msg := make([]byte, 8+ihl*4+8)
+	msg[0], msg[1] = icmpDestUnreachable, icmpFragNeeded
+	binary.BigEndian.PutUint16(msg[6:8], uint16(pmtu))
+	ip := msg[8:]
+	ip[0] = 0x40 | byte(ihl)
+	ip[9] = ipProtoUDP
+	copy(ip[16:20], dst.IP.To4())
+	udp := ip[ihl*4:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	return msg
+}
+
+func TestParseICMPFragNeeded(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 6783}
+	valid := makeFragNeeded(1400, dst, 6783, 5)
+
+	modified := func(f func(msg []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"with IP options", makeFragNeeded(1400, dst, 6783, 6), true},
+		{"empty", nil, false},
+		{"short ICMP header", valid[:7], false},
+		{"wrong type", modified(func(msg []byte) []byte { msg[0] = 11; return msg }), false},
+		{"wrong code", modified(func(msg []byte) []byte { msg[1] = 1; return msg }), false},
+		{"no MTU reported", modified(func(msg []byte) []byte { msg[6], msg[7] = 0, 0; return msg }), false},
+		{"short IP header", valid[:8+19], false},
+		{"not IPv4", modified(func(msg []byte) []byte { msg[8] = 0x65; return msg }), false},
+		{"not UDP", modified(func(msg []byte) []byte { msg[8+9] = 6; return msg }), false},
+		{"short UDP header", valid[:len(valid)-1], false},
+		{"options truncate UDP header", makeFragNeeded(1400, dst, 6783, 6)[:8+20+8], false},
+	} {
+		raddr, srcPort, pmtu, ok := parseICMPFragNeeded(tc.msg)
+		require.Equal(t, tc.ok, ok, tc.name)
+		if ok {
+			require.Equal(t, dst.String(), raddr.String(), tc.name)
+			require.Equal(t, 6783, srcPort, tc.name)
+			require.Equal(t, 1400, pmtu, tc.name)
+		}
+	}
+}
+
+func makePacketTooBig(pmtu int, dst *net.UDPAddr, srcPort int) []byte {
+	msg := make([]byte, 8+40+8)
+	msg[0] = icmpv6TooBig
+	binary.BigEndian.PutUint32(msg[4:8], uint32(pmtu))
+	ip := msg[8:]
+	ip[0] = 0x60
+	ip[6] = ipProtoUDP
+	copy(ip[24:40], dst.IP.To16())
+	udp := ip[40:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(srcPort))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	return msg
+}
+
+func TestParseICMPv6PacketTooBig(t *testing.T) {
+	dst := &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 6783}
+	valid := makePacketTooBig(1400, dst, 6783)
+
+	modified := func(f func(msg []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"empty", nil, false},
+		{"wrong type", modified(func(msg []byte) []byte { msg[0] = 1; return msg }), false},
+		{"wrong code", modified(func(msg []byte) []byte { msg[1] = 1; return msg }), false},
+		{"no MTU reported", modified(func(msg []byte) []byte { msg[6], msg[7] = 0, 0; return msg }), false},
+		{"not IPv6", modified(func(msg []byte) []byte { msg[8] = 0x45; return msg }), false},
+		{"not UDP", modified(func(msg []byte) []byte { msg[8+6] = 6; return msg }), false},
+		{"short UDP header", valid[:len(valid)-1], false},
+	} {
+		raddr, srcPort, pmtu, ok := parseICMPv6PacketTooBig(tc.msg)
+		require.Equal(t, tc.ok, ok, tc.name)
+		if ok {
+			require.Equal(t, dst.String(), raddr.String(), tc.name)
+			require.Equal(t, 6783, srcPort, tc.name)
+			require.Equal(t, 1400, pmtu, tc.name)
+		}
+	}
+}
+
+func TestUDPAddrsEqual(t *testing.T) {
+	// A dual-stack socket reports IPv4 senders in IPv6 form
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To4(), Port: 6783}
+	mapped := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2).To16(), Port: 6783}
+	require.True(t, udpAddrsEqual(v4, mapped))
+	require.False(t, udpAddrsEqual(v4, &net.UDPAddr{IP: v4.IP, Port: 6784}))
+	require.False(t, udpAddrsEqual(mapped, &net.UDPAddr{IP: net.ParseIP("fd00::2"), Port: 6783}))
+	require.Equal(t, UDPOverhead, udpOverheadFor(mapped.IP))
+	require.Equal(t, UDPOverheadIPv6, udpOverheadFor(net.ParseIP("fd00::2")))
+}
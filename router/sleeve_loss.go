@@ -0,0 +1,41 @@
+package router
+
+import (
+	"math"
+)
+
+// Sleeve heartbeats carry a sequence number, as well as the
+// connection's UID, when the peer says in the handshake that it
+// understands them; peers which don't would take the longer frame for
+// a PMTU test. The receiver estimates the loss on the UDP path from
+// the gaps in the sequence. Heartbeats are infrequent once the
+// connection is established, so the estimate follows changes in loss
+// over minutes rather than seconds.
+
+const heartbeatSeqFeature = "SleeveHeartbeatSeq"
+
+// How much each heartbeat counts for in the estimate
+const heartbeatLossWeight = 1.0 / 16
+
+type heartbeatLoss struct {
+	lastSeq uint64
+	missed  uint64
+	loss    float64 // exponentially weighted fraction of heartbeats missed
+}
+
+// seen records the arrival of heartbeat seq. The estimate starts from
+// the first one seen, since those sent before the peer knew our
+// address were bound to be lost, and heartbeats arriving out of order
+// are ignored.
+func (hl *heartbeatLoss) seen(seq uint64) {
+	if seq <= hl.lastSeq {
+		return
+	}
+	if hl.lastSeq > 0 {
+		missed := seq - hl.lastSeq - 1
+		hl.missed += missed
+		hl.loss = 1 - (1-hl.loss)*math.Pow(1-heartbeatLossWeight, float64(missed))
+		hl.loss *= 1 - heartbeatLossWeight
+	}
+	hl.lastSeq = seq
+}
@@ -0,0 +1,33 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatLoss(t *testing.T) {
+	var hl heartbeatLoss
+	hl.seen(5) // the first
+	for seq := uint64(6); seq < 50; seq++ {
+		hl.seen(seq)
+	}
+	require.Equal(t, uint64(0), hl.missed)
+	require.Equal(t, 0.0, hl.loss)
+
+	// every other one lost
+	for seq := uint64(51); seq < 500; seq += 2 {
+		hl.seen(seq)
+	}
+	require.Equal(t, uint64(225), hl.missed)
+	require.InDelta(t, 0.5, hl.loss, 0.05)
+
+	hl.seen(300) // late
+	require.Equal(t, uint64(499), hl.lastSeq)
+
+	// and recovering
+	for seq := uint64(500); seq < 600; seq++ {
+		hl.seen(seq)
+	}
+	require.InDelta(t, 0, hl.loss, 0.01)
+}
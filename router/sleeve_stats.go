@@ -0,0 +1,97 @@
+package router
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Upper bounds of the frame size histogram buckets
+var frameSizeBuckets = []int{128, 256, 512, 1024, 1514, 9014, MaxUDPPacketSize}
+
+// Per-connection counters, updated atomically since frames are
+// forwarded from the capture goroutines as well as the forwarder's
+// own.
+type sleeveStats struct {
+	// 64-bit counters first, for alignment on 32-bit platforms
+	fragmented      uint64
+	fragments       uint64
+	tooBigDropped   uint64
+	fragNeededSent  uint64
+	pmtuDiscoveries uint64
+	frameSizes      []uint64
+}
+
+func newSleeveStats() *sleeveStats {
+	return &sleeveStats{frameSizes: make([]uint64, len(frameSizeBuckets)+1)}
+}
+
+func (stats *sleeveStats) recordFrame(size int) {
+	i := 0
+	for i < len(frameSizeBuckets) && size > frameSizeBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&stats.frameSizes[i], 1)
+}
+
+func count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+type SleeveConnectionStats struct {
+	Peer             string
+	RemoteAddr       string
+	MTU              int
+	StackFrag        bool
+	FrameSizes       map[string]uint64
+	FramesFragmented uint64
+	Fragments        uint64
+	TooBigDropped    uint64
+	FragNeededSent   uint64
+	PMTUDiscoveries  uint64
+	// Estimated from heartbeat sequence numbers, if the peer sends them
+	HeartbeatLoss    float64
+	HeartbeatsMissed uint64
+}
+
+func (fwd *sleeveForwarder) connectionStats() SleeveConnectionStats {
+	fwd.lock.RLock()
+	remoteAddr := fwd.remoteAddr
+	mtu := fwd.mtu
+	stackFrag := fwd.stackFrag
+	loss := fwd.heartbeatLoss
+	fwd.lock.RUnlock()
+
+	stats := fwd.stats
+	sizes := make(map[string]uint64)
+	for i := range stats.frameSizes {
+		label := fmt.Sprintf(">%d", frameSizeBuckets[len(frameSizeBuckets)-1])
+		if i < len(frameSizeBuckets) {
+			label = fmt.Sprintf("<=%d", frameSizeBuckets[i])
+		}
+		sizes[label] = atomic.LoadUint64(&stats.frameSizes[i])
+	}
+	return SleeveConnectionStats{
+		Peer:             fwd.remotePeer.String(),
+		RemoteAddr:       fmt.Sprint(remoteAddr),
+		MTU:              mtu,
+		StackFrag:        stackFrag,
+		FrameSizes:       sizes,
+		FramesFragmented: atomic.LoadUint64(&stats.fragmented),
+		Fragments:        atomic.LoadUint64(&stats.fragments),
+		TooBigDropped:    atomic.LoadUint64(&stats.tooBigDropped),
+		FragNeededSent:   atomic.LoadUint64(&stats.fragNeededSent),
+		PMTUDiscoveries:  atomic.LoadUint64(&stats.pmtuDiscoveries),
+		HeartbeatLoss:    loss.loss,
+		HeartbeatsMissed: loss.missed,
+	}
+}
+
+func (sleeve *SleeveOverlay) Diagnostics() interface{} {
+	sleeve.lock.Lock()
+	defer sleeve.lock.Unlock()
+	connections := make([]SleeveConnectionStats, 0, len(sleeve.forwarders))
+	for _, fwd := range sleeve.forwarders {
+		connections = append(connections, fwd.connectionStats())
+	}
+	return connections
+}
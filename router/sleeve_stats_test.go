@@ -0,0 +1,31 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSleeveFrameSizeHistogram(t *testing.T) {
+	fwd := prepareTestForwarder(t, makeTestSleeve(0))
+	defer fwd.Stop()
+
+	for _, size := range []int{0, 128, 129, 1514, 1515, 9014, MaxUDPPacketSize, MaxUDPPacketSize + 1} {
+		fwd.stats.recordFrame(size)
+	}
+	count(&fwd.stats.fragNeededSent)
+
+	stats := fwd.connectionStats()
+	require.Equal(t, map[string]uint64{
+		"<=128":   2,
+		"<=256":   1,
+		"<=512":   0,
+		"<=1024":  0,
+		"<=1514":  1,
+		"<=9014":  2,
+		"<=65535": 1,
+		">65535":  1,
+	}, stats.FrameSizes)
+	require.Equal(t, uint64(1), stats.FragNeededSent)
+	require.Equal(t, DefaultMTU, stats.MTU)
+}
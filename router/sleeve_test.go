@@ -0,0 +1,54 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+)
+
+// A sleeve overlay with just enough set up to create forwarders which
+// never hear from their remote peer.
+func makeTestSleeve(establishTimeout time.Duration) *SleeveOverlay {
+	sleeve := NewSleeveOverlay(0, establishTimeout, logrus.NewEntry(common.Log)).(*SleeveOverlay)
+	sleeve.localPeer = &mesh.Peer{}
+	sleeve.forwarders = make(map[mesh.PeerName]*sleeveForwarder)
+	return sleeve
+}
+
+func prepareTestForwarder(t *testing.T, sleeve *SleeveOverlay) *sleeveForwarder {
+	conn, err := sleeve.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer:         &mesh.Peer{},
+		LocalAddr:          &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		SendControlMessage: func(byte, []byte) error { return nil },
+	})
+	require.NoError(t, err)
+	return conn.(*sleeveForwarder)
+}
+
+func TestSleeveEstablishTimeout(t *testing.T) {
+	fwd := prepareTestForwarder(t, makeTestSleeve(50*time.Millisecond))
+	// Not even confirmed: the deadline runs from creation
+	select {
+	case err := <-fwd.ErrorChannel():
+		require.EqualError(t, err, "timed out waiting for connection to be established")
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "forwarder not torn down")
+	}
+}
+
+func TestSleeveEstablishTimeoutDisabled(t *testing.T) {
+	fwd := prepareTestForwarder(t, makeTestSleeve(0))
+	select {
+	case err := <-fwd.ErrorChannel():
+		require.FailNow(t, "forwarder torn down", "%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	fwd.Stop()
+	require.NoError(t, <-fwd.ErrorChannel())
+}
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/weaveworks/mesh"
+)
+
+// A snapshot of the topology, for the readers of it outside the data
+// path: IPAM and DNS asking whether a peer is known, IPAM choosing
+// nearby peers over distant ones, probes and so on. Each snapshot is
+// worked out from mesh's status when first asked for, and again once
+// the routes have changed or peers have gone, and is never modified
+// after that, so reading one takes no locks. Only working one out
+// takes mesh's, once per change rather than once per reader, as does
+// looking up a peer the snapshot doesn't know yet.
+
+// Topology is a snapshot of the peers and the routes from us to them.
+type Topology struct {
+	Peers  []mesh.PeerStatus
+	Routes map[mesh.PeerName]mesh.PeerName // next hop to each peer we can reach
+	known  map[mesh.PeerName]struct{}
+	hops   map[mesh.PeerName]int
+}
+
+type topologyCache struct {
+	sync.Mutex              // held while working out a snapshot
+	generation uint32       // accessed atomically; bumped on every change
+	current    atomic.Value // *Topology; nil until worked out
+}
+
+func (router *NetworkRouter) invalidateTopology() {
+	atomic.AddUint32(&router.topology.generation, 1)
+	router.topology.current.Store((*Topology)(nil))
+}
+
+// Topology returns the latest snapshot of the topology. It must not
+// be modified.
+func (router *NetworkRouter) Topology() *Topology {
+	if topology, _ := router.topology.current.Load().(*Topology); topology != nil {
+		return topology
+	}
+	router.topology.Lock()
+	defer router.topology.Unlock()
+	if topology, _ := router.topology.current.Load().(*Topology); topology != nil {
+		return topology // worked out while we waited
+	}
+	generation := atomic.LoadUint32(&router.topology.generation)
+	topology := newTopology(router.Ourself.Name, mesh.NewStatus(router.Router))
+	// Don't keep it if the topology changed while we worked it out;
+	// the next reader works out another
+	if atomic.LoadUint32(&router.topology.generation) == generation {
+		router.topology.current.Store(topology)
+	}
+	return topology
+}
+
+// Hops returns the number of hops to peer over established
+// connections, or 0 if there is no route to it.
+func (router *NetworkRouter) Hops(peer mesh.PeerName) int {
+	return router.Topology().Hops(peer)
+}
+
+// IsKnownPeer returns whether peer is in the topology. A peer added to
+// mesh's table only reaches the snapshot once the routes have been
+// worked out again, which they aren't until it can be reached, so a
+// miss is looked up in the table itself.
+func (router *NetworkRouter) IsKnownPeer(peer mesh.PeerName) bool {
+	return isKnownPeer(router.Topology(), router.Peers, peer)
+}
+
+// The part of mesh.Peers needed to look up a peer
+type peerTable interface {
+	Fetch(name mesh.PeerName) *mesh.Peer
+}
+
+func isKnownPeer(topology *Topology, peers peerTable, peer mesh.PeerName) bool {
+	return topology.IsKnown(peer) || peers.Fetch(peer) != nil
+}
+
+func newTopology(ourName mesh.PeerName, status *mesh.Status) *Topology {
+	topology := &Topology{
+		Peers:  status.Peers,
+		Routes: make(map[mesh.PeerName]mesh.PeerName, len(status.UnicastRoutes)),
+		known:  make(map[mesh.PeerName]struct{}, len(status.Peers))}
+	for _, route := range status.UnicastRoutes {
+		dest, err1 := mesh.PeerNameFromString(route.Dest)
+		via, err2 := mesh.PeerNameFromString(route.Via)
+		if err1 == nil && err2 == nil {
+			topology.Routes[dest] = via
+		}
+	}
+	neighbours := make(map[mesh.PeerName][]mesh.PeerName)
+	for _, peer := range status.Peers {
+		name, err := mesh.PeerNameFromString(peer.Name)
+		if err != nil {
+			continue
+		}
+		topology.known[name] = struct{}{}
+		for _, conn := range peer.Connections {
+			if other, err := mesh.PeerNameFromString(conn.Name); err == nil && conn.Established {
+				neighbours[name] = append(neighbours[name], other)
+			}
+		}
+	}
+	topology.hops = countHops(ourName, neighbours)
+	return topology
+}
+
+func countHops(ourName mesh.PeerName, neighbours map[mesh.PeerName][]mesh.PeerName) map[mesh.PeerName]int {
+	counts := map[mesh.PeerName]int{ourName: 0}
+	for frontier := []mesh.PeerName{ourName}; len(frontier) > 0; {
+		var next []mesh.PeerName
+		for _, name := range frontier {
+			for _, other := range neighbours[name] {
+				if _, seen := counts[other]; !seen {
+					counts[other] = counts[name] + 1
+					next = append(next, other)
+				}
+			}
+		}
+		frontier = next
+	}
+	return counts
+}
+
+// IsKnown returns whether peer is in the topology.
+func (topology *Topology) IsKnown(peer mesh.PeerName) bool {
+	_, found := topology.known[peer]
+	return found
+}
+
+// Hops returns the number of hops to peer over established
+// connections, or 0 if there is no route to it.
+func (topology *Topology) Hops(peer mesh.PeerName) int {
+	return topology.hops[peer]
+}
+
+// Peer returns the status of the named peer, if it is in the
+// topology.
+func (topology *Topology) Peer(name string) (mesh.PeerStatus, bool) {
+	for _, peer := range topology.Peers {
+		if peer.Name == name {
+			return peer, true
+		}
+	}
+	return mesh.PeerStatus{}, false
+}
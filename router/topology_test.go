@@ -0,0 +1,46 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/mesh"
+)
+
+func TestCountHops(t *testing.T) {
+	// 1 - 2 - 3, and 4 which isn't connected to anyone
+	neighbours := map[mesh.PeerName][]mesh.PeerName{
+		1: {2},
+		2: {1, 3},
+		3: {2},
+	}
+	topology := &Topology{hops: countHops(1, neighbours)}
+	require.Equal(t, 0, topology.Hops(1))
+	require.Equal(t, 1, topology.Hops(2))
+	require.Equal(t, 2, topology.Hops(3))
+	require.Equal(t, 0, topology.Hops(4), "no route")
+}
+
+type mapPeerTable map[mesh.PeerName]*mesh.Peer
+
+func (peers mapPeerTable) Fetch(name mesh.PeerName) *mesh.Peer {
+	return peers[name]
+}
+
+func TestKnownPeerWithoutRoute(t *testing.T) {
+	// Peer 2 has been added to the table, but the routes, and so the
+	// snapshot, haven't caught up with it
+	topology := &Topology{
+		Routes: map[mesh.PeerName]mesh.PeerName{},
+		known:  map[mesh.PeerName]struct{}{1: {}},
+		hops:   countHops(1, nil)}
+	peer2 := &mesh.Peer{}
+	peer2.Name = 2
+	peers := mapPeerTable{2: peer2}
+
+	require.False(t, topology.IsKnown(2))
+	require.True(t, isKnownPeer(topology, peers, 1))
+	require.True(t, isKnownPeer(topology, peers, 2))
+	require.False(t, isKnownPeer(topology, peers, 3))
+	require.Equal(t, 0, topology.Hops(2), "no route")
+}
@@ -0,0 +1,480 @@
+// ipamscale runs hundreds of IP allocators in one process, connected
+// by the simulated gossip router used in unit tests, and drives them
+// with random allocations, releases and peers coming and going,
+// checking as it goes that no address is ever handed out twice and
+// that the peers agree on the ring. It is meant to be run for minutes
+// at a time before a release, to catch regressions that only show up
+// at scale.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+
+	"github.com/weaveworks/weave/common"
+	"github.com/weaveworks/weave/ipam"
+	"github.com/weaveworks/weave/ipam/ring"
+	"github.com/weaveworks/weave/net/address"
+	"github.com/weaveworks/weave/testing/gossip"
+)
+
+var (
+	numPeers    = flag.Int("peers", 200, "number of allocators to start with")
+	duration    = flag.Duration("duration", 5*time.Minute, "how long to run for")
+	workers     = flag.Int("workers", 20, "concurrent clients allocating and releasing addresses")
+	perPeer     = flag.Int("containers", 20, "addresses held per peer above which clients release rather than allocate")
+	churnEvery  = flag.Duration("churn", 10*time.Second, "interval between a peer leaving and another joining (0 for none)")
+	checkEvery  = flag.Duration("check", 30*time.Second, "interval between audits of the ring across peers")
+	settle      = flag.Duration("settle", 30*time.Second, "time allowed at the end for gossip to settle before the final audit")
+	opTimeout   = flag.Duration("op-timeout", 30*time.Second, "give up on an allocation after this long")
+	cidr        = flag.String("range", "10.32.0.0/12", "allocation range")
+	loss        = flag.Float64("loss", 0, "fraction of gossip messages to drop")
+	seed        = flag.Int64("seed", time.Now().UnixNano(), "random seed, to repeat a run")
+	logLevel    = flag.String("log-level", "warning", "logging level of the allocators")
+	maxFailures = flag.Int("max-failures", 0, "invariant violations to tolerate before exiting with an error")
+)
+
+type peer struct {
+	sync.RWMutex // held for writing while the peer leaves
+	name         mesh.PeerName
+	alloc        *ipam.Allocator
+	gone         bool
+}
+
+type holding struct {
+	peer  *peer
+	ident string
+}
+
+type simulation struct {
+	universe address.Range
+	quorum   uint
+	router   *gossip.TestRouter
+
+	lock     sync.Mutex
+	peers    []*peer
+	held     map[address.Address]holding // every address a client holds
+	nextPeer int
+	nextID   int
+
+	knownLock sync.RWMutex // separate, as the allocators consult it
+	known     map[mesh.PeerName]bool
+
+	crashed []mesh.PeerName // to be taken over by another peer
+
+	stats struct {
+		sync.Mutex
+		allocated, released, failed, joined, left, crashed int
+		latencies                                          []time.Duration
+		violations                                         int
+		seen                                               map[string]bool
+	}
+}
+
+func main() {
+	flag.Parse()
+	common.SetLogLevel(*logLevel)
+	rand.Seed(*seed)
+	common.Log.Infof("seed %d", *seed)
+
+	_, universe, err := address.ParseCIDR(*cidr)
+	if err != nil {
+		fatal(err)
+	}
+	sim := &simulation{
+		universe: universe.Range(),
+		quorum:   uint(*numPeers/2 + 1),
+		router:   gossip.NewTestRouter(float32(*loss)),
+		held:     make(map[address.Address]holding),
+		known:    make(map[mesh.PeerName]bool),
+	}
+	sim.stats.seen = make(map[string]bool)
+	sim.router.OnError = func(err error) { sim.violation("%s", err) }
+	for i := 0; i < *numPeers; i++ {
+		sim.join()
+	}
+	for _, p := range sim.peers {
+		p.alloc.Prime()
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sim.client(stop)
+		}()
+	}
+	if *churnEvery > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sim.churn(stop)
+		}()
+	}
+
+	start := time.Now()
+	deadline := time.After(*duration)
+	check := time.NewTicker(*checkEvery)
+loop:
+	for {
+		select {
+		case <-check.C:
+			sim.check(false)
+			sim.report(time.Since(start))
+		case <-deadline:
+			break loop
+		}
+	}
+	check.Stop()
+	close(stop)
+	wg.Wait()
+
+	// Once periodic gossip has settled, the peers must agree exactly
+	time.Sleep(*settle)
+	sim.router.Flush()
+	sim.check(true)
+	sim.report(time.Since(start))
+
+	sim.stats.Lock()
+	violations := sim.stats.violations
+	sim.stats.Unlock()
+	if violations > *maxFailures {
+		fmt.Fprintf(os.Stderr, "FAIL: %d invariant violations (seed %d)\n", violations, *seed)
+		os.Exit(1)
+	}
+	fmt.Println("PASS")
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func (sim *simulation) isKnownPeer(name mesh.PeerName) bool {
+	sim.knownLock.RLock()
+	defer sim.knownLock.RUnlock()
+	return sim.known[name]
+}
+
+func (sim *simulation) setKnown(name mesh.PeerName, known bool) {
+	sim.knownLock.Lock()
+	defer sim.knownLock.Unlock()
+	sim.known[name] = known
+}
+
+// Start a new allocator and connect it to the others
+func (sim *simulation) join() *peer {
+	sim.lock.Lock()
+	sim.nextPeer++
+	n := sim.nextPeer
+	sim.lock.Unlock()
+
+	name, err := mesh.PeerNameFromString(fmt.Sprintf("00:00:00:%02x:%02x:%02x", n>>16&0xff, n>>8&0xff, n&0xff))
+	if err != nil {
+		fatal(err)
+	}
+	sim.setKnown(name, true)
+	alloc := ipam.NewAllocator(name, mesh.PeerUID(rand.Int63()), fmt.Sprint("sim", n), sim.universe, sim.quorum, sim.isKnownPeer)
+	gossiper := &startingGossiper{alloc, make(chan struct{})}
+	alloc.SetInterfaces(sim.router.Connect(name, gossiper))
+	alloc.Start()
+	close(gossiper.started)
+
+	p := &peer{name: name, alloc: alloc}
+	sim.lock.Lock()
+	sim.peers = append(sim.peers, p)
+	sim.lock.Unlock()
+	return p
+}
+
+// Gossip can arrive as soon as a peer is connected, which has to be
+// before its allocator starts; it is held until then.
+type startingGossiper struct {
+	*ipam.Allocator
+	started chan struct{}
+}
+
+func (g *startingGossiper) OnGossipUnicast(sender mesh.PeerName, msg []byte) error {
+	<-g.started
+	return g.Allocator.OnGossipUnicast(sender, msg)
+}
+
+func (g *startingGossiper) OnGossipBroadcast(sender mesh.PeerName, msg []byte) (mesh.GossipData, error) {
+	<-g.started
+	return g.Allocator.OnGossipBroadcast(sender, msg)
+}
+
+func (g *startingGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	<-g.started
+	return g.Allocator.OnGossip(msg)
+}
+
+func (g *startingGossiper) Gossip() mesh.GossipData {
+	<-g.started
+	return g.Allocator.Gossip()
+}
+
+func (sim *simulation) livePeers() []*peer {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return append([]*peer(nil), sim.peers...)
+}
+
+func (sim *simulation) randomPeer() *peer {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.peers[rand.Intn(len(sim.peers))]
+}
+
+// Remove a peer: gracefully, so that it hands its space on, or as if
+// it had crashed, leaving its space to be taken over by hand
+func (sim *simulation) leave(crash bool) {
+	sim.lock.Lock()
+	if len(sim.peers) < 2 {
+		sim.lock.Unlock()
+		return
+	}
+	i := rand.Intn(len(sim.peers))
+	p := sim.peers[i]
+	sim.peers = append(sim.peers[:i], sim.peers[i+1:]...)
+	sim.lock.Unlock()
+
+	// The allocator is cut off rather than stopped, since gossip it
+	// sent may still be waiting for it to encode it
+	p.Lock() // wait for clients to finish with it
+	p.gone = true
+	if !crash {
+		p.alloc.Shutdown()
+	}
+	sim.router.RemovePeer(p.name)
+	sim.setKnown(p.name, false)
+	p.Unlock()
+
+	sim.lock.Lock()
+	for addr, h := range sim.held {
+		if h.peer == p {
+			delete(sim.held, addr)
+		}
+	}
+	sim.lock.Unlock()
+
+	if crash {
+		sim.crashed = append(sim.crashed, p.name)
+	}
+
+	sim.stats.Lock()
+	if crash {
+		sim.stats.crashed++
+	} else {
+		sim.stats.left++
+	}
+	sim.stats.Unlock()
+}
+
+func (sim *simulation) churn(stop <-chan struct{}) {
+	ticker := time.NewTicker(*churnEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// As an administrator would, only take over from a
+			// crashed peer once what it last said has had time to
+			// spread
+			for _, name := range sim.crashed {
+				sim.takeOver(name)
+			}
+			sim.crashed = nil
+			sim.leave(rand.Intn(2) == 0)
+			sim.join()
+			sim.stats.Lock()
+			sim.stats.joined++
+			sim.stats.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (sim *simulation) takeOver(name mesh.PeerName) {
+	heir := sim.randomPeer()
+	heir.RLock()
+	defer heir.RUnlock()
+	if heir.gone {
+		return
+	}
+	// a peer which crashed before it got any space leaves nothing
+	if err := heir.alloc.AdminTakeoverRanges(name.String(), true); err != nil && err != ring.ErrNotFound {
+		sim.violation("taking over from %s: %s", name, err)
+	}
+}
+
+// Allocate and release addresses on random peers until told to stop
+func (sim *simulation) client(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		p := sim.randomPeer()
+		p.RLock()
+		if !p.gone {
+			if sim.holdingOn(p) < *perPeer && rand.Intn(2) == 0 {
+				sim.allocate(p)
+			} else {
+				sim.release(p)
+			}
+		}
+		p.RUnlock()
+	}
+}
+
+func (sim *simulation) holdingOn(p *peer) int {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	count := 0
+	for _, h := range sim.held {
+		if h.peer == p {
+			count++
+		}
+	}
+	return count
+}
+
+func (sim *simulation) allocate(p *peer) {
+	sim.lock.Lock()
+	sim.nextID++
+	ident := fmt.Sprint("container", sim.nextID)
+	sim.lock.Unlock()
+
+	start := time.Now()
+	addr, err := p.alloc.Allocate(ident, sim.universe, func() bool { return time.Since(start) > *opTimeout })
+	latency := time.Since(start)
+	if err != nil {
+		sim.stats.Lock()
+		sim.stats.failed++
+		sim.stats.Unlock()
+		if ipam.ErrorKind(err) != ipam.ErrShuttingDown {
+			common.Log.Warnf("allocating on %s: %s", p.name, err)
+		}
+		return
+	}
+
+	sim.lock.Lock()
+	if other, found := sim.held[addr]; found {
+		sim.lock.Unlock()
+		sim.violation("%s given to %s on %s, but already held by %s on %s", addr, ident, p.name, other.ident, other.peer.name)
+		return
+	}
+	sim.held[addr] = holding{p, ident}
+	sim.lock.Unlock()
+
+	sim.stats.Lock()
+	sim.stats.allocated++
+	sim.stats.latencies = append(sim.stats.latencies, latency)
+	sim.stats.Unlock()
+}
+
+func (sim *simulation) release(p *peer) {
+	sim.lock.Lock()
+	var addr address.Address
+	var h holding
+	found := false
+	for a, candidate := range sim.held {
+		if candidate.peer == p {
+			addr, h, found = a, candidate, true
+			break
+		}
+	}
+	if found {
+		// forget it first, as it may be handed out again at once
+		delete(sim.held, addr)
+	}
+	sim.lock.Unlock()
+	if !found {
+		return
+	}
+	if err := p.alloc.Delete(h.ident); err != nil {
+		sim.violation("releasing %s of %s on %s: %s", addr, h.ident, p.name, err)
+		return
+	}
+	sim.stats.Lock()
+	sim.stats.released++
+	sim.stats.Unlock()
+}
+
+// Check that no allocator has found itself inconsistent, and audit
+// the ring from a random peer. Until gossip has settled, only
+// conflicting owners count; once it has, any divergence does.
+func (sim *simulation) check(settled bool) {
+	for _, p := range sim.livePeers() {
+		if p.alloc.Readiness() == ipam.Quarantined {
+			sim.violation("%s is quarantined", p.name)
+		}
+	}
+	p := sim.randomPeer()
+	p.RLock()
+	defer p.RUnlock()
+	if p.gone {
+		return
+	}
+	report := p.alloc.Audit(*checkEvery / 3)
+	for _, peer := range report.Peers {
+		if settled && peer.Status == "no answer" {
+			sim.violation("%s did not answer the audit", peer.Peer)
+		}
+	}
+	for _, d := range report.Divergences {
+		if settled || d.Kind == ring.ConflictingOwner {
+			sim.violation("%s at %v: %s", d.Kind, d.Token, d.Detail)
+		}
+	}
+}
+
+func (sim *simulation) violation(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	sim.stats.Lock()
+	defer sim.stats.Unlock()
+	sim.stats.violations++
+	// once a peer is inconsistent it tends to say so over and over
+	if !sim.stats.seen[msg] {
+		sim.stats.seen[msg] = true
+		common.Log.Errorf("VIOLATION: %s", msg)
+	}
+}
+
+func (sim *simulation) report(elapsed time.Duration) {
+	peers := len(sim.livePeers())
+	sim.lock.Lock()
+	held := len(sim.held)
+	sim.lock.Unlock()
+
+	sim.stats.Lock()
+	defer sim.stats.Unlock()
+	latencies := sim.stats.latencies
+	sort.Sort(durations(latencies))
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("%s: %d peers (%d joined, %d left, %d crashed), %d held, %d allocated, %d released, %d failed; allocate p50 %s p99 %s; %d violations\n",
+		elapsed-elapsed%time.Second, peers, sim.stats.joined, sim.stats.left, sim.stats.crashed, held,
+		sim.stats.allocated, sim.stats.released, sim.stats.failed, percentile(0.5), percentile(0.99), sim.stats.violations)
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
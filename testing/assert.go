@@ -0,0 +1,144 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite golden files with the output of the tests, rather than comparing with them")
+
+// AssertEqual is like require.Equal, but when the two differ it shows
+// the lines which do, rather than both values in full. Strings, byte
+// slices and Stringers are compared as text; other values as JSON.
+func AssertEqual(t *testing.T, expected, actual interface{}, desc string) {
+	if reflect.DeepEqual(expected, actual) {
+		return
+	}
+	require.FailNow(t, fmt.Sprintf("Not equal (- expected, + actual):\n%s", Diff(asText(expected), asText(actual))), desc)
+}
+
+// AssertGolden compares actual with the file testdata/<name>.golden.
+// Run the tests with -update-golden to write the file instead, after
+// checking that the differences are what you expect.
+func AssertGolden(t *testing.T, name string, actual []byte) {
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		require.NoError(t, os.MkdirAll("testdata", 0755))
+		require.NoError(t, ioutil.WriteFile(path, actual, 0644))
+		return
+	}
+	expected, err := ioutil.ReadFile(path)
+	require.NoError(t, err, "reading golden file; run with -update-golden to create it")
+	if !bytes.Equal(expected, actual) {
+		require.FailNow(t, fmt.Sprintf("Output differs from %s (- expected, + actual):\n%s", path, Diff(string(expected), string(actual))))
+	}
+}
+
+// AssertEventually polls cond until it holds, failing the test if it
+// still does not once timeout has passed.
+func AssertEventually(t *testing.T, timeout time.Duration, cond func() bool, desc string) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, fmt.Sprintf("condition not met within %s", timeout), desc)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func asText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case fmt.Stringer:
+		return v.String()
+	}
+	if buf, err := json.MarshalIndent(value, "", "  "); err == nil {
+		return string(buf)
+	}
+	return fmt.Sprintf("%#v", value)
+}
+
+// Diff returns the lines of a and b, those only in a prefixed with
+// "-" and those only in b with "+". Long runs of common lines are
+// elided.
+func Diff(a, b string) string {
+	as, bs := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// common[i][j] is the length of the longest common subsequence
+	// of as[i:] and bs[j:]
+	common := make([][]int, len(as)+1)
+	for i := range common {
+		common[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			switch {
+			case as[i] == bs[j]:
+				common[i][j] = common[i+1][j+1] + 1
+			case common[i+1][j] >= common[i][j+1]:
+				common[i][j] = common[i+1][j]
+			default:
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table to give each line of the result its prefix
+	type line struct {
+		prefix, text string
+	}
+	var diff []line
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			diff = append(diff, line{" ", as[i]})
+			i++
+			j++
+		case j == len(bs) || (i < len(as) && common[i+1][j] >= common[i][j+1]):
+			diff = append(diff, line{"-", as[i]})
+			i++
+		default:
+			diff = append(diff, line{"+", bs[j]})
+			j++
+		}
+	}
+
+	// Keep common lines within a couple of a change
+	const context = 2
+	near := func(k int) bool {
+		for d := k - context; d <= k+context; d++ {
+			if d >= 0 && d < len(diff) && diff[d].prefix != " " {
+				return true
+			}
+		}
+		return false
+	}
+	var result []string
+	elided := false
+	for k, l := range diff {
+		if l.prefix == " " && !near(k) {
+			if !elided {
+				result = append(result, "  ...")
+				elided = true
+			}
+			continue
+		}
+		result = append(result, l.prefix+" "+l.text)
+		elided = false
+	}
+	return strings.Join(result, "\n")
+}
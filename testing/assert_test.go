@@ -0,0 +1,33 @@
+package testing
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	a := strings.Join([]string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}, "\n")
+	b := strings.Join([]string{"1", "2", "3", "4", "five", "6", "7", "8", "9", "10", "11", "12"}, "\n")
+	require.Equal(t, strings.Join([]string{
+		"  ...",
+		"  3",
+		"  4",
+		"- 5",
+		"+ five",
+		"  6",
+		"  7",
+		"  ...",
+		"  10",
+		"  11",
+		"+ 12",
+	}, "\n"), Diff(a, b))
+	require.Equal(t, "  a\n- ", Diff("a\n", "a"), "a missing newline shows")
+}
+
+func TestAssertEventually(t *testing.T) {
+	start := time.Now()
+	AssertEventually(t, time.Second, func() bool { return time.Since(start) > 20*time.Millisecond }, "time passes")
+}
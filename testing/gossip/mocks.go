@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/weaveworks/mesh"
@@ -31,22 +32,50 @@ type flushMessage struct {
 	flushChan chan struct{}
 }
 
+// Peers can be connected and removed while others are gossiping, as
+// in a simulation of peers coming and going.
 type TestRouter struct {
+	sync.RWMutex
 	gossipChans map[mesh.PeerName]chan interface{}
 	loss        float32 // 0.0 means no loss
+	// If set, errors from gossipers are passed to OnError rather than
+	// panicking. Set it before connecting any.
+	OnError func(err error)
 }
 
 func NewTestRouter(loss float32) *TestRouter {
-	return &TestRouter{make(map[mesh.PeerName]chan interface{}, 100), loss}
+	return &TestRouter{gossipChans: make(map[mesh.PeerName]chan interface{}, 100), loss: loss}
 }
 
 func (grouter *TestRouter) Stop() {
-	for peer := range grouter.gossipChans {
+	for _, peer := range grouter.Peers() {
 		grouter.RemovePeer(peer)
 	}
 }
 
+// Peers returns the names of the peers connected
+func (grouter *TestRouter) Peers() []mesh.PeerName {
+	grouter.RLock()
+	defer grouter.RUnlock()
+	peers := make([]mesh.PeerName, 0, len(grouter.gossipChans))
+	for peer := range grouter.gossipChans {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (grouter *TestRouter) gossipChan(peer mesh.PeerName) chan interface{} {
+	grouter.RLock()
+	defer grouter.RUnlock()
+	return grouter.gossipChans[peer]
+}
+
 func (grouter *TestRouter) gossipBroadcast(sender mesh.PeerName, update mesh.GossipData) error {
+	grouter.RLock()
+	defer grouter.RUnlock()
+	if _, connected := grouter.gossipChans[sender]; !connected {
+		return nil // removed peers are cut off
+	}
 	for _, gossipChan := range grouter.gossipChans {
 		select {
 		case gossipChan <- broadcastMessage{sender: sender, data: update}:
@@ -58,6 +87,8 @@ func (grouter *TestRouter) gossipBroadcast(sender mesh.PeerName, update mesh.Gos
 }
 
 func (grouter *TestRouter) gossip(sender mesh.PeerName, update mesh.GossipData) error {
+	grouter.RLock()
+	defer grouter.RUnlock()
 	count := int(math.Log2(float64(len(grouter.gossipChans))))
 	for dest, gossipChan := range grouter.gossipChans {
 		if dest == sender {
@@ -77,7 +108,11 @@ func (grouter *TestRouter) gossip(sender mesh.PeerName, update mesh.GossipData)
 }
 
 func (grouter *TestRouter) Flush() {
-	for _, gossipChan := range grouter.gossipChans {
+	for _, peer := range grouter.Peers() {
+		gossipChan := grouter.gossipChan(peer)
+		if gossipChan == nil {
+			continue // removed meanwhile
+		}
 		flushChan := make(chan struct{})
 		gossipChan <- flushMessage{flushChan: flushChan}
 		<-flushChan
@@ -85,11 +120,13 @@ func (grouter *TestRouter) Flush() {
 }
 
 func (grouter *TestRouter) RemovePeer(peer mesh.PeerName) {
+	grouter.Lock()
 	gossipChan := grouter.gossipChans[peer]
+	delete(grouter.gossipChans, peer)
+	grouter.Unlock()
 	resultChan := make(chan struct{})
 	gossipChan <- exitMessage{exitChan: resultChan}
 	<-resultChan
-	delete(grouter.gossipChans, peer)
 }
 
 type TestRouterClient struct {
@@ -115,7 +152,7 @@ func (grouter *TestRouter) run(sender mesh.PeerName, gossiper mesh.Gossiper, gos
 					continue
 				}
 				if err := gossiper.OnGossipUnicast(message.sender, message.buf); err != nil {
-					panic(fmt.Sprintf("Error doing gossip unicast to %s: %s", message.sender, err))
+					grouter.fail(fmt.Errorf("Error doing gossip unicast to %s: %s", message.sender, err))
 				}
 
 			case broadcastMessage:
@@ -124,7 +161,7 @@ func (grouter *TestRouter) run(sender mesh.PeerName, gossiper mesh.Gossiper, gos
 				}
 				for _, msg := range message.data.Encode() {
 					if _, err := gossiper.OnGossipBroadcast(message.sender, msg); err != nil {
-						panic(fmt.Sprintf("Error doing gossip broadcast: %s", err))
+						grouter.fail(fmt.Errorf("Error doing gossip broadcast: %s", err))
 					}
 				}
 			case gossipMessage:
@@ -134,7 +171,8 @@ func (grouter *TestRouter) run(sender mesh.PeerName, gossiper mesh.Gossiper, gos
 				for _, msg := range message.data.Encode() {
 					diff, err := gossiper.OnGossip(msg)
 					if err != nil {
-						panic(fmt.Sprintf("Error doing gossip: %s", err))
+						grouter.fail(fmt.Errorf("Error doing gossip: %s", err))
+						continue
 					}
 					if diff == nil {
 						continue
@@ -142,9 +180,9 @@ func (grouter *TestRouter) run(sender mesh.PeerName, gossiper mesh.Gossiper, gos
 					// Sanity check - reconsuming the diff should yield nil
 					for _, diffMsg := range diff.Encode() {
 						if nextDiff, err := gossiper.OnGossip(diffMsg); err != nil {
-							panic(fmt.Sprintf("Error doing gossip: %s", err))
+							grouter.fail(fmt.Errorf("Error doing gossip: %s", err))
 						} else if nextDiff != nil {
-							panic(fmt.Sprintf("Breach of gossip interface: %v != nil", nextDiff))
+							grouter.fail(fmt.Errorf("Breach of gossip interface: %v != nil", nextDiff))
 						}
 					}
 					grouter.gossip(message.sender, diff)
@@ -156,18 +194,30 @@ func (grouter *TestRouter) run(sender mesh.PeerName, gossiper mesh.Gossiper, gos
 	}
 }
 
+func (grouter *TestRouter) fail(err error) {
+	if grouter.OnError == nil {
+		panic(err.Error())
+	}
+	grouter.OnError(err)
+}
+
 func (grouter *TestRouter) Connect(sender mesh.PeerName, gossiper mesh.Gossiper) mesh.Gossip {
 	gossipChan := make(chan interface{}, 100)
 
 	go grouter.run(sender, gossiper, gossipChan)
 
+	grouter.Lock()
 	grouter.gossipChans[sender] = gossipChan
+	grouter.Unlock()
 	return TestRouterClient{grouter, sender}
 }
 
 func (client TestRouterClient) GossipUnicast(dstPeerName mesh.PeerName, buf []byte) error {
+	if client.router.gossipChan(client.sender) == nil {
+		return nil // removed peers are cut off
+	}
 	select {
-	case client.router.gossipChans[dstPeerName] <- unicastMessage{sender: client.sender, buf: buf}:
+	case client.router.gossipChan(dstPeerName) <- unicastMessage{sender: client.sender, buf: buf}:
 	default: // drop the message if we cannot send it
 		common.Log.Errorf("Dropping message")
 	}
@@ -0,0 +1,363 @@
+// Package netem provides TCP and UDP proxies which inject network
+// faults - latency, packet loss, undersized paths and connection
+// resets - between two endpoints, for exercising router connection
+// resilience in-process.
+package netem
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Faults describes the impairments applied to traffic passing through
+// a proxy. The zero value forwards traffic untouched.
+type Faults struct {
+	// Latency is added before forwarding each chunk or datagram.
+	Latency time.Duration
+	// DropRate is the fraction of UDP datagrams silently discarded.
+	DropRate float64
+	// MaxDatagram, if non-zero, causes larger UDP datagrams to be
+	// discarded, like a path with a smaller MTU than advertised.
+	MaxDatagram int
+	// FragNeeded makes the UDP proxy answer datagrams discarded for
+	// exceeding MaxDatagram with an ICMP "fragmentation needed"
+	// message, as a router would. Sending these requires CAP_NET_RAW.
+	FragNeeded bool
+}
+
+type faultState struct {
+	sync.Mutex
+	faults Faults
+	rand   *rand.Rand
+}
+
+func newFaultState() *faultState {
+	return &faultState{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (fs *faultState) set(faults Faults) {
+	fs.Lock()
+	fs.faults = faults
+	fs.Unlock()
+}
+
+func (fs *faultState) get() Faults {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.faults
+}
+
+// drop decides whether a datagram of the given size should be lost,
+// and if so whether the sender should be told the path MTU.
+func (fs *faultState) drop(size int) (drop bool, fragNeeded bool) {
+	fs.Lock()
+	defer fs.Unlock()
+	if fs.faults.MaxDatagram > 0 && size > fs.faults.MaxDatagram {
+		return true, fs.faults.FragNeeded
+	}
+	return fs.faults.DropRate > 0 && fs.rand.Float64() < fs.faults.DropRate, false
+}
+
+// TCPProxy accepts connections on a local port and relays them to a
+// target address.
+type TCPProxy struct {
+	*faultState
+	listener net.Listener
+	target   string
+
+	connsLock sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+// NewTCPProxy starts a proxy on an ephemeral loopback port which
+// relays connections to target.
+func NewTCPProxy(target string) (*TCPProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return newTCPProxy(listener, target), nil
+}
+
+func newTCPProxy(listener net.Listener, target string) *TCPProxy {
+	proxy := &TCPProxy{
+		faultState: newFaultState(),
+		listener:   listener,
+		target:     target,
+		conns:      make(map[net.Conn]struct{}),
+	}
+	go proxy.acceptLoop()
+	return proxy
+}
+
+// Addr returns the address clients should connect to.
+func (proxy *TCPProxy) Addr() string {
+	return proxy.listener.Addr().String()
+}
+
+// SetFaults changes the impairments applied from now on.
+func (proxy *TCPProxy) SetFaults(faults Faults) {
+	proxy.set(faults)
+}
+
+// ResetConnections abruptly terminates all connections currently
+// being relayed; new connections are still accepted.
+func (proxy *TCPProxy) ResetConnections() {
+	proxy.connsLock.Lock()
+	defer proxy.connsLock.Unlock()
+	for conn := range proxy.conns {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0) // send RST rather than FIN
+		}
+		conn.Close()
+		delete(proxy.conns, conn)
+	}
+}
+
+// Close stops accepting connections and resets existing ones.
+func (proxy *TCPProxy) Close() error {
+	err := proxy.listener.Close()
+	proxy.ResetConnections()
+	return err
+}
+
+func (proxy *TCPProxy) acceptLoop() {
+	for {
+		client, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+		server, err := net.Dial("tcp", proxy.target)
+		if err != nil {
+			client.Close()
+			continue
+		}
+		proxy.track(client, server)
+		go proxy.relay(client, server)
+		go proxy.relay(server, client)
+	}
+}
+
+func (proxy *TCPProxy) track(conns ...net.Conn) {
+	proxy.connsLock.Lock()
+	defer proxy.connsLock.Unlock()
+	for _, conn := range conns {
+		proxy.conns[conn] = struct{}{}
+	}
+}
+
+func (proxy *TCPProxy) untrack(conns ...net.Conn) {
+	proxy.connsLock.Lock()
+	defer proxy.connsLock.Unlock()
+	for _, conn := range conns {
+		delete(proxy.conns, conn)
+	}
+}
+
+func (proxy *TCPProxy) relay(dst, src net.Conn) {
+	defer proxy.untrack(dst, src)
+	defer dst.Close()
+	defer src.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if latency := proxy.get().Latency; latency > 0 {
+				time.Sleep(latency)
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				if tcpConn, ok := dst.(*net.TCPConn); ok {
+					tcpConn.SetLinger(0)
+				}
+			}
+			return
+		}
+	}
+}
+
+// UDPProxy relays datagrams between a single client and a target.
+// Datagrams from the target are returned to whichever client address
+// most recently sent to the proxy.
+type UDPProxy struct {
+	*faultState
+	conn     *net.UDPConn
+	upstream *net.UDPConn
+
+	clientLock sync.Mutex
+	client     *net.UDPAddr
+}
+
+// NewUDPProxy starts a proxy on an ephemeral loopback port which
+// relays datagrams to target.
+func NewUDPProxy(target string) (*UDPProxy, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	return newUDPProxy(conn, target)
+}
+
+func newUDPProxy(conn *net.UDPConn, target string) (*UDPProxy, error) {
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	upstream, err := net.DialUDP("udp", nil, targetAddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	proxy := &UDPProxy{faultState: newFaultState(), conn: conn, upstream: upstream}
+	go proxy.forwardLoop()
+	go proxy.returnLoop()
+	return proxy, nil
+}
+
+// NewProxyPair starts a TCP and a UDP proxy on the same loopback
+// port, both relaying to target. Weave routers expect a peer's UDP
+// port to match its TCP one, so this is what is needed to interpose
+// on both paths between two routers.
+func NewProxyPair(target string) (*TCPProxy, *UDPProxy, error) {
+	for attempt := 0; ; attempt++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: listener.Addr().(*net.TCPAddr).Port})
+		if err != nil {
+			listener.Close()
+			if attempt < 10 { // UDP port already taken; try another
+				continue
+			}
+			return nil, nil, err
+		}
+		udpProxy, err := newUDPProxy(conn, target)
+		if err != nil {
+			listener.Close()
+			return nil, nil, err
+		}
+		return newTCPProxy(listener, target), udpProxy, nil
+	}
+}
+
+// Addr returns the address clients should send to.
+func (proxy *UDPProxy) Addr() string {
+	return proxy.conn.LocalAddr().String()
+}
+
+// SetFaults changes the impairments applied from now on.
+func (proxy *UDPProxy) SetFaults(faults Faults) {
+	proxy.set(faults)
+}
+
+func (proxy *UDPProxy) Close() error {
+	proxy.upstream.Close()
+	return proxy.conn.Close()
+}
+
+func (proxy *UDPProxy) forwardLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := proxy.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		proxy.clientLock.Lock()
+		proxy.client = addr
+		proxy.clientLock.Unlock()
+		proxy.deliver(buf[:n], addr, proxy.conn.LocalAddr().(*net.UDPAddr),
+			func(b []byte) { proxy.upstream.Write(b) })
+	}
+}
+
+func (proxy *UDPProxy) returnLoop() {
+	buf := make([]byte, 65535)
+	for {
+		n, err := proxy.upstream.Read(buf)
+		if err != nil {
+			return
+		}
+		proxy.clientLock.Lock()
+		client := proxy.client
+		proxy.clientLock.Unlock()
+		if client != nil {
+			proxy.deliver(buf[:n], proxy.upstream.RemoteAddr().(*net.UDPAddr), proxy.upstream.LocalAddr().(*net.UDPAddr),
+				func(b []byte) { proxy.conn.WriteToUDP(b, client) })
+		}
+	}
+}
+
+// deliver sends a copy of datagram, which src sent to dst, via send,
+// subject to the current faults. Delayed datagrams are sent
+// asynchronously so that latency does not also throttle throughput.
+func (proxy *UDPProxy) deliver(datagram []byte, src, dst *net.UDPAddr, send func([]byte)) {
+	if drop, fragNeeded := proxy.drop(len(datagram)); drop {
+		if fragNeeded {
+			sendFragNeeded(src, dst, len(datagram), proxy.get().MaxDatagram+ipUDPHeaderSize)
+		}
+		return
+	}
+	latency := proxy.get().Latency
+	if latency == 0 {
+		send(datagram)
+		return
+	}
+	datagram = append([]byte(nil), datagram...)
+	time.AfterFunc(latency, func() { send(datagram) })
+}
+
+const ipUDPHeaderSize = 20 + 8
+
+// sendFragNeeded tells src, which sent a datagram of the given size
+// to dst, that the path MTU is pmtu. Errors are ignored, as they would
+// be for a router sending ICMP.
+func sendFragNeeded(src, dst *net.UDPAddr, size int, pmtu int) {
+	conn, err := net.DialIP("ip4:icmp", nil, &net.IPAddr{IP: src.IP})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	msg := make([]byte, 8+ipUDPHeaderSize)
+	msg[0], msg[1] = 3, 4 // destination unreachable, fragmentation needed
+	binary.BigEndian.PutUint16(msg[6:8], uint16(pmtu))
+	// the start of the offending packet: IPv4 header, then UDP header
+	ip := msg[8:28]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipUDPHeaderSize+size))
+	ip[6] = 0x40 // DF
+	ip[8] = 64   // TTL
+	ip[9] = 17   // UDP
+	copy(ip[12:16], src.IP.To4())
+	copy(ip[16:20], dst.IP.To4())
+	udp := msg[28:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(8+size))
+	binary.BigEndian.PutUint16(msg[2:4], checksum(msg))
+	conn.Write(msg)
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + sum>>16
+	}
+	return ^uint16(sum)
+}
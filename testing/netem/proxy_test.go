@@ -0,0 +1,193 @@
+package netem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func tcpEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestTCPProxyRelaysAndDelays(t *testing.T) {
+	server := tcpEchoServer(t)
+	defer server.Close()
+	proxy, err := NewTCPProxy(server.Addr().String())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", line)
+
+	proxy.SetFaults(Faults{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	_, err = conn.Write([]byte("slow\n"))
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "slow\n", line)
+	// latency is applied in both directions
+	require.True(t, time.Since(start) >= 100*time.Millisecond, "latency not applied")
+}
+
+func TestTCPProxyReset(t *testing.T) {
+	server := tcpEchoServer(t)
+	defer server.Close()
+	proxy, err := NewTCPProxy(server.Addr().String())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("x"))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.NoError(t, err)
+
+	proxy.ResetConnections()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	// new connections still work after a reset
+	conn2, err := net.Dial("tcp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte("y"))
+	require.NoError(t, err)
+	_, err = conn2.Read(make([]byte, 1))
+	require.NoError(t, err)
+}
+
+func udpRoundTrip(conn net.Conn, size int) error {
+	if _, err := conn.Write(make([]byte, size)); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 65535))
+	return err
+}
+
+func TestUDPProxyFaults(t *testing.T) {
+	server := udpEchoServer(t)
+	defer server.Close()
+	proxy, err := NewUDPProxy(server.LocalAddr().String())
+	require.NoError(t, err)
+	defer proxy.Close()
+
+	conn, err := net.Dial("udp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, udpRoundTrip(conn, 100))
+
+	proxy.SetFaults(Faults{MaxDatagram: 500})
+	require.NoError(t, udpRoundTrip(conn, 100))
+	require.Error(t, udpRoundTrip(conn, 1000), "oversized datagram should be dropped")
+
+	proxy.SetFaults(Faults{DropRate: 1})
+	require.Error(t, udpRoundTrip(conn, 100), "datagram should be dropped")
+
+	proxy.SetFaults(Faults{})
+	require.NoError(t, udpRoundTrip(conn, 100))
+}
+
+func TestProxyPairSharesPort(t *testing.T) {
+	server := tcpEchoServer(t)
+	defer server.Close()
+	tcpProxy, udpProxy, err := NewProxyPair(server.Addr().String())
+	require.NoError(t, err)
+	defer tcpProxy.Close()
+	defer udpProxy.Close()
+
+	require.Equal(t, tcpProxy.Addr(), udpProxy.Addr())
+}
+
+func TestUDPProxyFragNeeded(t *testing.T) {
+	icmp, err := net.ListenIP("ip4:icmp", &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("needs CAP_NET_RAW: ", err)
+	}
+	defer icmp.Close()
+
+	server := udpEchoServer(t)
+	defer server.Close()
+	proxy, err := NewUDPProxy(server.LocalAddr().String())
+	require.NoError(t, err)
+	defer proxy.Close()
+	proxy.SetFaults(Faults{MaxDatagram: 500, FragNeeded: true})
+
+	conn, err := net.Dial("udp", proxy.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Error(t, udpRoundTrip(conn, 1000))
+
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	proxyPort := proxy.conn.LocalAddr().(*net.UDPAddr).Port
+	buf := make([]byte, 1500)
+	for {
+		icmp.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := icmp.ReadFrom(buf)
+		require.NoError(t, err)
+		msg := buf[:n]
+		if len(msg) < 36 || msg[0] != 3 || msg[1] != 4 {
+			continue
+		}
+		require.Equal(t, uint16(528), binary.BigEndian.Uint16(msg[6:8]))
+		require.Equal(t, uint16(0), checksum(msg))
+		require.Equal(t, uint16(localPort), binary.BigEndian.Uint16(msg[28:30]))
+		require.Equal(t, uint16(proxyPort), binary.BigEndian.Uint16(msg[30:32]))
+		return
+	}
+}